@@ -0,0 +1,75 @@
+package testdbpool
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+	"github.com/yuku/testdbpool/internal/templatedb"
+)
+
+// sentinelRowsKey is the template metadata key under which the row count of
+// Config.ReuseSentinelTable in the template is recorded.
+const sentinelRowsKey = "testdbpool.sentinel_rows"
+
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// countSentinelRows returns the row count of table, which may be qualified
+// with its schema.
+func countSentinelRows(ctx context.Context, q rowQuerier, table string) (int64, error) {
+	ident, err := sqlbuild.Ident(strings.Split(table, ".")...)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sentinel table %s: %w", table, err)
+	}
+	var rows int64
+	if err := q.QueryRow(ctx, `SELECT count(*) FROM `+ident).Scan(&rows); err != nil {
+		return 0, fmt.Errorf("failed to count rows of sentinel table %s: %w", table, err)
+	}
+	return rows, nil
+}
+
+// recordSentinelRows records the row count of table in the template database
+// conn is connected to in the template metadata.
+func recordSentinelRows(ctx context.Context, conn *pgx.Conn, table string) error {
+	rows, err := countSentinelRows(ctx, conn, table)
+	if err != nil {
+		return err
+	}
+	if err := templatedb.SetValue(ctx, sentinelRowsKey, strconv.FormatInt(rows, 10)); err != nil {
+		return fmt.Errorf("failed to record rows of sentinel table %s: %w", table, err)
+	}
+	return nil
+}
+
+// verifyReleasedFunc returns the function that accepts a test database kept
+// by Config.ReuseAcrossRuns if the row count of Config.ReuseSentinelTable in
+// it matches the one recorded in the metadata of the template database it
+// was cloned from. It returns nil if ReuseAcrossRuns is not set, so that kept
+// databases are recreated.
+func verifyReleasedFunc(cfg *Config) func(context.Context, *pgxpool.Pool, map[string]string) error {
+	if !cfg.ReuseAcrossRuns {
+		return nil
+	}
+	table := cfg.ReuseSentinelTable
+	return func(ctx context.Context, pool *pgxpool.Pool, values map[string]string) error {
+		ctx = withInternalQueries(ctx)
+		want, ok := values[sentinelRowsKey]
+		if !ok {
+			return fmt.Errorf("template has no recorded row count of sentinel table %s", table)
+		}
+		rows, err := countSentinelRows(ctx, pool, table)
+		if err != nil {
+			return err
+		}
+		if got := strconv.FormatInt(rows, 10); got != want {
+			return fmt.Errorf("sentinel table %s has %s rows, want %s", table, got, want)
+		}
+		return nil
+	}
+}
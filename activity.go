@@ -0,0 +1,96 @@
+package testdbpool
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// activityLockID is the advisory lock ID that serializes the creation of the
+// activity table.
+const activityLockID = 132435465770
+
+// setupActivityTable creates the table that records when each pool was last
+// used, which CleanupOptions.OlderThan goes by.
+func setupActivityTable(ctx context.Context, pool *pgxpool.Pool) error {
+	return pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		// CREATE TABLE IF NOT EXISTS is not safe against concurrent creation.
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, activityLockID); err != nil {
+			return fmt.Errorf("failed to acquire advisory lock: %w", err)
+		}
+		_, err := tx.Exec(ctx, `
+			CREATE TABLE IF NOT EXISTS testdbpool_activity (
+				pool_id TEXT PRIMARY KEY,
+				last_used_at TIMESTAMPTZ NOT NULL
+			)`)
+		if err != nil {
+			return fmt.Errorf("failed to create activity table: %w", err)
+		}
+		return nil
+	})
+}
+
+// recordUse records that a test database of the pool has just been acquired
+// or released, according to the clock of the server. A failure is only
+// logged, as it merely makes CleanupAllPools consider the pool older.
+func (p *Pool) recordUse(ctx context.Context) {
+	_, err := p.cfg.Pool.Exec(ctx, `
+		INSERT INTO testdbpool_activity (pool_id, last_used_at) VALUES ($1, now())
+		ON CONFLICT (pool_id) DO UPDATE SET last_used_at = EXCLUDED.last_used_at`,
+		p.cfg.ID,
+	)
+	if err != nil {
+		p.eventLogger().Warn("failed to record the use of the pool", "error", err)
+	}
+}
+
+// lastUsed returns the times at which the pools whose IDs start with prefix
+// were last used, by pool ID. Pools that have not been used since the
+// activity table was introduced are missing.
+func lastUsed(ctx context.Context, pool *pgxpool.Pool, prefix string) (map[string]time.Time, error) {
+	var exists bool
+	if err := pool.QueryRow(ctx, `SELECT to_regclass('testdbpool_activity') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to check activity table: %w", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	rows, err := pool.Query(ctx, `
+		SELECT pool_id, last_used_at FROM testdbpool_activity
+		WHERE left(pool_id, length($1)) = $1`,
+		prefix,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read activity of pools: %w", err)
+	}
+	used := map[string]time.Time{}
+	var id string
+	var at time.Time
+	_, err = pgx.ForEachRow(rows, []any{&id, &at}, func() error {
+		used[id] = at
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read activity of pools: %w", err)
+	}
+	return used, nil
+}
+
+// forgetActivity removes the activity of the pool poolID, if any is recorded.
+func forgetActivity(ctx context.Context, pool *pgxpool.Pool, poolID string) error {
+	var exists bool
+	if err := pool.QueryRow(ctx, `SELECT to_regclass('testdbpool_activity') IS NOT NULL`).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check activity table: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+	if _, err := pool.Exec(ctx, `DELETE FROM testdbpool_activity WHERE pool_id = $1`, poolID); err != nil {
+		return fmt.Errorf("failed to remove activity of pool %s: %w", poolID, err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Package anonymize provides helpers for the final anonymization pass of
+// template databases built from production dumps.
+//
+// MaskColumns overwrites sensitive columns according to a list of rules and
+// VerifyMasked checks that no sensitive values remain. Both are meant to be
+// called from SetupTemplate with the connection to the template database:
+//
+//	SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+//		if err := restoreDump(ctx, conn); err != nil {
+//			return err
+//		}
+//		if err := anonymize.MaskColumns(ctx, conn, []anonymize.Rule{
+//			{Table: "users", Column: "email", Strategy: anonymize.FakeEmail()},
+//			{Table: "users", Column: "phone", Strategy: anonymize.NullOut()},
+//		}); err != nil {
+//			return err
+//		}
+//		return anonymize.VerifyMasked(ctx, conn, []anonymize.Probe{
+//			{Table: "users", Column: "email", Pattern: `@(?!example\.com$)`},
+//		})
+//	}
+package anonymize
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yuku/testdbpool"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// Rule describes how to mask a column.
+type Rule struct {
+	// Table is the name of the table, optionally schema-qualified
+	// (e.g. "public.users").
+	Table string
+
+	// Column is the name of the column to mask.
+	Column string
+
+	// Strategy is how the values of the column are replaced.
+	Strategy Strategy
+}
+
+// Strategy is how the values of a column are replaced. Use the functions of
+// this package such as NullOut and FakeEmail to get one.
+type Strategy interface {
+	// setExpr returns the SQL expression of the new value of the column
+	// col. arg adds a query argument and returns its placeholder.
+	setExpr(col string, arg func(any) string) string
+}
+
+type nullOut struct{}
+
+func (nullOut) setExpr(string, func(any) string) string {
+	return "NULL"
+}
+
+// NullOut replaces every value of the column with NULL.
+func NullOut() Strategy {
+	return nullOut{}
+}
+
+type fixedValue struct {
+	value any
+}
+
+func (s fixedValue) setExpr(_ string, arg func(any) string) string {
+	return arg(s.value)
+}
+
+// FixedValue replaces every value of the column with value.
+func FixedValue(value any) Strategy {
+	return fixedValue{value: value}
+}
+
+type hashWithSalt struct {
+	salt string
+}
+
+func (s hashWithSalt) setExpr(col string, arg func(any) string) string {
+	return fmt.Sprintf(
+		`CASE WHEN %[1]s IS NULL THEN NULL ELSE encode(sha256(convert_to(%[2]s || %[1]s::text, 'UTF8')), 'hex') END`,
+		col, arg(s.salt),
+	)
+}
+
+// HashWithSalt replaces every non-NULL value of a text column with the hex
+// encoded SHA-256 hash of the salt followed by the value. Equal values stay
+// equal, so the column can still be joined and grouped on.
+func HashWithSalt(salt string) Strategy {
+	return hashWithSalt{salt: salt}
+}
+
+type fakeEmail struct{}
+
+func (fakeEmail) setExpr(col string, _ func(any) string) string {
+	return fmt.Sprintf(
+		`CASE WHEN %[1]s IS NULL THEN NULL ELSE 'user_' || left(md5(%[1]s::text), 16) || '@example.com' END`,
+		col,
+	)
+}
+
+// FakeEmail replaces every non-NULL value of a text column with an address
+// at example.com derived from the original value, so that equal values, and
+// thus unique constraints, are preserved.
+func FakeEmail() Strategy {
+	return fakeEmail{}
+}
+
+type shuffleWithinColumn struct{}
+
+func (shuffleWithinColumn) setExpr(string, func(any) string) string {
+	panic("shuffleWithinColumn is applied with its own statement")
+}
+
+// ShuffleWithinColumn randomly permutes the values of the column among the
+// rows of the table, which keeps the distribution of values but breaks their
+// association with the rest of the row. Unlike the other strategies, each
+// shuffled column is updated with its own statement.
+func ShuffleWithinColumn() Strategy {
+	return shuffleWithinColumn{}
+}
+
+// MaskColumns masks columns according to rules. Rules for the same table are
+// applied with a single UPDATE statement, except for ShuffleWithinColumn.
+// After each statement, the progress is reported with
+// testdbpool.ReportSetupProgress, including the number of updated rows,
+// so that masking big tables can be followed with Config.SetupProgress.
+func MaskColumns(ctx context.Context, conn *pgx.Conn, rules []Rule) error {
+	stmts, err := buildStatements(rules)
+	if err != nil {
+		return err
+	}
+
+	for i, stmt := range stmts {
+		tag, err := conn.Exec(ctx, stmt.sql, stmt.args...)
+		if err != nil {
+			return fmt.Errorf("failed to mask %s: %w", stmt.desc, err)
+		}
+		testdbpool.ReportSetupProgress(ctx, i+1, len(stmts),
+			fmt.Sprintf("masked %s (%d rows)", stmt.desc, tag.RowsAffected()))
+	}
+	return nil
+}
+
+// statement is an UPDATE statement built from rules.
+type statement struct {
+	sql  string
+	args []any
+
+	// desc describes the masked columns for progress reports and errors.
+	desc string
+}
+
+// buildStatements builds the UPDATE statements that apply rules, in the order
+// in which the tables first appear in rules.
+func buildStatements(rules []Rule) ([]statement, error) {
+	type tableRules struct {
+		name    string
+		ident   string
+		sets    []string
+		columns []string
+		args    []any
+	}
+
+	var tables []*tableRules
+	byName := map[string]*tableRules{}
+	var shuffles []statement
+	for _, rule := range rules {
+		ident, err := sqlbuild.Table(rule.Table)
+		if err != nil {
+			return nil, err
+		}
+		col, err := sqlbuild.Column(rule.Column)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Strategy == nil {
+			return nil, fmt.Errorf("no strategy for column %s.%s", rule.Table, rule.Column)
+		}
+
+		if _, ok := rule.Strategy.(shuffleWithinColumn); ok {
+			shuffles = append(shuffles, shuffleStatement(ident, col, rule.Table+"."+rule.Column))
+			continue
+		}
+
+		t, ok := byName[ident]
+		if !ok {
+			t = &tableRules{name: rule.Table, ident: ident}
+			byName[ident] = t
+			tables = append(tables, t)
+		}
+		arg := func(v any) string {
+			t.args = append(t.args, v)
+			return fmt.Sprintf("$%d", len(t.args))
+		}
+		t.sets = append(t.sets, fmt.Sprintf("%s = %s", col, rule.Strategy.setExpr(col, arg)))
+		t.columns = append(t.columns, rule.Column)
+	}
+
+	stmts := make([]statement, 0, len(tables)+len(shuffles))
+	for _, t := range tables {
+		stmts = append(stmts, statement{
+			sql:  fmt.Sprintf("UPDATE %s SET %s", t.ident, strings.Join(t.sets, ", ")),
+			args: t.args,
+			desc: fmt.Sprintf("%s(%s)", t.name, strings.Join(t.columns, ", ")),
+		})
+	}
+	return append(stmts, shuffles...), nil
+}
+
+// shuffleStatement returns the statement that permutes the values of the
+// column col of the table, both quoted, by pairing rows and values that are
+// each numbered in a random order.
+func shuffleStatement(table, col string, desc string) statement {
+	return statement{
+		sql: fmt.Sprintf(`
+			UPDATE %[1]s SET %[2]s = shuffled.value
+			FROM (
+				SELECT r.row_id, v.value
+				FROM (SELECT ctid AS row_id, row_number() OVER (ORDER BY random()) AS n FROM %[1]s) r
+				JOIN (SELECT %[2]s AS value, row_number() OVER (ORDER BY random()) AS n FROM %[1]s) v USING (n)
+			) shuffled
+			WHERE %[1]s.ctid = shuffled.row_id`, table, col),
+		desc: desc + " (shuffle)",
+	}
+}
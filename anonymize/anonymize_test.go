@@ -0,0 +1,152 @@
+package anonymize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestBuildStatements(t *testing.T) {
+	t.Run("rules for the same table are merged", func(t *testing.T) {
+		stmts, err := buildStatements([]Rule{
+			{Table: "users", Column: "phone", Strategy: NullOut()},
+			{Table: "public.orders", Column: "note", Strategy: FixedValue("redacted")},
+			{Table: "users", Column: "name", Strategy: FixedValue("anonymous")},
+		})
+		require.NoError(t, err)
+		require.Len(t, stmts, 2)
+
+		assert.Equal(t, `UPDATE "users" SET "phone" = NULL, "name" = $1`, stmts[0].sql)
+		assert.Equal(t, []any{"anonymous"}, stmts[0].args)
+		assert.Equal(t, "users(phone, name)", stmts[0].desc)
+
+		assert.Equal(t, `UPDATE "public"."orders" SET "note" = $1`, stmts[1].sql)
+		assert.Equal(t, []any{"redacted"}, stmts[1].args)
+	})
+
+	t.Run("shuffles get their own statement", func(t *testing.T) {
+		stmts, err := buildStatements([]Rule{
+			{Table: "users", Column: "city", Strategy: ShuffleWithinColumn()},
+			{Table: "users", Column: "phone", Strategy: NullOut()},
+		})
+		require.NoError(t, err)
+		require.Len(t, stmts, 2)
+		assert.Equal(t, `UPDATE "users" SET "phone" = NULL`, stmts[0].sql)
+		assert.Contains(t, stmts[1].sql, `UPDATE "users" SET "city" = shuffled.value`)
+	})
+
+	t.Run("invalid rules", func(t *testing.T) {
+		_, err := buildStatements([]Rule{{Table: "a.b.c", Column: "x", Strategy: NullOut()}})
+		assert.ErrorContains(t, err, "invalid table name: a.b.c")
+
+		_, err = buildStatements([]Rule{{Table: "users", Column: "x; DROP", Strategy: NullOut()}})
+		assert.ErrorContains(t, err, "invalid column name: x; DROP")
+
+		_, err = buildStatements([]Rule{{Table: "users", Column: "x"}})
+		assert.ErrorContains(t, err, "no strategy for column users.x")
+	})
+}
+
+func TestMaskColumns(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	conn := acquireConn(t)
+	_, err := conn.Exec(ctx, `
+		CREATE TEMP TABLE users (id INT, email TEXT, phone TEXT, name TEXT, token TEXT, city TEXT);
+		INSERT INTO users VALUES
+			(1, 'alice@corp.com', '555-0100', 'Alice', 'secret', 'Tokyo'),
+			(2, 'bob@corp.com', '555-0101', 'Bob', 'secret', 'Osaka'),
+			(3, NULL, NULL, 'Carol', NULL, 'Kyoto');
+	`)
+	require.NoError(t, err)
+
+	err = MaskColumns(ctx, conn, []Rule{
+		{Table: "users", Column: "email", Strategy: FakeEmail()},
+		{Table: "users", Column: "phone", Strategy: NullOut()},
+		{Table: "users", Column: "name", Strategy: FixedValue("anonymous")},
+		{Table: "users", Column: "token", Strategy: HashWithSalt("pepper")},
+		{Table: "users", Column: "city", Strategy: ShuffleWithinColumn()},
+	})
+	require.NoError(t, err)
+
+	type user struct {
+		Email, Phone, Token *string
+		Name, City          string
+	}
+	rows, err := conn.Query(ctx, `SELECT email, phone, name, token, city FROM users ORDER BY id`)
+	require.NoError(t, err)
+	users, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (user, error) {
+		var u user
+		err := row.Scan(&u.Email, &u.Phone, &u.Name, &u.Token, &u.City)
+		return u, err
+	})
+	require.NoError(t, err)
+	require.Len(t, users, 3)
+
+	var cities []string
+	for _, u := range users {
+		assert.Nil(t, u.Phone, "NullOut")
+		assert.Equal(t, "anonymous", u.Name, "FixedValue")
+		cities = append(cities, u.City)
+	}
+
+	// FakeEmail keeps NULLs and distinct values distinct.
+	require.NotNil(t, users[0].Email)
+	require.NotNil(t, users[1].Email)
+	assert.Regexp(t, `^user_[0-9a-f]{16}@example\.com$`, *users[0].Email)
+	assert.NotEqual(t, *users[0].Email, *users[1].Email)
+	assert.Nil(t, users[2].Email)
+
+	// HashWithSalt keeps equal values equal.
+	require.NotNil(t, users[0].Token)
+	assert.Len(t, *users[0].Token, 64)
+	assert.Equal(t, users[0].Token, users[1].Token)
+	assert.Nil(t, users[2].Token)
+
+	// ShuffleWithinColumn keeps the values of the column.
+	assert.ElementsMatch(t, []string{"Tokyo", "Osaka", "Kyoto"}, cities)
+}
+
+func TestVerifyMasked(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	conn := acquireConn(t)
+	_, err := conn.Exec(ctx, `
+		CREATE TEMP TABLE users (email TEXT);
+		INSERT INTO users VALUES ('alice@corp.com'), ('user_1@example.com'), (NULL);
+	`)
+	require.NoError(t, err)
+
+	probe := Probe{Table: "users", Column: "email", Pattern: `@corp\.com$`}
+	err = VerifyMasked(ctx, conn, []Probe{probe})
+	var unmasked *UnmaskedError
+	require.ErrorAs(t, err, &unmasked)
+	assert.Equal(t, []Finding{{Probe: probe, Count: 1}}, unmasked.Findings)
+	assert.NotContains(t, err.Error(), "alice", "values must not be leaked")
+
+	require.NoError(t, MaskColumns(ctx, conn, []Rule{
+		{Table: "users", Column: "email", Strategy: FakeEmail()},
+	}))
+	assert.NoError(t, VerifyMasked(ctx, conn, []Probe{probe}))
+}
+
+// acquireConn returns a dedicated connection so that temporary tables are
+// visible to every statement of the test.
+func acquireConn(t *testing.T) *pgx.Conn {
+	t.Helper()
+	pool := testutil.GetTestDBPool(t)
+	conn, err := pool.Acquire(context.Background())
+	require.NoError(t, err)
+	t.Cleanup(conn.Release)
+	return conn.Conn()
+}
@@ -0,0 +1,83 @@
+package anonymize
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// Probe describes values that must not remain in a column after masking.
+type Probe struct {
+	// Table is the name of the table, optionally schema-qualified
+	// (e.g. "public.users").
+	Table string
+
+	// Column is the name of the column to check.
+	Column string
+
+	// Pattern is a regular expression, as understood by the PostgreSQL ~
+	// operator, that no value of the column (cast to text) may match, e.g.
+	// `^[^@]+@[^@]+$` for email addresses.
+	Pattern string
+}
+
+// Finding is a probe that matched values.
+type Finding struct {
+	Probe
+
+	// Count is the number of values that matched the probe.
+	Count int64
+}
+
+// UnmaskedError is returned by VerifyMasked when values matching the probes
+// remain.
+type UnmaskedError struct {
+	// Findings lists every probe that matched values.
+	Findings []Finding
+}
+
+// Error implements the error interface.
+func (e *UnmaskedError) Error() string {
+	reports := make([]string, 0, len(e.Findings))
+	for _, f := range e.Findings {
+		reports = append(reports, fmt.Sprintf("%s.%s has %d values matching %q", f.Table, f.Column, f.Count, f.Pattern))
+	}
+	return "unmasked values remain: " + strings.Join(reports, "; ")
+}
+
+// VerifyMasked checks that no value matches the probes. It returns an
+// *UnmaskedError listing every probe that matched values. The values
+// themselves are never included in the error.
+func VerifyMasked(ctx context.Context, conn *pgx.Conn, probes []Probe) error {
+	var findings []Finding
+	for _, probe := range probes {
+		ident, err := sqlbuild.Table(probe.Table)
+		if err != nil {
+			return err
+		}
+		col, err := sqlbuild.Column(probe.Column)
+		if err != nil {
+			return err
+		}
+
+		var count int64
+		err = conn.QueryRow(ctx, fmt.Sprintf(
+			`SELECT COUNT(*) FROM %s WHERE %s::text ~ $1`,
+			ident, col,
+		), probe.Pattern).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("failed to probe %s.%s: %w", probe.Table, probe.Column, err)
+		}
+		if count > 0 {
+			findings = append(findings, Finding{Probe: probe, Count: count})
+		}
+	}
+
+	if len(findings) > 0 {
+		return &UnmaskedError{Findings: findings}
+	}
+	return nil
+}
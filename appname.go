@@ -0,0 +1,69 @@
+package testdbpool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/yuku/testdbpool/internal/pgconst"
+)
+
+const (
+	// defaultApplicationNamePrefix is the prefix of the application_name of
+	// labelled test databases if neither Config.ApplicationNamePrefix nor the
+	// root pool sets one.
+	defaultApplicationNamePrefix = "testdbpool"
+
+	// applicationNameHashLength is the number of hex digits of the hash that
+	// replaces the end of an application_name that is too long.
+	applicationNameHashLength = 8
+)
+
+// applicationNamePrefix returns the prefix of the application_name of
+// labelled test databases of cfg.
+func applicationNamePrefix(cfg *Config) string {
+	if cfg.ApplicationNamePrefix != "" {
+		return cfg.ApplicationNamePrefix
+	}
+	if name := cfg.RuntimeParams["application_name"]; name != "" {
+		return name
+	}
+	if name := cfg.Pool.Config().ConnConfig.RuntimeParams["application_name"]; name != "" {
+		return name
+	}
+	return defaultApplicationNamePrefix
+}
+
+// applicationName returns the application_name of the test database at index
+// of the pool poolID acquired with label, in the form
+// "<prefix>/<poolID>/<index>/<label>". Characters other than printable ASCII
+// letters, digits and "/._-=:" are replaced with "_", as the server replaces
+// non-ASCII ones with "?" and quotes and spaces break log parsers. If the
+// result exceeds the 63 bytes the server keeps, it is truncated and ends with
+// "~" and a hash of the full name, so that different long labels stay
+// distinguishable.
+func applicationName(prefix, poolID string, index int, label string) string {
+	name := sanitizeApplicationName(prefix + "/" + poolID + "/" + strconv.Itoa(index) + "/" + label)
+	if len(name) <= pgconst.MaxIdentifierLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:applicationNameHashLength]
+	return name[:pgconst.MaxIdentifierLength-len(hash)-1] + "~" + hash
+}
+
+// sanitizeApplicationName replaces the characters of s that are not safe in
+// an application_name with "_".
+func sanitizeApplicationName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		case strings.ContainsRune("/._-=:", r):
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,90 @@
+package testdbpool
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestApplicationName(t *testing.T) {
+	assert.Equal(t,
+		"testdbpool/app/3/TestUsers/create_with_quote_s_=1",
+		applicationName("testdbpool", "app", 3, "TestUsers/create_with_quote's =1"),
+	)
+	assert.Equal(t,
+		"ci_job/app/0/Test__",
+		applicationName("ci job", "app", 0, "Test日本"),
+	)
+
+	long := "TestSomething/" + strings.Repeat("very_long_subtest_name_", 5)
+	got := applicationName("testdbpool", "app", 12, long)
+	assert.Len(t, got, 63)
+	assert.True(t, strings.HasPrefix(got, "testdbpool/app/12/TestSomething/very_long_subtest_name"), got)
+	assert.Regexp(t, `~[0-9a-f]{8}$`, got)
+
+	// Labels that only differ after the cut get different names.
+	other := applicationName("testdbpool", "app", 12, long+"x")
+	assert.NotEqual(t, got, other)
+	assert.Equal(t, got[:54], other[:54])
+}
+
+func TestApplicationNamePrefix(t *testing.T) {
+	assert.Equal(t, "ci", applicationNamePrefix(&Config{
+		ApplicationNamePrefix: "ci",
+		RuntimeParams:         map[string]string{"application_name": "billing"},
+	}))
+	assert.Equal(t, "billing", applicationNamePrefix(&Config{
+		RuntimeParams: map[string]string{"application_name": "billing"},
+	}))
+}
+
+func TestPool_AcquireWithLabel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-acquire-with-label",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			return nil
+		},
+		ApplicationNamePrefix: "ci",
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	label := "TestCheckout/" + strings.Repeat("applies_discount_to_every_item_", 3)
+	db, err := pool.AcquireWithLabel(ctx, label)
+	require.NoError(t, err)
+	assert.Equal(t, label, db.Label())
+
+	var pid int32
+	require.NoError(t, db.Pool().QueryRow(ctx, `SELECT pg_backend_pid()`).Scan(&pid))
+	var appName string
+	err = connPool.QueryRow(ctx,
+		`SELECT application_name FROM pg_stat_activity WHERE pid = $1`, pid,
+	).Scan(&appName)
+	require.NoError(t, err)
+	assert.Equal(t, applicationName("ci", "test-acquire-with-label", 0, label), appName)
+	assert.Len(t, appName, 63)
+	assert.True(t, strings.HasPrefix(appName, "ci/test-acquire-with-label/0/TestCheckout/"), appName)
+	require.NoError(t, db.Release(ctx))
+
+	t.Run("AcquireT", func(t *testing.T) {
+		db := pool.AcquireT(t)
+		var appName string
+		require.NoError(t, db.Pool().QueryRow(ctx, `SHOW application_name`).Scan(&appName))
+		assert.Equal(t, "ci/test-acquire-with-label/0/TestPool_AcquireWithLabel/AcquireT", appName)
+	})
+}
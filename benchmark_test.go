@@ -23,6 +23,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -54,6 +55,50 @@ func BenchmarkAcquireReleaseCycle(b *testing.B) {
 	}
 }
 
+// BenchmarkResetDatabaseCycle benchmarks the acquire/release cycle with
+// Config.ResetDatabase, which truncates released databases for reuse instead
+// of dropping them, for comparison with BenchmarkAcquireReleaseCycle.
+func BenchmarkResetDatabaseCycle(b *testing.B) {
+	ctx := context.Background()
+	connPool := getBenchmarkDBPool(b)
+	defer cleanupBenchmarkNumpool(connPool)
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "reset_benchmark",
+		Pool:         connPool,
+		MaxDatabases: 8,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE bench_items (id SERIAL PRIMARY KEY, name TEXT, value INTEGER)`)
+			return err
+		},
+		ResetDatabase: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `TRUNCATE bench_items RESTART IDENTITY`)
+			return err
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pool.Cleanup()
+
+	for i := range b.N {
+		db, err := pool.Acquire(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, err = db.Pool().Exec(ctx, `INSERT INTO bench_items (name, value) VALUES ($1, $2)`, "test", i)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		err = db.Release(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 // BenchmarkWithDataOperations benchmarks acquire/release with actual data operations
 func BenchmarkWithDataOperations(b *testing.B) {
 	ctx := context.Background()
@@ -131,30 +176,6 @@ func BenchmarkLargeSchema(b *testing.B) {
 	connPool := getBenchmarkDBPool(b)
 	defer cleanupBenchmarkNumpool(connPool)
 
-	createLargeSchemaSetup := func(ctx context.Context, conn *pgx.Conn) error {
-		// Create multiple tables with indexes and constraints
-		for i := range 10 {
-			_, err := conn.Exec(ctx, `
-				CREATE TABLE `+fmt.Sprintf("bench_table_%d", i)+` (
-					id SERIAL PRIMARY KEY,
-					name TEXT NOT NULL,
-					value INTEGER DEFAULT 0,
-					created_at TIMESTAMP DEFAULT NOW()
-				)
-			`)
-			if err != nil {
-				return err
-			}
-
-			// Add indexes
-			_, err = conn.Exec(ctx, `CREATE INDEX idx_`+fmt.Sprintf("bench_table_%d", i)+`_name ON `+fmt.Sprintf("bench_table_%d", i)+` (name)`)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	}
-
 	pool, err := testdbpool.New(ctx, &testdbpool.Config{
 		ID:            "large_schema_benchmark",
 		Pool:          connPool,
@@ -187,6 +208,73 @@ func BenchmarkLargeSchema(b *testing.B) {
 	}
 }
 
+// BenchmarkCloneStrategy compares the CREATE DATABASE strategies of
+// PostgreSQL 15 and later for cloning the large schema template.
+func BenchmarkCloneStrategy(b *testing.B) {
+	ctx := context.Background()
+	connPool := getBenchmarkDBPool(b)
+	defer cleanupBenchmarkNumpool(connPool)
+
+	var version int
+	if err := connPool.QueryRow(ctx, `SELECT current_setting('server_version_num')::int`).Scan(&version); err != nil {
+		b.Fatal(err)
+	}
+	if version < 150000 {
+		b.Skip("CREATE DATABASE STRATEGY requires PostgreSQL 15 or later")
+	}
+
+	for _, strategy := range []testdbpool.CloneStrategy{testdbpool.CloneStrategyFileCopy, testdbpool.CloneStrategyWALLog} {
+		b.Run(string(strategy), func(b *testing.B) {
+			pool, err := testdbpool.New(ctx, &testdbpool.Config{
+				ID:            "clone_strategy_benchmark_" + strings.ToLower(string(strategy)),
+				Pool:          connPool,
+				MaxDatabases:  4,
+				SetupTemplate: createLargeSchemaSetup,
+				CloneStrategy: strategy,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer pool.Cleanup()
+
+			for range b.N {
+				db, err := pool.Acquire(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := db.Release(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// createLargeSchemaSetup sets up a template of 10 tables with indexes.
+func createLargeSchemaSetup(ctx context.Context, conn *pgx.Conn) error {
+	// Create multiple tables with indexes and constraints
+	for i := range 10 {
+		_, err := conn.Exec(ctx, `
+			CREATE TABLE `+fmt.Sprintf("bench_table_%d", i)+` (
+				id SERIAL PRIMARY KEY,
+				name TEXT NOT NULL,
+				value INTEGER DEFAULT 0,
+				created_at TIMESTAMP DEFAULT NOW()
+			)
+		`)
+		if err != nil {
+			return err
+		}
+
+		// Add indexes
+		_, err = conn.Exec(ctx, `CREATE INDEX idx_`+fmt.Sprintf("bench_table_%d", i)+`_name ON `+fmt.Sprintf("bench_table_%d", i)+` (name)`)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // createBenchmarkPool creates a test pool for benchmarking
 func createBenchmarkPool(b *testing.B, ctx context.Context, connPool *pgxpool.Pool, id string) *testdbpool.Pool {
 	pool, err := testdbpool.New(ctx, &testdbpool.Config{
@@ -226,3 +314,42 @@ func cleanupBenchmarkNumpool(pool *pgxpool.Pool) {
 	_ = numpool.Cleanup(context.Background(), pool)
 	pool.Close()
 }
+
+// BenchmarkCleanup compares dropping the databases of a large pool with an
+// effectively unbounded number of workers against the default bound.
+func BenchmarkCleanup(b *testing.B) {
+	ctx := context.Background()
+	connPool := getBenchmarkDBPool(b)
+	defer cleanupBenchmarkNumpool(connPool)
+
+	const maxDatabases = 32
+	for _, concurrency := range []int{maxDatabases, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for range b.N {
+				b.StopTimer()
+				pool, err := testdbpool.New(ctx, &testdbpool.Config{
+					ID:           "cleanup_benchmark",
+					Pool:         connPool,
+					MaxDatabases: maxDatabases,
+					SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+						_, err := conn.Exec(ctx, `CREATE TABLE bench_items (id SERIAL PRIMARY KEY, name TEXT, value INTEGER)`)
+						return err
+					},
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for range maxDatabases {
+					if _, err := pool.Acquire(ctx); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StartTimer()
+
+				if _, err := pool.CleanupContext(ctx, testdbpool.CleanupOptions{Concurrency: concurrency}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
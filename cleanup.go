@@ -2,9 +2,18 @@ package testdbpool
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/yuku/numpool"
+	"github.com/yuku/testdbpool/internal/clock"
+	"github.com/yuku/testdbpool/internal/pgconst"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+	"github.com/yuku/testdbpool/internal/templatedb"
 )
 
 // ListPools returns a list of pool IDs that match the given prefix.
@@ -18,13 +27,421 @@ func ListPools(ctx context.Context, pool *pgxpool.Pool, prefix string) ([]string
 	return manager.ListPools(ctx, prefix)
 }
 
+// PoolInfo describes a registered pool, as returned by ListPoolsInfo.
+type PoolInfo struct {
+	// ID is the effective ID of the pool (see Pool.EffectiveID).
+	ID string
+
+	// MaxDatabases is the maximum number of test databases of the pool.
+	MaxDatabases int
+
+	// NamePrefix is the Config.NamePrefix the pool was registered with.
+	NamePrefix string
+
+	// VariantKey is the Config.TemplateVariantKey the pool was registered
+	// with, or empty if it has none or was registered before variant keys
+	// were recorded.
+	VariantKey string
+
+	// TemplateName is the name of the template database of the pool.
+	TemplateName string
+
+	// CreatedAt is the time at which the template database finished being
+	// set up, or the zero time if it does not exist or was built before the
+	// time was recorded.
+	CreatedAt time.Time
+
+	// DatabaseCount is the number of test databases of the pool that exist,
+	// whether in use or not.
+	DatabaseCount int
+
+	// LastUsedAt is the time at which a test database of the pool was last
+	// acquired or released, or the zero time if that has not been recorded.
+	LastUsedAt time.Time
+}
+
+// ListPoolsInfo is like ListPools, but also returns what is recorded with
+// the registration of each pool and what its databases look like, e.g. to
+// tell apart the template variants of a pool ID in cleanup scripts, or to
+// find the stale pools that keep the most databases before calling
+// CleanupPool.
+func ListPoolsInfo(ctx context.Context, pool *pgxpool.Pool, prefix string) ([]PoolInfo, error) {
+	manager, err := numpool.Setup(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	manager.Close()
+
+	rows, err := pool.Query(ctx, `
+		SELECT id, max_resources_count, metadata FROM numpools
+		WHERE left(id, length($1)) = $1
+		ORDER BY id`,
+		prefix,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pools: %w", err)
+	}
+	var infos []PoolInfo
+	var id string
+	var maxDatabases int
+	var raw []byte
+	_, err = pgx.ForEachRow(rows, []any{&id, &maxDatabases, &raw}, func() error {
+		meta, err := decodePoolMetadata(raw)
+		if err != nil {
+			return fmt.Errorf("pool %s: %w", id, err)
+		}
+		infos = append(infos, PoolInfo{
+			ID:           id,
+			MaxDatabases: maxDatabases,
+			NamePrefix:   meta.NamePrefix,
+			VariantKey:   meta.VariantKey,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pools: %w", err)
+	}
+
+	used, err := lastUsed(ctx, pool, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range infos {
+		if err := describeDatabases(ctx, pool, &infos[i]); err != nil {
+			return nil, err
+		}
+		infos[i].LastUsedAt = used[infos[i].ID]
+	}
+	return infos, nil
+}
+
+// describeDatabases fills in the fields of info that describe the template
+// and test databases of the pool.
+func describeDatabases(ctx context.Context, pool *pgxpool.Pool, info *PoolInfo) error {
+	// A registration that is too long for a template name has no template.
+	info.TemplateName, _ = templatedb.TemplateDatabaseName(info.NamePrefix, info.ID)
+
+	var comment *string
+	err := pool.QueryRow(ctx, `
+		SELECT
+			(SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1),
+			(SELECT count(*) FROM pg_database
+				WHERE left(datname, length($2)) = $2
+					AND substr(datname, length($2) + 1) ~ '^[0-9]+$')`,
+		info.TemplateName, templatedb.TestDatabasePrefix(info.NamePrefix, info.ID),
+	).Scan(&comment, &info.DatabaseCount)
+	if err != nil {
+		return fmt.Errorf("failed to describe databases of pool %s: %w", info.ID, err)
+	}
+	if comment != nil {
+		info.CreatedAt = templatedb.CreatedAt(*comment)
+	}
+	return nil
+}
+
 // CleanupPool removes a testdbpool instance and all its associated resources.
 // This includes dropping all test databases and cleaning up the template database.
+// The databases are found by the Config.NamePrefix recorded for the pool.
+// Databases that are still in use are left behind, and the pool is removed
+// nevertheless.
 func CleanupPool(ctx context.Context, pool *pgxpool.Pool, poolID string) error {
+	return cleanupPool(ctx, pool, poolID, skipInUse)
+}
+
+// CleanupPoolForce is like CleanupPool, but drops the databases that are
+// still in use as well, e.g. by a stuck test process, by terminating the
+// other sessions connected to each database before dropping it. As
+// terminated sessions take a moment to go away, a drop that still finds the
+// database in use is retried a few times.
+func CleanupPoolForce(ctx context.Context, pool *pgxpool.Pool, poolID string) error {
+	return cleanupPool(ctx, pool, poolID, terminateInUse)
+}
+
+// cleanupPool drops the databases of the pool poolID, handling those in use
+// according to inUse, and removes the pool.
+func cleanupPool(ctx context.Context, pool *pgxpool.Pool, poolID string, inUse inUsePolicy) error {
 	manager, err := numpool.Setup(ctx, pool)
 	if err != nil {
 		return err
 	}
 	defer manager.Close()
-	return manager.DeletePool(ctx, poolID)
+	if err := dropPoolDatabases(ctx, clock.Real, pool, poolID, inUse); err != nil {
+		return err
+	}
+	if err := manager.DeletePool(ctx, poolID); err != nil {
+		return err
+	}
+	return forgetActivity(ctx, pool, poolID)
+}
+
+// PoolCleanup is the outcome of removing a single pool with CleanupAllPools.
+type PoolCleanup struct {
+	// ID is the ID of the pool.
+	ID string
+
+	// Databases are the names of the test databases and then the template
+	// database of the pool that were dropped, or would be dropped in a dry
+	// run.
+	Databases []string
+
+	// Err is the error returned while removing the pool, if any.
+	Err error
+}
+
+// CleanupAllPools removes every pool whose ID starts with prefix together
+// with its databases, like CleanupPool, e.g. from a cleanup job for shared
+// CI servers. opts.OlderThan restricts it to pools that have not been used
+// for a while, and opts.DryRun reports what would be removed without
+// removing anything. Databases that are still in use are left behind. The
+// returned error joins the errors of the pools that could not be removed.
+func CleanupAllPools(ctx context.Context, pool *pgxpool.Pool, prefix string, opts CleanupOptions) ([]PoolCleanup, error) {
+	infos, err := ListPoolsInfo(ctx, pool, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pools: %w", err)
+	}
+
+	var now time.Time
+	if opts.OlderThan > 0 {
+		if err := pool.QueryRow(ctx, `SELECT now()`).Scan(&now); err != nil {
+			return nil, fmt.Errorf("failed to get server time: %w", err)
+		}
+	}
+
+	var results []PoolCleanup
+	var errs []error
+	for _, info := range infos {
+		if opts.OlderThan > 0 {
+			// A template built but not used yet counts as a use.
+			last := info.LastUsedAt
+			if info.CreatedAt.After(last) {
+				last = info.CreatedAt
+			}
+			if last.IsZero() && info.DatabaseCount > 0 {
+				continue
+			}
+			if !last.IsZero() && now.Sub(last) <= opts.OlderThan {
+				continue
+			}
+		}
+		result := cleanupPoolInfo(ctx, pool, info, opts.DryRun)
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("failed to clean up pool %s: %w", info.ID, result.Err))
+		}
+		results = append(results, result)
+	}
+	return results, errors.Join(errs...)
+}
+
+// cleanupPoolInfo removes the pool described by info, or only lists its
+// databases if dryRun is set.
+func cleanupPoolInfo(ctx context.Context, pool *pgxpool.Pool, info PoolInfo, dryRun bool) PoolCleanup {
+	result := PoolCleanup{ID: info.ID}
+	names, err := poolDatabaseNames(ctx, pool, info)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if dryRun {
+		result.Databases = names
+		return result
+	}
+
+	result.Err = CleanupPool(ctx, pool, info.ID)
+	// Report only what is gone, as databases in use are left behind.
+	left, err := poolDatabaseNames(ctx, pool, info)
+	if err != nil {
+		result.Err = errors.Join(result.Err, err)
+		return result
+	}
+	for _, name := range names {
+		if !slices.Contains(left, name) {
+			result.Databases = append(result.Databases, name)
+		}
+	}
+	return result
+}
+
+// poolDatabaseNames returns the names of the existing test databases and then
+// the template database of the pool described by info.
+func poolDatabaseNames(ctx context.Context, pool *pgxpool.Pool, info PoolInfo) ([]string, error) {
+	tests, template, err := poolDatabases(ctx, pool, info.NamePrefix, info.ID)
+	if err != nil {
+		return nil, err
+	}
+	if template != "" {
+		tests = append(tests, template)
+	}
+	return tests, nil
+}
+
+// CleanupStale removes the pools whose IDs start with prefix and consist of
+// the ID of this Pool followed by the hash of another schema fingerprint (see
+// Config.SchemaFingerprint), dropping their template and test databases.
+// Pools without a fingerprint hash or with another base ID are left alone.
+// It returns the IDs of the removed pools; a pool whose databases are still
+// in use is not removed, and the returned error joins the reasons.
+// It fails if this Pool was created without Config.SchemaFingerprint.
+func (p *Pool) CleanupStale(ctx context.Context, prefix string) ([]string, error) {
+	base, current, ok := splitFingerprintSuffix(p.cfg.ID)
+	if p.cfg.SchemaFingerprint == nil || !ok {
+		return nil, fmt.Errorf("CleanupStale requires SchemaFingerprint to be set")
+	}
+
+	ids, err := ListPools(ctx, p.cfg.Pool, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pools: %w", err)
+	}
+
+	var removed []string
+	var errs []error
+	for _, id := range ids {
+		if b, suffix, ok := splitFingerprintSuffix(id); !ok || b != base || suffix == current {
+			continue
+		}
+		if err := dropPoolDatabases(ctx, p.clock, p.cfg.Pool, id, failInUse); err != nil {
+			errs = append(errs, fmt.Errorf("failed to clean up stale pool %s: %w", id, err))
+			continue
+		}
+		if err := CleanupPool(ctx, p.cfg.Pool, id); err != nil {
+			errs = append(errs, fmt.Errorf("failed to clean up stale pool %s: %w", id, err))
+			continue
+		}
+		removed = append(removed, id)
+	}
+	return removed, errors.Join(errs...)
+}
+
+// inUsePolicy is what dropPoolDatabases does with a database that is still
+// in use.
+type inUsePolicy int
+
+const (
+	// failInUse fails on the database.
+	failInUse inUsePolicy = iota
+
+	// skipInUse leaves the database alone.
+	skipInUse
+
+	// terminateInUse terminates the sessions connected to the database and
+	// drops it.
+	terminateInUse
+)
+
+// forceDropAttempts and forceDropBackoff bound how often and after how long
+// a drop that terminated the sessions of the database is retried while the
+// database is still in use.
+const (
+	forceDropAttempts = 5
+	forceDropBackoff  = 100 * time.Millisecond
+)
+
+// dropPoolDatabases drops the test databases and then the template database
+// of the pool poolID, named with its recorded name prefix. It fails on the
+// first database that cannot be dropped, and handles databases that are still
+// in use according to inUse, backing off on clk.
+func dropPoolDatabases(ctx context.Context, clk clock.Clock, pool *pgxpool.Pool, poolID string, inUse inUsePolicy) error {
+	namePrefix, err := lookupNamePrefix(ctx, pool, poolID)
+	if err != nil {
+		return err
+	}
+	drop := func(name string) error {
+		query, err := sqlbuild.DropDatabase(name, false)
+		if err != nil {
+			return err
+		}
+		if inUse == terminateInUse {
+			return terminateAndDrop(ctx, clk, pool, name, query)
+		}
+		_, err = pool.Exec(ctx, query)
+		if inUse == skipInUse && pgconst.IsObjectInUse(err) {
+			return nil
+		}
+		return err
+	}
+
+	tests, template, err := poolDatabases(ctx, pool, namePrefix, poolID)
+	if err != nil {
+		return err
+	}
+	for _, name := range tests {
+		if err := drop(name); err != nil {
+			return fmt.Errorf("failed to drop test database %s: %w", name, err)
+		}
+	}
+
+	if template == "" {
+		return nil
+	}
+	// A template database must be unmarked as such before it can be dropped.
+	query, err := sqlbuild.AlterIsTemplate(template, false)
+	if err != nil {
+		return err
+	}
+	if _, err := pool.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to alter template database: %w", err)
+	}
+	if err := drop(template); err != nil {
+		return fmt.Errorf("failed to drop template database %s: %w", template, err)
+	}
+	return nil
+}
+
+// terminateAndDrop runs query, which drops the database name, after
+// terminating the other sessions connected to it, retrying while they have
+// not gone away yet. The backoff between the attempts is measured by clk.
+func terminateAndDrop(ctx context.Context, clk clock.Clock, pool *pgxpool.Pool, name, query string) error {
+	for attempt := 1; ; attempt++ {
+		_, err := pool.Exec(ctx, `
+			SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+			WHERE datname = $1 AND pid <> pg_backend_pid()`,
+			name,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to terminate connections: %w", err)
+		}
+		_, err = pool.Exec(ctx, query)
+		if !pgconst.IsObjectInUse(err) || attempt == forceDropAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clk.After(time.Duration(attempt) * forceDropBackoff):
+		}
+	}
+}
+
+// poolDatabases returns the names of the existing test databases of the pool
+// poolID, named with namePrefix, and the name of its template database, which
+// is empty if it does not exist.
+func poolDatabases(ctx context.Context, pool *pgxpool.Pool, namePrefix, poolID string) ([]string, string, error) {
+	prefix := templatedb.TestDatabasePrefix(namePrefix, poolID)
+	rows, err := pool.Query(ctx, `
+		SELECT datname FROM pg_database
+		WHERE left(datname, length($1)) = $1
+			AND substr(datname, length($1) + 1) ~ '^[0-9]+$'
+		ORDER BY length(datname), datname`,
+		prefix,
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list test databases: %w", err)
+	}
+	tests, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list test databases: %w", err)
+	}
+
+	template, err := templatedb.TemplateDatabaseName(namePrefix, poolID)
+	if err != nil {
+		return nil, "", err
+	}
+	var exists bool
+	err = pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)`, template).Scan(&exists)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to check if template database exists: %w", err)
+	}
+	if !exists {
+		template = ""
+	}
+	return tests, template, nil
 }
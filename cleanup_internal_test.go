@@ -0,0 +1,81 @@
+package testdbpool
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestPool_CleanupContext_Concurrency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-cleanup-concurrency",
+		Pool:         connPool,
+		MaxDatabases: 10,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+
+	for range 4 {
+		_, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+	}
+
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	beforeCleanupDrop = func(string) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}
+	t.Cleanup(func() { beforeCleanupDrop = nil })
+	result, err := pool.CleanupContext(ctx, CleanupOptions{Concurrency: 3})
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, maxInFlight, "drops in flight should be bounded by Concurrency")
+	require.Len(t, result.Databases, 10)
+	for i, db := range result.Databases {
+		assert.Equal(t, getTestDBName(pool.cfg.NamePrefix, pool.cfg.ID, i), db.Name)
+		assert.NoError(t, db.Err)
+		assert.False(t, testutil.DBExists(t, connPool, db.Name))
+	}
+	assert.Equal(t, pool.TemplateDBName(), result.Template.Name)
+	assert.NoError(t, result.Template.Err)
+	assert.False(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+}
+
+func TestSplitFingerprintSuffix(t *testing.T) {
+	id := "myapp" + fingerprintSuffix("CREATE TABLE users (id INT);")
+	base, suffix, ok := splitFingerprintSuffix(id)
+	require.True(t, ok)
+	assert.Equal(t, "myapp", base)
+	assert.Equal(t, id[len("myapp"):], suffix)
+
+	for _, id := range []string{"myapp", "myapp-plain", "myapp_0123456789ab", "myapp-0123456789AB", "-0123456789a"} {
+		_, _, ok := splitFingerprintSuffix(id)
+		assert.False(t, ok, id)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/assert"
@@ -103,6 +104,136 @@ func TestListPools(t *testing.T) {
 	})
 }
 
+func TestListPoolsInfo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-list-info",
+		Pool:         connPool,
+		MaxDatabases: 3,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	infos, err := testdbpool.ListPoolsInfo(ctx, connPool, "test-list-info")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, pool.TemplateDBName(), infos[0].TemplateName)
+	assert.True(t, infos[0].CreatedAt.IsZero(), "template should not be built yet")
+	assert.Zero(t, infos[0].DatabaseCount)
+
+	db1, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer db1.Release(ctx)
+	db2, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer db2.Release(ctx)
+
+	infos, err = testdbpool.ListPoolsInfo(ctx, connPool, "test-list-info")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "test-list-info", infos[0].ID)
+	assert.Equal(t, 3, infos[0].MaxDatabases)
+	assert.WithinDuration(t, time.Now(), infos[0].CreatedAt, time.Minute)
+	assert.Equal(t, 2, infos[0].DatabaseCount)
+	assert.WithinDuration(t, time.Now(), infos[0].LastUsedAt, time.Minute)
+}
+
+func TestCleanupAllPools(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	var pools []*testdbpool.Pool
+	var held []string
+	for _, id := range []string{"test-cleanup-all-a", "test-cleanup-all-b"} {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           id,
+			Pool:         connPool,
+			MaxDatabases: 2,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+				return err
+			},
+		})
+		require.NoError(t, err)
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		// Keep the database without a connection, as if a crashed process
+		// had left it behind.
+		held = append(held, db.Name())
+		db.Pool().Close()
+		pools = append(pools, pool)
+	}
+	t.Cleanup(func() {
+		for _, pool := range pools {
+			pool.Cleanup()
+		}
+	})
+
+	results, err := testdbpool.CleanupAllPools(ctx, connPool, "test-cleanup-all-", testdbpool.CleanupOptions{
+		OlderThan: time.Hour,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, results, "fresh pools should be left alone")
+
+	// Pretend that both templates were built long ago, and that only the
+	// first pool has been used since.
+	for _, pool := range pools {
+		_, err := connPool.Exec(ctx, fmt.Sprintf(`COMMENT ON DATABASE %s IS '{"metadata_version": 2, "created_at": "2020-01-01T00:00:00Z"}'`,
+			pgx.Identifier{pool.TemplateDBName()}.Sanitize()))
+		require.NoError(t, err)
+	}
+	_, err = connPool.Exec(ctx, `UPDATE testdbpool_activity SET last_used_at = now() - interval '2 hours' WHERE pool_id = $1`,
+		pools[1].EffectiveID())
+	require.NoError(t, err)
+	results, err = testdbpool.CleanupAllPools(ctx, connPool, "test-cleanup-all-", testdbpool.CleanupOptions{
+		DryRun:    true,
+		OlderThan: time.Hour,
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 1, "recently used pools should be left alone")
+	assert.Equal(t, pools[1].EffectiveID(), results[0].ID)
+
+	results, err = testdbpool.CleanupAllPools(ctx, connPool, "test-cleanup-all-", testdbpool.CleanupOptions{
+		DryRun: true,
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	for i, result := range results {
+		assert.Equal(t, pools[i].EffectiveID(), result.ID)
+		assert.Equal(t, []string{held[i], pools[i].TemplateDBName()}, result.Databases)
+		assert.NoError(t, result.Err)
+		assert.True(t, testutil.DBExists(t, connPool, held[i]), "dry run should not drop databases")
+	}
+
+	results, err = testdbpool.CleanupAllPools(ctx, connPool, "test-cleanup-all-", testdbpool.CleanupOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	for i, result := range results {
+		assert.Equal(t, []string{held[i], pools[i].TemplateDBName()}, result.Databases)
+		assert.False(t, testutil.DBExists(t, connPool, held[i]))
+		assert.False(t, testutil.DBExists(t, connPool, pools[i].TemplateDBName()))
+	}
+	ids, err := testdbpool.ListPools(ctx, connPool, "test-cleanup-all-")
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
 func TestCleanupPool(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integration test")
@@ -195,6 +326,55 @@ func TestCleanupPool(t *testing.T) {
 	})
 }
 
+func TestCleanupPoolForce(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newPool := func(t *testing.T, id string) (*testdbpool.Pool, *testdbpool.TestDB) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           id,
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+				return err
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+		// Keep the database acquired with open connections, like a stuck
+		// test process.
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, db.Pool().Ping(ctx))
+		return pool, db
+	}
+
+	t.Run("CleanupPool leaves databases in use behind", func(t *testing.T) {
+		_, db := newPool(t, "test-cleanup-force-conservative")
+
+		require.NoError(t, testdbpool.CleanupPool(ctx, connPool, "test-cleanup-force-conservative"))
+		assert.True(t, testutil.DBExists(t, connPool, db.Name()))
+		require.NoError(t, db.Pool().Ping(ctx))
+	})
+
+	t.Run("CleanupPoolForce terminates connections", func(t *testing.T) {
+		pool, db := newPool(t, "test-cleanup-force")
+
+		require.NoError(t, testdbpool.CleanupPoolForce(ctx, connPool, "test-cleanup-force"))
+		assert.False(t, testutil.DBExists(t, connPool, db.Name()))
+		assert.False(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+		pools, err := testdbpool.ListPools(ctx, connPool, "test-cleanup-force")
+		require.NoError(t, err)
+		assert.Empty(t, pools)
+	})
+}
+
 func TestListAndCleanupIntegration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integration test")
@@ -266,3 +446,195 @@ func TestListAndCleanupIntegration(t *testing.T) {
 		assert.Contains(t, pools, currentPoolID, "current pool should remain")
 	})
 }
+
+func TestPool_CleanupStale(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newPool := func(id, fingerprint string) *testdbpool.Pool {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           id,
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE test_table (id INT)`)
+				return err
+			},
+			SchemaFingerprint: func() (string, error) {
+				return fingerprint, nil
+			},
+		})
+		require.NoError(t, err)
+		return pool
+	}
+
+	// A pool of an old schema, with its template and a test database.
+	old := newPool("stale-test", "CREATE TABLE users (id INT);")
+	db, err := old.Acquire(ctx)
+	require.NoError(t, err)
+	oldDB := db.Name()
+	require.NoError(t, db.Release(ctx))
+	require.NoError(t, old.Close(ctx))
+	require.Regexp(t, `^stale-test-[0-9a-f]{12}$`, old.EffectiveID())
+	require.Equal(t, "testdbpooltmpl_"+old.EffectiveID(), old.TemplateDBName())
+
+	// Pools sharing the prefix without a fingerprint are left alone.
+	plain, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "stale-test-plain",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(plain.Cleanup)
+
+	// So are pools of another base ID sharing the prefix.
+	other := newPool("stale-test-other", "CREATE TABLE users (id INT);")
+	t.Cleanup(other.Cleanup)
+
+	current := newPool("stale-test", "CREATE TABLE users (id BIGINT);")
+	t.Cleanup(current.Cleanup)
+	assert.NotEqual(t, old.EffectiveID(), current.EffectiveID())
+	db, err = current.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db.Release(ctx))
+
+	removed, err := current.CleanupStale(ctx, "stale-test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{old.EffectiveID()}, removed)
+
+	pools, err := testdbpool.ListPools(ctx, connPool, "stale-test")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{current.EffectiveID(), "stale-test-plain", other.EffectiveID()}, pools)
+	assert.False(t, testutil.DBExists(t, connPool, oldDB))
+	assert.False(t, testutil.DBExists(t, connPool, old.TemplateDBName()))
+	assert.True(t, testutil.DBExists(t, connPool, current.TemplateDBName()))
+
+	t.Run("requires SchemaFingerprint", func(t *testing.T) {
+		_, err := plain.CleanupStale(ctx, "stale-test")
+		assert.ErrorContains(t, err, "CleanupStale requires SchemaFingerprint to be set")
+	})
+}
+
+func TestNamePrefix(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	poolID := "test-name-prefix"
+	newConfig := func(prefix string) *testdbpool.Config {
+		return &testdbpool.Config{
+			ID:           poolID,
+			Pool:         connPool,
+			MaxDatabases: 1,
+			NamePrefix:   prefix,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+		}
+	}
+
+	pool, err := testdbpool.New(ctx, newConfig("ci_tmp_test"))
+	require.NoError(t, err)
+	assert.Equal(t, "ci_tmp_testtmpl_test-name-prefix", pool.TemplateDBName())
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "ci_tmp_test_test-name-prefix_0", db.Name())
+	assert.True(t, testutil.DBExists(t, connPool, db.Name()))
+	require.NoError(t, db.Release(ctx))
+
+	// The prefix is recorded with the pool, so it cannot silently change.
+	_, err = testdbpool.New(ctx, newConfig(""))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `pool test-name-prefix is registered with NamePrefix "ci_tmp_test", got "testdbpool"`)
+
+	require.NoError(t, pool.Close(ctx))
+	require.NoError(t, testdbpool.CleanupPool(ctx, connPool, poolID))
+	assert.False(t, testutil.DBExists(t, connPool, "ci_tmp_test_test-name-prefix_0"))
+	assert.False(t, testutil.DBExists(t, connPool, "ci_tmp_testtmpl_test-name-prefix"))
+}
+
+func TestTemplateVariantKey(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newConfig := func(variant string) *testdbpool.Config {
+		return &testdbpool.Config{
+			ID:                 "test-variant",
+			Pool:               connPool,
+			MaxDatabases:       1,
+			TemplateVariantKey: variant,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE flags (name TEXT)`)
+				if err == nil && variant == "flags=a,b" {
+					_, err = conn.Exec(ctx, `INSERT INTO flags VALUES ('a'), ('b')`)
+				}
+				return err
+			},
+		}
+	}
+	cfgA, cfgB := newConfig("flags=a,b"), newConfig("flags=")
+
+	poolA, err := testdbpool.New(ctx, cfgA)
+	require.NoError(t, err)
+	t.Cleanup(func() { poolA.Cleanup() })
+	poolB, err := testdbpool.New(ctx, cfgB)
+	require.NoError(t, err)
+	t.Cleanup(func() { poolB.Cleanup() })
+
+	assert.Equal(t, cfgA.ID, cfgB.ID)
+	assert.Equal(t, "flags=a,b", poolA.VariantKey())
+	assert.Equal(t, "flags=", poolB.VariantKey())
+	assert.NotEqual(t, poolA.EffectiveID(), poolB.EffectiveID())
+	assert.NotEqual(t, poolA.TemplateDBName(), poolB.TemplateDBName())
+
+	dbA, err := poolA.Acquire(ctx)
+	require.NoError(t, err)
+	defer dbA.Release(ctx)
+	dbB, err := poolB.Acquire(ctx)
+	require.NoError(t, err)
+	defer dbB.Release(ctx)
+	assert.NotEqual(t, dbA.Name(), dbB.Name())
+
+	// Each variant was built by its own SetupTemplate.
+	var countA, countB int
+	require.NoError(t, dbA.Pool().QueryRow(ctx, `SELECT count(*) FROM flags`).Scan(&countA))
+	require.NoError(t, dbB.Pool().QueryRow(ctx, `SELECT count(*) FROM flags`).Scan(&countB))
+	assert.Equal(t, 2, countA)
+	assert.Equal(t, 0, countB)
+
+	metadata, err := poolA.TemplateMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "flags=a,b", metadata["testdbpool.variant"])
+
+	infos, err := testdbpool.ListPoolsInfo(ctx, connPool, "test-variant")
+	require.NoError(t, err)
+	variants := map[string]string{}
+	for _, info := range infos {
+		assert.Equal(t, 1, info.MaxDatabases)
+		assert.Equal(t, "testdbpool", info.NamePrefix)
+		assert.Equal(t, "testdbpooltmpl_"+info.ID, info.TemplateName)
+		variants[info.ID] = info.VariantKey
+	}
+	assert.Equal(t, map[string]string{
+		poolA.EffectiveID(): "flags=a,b",
+		poolB.EffectiveID(): "flags=",
+	}, variants)
+}
@@ -0,0 +1,76 @@
+package testdbpool
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// createFunc creates the test database name for the slot index and returns a
+// pool connected to it whose connections use appName, if not empty. It
+// reports whether an existing database was reused instead of created.
+type createFunc func(ctx context.Context, index int, name, appName string) (*pgxpool.Pool, bool, error)
+
+// cloneTemplate is the createFunc that clones the template database, or
+// reuses a clean test database together with the pool retained for index
+// (see Config.ReuseClonePools).
+func (p *Pool) cloneTemplate(ctx context.Context, index int, name, appName string) (*pgxpool.Pool, bool, error) {
+	return p.templateDB.CreateReusing(ctx, name, appName, p.takeClonePool(index))
+}
+
+// createEmpty is the createFunc of AcquireEmpty. The database is recreated,
+// so a pool retained for index is closed first.
+func (p *Pool) createEmpty(ctx context.Context, index int, name, appName string) (*pgxpool.Pool, bool, error) {
+	if pool := p.takeClonePool(index); pool != nil {
+		pool.Close()
+	}
+	pool, err := p.templateDB.CreateEmpty(ctx, name, appName)
+	return pool, false, err
+}
+
+// retainClonePool keeps pool, connected to the reset test database of the
+// slot index, for the next acquirer of index. It closes pool instead if the
+// Pool is closed.
+func (p *Pool) retainClonePool(index int, pool *pgxpool.Pool) {
+	p.clonePoolsMu.Lock()
+	defer p.clonePoolsMu.Unlock()
+
+	if p.clonePoolsClosed || index >= len(p.clonePools) {
+		pool.Close()
+		return
+	}
+	if old := p.clonePools[index]; old != nil && old != pool {
+		old.Close()
+	}
+	p.clonePools[index] = pool
+}
+
+// takeClonePool removes the pool retained for the slot index and returns
+// it, or nil if there is none.
+func (p *Pool) takeClonePool(index int) *pgxpool.Pool {
+	p.clonePoolsMu.Lock()
+	defer p.clonePoolsMu.Unlock()
+
+	if index >= len(p.clonePools) {
+		return nil
+	}
+	pool := p.clonePools[index]
+	p.clonePools[index] = nil
+	return pool
+}
+
+// closeClonePools closes the retained pools, so that their connections do
+// not keep the test databases from being dropped, and makes later releases
+// close their pools.
+func (p *Pool) closeClonePools() {
+	p.clonePoolsMu.Lock()
+	defer p.clonePoolsMu.Unlock()
+
+	p.clonePoolsClosed = true
+	for i, pool := range p.clonePools {
+		if pool != nil {
+			pool.Close()
+			p.clonePools[i] = nil
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrPoolClosing is returned by Acquire and its variants once CloseWait has
+// been called on the Pool.
+var ErrPoolClosing = errors.New("pool is closing")
+
+// beginAcquire registers an acquisition in progress, which CloseWait waits
+// for. It returns ErrPoolClosing if CloseWait has been called. Every
+// successful call must be followed by a call of endAcquire.
+func (p *Pool) beginAcquire() error {
+	p.closeMu.Lock()
+	defer p.closeMu.Unlock()
+	if p.closing {
+		return ErrPoolClosing
+	}
+	p.active++
+	return nil
+}
+
+// endAcquire ends an acquisition registered with beginAcquire, or the
+// lifetime of a test database registered with holdTestDB.
+func (p *Pool) endAcquire() {
+	p.closeMu.Lock()
+	defer p.closeMu.Unlock()
+	p.active--
+	if p.active == 0 && p.drained != nil {
+		close(p.drained)
+		p.drained = nil
+	}
+}
+
+// holdTestDB registers a test database that has been acquired, which
+// CloseWait waits for until it is released.
+func (p *Pool) holdTestDB() {
+	p.closeMu.Lock()
+	defer p.closeMu.Unlock()
+	p.active++
+}
+
+// CloseWait closes the pool like Close, but first makes Acquire and its
+// variants fail with ErrPoolClosing and waits until the acquisitions in
+// progress have finished and all test databases acquired through this Pool
+// have been released, e.g. by background goroutines of tests. This makes
+// shutdown deterministic instead of racing with late acquisitions.
+// If ctx is done first, CloseWait returns its error without closing the
+// pool; acquisitions keep failing with ErrPoolClosing.
+func (p *Pool) CloseWait(ctx context.Context) error {
+	p.closeMu.Lock()
+	p.closing = true
+	var drained chan struct{}
+	if p.active > 0 {
+		if p.drained == nil {
+			p.drained = make(chan struct{})
+		}
+		drained = p.drained
+	}
+	p.closeMu.Unlock()
+
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return fmt.Errorf("failed to wait for outstanding test databases: %w", ctx.Err())
+		}
+	}
+	return p.Close(ctx)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// outputFile is the name of the file generated by init.
+const outputFile = "testmain_test.go"
+
+// maxPoolIDLength is the maximum length of a pool ID for which the names of
+// the template database ("testdbpooltmpl_<id>") and the test databases
+// ("testdbpool_<id>_<index>") fit in PostgreSQL's 63 byte limit.
+const maxPoolIDLength = 48
+
+//go:embed templates/testmain.go.tmpl
+var templates embed.FS
+
+var testMainTemplate = template.Must(
+	template.New("testmain.go.tmpl").
+		Funcs(template.FuncMap{"quote": strconv.Quote}).
+		ParseFS(templates, "templates/testmain.go.tmpl"),
+)
+
+// validPoolID matches the pool IDs that init accepts.
+var validPoolID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// initOptions are the options of the generated TestMain.
+type initOptions struct {
+	// Package is the package name of the generated file.
+	Package string
+
+	// PoolID is the ID of the test database pool.
+	PoolID string
+
+	// SchemaFile is the slash-separated path, relative to the package
+	// directory, of an SQL file to embed and run in SetupTemplate.
+	// If empty, SetupTemplate is left for the user to fill in.
+	SchemaFile string
+
+	// Stdlib makes tests use database/sql via pgx's stdlib driver instead of
+	// pgxpool.Pool.
+	Stdlib bool
+}
+
+// declaredNames returns the top-level names that the generated file declares.
+func (o initOptions) declaredNames() []string {
+	names := []string{"TestMain", "run", "testPool"}
+	if o.SchemaFile != "" {
+		names = append(names, "schema")
+	}
+	if o.Stdlib {
+		names = append(names, "openDB")
+	} else {
+		names = append(names, "acquireDB")
+	}
+	return names
+}
+
+// runInit runs the init subcommand for the package in dir.
+func runInit(args []string, dir string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: testdbpool init [flags]\n\n"+
+			"Generates %s with TestMain scaffolding for the package in the current directory.\n\n"+
+			"Flags:\n", outputFile)
+		fs.PrintDefaults()
+	}
+
+	var opts initOptions
+	var pgxStyle, force bool
+	fs.StringVar(&opts.PoolID, "pool-id", "", "`ID` of the test database pool (default: derived from the directory name)")
+	fs.StringVar(&opts.SchemaFile, "schema-file", "", "SQL `file`, relative to the package directory, to embed and run in SetupTemplate")
+	fs.BoolVar(&pgxStyle, "pgx", false, "give tests a *pgxpool.Pool (default)")
+	fs.BoolVar(&opts.Stdlib, "stdlib", false, "give tests a *sql.DB using pgx's database/sql driver")
+	fs.StringVar(&opts.Package, "package", "", "package `name` of the generated file (default: detected from existing files)")
+	fs.BoolVar(&force, "force", false, "overwrite an existing "+outputFile)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if pgxStyle && opts.Stdlib {
+		return errors.New("-pgx and -stdlib are mutually exclusive")
+	}
+
+	if err := completeOptions(&opts, dir); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, outputFile)
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("%s already exists; use -force to overwrite it", outputFile)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to check %s: %w", outputFile, err)
+	}
+	if err := checkConflicts(dir, opts); err != nil {
+		return err
+	}
+
+	src, err := generate(opts)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, src, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", outputFile, err)
+	}
+	fmt.Fprintf(stdout, "wrote %s\n", path)
+	return nil
+}
+
+// completeOptions validates opts and fills in the defaults derived from the
+// package in dir.
+func completeOptions(opts *initOptions, dir string) error {
+	if opts.PoolID == "" {
+		opts.PoolID = defaultPoolID(filepath.Base(dir))
+	}
+	if !validPoolID.MatchString(opts.PoolID) {
+		return fmt.Errorf("pool ID must consist of letters, digits, '_' and '-', got %q", opts.PoolID)
+	}
+	if len(opts.PoolID) > maxPoolIDLength {
+		return fmt.Errorf("pool ID must not be longer than %d bytes, got %q", maxPoolIDLength, opts.PoolID)
+	}
+
+	if opts.SchemaFile != "" {
+		schemaFile, err := checkSchemaFile(dir, opts.SchemaFile)
+		if err != nil {
+			return err
+		}
+		opts.SchemaFile = schemaFile
+	}
+
+	if opts.Package == "" {
+		pkg, err := detectPackage(dir)
+		if err != nil {
+			return err
+		}
+		opts.Package = pkg
+	}
+	if !token.IsIdentifier(opts.Package) {
+		return fmt.Errorf("invalid package name %q", opts.Package)
+	}
+	return nil
+}
+
+// defaultPoolID derives a pool ID from the name of the package directory.
+func defaultPoolID(base string) string {
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, base)
+	if len(id) > maxPoolIDLength {
+		id = id[:maxPoolIDLength]
+	}
+	return id
+}
+
+// checkSchemaFile checks that file can be embedded into the package in dir
+// and returns it as a slash-separated path.
+func checkSchemaFile(dir, file string) (string, error) {
+	if !filepath.IsLocal(file) {
+		return "", fmt.Errorf("schema file must be inside the package directory, got %s", file)
+	}
+	// go:embed patterns are path.Match patterns separated by spaces.
+	if strings.ContainsAny(file, " *?[]\\\"`") {
+		return "", fmt.Errorf("schema file name contains characters unsupported by go:embed: %s", file)
+	}
+	info, err := os.Stat(filepath.Join(dir, file))
+	if err != nil {
+		return "", fmt.Errorf("failed to check schema file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("schema file is not a regular file: %s", file)
+	}
+	return filepath.ToSlash(filepath.Clean(file)), nil
+}
+
+// goFile is a Go file of the package directory.
+type goFile struct {
+	name string
+	ast  *ast.File
+}
+
+// parseGoFiles parses the Go files in dir. With mode parser.PackageClauseOnly
+// only the package clauses are parsed.
+func parseGoFiles(dir string, mode parser.Mode) ([]goFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package directory: %w", err)
+	}
+
+	fset := token.NewFileSet()
+	var files []goFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, mode|parser.SkipObjectResolution)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		files = append(files, goFile{name: name, ast: f})
+	}
+	return files, nil
+}
+
+// detectPackage returns the package name for the generated file: the package
+// of the existing test files, so that they can use the generated helpers, or
+// the external test package if there are none.
+func detectPackage(dir string) (string, error) {
+	files, err := parseGoFiles(dir, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+
+	var testPkgs, pkgs []string
+	for _, f := range files {
+		if f.name == outputFile {
+			continue
+		}
+		if strings.HasSuffix(f.name, "_test.go") {
+			testPkgs = append(testPkgs, f.ast.Name.Name)
+		} else {
+			pkgs = append(pkgs, f.ast.Name.Name)
+		}
+	}
+
+	slices.Sort(testPkgs)
+	testPkgs = slices.Compact(testPkgs)
+	switch len(testPkgs) {
+	case 0:
+	case 1:
+		return testPkgs[0], nil
+	default:
+		return "", fmt.Errorf(
+			"test files use several packages (%s); choose one with -package",
+			strings.Join(testPkgs, ", "),
+		)
+	}
+
+	if len(pkgs) > 0 {
+		return pkgs[0] + "_test", nil
+	}
+	pkg := strings.ReplaceAll(defaultPoolID(filepath.Base(dir)), "-", "_")
+	if !token.IsIdentifier(pkg) {
+		return "", errors.New("cannot derive a package name from the directory name; set one with -package")
+	}
+	return pkg + "_test", nil
+}
+
+// checkConflicts reports an error if the package in dir already declares
+// TestMain or any other name that the generated file would declare.
+func checkConflicts(dir string, opts initOptions) error {
+	files, err := parseGoFiles(dir, 0)
+	if err != nil {
+		return err
+	}
+
+	// Internal and external test files are linked into one test binary, so
+	// there can be only one TestMain among all of them.
+	basePkg := strings.TrimSuffix(opts.Package, "_test")
+	names := opts.declaredNames()
+	for _, f := range files {
+		if f.name == outputFile {
+			continue
+		}
+		isTest := strings.HasSuffix(f.name, "_test.go")
+		samePkg := f.ast.Name.Name == opts.Package ||
+			// Non-test files are part of the internal test package.
+			(!isTest && f.ast.Name.Name == basePkg && opts.Package == basePkg)
+
+		for _, decl := range f.ast.Decls {
+			for _, name := range declNames(decl) {
+				if isTest && name == "TestMain" {
+					return fmt.Errorf("%s already defines TestMain; remove it or merge the generated code by hand", f.name)
+				}
+				if samePkg && slices.Contains(names, name) {
+					return fmt.Errorf("%s already declares %s, which the generated file declares too", f.name, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// declNames returns the names declared by a top-level declaration, excluding
+// methods.
+func declNames(decl ast.Decl) []string {
+	var names []string
+	switch decl := decl.(type) {
+	case *ast.FuncDecl:
+		if decl.Recv == nil {
+			names = append(names, decl.Name.Name)
+		}
+	case *ast.GenDecl:
+		for _, spec := range decl.Specs {
+			switch spec := spec.(type) {
+			case *ast.ValueSpec:
+				for _, name := range spec.Names {
+					names = append(names, name.Name)
+				}
+			case *ast.TypeSpec:
+				names = append(names, spec.Name.Name)
+			}
+		}
+	}
+	return names
+}
+
+// generate returns the gofmt-formatted source of the generated file.
+func generate(opts initOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := testMainTemplate.Execute(&buf, opts); err != nil {
+		return nil, fmt.Errorf("failed to execute template: %w", err)
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to format generated code: %w", err)
+	}
+	return src, nil
+}
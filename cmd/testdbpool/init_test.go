@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+var generateTests = []struct {
+	name string
+	opts initOptions
+}{
+	{
+		name: "pgx",
+		opts: initOptions{Package: "app_test", PoolID: "app"},
+	},
+	{
+		name: "pgx_schema",
+		opts: initOptions{Package: "app_test", PoolID: "app", SchemaFile: "testdata/schema.sql"},
+	},
+	{
+		name: "stdlib",
+		opts: initOptions{Package: "app", PoolID: "app", Stdlib: true},
+	},
+	{
+		name: "stdlib_schema",
+		opts: initOptions{Package: "app", PoolID: "app", SchemaFile: "schema.sql", Stdlib: true},
+	},
+}
+
+func TestGenerate(t *testing.T) {
+	for _, tt := range generateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := generate(tt.opts)
+			require.NoError(t, err)
+
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				require.NoError(t, os.WriteFile(golden, got, 0o644))
+			}
+			want, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), string(got))
+		})
+	}
+}
+
+// TestGenerate_Builds checks that the generated code compiles against the
+// current API of testdbpool.
+func TestGenerate_Builds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that builds generated code")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	root, err := filepath.Abs("../..")
+	require.NoError(t, err)
+	goSum, err := os.ReadFile(filepath.Join(root, "go.sum"))
+	require.NoError(t, err)
+
+	for _, tt := range generateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "go.mod", "module example.com/app\n\ngo 1.23\n\n"+
+				"require github.com/yuku/testdbpool v0.0.0\n\n"+
+				"replace github.com/yuku/testdbpool => "+root+"\n")
+			writeFile(t, dir, "go.sum", string(goSum))
+			writeFile(t, dir, "app.go", "package app\n")
+			if tt.opts.SchemaFile != "" {
+				writeFile(t, dir, tt.opts.SchemaFile, "CREATE TABLE users (id INT);\n")
+			}
+
+			var stdout, stderr bytes.Buffer
+			args := []string{"-pool-id", tt.opts.PoolID, "-package", tt.opts.Package}
+			if tt.opts.SchemaFile != "" {
+				args = append(args, "-schema-file", tt.opts.SchemaFile)
+			}
+			if tt.opts.Stdlib {
+				args = append(args, "-stdlib")
+			}
+			require.NoError(t, runInit(args, dir, &stdout, &stderr), stderr.String())
+
+			for _, args := range [][]string{{"mod", "tidy"}, {"vet", "./..."}} {
+				cmd := exec.Command(goBin, args...)
+				cmd.Dir = dir
+				cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off")
+				out, err := cmd.CombinedOutput()
+				require.NoError(t, err, "go %v:\n%s", args, out)
+			}
+		})
+	}
+}
+
+func TestRunInit(t *testing.T) {
+	t.Run("detects the package of existing test files", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "My.Service")
+		writeFile(t, dir, "service.go", "package service\n")
+		writeFile(t, dir, "service_test.go", "package service\n")
+
+		require.NoError(t, runInit(nil, dir, &bytes.Buffer{}, &bytes.Buffer{}))
+		src := readFile(t, dir, outputFile)
+		assert.Contains(t, src, "package service\n")
+		assert.Contains(t, src, `ID:   "my-service",`)
+		assert.Contains(t, src, "func acquireDB(t testing.TB) *pgxpool.Pool {")
+	})
+
+	t.Run("uses the external test package without test files", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, dir, "service.go", "package service\n")
+
+		require.NoError(t, runInit([]string{"--pool-id", "svc"}, dir, &bytes.Buffer{}, &bytes.Buffer{}))
+		assert.Contains(t, readFile(t, dir, outputFile), "package service_test\n")
+	})
+
+	t.Run("overwrites its own output with -force", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, dir, "service.go", "package service\n")
+		require.NoError(t, runInit(nil, dir, &bytes.Buffer{}, &bytes.Buffer{}))
+
+		err := runInit([]string{"-stdlib"}, dir, &bytes.Buffer{}, &bytes.Buffer{})
+		assert.ErrorContains(t, err, "testmain_test.go already exists")
+
+		require.NoError(t, runInit([]string{"-stdlib", "-force"}, dir, &bytes.Buffer{}, &bytes.Buffer{}))
+		assert.Contains(t, readFile(t, dir, outputFile), "func openDB(t testing.TB) *sql.DB {")
+	})
+
+	errorTests := []struct {
+		name  string
+		files map[string]string
+		args  []string
+		want  string
+	}{
+		{
+			name:  "existing TestMain in another test package",
+			files: map[string]string{"main_test.go": "package service\n\nimport \"testing\"\n\nfunc TestMain(m *testing.M) {}\n"},
+			args:  []string{"-package", "service_test"},
+			want:  "main_test.go already defines TestMain",
+		},
+		{
+			name:  "conflicting declaration",
+			files: map[string]string{"helpers_test.go": "package service_test\n\nvar testPool = 1\n"},
+			want:  "helpers_test.go already declares testPool",
+		},
+		{
+			name:  "conflicting declaration in the package under test",
+			files: map[string]string{"service.go": "package service\n\nfunc acquireDB() {}\n"},
+			args:  []string{"-package", "service"},
+			want:  "service.go already declares acquireDB",
+		},
+		{
+			name: "several test packages",
+			files: map[string]string{
+				"a_test.go": "package service\n",
+				"b_test.go": "package service_test\n",
+			},
+			want: "choose one with -package",
+		},
+		{
+			name: "pgx and stdlib",
+			args: []string{"-pgx", "-stdlib"},
+			want: "mutually exclusive",
+		},
+		{
+			name: "schema file outside the package",
+			args: []string{"-schema-file", "../schema.sql"},
+			want: "must be inside the package directory",
+		},
+		{
+			name: "missing schema file",
+			args: []string{"-schema-file", "schema.sql"},
+			want: "failed to check schema file",
+		},
+		{
+			name:  "schema file with glob characters",
+			files: map[string]string{"schema[1].sql": ""},
+			args:  []string{"-schema-file", "schema[1].sql"},
+			want:  "unsupported by go:embed",
+		},
+		{
+			name: "invalid pool ID",
+			args: []string{"-pool-id", "my pool"},
+			want: "pool ID must consist of",
+		},
+		{
+			name: "too long pool ID",
+			args: []string{"-pool-id", "a123456789b123456789c123456789d123456789e123456789"},
+			want: "pool ID must not be longer than 48 bytes",
+		},
+		{
+			name: "unexpected argument",
+			args: []string{"extra"},
+			want: "unexpected arguments: extra",
+		},
+	}
+	for _, tt := range errorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "service")
+			writeFile(t, dir, "doc.go", "package service\n")
+			for name, content := range tt.files {
+				writeFile(t, dir, name, content)
+			}
+
+			err := runInit(tt.args, dir, &bytes.Buffer{}, &bytes.Buffer{})
+			assert.ErrorContains(t, err, tt.want)
+			assert.NoFileExists(t, filepath.Join(dir, outputFile))
+		})
+	}
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func readFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	require.NoError(t, err)
+	return string(b)
+}
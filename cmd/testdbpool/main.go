@@ -0,0 +1,64 @@
+// Command testdbpool provides tooling for projects that use the testdbpool
+// package.
+//
+// Usage:
+//
+//	testdbpool init [flags]
+//
+// The init subcommand generates a testmain_test.go with the TestMain
+// scaffolding that creates and cleans up a test database pool for the Go
+// package in the current directory. Run "testdbpool init -h" for its flags.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "init":
+		var dir string
+		dir, err = os.Getwd()
+		if err == nil {
+			err = runInit(args[1:], dir, stdout, stderr)
+		}
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "testdbpool: unknown command %q\n", args[0])
+		usage(stderr)
+		return 2
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "testdbpool: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func usage(w io.Writer) {
+	fmt.Fprint(w, `Usage: testdbpool <command> [flags]
+
+Commands:
+  init    generate TestMain scaffolding for the package in the current directory
+`)
+}
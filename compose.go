@@ -0,0 +1,99 @@
+package testdbpool
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SetupStepError is returned by the functions built with ComposeSetup when
+// one of their steps fails.
+type SetupStepError struct {
+	// Index is the position of the failed step among the steps, starting at
+	// 1.
+	Index int
+
+	// Steps is the number of steps.
+	Steps int
+
+	// Name is the name given to the step with NamedSetup, or empty.
+	Name string
+
+	// Err is the error of the step.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *SetupStepError) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("setup step %d/%d (%s) failed: %v", e.Index, e.Steps, e.Name, e.Err)
+	}
+	return fmt.Sprintf("setup step %d/%d failed: %v", e.Index, e.Steps, e.Err)
+}
+
+// Unwrap returns the error of the step.
+func (e *SetupStepError) Unwrap() error {
+	return e.Err
+}
+
+// namedStepError carries the name of a step built with NamedSetup to
+// ComposeSetup. It reads like the error of the step alone.
+type namedStepError struct {
+	name string
+	err  error
+}
+
+func (e *namedStepError) Error() string {
+	return e.err.Error()
+}
+
+func (e *namedStepError) Unwrap() error {
+	return e.err
+}
+
+// ComposeSetup returns a function suitable for Config.SetupTemplate that runs
+// fns in order on the same connection, e.g. to keep the extensions, the
+// schema and the seed data of a project apart:
+//
+//	cfg.SetupTemplate = testdbpool.ComposeSetup(
+//		testdbpool.NamedSetup("extensions", createExtensions),
+//		testdbpool.NamedSetup("schema", testdbpool.SetupFromSQLFiles("sql/schema.sql")),
+//		seedUsers,
+//	)
+//
+// It stops at the first step that fails and returns a *SetupStepError naming
+// the step by its position and, if given with NamedSetup, its name. Nil
+// functions are skipped.
+func ComposeSetup(fns ...func(context.Context, *pgx.Conn) error) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		for i, fn := range fns {
+			if fn == nil {
+				continue
+			}
+			if err := fn(ctx, conn); err != nil {
+				stepErr := &SetupStepError{Index: i + 1, Steps: len(fns), Err: err}
+				if named, ok := err.(*namedStepError); ok {
+					stepErr.Name, stepErr.Err = named.name, named.err
+				}
+				return stepErr
+			}
+		}
+		return nil
+	}
+}
+
+// NamedSetup names fn for the errors of ComposeSetup. The step is run with
+// TimeTemplateStep, so that its duration is reported to
+// Config.OnTemplateStep.
+func NamedSetup(name string, fn func(context.Context, *pgx.Conn) error) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		err := TimeTemplateStep(ctx, name, func() error {
+			return fn(ctx, conn)
+		})
+		if err != nil {
+			return &namedStepError{name: name, err: err}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,75 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/clock"
+)
+
+func TestComposeSetup(t *testing.T) {
+	ctx := context.Background()
+	var ran []string
+	step := func(name string, err error) func(context.Context, *pgx.Conn) error {
+		return func(ctx context.Context, conn *pgx.Conn) error {
+			ran = append(ran, name)
+			return err
+		}
+	}
+	errSeed := errors.New(`relation "users" does not exist`)
+
+	t.Run("runs the steps in order", func(t *testing.T) {
+		ran = nil
+		setup := ComposeSetup(step("extensions", nil), nil, NamedSetup("schema", step("schema", nil)))
+		require.NoError(t, setup(ctx, nil))
+		assert.Equal(t, []string{"extensions", "schema"}, ran)
+	})
+
+	t.Run("stops at the first error", func(t *testing.T) {
+		ran = nil
+		setup := ComposeSetup(step("schema", nil), step("seed", errSeed), step("index", nil))
+		err := setup(ctx, nil)
+		assert.Equal(t, []string{"schema", "seed"}, ran)
+		require.ErrorIs(t, err, errSeed)
+		var stepErr *SetupStepError
+		require.ErrorAs(t, err, &stepErr)
+		assert.Equal(t, SetupStepError{Index: 2, Steps: 3, Err: errSeed}, *stepErr)
+		assert.EqualError(t, err, `setup step 2/3 failed: relation "users" does not exist`)
+	})
+
+	t.Run("names the failed step", func(t *testing.T) {
+		setup := ComposeSetup(step("schema", nil), NamedSetup("seed", step("seed", errSeed)))
+		err := setup(ctx, nil)
+		require.ErrorIs(t, err, errSeed)
+		assert.EqualError(t, err, `setup step 2/2 (seed) failed: relation "users" does not exist`)
+	})
+
+	t.Run("names nested steps", func(t *testing.T) {
+		setup := ComposeSetup(
+			NamedSetup("schema", step("schema", nil)),
+			NamedSetup("seed", ComposeSetup(step("users", nil), NamedSetup("posts", step("posts", errSeed)))),
+		)
+		assert.EqualError(t, setup(ctx, nil), `setup step 2/2 (seed) failed: setup step 2/2 (posts) failed: relation "users" does not exist`)
+	})
+
+	t.Run("reports named steps to Config.OnTemplateStep", func(t *testing.T) {
+		var steps []string
+		setup := setupTemplateFunc(&Config{
+			SetupTemplate: ComposeSetup(
+				NamedSetup("extensions", step("extensions", nil)),
+				step("schema", nil),
+				NamedSetup("seed", step("seed", errSeed)),
+			),
+			OnTemplateStep: func(name string, d time.Duration) {
+				steps = append(steps, name)
+			},
+		}, clock.Real)
+		require.ErrorIs(t, setup(ctx, nil), errSeed)
+		assert.Equal(t, []string{"extensions", "seed"}, steps)
+	})
+}
@@ -3,7 +3,9 @@ package testdbpool
 import (
 	"context"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -124,6 +126,38 @@ func TestConfig_Validate(t *testing.T) {
 			wantErr: true,
 			errMsg:  "SetupTemplate function is required",
 		},
+		{
+			name: "SetupFromDatabase instead of SetupTemplate",
+			config: Config{
+				ID:                "test-pool",
+				Pool:              &pgxpool.Pool{},
+				MaxDatabases:      5,
+				SetupFromDatabase: "curated",
+			},
+			wantErr: false,
+		},
+		{
+			name: "SetupFromDatabase is the template of the pool",
+			config: Config{
+				ID:                "test-pool",
+				Pool:              &pgxpool.Pool{},
+				MaxDatabases:      5,
+				SetupFromDatabase: "testdbpooltmpl_test-pool",
+			},
+			wantErr: true,
+			errMsg:  "SetupFromDatabase must not be a database of the pool itself, got testdbpooltmpl_test-pool",
+		},
+		{
+			name: "SetupFromDatabase is a test database of the pool",
+			config: Config{
+				ID:                "test-pool",
+				Pool:              &pgxpool.Pool{},
+				MaxDatabases:      5,
+				SetupFromDatabase: "testdbpool_test-pool_0",
+			},
+			wantErr: true,
+			errMsg:  "SetupFromDatabase must not be a database of the pool itself, got testdbpool_test-pool_0",
+		},
 		{
 			name: "all fields nil except ID",
 			config: Config{
@@ -205,6 +239,322 @@ func TestConfig_Validate(t *testing.T) {
 			wantErr: true,
 			errMsg:  "invalid DatabaseOwner: this_is_a_very_long_identifier_name_that_exceeds_the_maximum_length",
 		},
+		{
+			name: "positive MaxTemplateAge",
+			config: Config{
+				ID:             "test-pool",
+				Pool:           &pgxpool.Pool{},
+				MaxDatabases:   5,
+				SetupTemplate:  validSetupTemplate,
+				MaxTemplateAge: 24 * time.Hour,
+			},
+			wantErr: false,
+		},
+		{
+			name: "negative MaxTemplateAge",
+			config: Config{
+				ID:             "test-pool",
+				Pool:           &pgxpool.Pool{},
+				MaxDatabases:   5,
+				SetupTemplate:  validSetupTemplate,
+				MaxTemplateAge: -time.Second,
+			},
+			wantErr: true,
+			errMsg:  "MaxTemplateAge must not be negative, got -1s",
+		},
+		{
+			name: "negative MaxPoolDiskBytes",
+			config: Config{
+				ID:               "test-pool",
+				Pool:             &pgxpool.Pool{},
+				MaxDatabases:     5,
+				SetupTemplate:    validSetupTemplate,
+				MaxPoolDiskBytes: -1,
+			},
+			wantErr: true,
+			errMsg:  "MaxPoolDiskBytes must not be negative, got -1",
+		},
+		{
+			name: "negative DiskUsageRefreshInterval",
+			config: Config{
+				ID:                       "test-pool",
+				Pool:                     &pgxpool.Pool{},
+				MaxDatabases:             5,
+				SetupTemplate:            validSetupTemplate,
+				DiskUsageRefreshInterval: -time.Second,
+			},
+			wantErr: true,
+			errMsg:  "DiskUsageRefreshInterval must not be negative, got -1s",
+		},
+		{
+			name: "negative TemplateSetupTimeout",
+			config: Config{
+				ID:                   "test-pool",
+				Pool:                 &pgxpool.Pool{},
+				MaxDatabases:         5,
+				SetupTemplate:        validSetupTemplate,
+				TemplateSetupTimeout: -time.Second,
+			},
+			wantErr: true,
+			errMsg:  "TemplateSetupTimeout must not be negative, got -1s",
+		},
+		{
+			name: "negative OrphanTakeoverAfter",
+			config: Config{
+				ID:                  "test-pool",
+				Pool:                &pgxpool.Pool{},
+				MaxDatabases:        5,
+				SetupTemplate:       validSetupTemplate,
+				OrphanTakeoverAfter: -time.Second,
+			},
+			wantErr: true,
+			errMsg:  "OrphanTakeoverAfter must not be negative, got -1s",
+		},
+		{
+			name: "negative AcquireTimeout",
+			config: Config{
+				ID:             "test-pool",
+				Pool:           &pgxpool.Pool{},
+				MaxDatabases:   5,
+				SetupTemplate:  validSetupTemplate,
+				AcquireTimeout: -time.Second,
+			},
+			wantErr: true,
+			errMsg:  "AcquireTimeout must not be negative, got -1s",
+		},
+		{
+			name: "invalid CloneStrategy",
+			config: Config{
+				ID:            "test-pool",
+				Pool:          &pgxpool.Pool{},
+				MaxDatabases:  5,
+				SetupTemplate: validSetupTemplate,
+				CloneStrategy: "COPY",
+			},
+			wantErr: true,
+			errMsg:  "invalid CloneStrategy: COPY",
+		},
+		{
+			name: "negative CreateRetries",
+			config: Config{
+				ID:            "test-pool",
+				Pool:          &pgxpool.Pool{},
+				MaxDatabases:  5,
+				SetupTemplate: validSetupTemplate,
+				CreateRetries: -1,
+			},
+			wantErr: true,
+			errMsg:  "CreateRetries must not be negative, got -1",
+		},
+		{
+			name: "RuntimeParams with search_path",
+			config: Config{
+				ID:            "test-pool",
+				Pool:          &pgxpool.Pool{},
+				MaxDatabases:  5,
+				SetupTemplate: validSetupTemplate,
+				RuntimeParams: map[string]string{"statement_timeout": "30s", "search_path": "app"},
+			},
+			wantErr: true,
+			errMsg:  "RuntimeParams must not set search_path; set it on Pool instead",
+		},
+		{
+			name: "RuntimeParams with empty name",
+			config: Config{
+				ID:            "test-pool",
+				Pool:          &pgxpool.Pool{},
+				MaxDatabases:  5,
+				SetupTemplate: validSetupTemplate,
+				RuntimeParams: map[string]string{"": "30s"},
+			},
+			wantErr: true,
+			errMsg:  "RuntimeParams must not contain an empty name",
+		},
+		{
+			name: "negative MaxConsecutiveFailures",
+			config: Config{
+				ID:                     "test-pool",
+				Pool:                   &pgxpool.Pool{},
+				MaxDatabases:           5,
+				SetupTemplate:          validSetupTemplate,
+				MaxConsecutiveFailures: -1,
+			},
+			wantErr: true,
+			errMsg:  "MaxConsecutiveFailures must not be negative, got -1",
+		},
+		{
+			name: "negative MaxTemplateSetupDuration",
+			config: Config{
+				ID:                       "test-pool",
+				Pool:                     &pgxpool.Pool{},
+				MaxDatabases:             5,
+				SetupTemplate:            validSetupTemplate,
+				MaxTemplateSetupDuration: -time.Second,
+			},
+			wantErr: true,
+			errMsg:  "MaxTemplateSetupDuration must not be negative, got -1s",
+		},
+		{
+			name: "ReuseClonePools without ResetDatabase",
+			config: Config{
+				ID:              "test-pool",
+				Pool:            &pgxpool.Pool{},
+				MaxDatabases:    5,
+				SetupTemplate:   validSetupTemplate,
+				ReuseClonePools: true,
+			},
+			wantErr: true,
+			errMsg:  "ReuseClonePools requires ResetDatabase",
+		},
+		{
+			name: "ResetBySnapshot with ResetDatabase",
+			config: Config{
+				ID:              "test-pool",
+				Pool:            &pgxpool.Pool{},
+				MaxDatabases:    5,
+				SetupTemplate:   validSetupTemplate,
+				ResetBySnapshot: true,
+				ResetDatabase: func(ctx context.Context, conn *pgx.Conn) error {
+					return nil
+				},
+			},
+			wantErr: true,
+			errMsg:  "ResetBySnapshot must not be set together with ResetDatabase",
+		},
+		{
+			name: "VerifyClean without reset",
+			config: Config{
+				ID:            "test-pool",
+				Pool:          &pgxpool.Pool{},
+				MaxDatabases:  5,
+				SetupTemplate: validSetupTemplate,
+				VerifyClean:   true,
+			},
+			wantErr: true,
+			errMsg:  "VerifyClean requires ResetDatabase or ResetBySnapshot",
+		},
+		{
+			name: "OnDirty without VerifyClean",
+			config: Config{
+				ID:              "test-pool",
+				Pool:            &pgxpool.Pool{},
+				MaxDatabases:    5,
+				SetupTemplate:   validSetupTemplate,
+				ResetBySnapshot: true,
+				OnDirty:         func(err *DirtyError) {},
+			},
+			wantErr: true,
+			errMsg:  "OnDirty requires VerifyClean",
+		},
+		{
+			name: "ReuseClonePools with ResetBySnapshot",
+			config: Config{
+				ID:              "test-pool",
+				Pool:            &pgxpool.Pool{},
+				MaxDatabases:    5,
+				SetupTemplate:   validSetupTemplate,
+				ResetBySnapshot: true,
+				ReuseClonePools: true,
+			},
+			wantErr: false,
+		},
+		{
+			name: "ReuseAcrossRuns without ReuseSentinelTable",
+			config: Config{
+				ID:              "test-pool",
+				Pool:            &pgxpool.Pool{},
+				MaxDatabases:    5,
+				SetupTemplate:   validSetupTemplate,
+				ReuseAcrossRuns: true,
+			},
+			wantErr: true,
+			errMsg:  "ReuseAcrossRuns requires ReuseSentinelTable",
+		},
+		{
+			name: "ReuseAcrossRuns without ResetDatabase",
+			config: Config{
+				ID:                 "test-pool",
+				Pool:               &pgxpool.Pool{},
+				MaxDatabases:       5,
+				SetupTemplate:      validSetupTemplate,
+				ReuseAcrossRuns:    true,
+				ReuseSentinelTable: "public.items",
+			},
+			wantErr: true,
+			errMsg:  "ReuseAcrossRuns requires ResetDatabase or ResetBySnapshot",
+		},
+		{
+			name: "valid NamePrefix",
+			config: Config{
+				ID:            "test-pool",
+				Pool:          &pgxpool.Pool{},
+				MaxDatabases:  5,
+				SetupTemplate: validSetupTemplate,
+				NamePrefix:    "ci_tmp_test",
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid NamePrefix",
+			config: Config{
+				ID:            "test-pool",
+				Pool:          &pgxpool.Pool{},
+				MaxDatabases:  5,
+				SetupTemplate: validSetupTemplate,
+				NamePrefix:    "ci-tmp",
+			},
+			wantErr: true,
+			errMsg:  "invalid NamePrefix: ci-tmp",
+		},
+		{
+			name: "NamePrefix and ID too long",
+			config: Config{
+				ID:            strings.Repeat("a", 41),
+				Pool:          &pgxpool.Pool{},
+				MaxDatabases:  5,
+				SetupTemplate: validSetupTemplate,
+				NamePrefix:    "ci_tmp_testdbpool_",
+			},
+			wantErr: true,
+			errMsg: "NamePrefix and ID are too long: template database name exceeds maximum length of 63 characters: " +
+				"ci_tmp_testdbpool_tmpl_" + strings.Repeat("a", 41),
+		},
+		{
+			name: "SetupFromDatabase is a test database of the pool with NamePrefix",
+			config: Config{
+				ID:                "test-pool",
+				Pool:              &pgxpool.Pool{},
+				MaxDatabases:      5,
+				NamePrefix:        "ci_tmp",
+				SetupFromDatabase: "ci_tmp_test-pool_3",
+			},
+			wantErr: true,
+			errMsg:  "SetupFromDatabase must not be a database of the pool itself, got ci_tmp_test-pool_3",
+		},
+		{
+			name: "RequiredExtensions with empty name",
+			config: Config{
+				ID:                 "test-pool",
+				Pool:               &pgxpool.Pool{},
+				MaxDatabases:       5,
+				SetupTemplate:      validSetupTemplate,
+				RequiredExtensions: []ExtensionRequirement{{MinVersion: "1.0"}},
+			},
+			wantErr: true,
+			errMsg:  "RequiredExtensions must not contain an empty name",
+		},
+		{
+			name: "RequiredRoles with invalid name",
+			config: Config{
+				ID:            "test-pool",
+				Pool:          &pgxpool.Pool{},
+				MaxDatabases:  5,
+				SetupTemplate: validSetupTemplate,
+				RequiredRoles: []RoleSpec{{Name: "app reader"}},
+			},
+			wantErr: true,
+			errMsg:  `invalid RequiredRoles name: "app reader"`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -291,6 +641,24 @@ func TestConfig_Validate_EdgeCases(t *testing.T) {
 	}
 }
 
+// TestNew_ValidatesEffectiveID tests that New rejects an ID that only gets too
+// long with the suffixes of the variant key and the schema fingerprint.
+func TestNew_ValidatesEffectiveID(t *testing.T) {
+	config := Config{
+		ID:                 strings.Repeat("a", 40),
+		Pool:               &pgxpool.Pool{},
+		MaxDatabases:       5,
+		SetupTemplate:      func(ctx context.Context, conn *pgx.Conn) error { return nil },
+		TemplateVariantKey: "en_US",
+		SchemaFingerprint:  func() (string, error) { return "CREATE TABLE users (id INT);", nil },
+	}
+	assert.NoError(t, config.Validate())
+
+	_, err := New(context.Background(), &config)
+	assert.ErrorContains(t, err, "NamePrefix and ID are too long")
+	assert.Equal(t, strings.Repeat("a", 40), config.ID, "New must not modify the config")
+}
+
 // TestIsValidPostgreSQLIdentifier tests the PostgreSQL identifier validation function
 func TestIsValidPostgreSQLIdentifier(t *testing.T) {
 	tests := []struct {
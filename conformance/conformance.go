@@ -0,0 +1,447 @@
+// Package conformance runs a curated part of testdbpool's own integration
+// tests against a PostgreSQL server of the caller's choosing, e.g. as a smoke
+// test before rolling a new server version out to CI:
+//
+//	func TestTestdbpoolConformance(t *testing.T) {
+//		rootPool, err := pgxpool.New(context.Background(), os.Getenv("CANDIDATE_DATABASE_URL"))
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		defer rootPool.Close()
+//		conformance.Run(t, rootPool, conformance.Options{CrossProcess: true})
+//	}
+//
+// Every check runs as a subtest of its own and only touches the pools and
+// databases it creates, whose IDs start with Options.IDPrefix, unless
+// Options.AllowDestructive is set.
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yuku/numpool"
+	"github.com/yuku/testdbpool"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// defaultIDPrefix is the default value of Options.IDPrefix.
+const defaultIDPrefix = "conformance"
+
+// Options configures Run.
+type Options struct {
+	// IDPrefix is the prefix of the IDs of the pools that the checks create.
+	// Optional. Default is "conformance".
+	IDPrefix string
+
+	// DatabaseOwner is an existing role that the owner check makes the owner
+	// of the template and test databases. The connection user of the root
+	// pool must be able to create databases owned by it.
+	// Optional. If empty, the owner check creates a role of its own if
+	// AllowDestructive is set, and is skipped otherwise.
+	DatabaseOwner string
+
+	// CrossProcess enables the check that shares a pool between two Pool
+	// instances with separate connections to the server, as test processes
+	// of different packages do.
+	CrossProcess bool
+
+	// AllowDestructive enables the checks that change state shared with
+	// other users of the server: creating and dropping a role, and removing
+	// the tables that numpool keeps for all pools on the server. Only set it
+	// against a server dedicated to the run.
+	AllowDestructive bool
+}
+
+// check is a check of the suite.
+type check struct {
+	name string
+	run  func(t *testing.T, s *suite)
+}
+
+// checks is the suite, in the order in which it runs.
+var checks = []check{
+	{"isolation", checkIsolation},
+	{"concurrency", checkConcurrency},
+	{"template reuse", checkTemplateReuse},
+	{"owner", checkOwner},
+	{"cleanup", checkCleanup},
+	{"cross process", checkCrossProcess},
+	{"numpool reset", checkNumpoolReset},
+}
+
+// suite is the state shared by the checks of a run.
+type suite struct {
+	ctx      context.Context
+	rootPool *pgxpool.Pool
+	opts     Options
+}
+
+// Run runs the suite against the server that rootPool is connected to, each
+// check as a subtest of t, and logs a summary of the results along with the
+// server version. rootPool is not closed.
+func Run(t *testing.T, rootPool *pgxpool.Pool, opts Options) {
+	t.Helper()
+	if opts.IDPrefix == "" {
+		opts.IDPrefix = defaultIDPrefix
+	}
+	s := &suite{ctx: context.Background(), rootPool: rootPool, opts: opts}
+
+	var version string
+	if err := rootPool.QueryRow(s.ctx, `SHOW server_version`).Scan(&version); err != nil {
+		t.Fatalf("failed to connect to the server: %v", err)
+	}
+
+	var mu sync.Mutex
+	results := make([]string, 0, len(checks))
+	var passed, failed, skipped int
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				mu.Lock()
+				defer mu.Unlock()
+				status := "PASS"
+				switch {
+				case t.Failed():
+					status = "FAIL"
+					failed++
+				case t.Skipped():
+					status = "SKIP"
+					skipped++
+				default:
+					passed++
+				}
+				results = append(results, fmt.Sprintf("  %s  %s", status, c.name))
+			})
+			c.run(t, s)
+		})
+	}
+
+	t.Logf("testdbpool conformance against PostgreSQL %s: %d passed, %d failed, %d skipped\n%s",
+		version, passed, failed, skipped, strings.Join(results, "\n"))
+}
+
+// newPool creates a pool whose ID is made of the prefix and name, which is
+// cleaned up and unregistered when t completes. setups counts the calls of
+// its SetupTemplate.
+func (s *suite) newPool(t *testing.T, name string, maxDatabases int, setups *atomic.Int32) *testdbpool.Pool {
+	t.Helper()
+	id := s.opts.IDPrefix + "_" + name
+	pool, err := testdbpool.New(s.ctx, s.config(id, maxDatabases, setups))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	t.Cleanup(func() {
+		pool.Cleanup()
+		_ = testdbpool.CleanupPool(s.ctx, s.rootPool, id)
+	})
+	return pool
+}
+
+// config returns the configuration of the pool id of the suite.
+func (s *suite) config(id string, maxDatabases int, setups *atomic.Int32) *testdbpool.Config {
+	return &testdbpool.Config{
+		ID:           id,
+		Pool:         s.rootPool,
+		MaxDatabases: maxDatabases,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			if setups != nil {
+				setups.Add(1)
+			}
+			_, err := conn.Exec(ctx, `CREATE TABLE items (id SERIAL PRIMARY KEY, name TEXT NOT NULL)`)
+			return err
+		},
+	}
+}
+
+// databaseExists reports whether the database name exists.
+func (s *suite) databaseExists(t *testing.T, name string) bool {
+	t.Helper()
+	var exists bool
+	err := s.rootPool.
+		QueryRow(s.ctx, `SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`, name).
+		Scan(&exists)
+	if err != nil {
+		t.Fatalf("failed to check if database %s exists: %v", name, err)
+	}
+	return exists
+}
+
+// countItems returns the number of rows of the items table of db.
+func countItems(ctx context.Context, db *testdbpool.TestDB) (int, error) {
+	var n int
+	err := db.Pool().QueryRow(ctx, `SELECT count(*) FROM items`).Scan(&n)
+	return n, err
+}
+
+// checkIsolation checks that test databases do not see each other's data and
+// that released databases are dropped and recreated from the template.
+func checkIsolation(t *testing.T, s *suite) {
+	pool := s.newPool(t, "isolation", 2, nil)
+
+	db1, err := pool.Acquire(s.ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+	db2 := pool.AcquireT(t)
+	if db1.Name() == db2.Name() {
+		t.Fatalf("acquired the same database %s twice", db1.Name())
+	}
+	if _, err := db1.Pool().Exec(s.ctx, `INSERT INTO items (name) VALUES ('only in db1')`); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if n, err := countItems(s.ctx, db2); err != nil || n != 0 {
+		t.Fatalf("db2 sees %d rows of db1 (err: %v)", n, err)
+	}
+
+	name := db1.Name()
+	if err := db1.Release(s.ctx); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if s.databaseExists(t, name) {
+		t.Fatalf("released database %s still exists", name)
+	}
+	db3 := pool.AcquireT(t)
+	if n, err := countItems(s.ctx, db3); err != nil || n != 0 {
+		t.Fatalf("reacquired database has %d rows instead of a fresh copy of the template (err: %v)", n, err)
+	}
+}
+
+// checkConcurrency checks that concurrent acquisitions beyond the size of the
+// pool wait for each other and always get a fresh database.
+func checkConcurrency(t *testing.T, s *suite) {
+	pool := s.newPool(t, "concurrency", 2, nil)
+
+	const workers, rounds = 6, 3
+	ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+	defer cancel()
+	errs := make(chan error, workers*rounds)
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rounds {
+				errs <- func() error {
+					db, err := pool.Acquire(ctx)
+					if err != nil {
+						return fmt.Errorf("worker %d: failed to acquire: %w", w, err)
+					}
+					defer func() { _ = db.Release(ctx) }()
+					if _, err := db.Pool().Exec(ctx, `INSERT INTO items (name) VALUES ($1)`, fmt.Sprint(w, r)); err != nil {
+						return fmt.Errorf("worker %d: failed to insert: %w", w, err)
+					}
+					if n, err := countItems(ctx, db); err != nil || n != 1 {
+						return fmt.Errorf("worker %d: database %s has %d rows instead of 1 (err: %v)", w, db.Name(), n, err)
+					}
+					return nil
+				}()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if stat := pool.Stat(); stat.AcquiredCount != 0 {
+		t.Errorf("%d databases are still acquired", stat.AcquiredCount)
+	}
+}
+
+// checkTemplateReuse checks that a pool created again with the same ID reuses
+// the template instead of setting it up again.
+func checkTemplateReuse(t *testing.T, s *suite) {
+	var setups atomic.Int32
+	pool := s.newPool(t, "template_reuse", 1, &setups)
+	db, err := pool.Acquire(s.ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+	if err := db.Release(s.ctx); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if err := pool.Close(s.ctx); err != nil {
+		t.Fatalf("failed to close pool: %v", err)
+	}
+
+	again, err := testdbpool.New(s.ctx, s.config(pool.EffectiveID(), 1, &setups))
+	if err != nil {
+		t.Fatalf("failed to create pool again: %v", err)
+	}
+	t.Cleanup(again.Cleanup)
+	if _, err := countItems(s.ctx, again.AcquireT(t)); err != nil {
+		t.Fatalf("database created from the reused template lacks its schema: %v", err)
+	}
+	if n := setups.Load(); n != 1 {
+		t.Fatalf("SetupTemplate ran %d times instead of once", n)
+	}
+}
+
+// checkOwner checks that the template and test databases are owned by
+// Config.DatabaseOwner.
+func checkOwner(t *testing.T, s *suite) {
+	owner := s.opts.DatabaseOwner
+	if owner == "" {
+		if !s.opts.AllowDestructive {
+			t.Skip("set Options.DatabaseOwner or Options.AllowDestructive to check database owners")
+		}
+		owner = s.opts.IDPrefix + "_owner"
+		role, err := sqlbuild.Ident(owner)
+		if err != nil {
+			t.Fatalf("invalid role name %s: %v", owner, err)
+		}
+		if _, err := s.rootPool.Exec(s.ctx, `CREATE ROLE `+role); err != nil {
+			t.Fatalf("failed to create role %s: %v", owner, err)
+		}
+		t.Cleanup(func() {
+			_, _ = s.rootPool.Exec(s.ctx, `DROP ROLE IF EXISTS `+role)
+		})
+	}
+
+	id := s.opts.IDPrefix + "_owner"
+	cfg := s.config(id, 1, nil)
+	cfg.DatabaseOwner = owner
+	pool, err := testdbpool.New(s.ctx, cfg)
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	// The pool must be gone before the role can be dropped.
+	defer func() {
+		pool.Cleanup()
+		_ = testdbpool.CleanupPool(s.ctx, s.rootPool, id)
+	}()
+
+	db, err := pool.Acquire(s.ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+	defer func() { _ = db.Release(s.ctx) }()
+	for _, name := range []string{pool.TemplateDBName(), db.Name()} {
+		var got string
+		err := s.rootPool.QueryRow(s.ctx,
+			`SELECT pg_get_userbyid(datdba) FROM pg_database WHERE datname = $1`, name,
+		).Scan(&got)
+		if err != nil {
+			t.Fatalf("failed to get owner of %s: %v", name, err)
+		}
+		if got != owner {
+			t.Errorf("database %s is owned by %s instead of %s", name, got, owner)
+		}
+	}
+}
+
+// checkCleanup checks that cleaning up a pool drops its template and test
+// databases and that unregistering it removes it from the listed pools.
+func checkCleanup(t *testing.T, s *suite) {
+	id := s.opts.IDPrefix + "_cleanup"
+	pool, err := testdbpool.New(s.ctx, s.config(id, 2, nil))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	dbs, err := pool.AcquireMultiple(s.ctx, 2)
+	if err != nil {
+		pool.Cleanup()
+		t.Fatalf("failed to acquire: %v", err)
+	}
+	names := []string{pool.TemplateDBName(), dbs[0].Name(), dbs[1].Name()}
+
+	if _, err := pool.CleanupContext(s.ctx, testdbpool.CleanupOptions{}); err != nil {
+		t.Errorf("failed to clean up: %v", err)
+	}
+	for _, name := range names {
+		if s.databaseExists(t, name) {
+			t.Errorf("database %s still exists after cleanup", name)
+		}
+	}
+
+	if err := testdbpool.CleanupPool(s.ctx, s.rootPool, id); err != nil {
+		t.Fatalf("failed to unregister pool: %v", err)
+	}
+	pools, err := testdbpool.ListPools(s.ctx, s.rootPool, id)
+	if err != nil {
+		t.Fatalf("failed to list pools: %v", err)
+	}
+	for _, p := range pools {
+		if p == id {
+			t.Errorf("pool %s is still registered after CleanupPool", id)
+		}
+	}
+}
+
+// checkCrossProcess checks that two Pool instances with separate connections
+// to the server share the databases of the same pool ID.
+func checkCrossProcess(t *testing.T, s *suite) {
+	if !s.opts.CrossProcess {
+		t.Skip("set Options.CrossProcess to check sharing a pool between processes")
+	}
+
+	other, err := pgxpool.NewWithConfig(s.ctx, s.rootPool.Config().Copy())
+	if err != nil {
+		t.Fatalf("failed to connect a second root pool: %v", err)
+	}
+	defer other.Close()
+
+	poolA := s.newPool(t, "cross_process", 1, nil)
+	cfg := s.config(poolA.EffectiveID(), 1, nil)
+	cfg.Pool = other
+	poolB, err := testdbpool.New(s.ctx, cfg)
+	if err != nil {
+		t.Fatalf("failed to create second pool: %v", err)
+	}
+	defer func() { _ = poolB.Close(s.ctx) }()
+
+	dbA, err := poolA.Acquire(s.ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire from first pool: %v", err)
+	}
+	if _, ok, err := poolB.TryAcquire(s.ctx); err != nil || ok {
+		t.Fatalf("second pool acquired a database while the only one was held by the first (ok: %t, err: %v)", ok, err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+		defer cancel()
+		db, err := poolB.Acquire(ctx)
+		if err == nil {
+			err = db.Release(s.ctx)
+		}
+		acquired <- err
+	}()
+	if err := dbA.Release(s.ctx); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if err := <-acquired; err != nil {
+		t.Fatalf("second pool did not get the database released by the first: %v", err)
+	}
+}
+
+// checkNumpoolReset checks that pools can be created again after the numpool
+// tables shared by all pools on the server have been removed.
+func checkNumpoolReset(t *testing.T, s *suite) {
+	if !s.opts.AllowDestructive {
+		t.Skip("set Options.AllowDestructive to check removing the numpool tables of the server")
+	}
+
+	if err := numpool.Cleanup(s.ctx, s.rootPool); err != nil {
+		t.Fatalf("failed to remove numpool tables: %v", err)
+	}
+	pool := s.newPool(t, "numpool_reset", 1, nil)
+	db, err := pool.Acquire(s.ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire after removing numpool tables: %v", err)
+	}
+	if err := db.Release(s.ctx); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package conformance_test
+
+import (
+	"testing"
+
+	"github.com/yuku/testdbpool/conformance"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+// TestRun runs the suite against the test server, so that it keeps passing
+// along with the integration tests of the repository.
+func TestRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	conformance.Run(t, connPool, conformance.Options{
+		CrossProcess:     true,
+		AllowDestructive: true,
+	})
+}
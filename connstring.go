@@ -0,0 +1,117 @@
+package testdbpool
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ConnConfig returns a copy of the connection configuration of the
+// connections of Pool, for callers that want to adjust it before connecting
+// themselves, e.g. with pgx.ConnectConfig. It points at the test database
+// with the credentials of Config.Pool, or those of Config.ConnStringFunc.
+// Unlike Conn, connecting with it does not run the AfterConnect hook of
+// Config.Pool, and the connection is not closed by Release.
+func (db *TestDB) ConnConfig() *pgx.ConnConfig {
+	return db.pool.Config().ConnConfig.Copy()
+}
+
+// ConnString returns a postgres:// URL for the database, e.g. to hand it to
+// an external process under test. It carries the host, port, user and
+// password that the connections of Pool use, also if they were resolved from
+// the environment or a password file, their runtime parameters such as
+// search_path and application_name, and the other settings of the
+// connection string of the root pool, such as sslmode, or of
+// Config.ConnStringFunc. Only the first host is included.
+func (db *TestDB) ConnString() string {
+	return connURL(db.pool.Config().ConnConfig)
+}
+
+// connURL returns a postgres:// URL for cfg.
+func connURL(cfg *pgx.ConnConfig) string {
+	settings := connStringSettings(cfg.ConnString())
+	for _, key := range []string{"host", "hostaddr", "port", "user", "password", "dbname", "database"} {
+		delete(settings, key)
+	}
+	for key, value := range cfg.RuntimeParams {
+		settings[key] = value
+	}
+
+	u := url.URL{Scheme: "postgres", Path: "/" + cfg.Database}
+	if cfg.Password != "" {
+		u.User = url.UserPassword(cfg.User, cfg.Password)
+	} else if cfg.User != "" {
+		u.User = url.User(cfg.User)
+	}
+	port := strconv.Itoa(int(cfg.Port))
+	if strings.HasPrefix(cfg.Host, "/") {
+		// Unix domain socket directories cannot be the host of a URL.
+		settings["host"] = cfg.Host
+		settings["port"] = port
+	} else {
+		u.Host = net.JoinHostPort(cfg.Host, port)
+	}
+
+	query := url.Values{}
+	for key, value := range settings {
+		query.Set(key, value)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// connStringSettings returns the settings of connString, which is either a
+// URL or in keyword/value format. Settings that cannot be parsed are left
+// out.
+func connStringSettings(connString string) map[string]string {
+	settings := map[string]string{}
+	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+		u, err := url.Parse(connString)
+		if err != nil {
+			return settings
+		}
+		for key, values := range u.Query() {
+			settings[key] = values[0]
+		}
+		return settings
+	}
+
+	s := connString
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return settings
+		}
+		eq := strings.IndexRune(s, '=')
+		if eq < 0 {
+			return settings
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeftFunc(s[eq+1:], unicode.IsSpace)
+
+		var value strings.Builder
+		if strings.HasPrefix(s, "'") {
+			s = s[1:]
+			for s != "" && s[0] != '\'' {
+				if s[0] == '\\' && len(s) > 1 {
+					s = s[1:]
+				}
+				value.WriteByte(s[0])
+				s = s[1:]
+			}
+			s = strings.TrimPrefix(s, "'")
+		} else {
+			end := strings.IndexFunc(s, unicode.IsSpace)
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(s[:end])
+			s = s[end:]
+		}
+		settings[key] = value.String()
+	}
+}
@@ -0,0 +1,54 @@
+package testdbpool
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnStringSettings(t *testing.T) {
+	assert.Equal(t,
+		map[string]string{"sslmode": "verify-full", "application_name": "app"},
+		connStringSettings("postgres://u:p@db:5432/postgres?sslmode=verify-full&application_name=app"),
+	)
+	assert.Equal(t,
+		map[string]string{"host": "db", "dbname": "postgres", "options": "-c search_path='a b'", "sslmode": "disable"},
+		connStringSettings(`host=db dbname = postgres options='-c search_path=\'a b\'' sslmode=disable`),
+	)
+	assert.Empty(t, connStringSettings(""))
+}
+
+func TestConnURL(t *testing.T) {
+	t.Run("TCP", func(t *testing.T) {
+		cfg, err := pgx.ParseConfig("host=db port=5433 user=app password='p@ss word' dbname=postgres sslmode=disable")
+		require.NoError(t, err)
+		cfg.Database = "testdbpool_app_0"
+		cfg.RuntimeParams["search_path"] = "app,public"
+
+		got := connURL(cfg)
+		assert.Equal(t, "postgres://app:p%40ss%20word@db:5433/testdbpool_app_0?search_path=app%2Cpublic&sslmode=disable", got)
+
+		parsed, err := pgx.ParseConfig(got)
+		require.NoError(t, err)
+		assert.Equal(t, "db", parsed.Host)
+		assert.Equal(t, uint16(5433), parsed.Port)
+		assert.Equal(t, "app", parsed.User)
+		assert.Equal(t, "p@ss word", parsed.Password)
+		assert.Equal(t, "testdbpool_app_0", parsed.Database)
+		assert.Equal(t, "app,public", parsed.RuntimeParams["search_path"])
+		assert.Nil(t, parsed.TLSConfig)
+	})
+
+	t.Run("Unix domain socket", func(t *testing.T) {
+		cfg, err := pgx.ParseConfig("host=/var/run/postgresql user=app dbname=postgres")
+		require.NoError(t, err)
+		cfg.Database = "testdbpool_app_1"
+
+		parsed, err := pgx.ParseConfig(connURL(cfg))
+		require.NoError(t, err)
+		assert.Equal(t, "/var/run/postgresql", parsed.Host)
+		assert.Equal(t, "testdbpool_app_1", parsed.Database)
+	})
+}
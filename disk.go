@@ -0,0 +1,136 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultDiskUsageRefreshInterval is the default value of
+// Config.DiskUsageRefreshInterval.
+const defaultDiskUsageRefreshInterval = 10 * time.Second
+
+// ErrDiskBudgetExceeded is returned by Acquire when the disk usage of the pool
+// exceeds Config.MaxPoolDiskBytes. Use errors.As with *DiskBudgetExceededError
+// to inspect the per-database breakdown.
+var ErrDiskBudgetExceeded = errors.New("pool disk budget exceeded")
+
+// DiskBudgetExceededError describes the disk usage that exceeded the budget.
+type DiskBudgetExceededError struct {
+	// Budget is the configured Config.MaxPoolDiskBytes.
+	Budget int64
+
+	// Usage is the disk usage of the pool at the time of the check.
+	Usage DiskUsage
+}
+
+// Error implements the error interface.
+func (e *DiskBudgetExceededError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: using %d bytes of %d", ErrDiskBudgetExceeded, e.Usage.TotalBytes, e.Budget)
+	for i, db := range e.Usage.Databases {
+		if i == 0 {
+			b.WriteString(" (")
+		} else {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %d", db.Name, db.Bytes)
+	}
+	if len(e.Usage.Databases) > 0 {
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+// Unwrap returns ErrDiskBudgetExceeded so that errors.Is can be used.
+func (e *DiskBudgetExceededError) Unwrap() error {
+	return ErrDiskBudgetExceeded
+}
+
+// DiskUsage is the disk footprint of a pool.
+type DiskUsage struct {
+	// Databases lists the sizes of the template database and all existing
+	// test databases, ordered by name.
+	Databases []DatabaseSize
+
+	// TotalBytes is the sum of the sizes of all databases.
+	TotalBytes int64
+}
+
+// DatabaseSize is the size of a single database as reported by pg_database_size.
+type DatabaseSize struct {
+	// Name is the name of the database.
+	Name string
+
+	// Bytes is the size of the database in bytes.
+	Bytes int64
+}
+
+// DiskUsage returns the disk usage of the template database and all existing
+// test databases of this pool, including those acquired by other processes
+// sharing the same pool ID.
+func (p *Pool) DiskUsage(ctx context.Context) (DiskUsage, error) {
+	names := make([]string, 0, p.cfg.MaxDatabases+1)
+	names = append(names, p.templateDB.Name())
+	for i := range p.cfg.MaxDatabases {
+		names = append(names, getTestDBName(p.cfg.NamePrefix, p.cfg.ID, i))
+	}
+
+	rows, err := p.cfg.Pool.Query(ctx,
+		`SELECT datname, pg_database_size(oid) FROM pg_database WHERE datname = ANY($1) ORDER BY datname`,
+		names,
+	)
+	if err != nil {
+		return DiskUsage{}, fmt.Errorf("failed to query database sizes: %w", err)
+	}
+	defer rows.Close()
+
+	var usage DiskUsage
+	for rows.Next() {
+		var size DatabaseSize
+		if err := rows.Scan(&size.Name, &size.Bytes); err != nil {
+			return DiskUsage{}, fmt.Errorf("failed to scan database size: %w", err)
+		}
+		usage.Databases = append(usage.Databases, size)
+		usage.TotalBytes += size.Bytes
+	}
+	if err := rows.Err(); err != nil {
+		return DiskUsage{}, fmt.Errorf("failed to query database sizes: %w", err)
+	}
+	return usage, nil
+}
+
+// checkDiskBudget returns a *DiskBudgetExceededError if the disk usage of the
+// pool exceeds Config.MaxPoolDiskBytes. The disk usage is cached and refreshed
+// at most once per Config.DiskUsageRefreshInterval to keep Acquire cheap.
+func (p *Pool) checkDiskBudget(ctx context.Context) error {
+	if p.cfg.MaxPoolDiskBytes <= 0 {
+		return nil
+	}
+
+	p.diskMu.Lock()
+	defer p.diskMu.Unlock()
+
+	interval := p.cfg.DiskUsageRefreshInterval
+	if interval == 0 {
+		interval = defaultDiskUsageRefreshInterval
+	}
+	if p.diskUsage == nil || p.clock.Now().Sub(p.diskUsageCheckedAt) >= interval {
+		usage, err := p.DiskUsage(ctx)
+		if err != nil {
+			return err
+		}
+		p.diskUsage = &usage
+		p.diskUsageCheckedAt = p.clock.Now()
+	}
+
+	if p.diskUsage.TotalBytes > p.cfg.MaxPoolDiskBytes {
+		return &DiskBudgetExceededError{
+			Budget: p.cfg.MaxPoolDiskBytes,
+			Usage:  *p.diskUsage,
+		}
+	}
+	return nil
+}
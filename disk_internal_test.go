@@ -0,0 +1,55 @@
+package testdbpool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/clock"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestPool_checkDiskBudget_Refresh(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-disk-budget-refresh",
+		Pool:         connPool,
+		MaxDatabases: 2,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			return nil
+		},
+		MaxPoolDiskBytes:         1 << 40,
+		DiskUsageRefreshInterval: time.Minute,
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+	fake := clock.NewFake(time.Now())
+	pool.clock = fake
+
+	require.NoError(t, pool.checkDiskBudget(ctx))
+	checkedAt := pool.diskUsageCheckedAt
+
+	// The cached usage is used until the interval elapses.
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Release(ctx) })
+	fake.Advance(time.Minute - time.Nanosecond)
+	require.NoError(t, pool.checkDiskBudget(ctx))
+	assert.Equal(t, checkedAt, pool.diskUsageCheckedAt)
+	assert.Empty(t, pool.diskUsage.Databases, "measured before the template was set up")
+
+	fake.Advance(time.Nanosecond)
+	require.NoError(t, pool.checkDiskBudget(ctx))
+	assert.Equal(t, fake.Now(), pool.diskUsageCheckedAt)
+	assert.Len(t, pool.diskUsage.Databases, 2, "template and test database")
+}
@@ -0,0 +1,99 @@
+package testdbpool_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestDiskBudgetExceededError(t *testing.T) {
+	err := error(&testdbpool.DiskBudgetExceededError{
+		Budget: 100,
+		Usage: testdbpool.DiskUsage{
+			Databases: []testdbpool.DatabaseSize{
+				{Name: "testdbpool_foo_0", Bytes: 80},
+				{Name: "testdbpooltmpl_foo", Bytes: 40},
+			},
+			TotalBytes: 120,
+		},
+	})
+
+	assert.ErrorIs(t, err, testdbpool.ErrDiskBudgetExceeded)
+	assert.EqualError(t, err,
+		"pool disk budget exceeded: using 120 bytes of 100 (testdbpool_foo_0: 80, testdbpooltmpl_foo: 40)")
+}
+
+func TestPool_DiskUsage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	setupTemplate := func(ctx context.Context, conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, `
+			CREATE TABLE foos (id SERIAL PRIMARY KEY, name TEXT);
+			INSERT INTO foos (name) SELECT repeat('x', 100) FROM generate_series(1, 1000);
+		`)
+		return err
+	}
+
+	t.Run("reports template and test databases", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            "test-disk-usage",
+			Pool:          connPool,
+			MaxDatabases:  2,
+			SetupTemplate: setupTemplate,
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		usage, err := pool.DiskUsage(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, usage.Databases, "nothing exists before the first acquire")
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+
+		usage, err = pool.DiskUsage(ctx)
+		require.NoError(t, err)
+		require.Len(t, usage.Databases, 2)
+		assert.Equal(t, db.Name(), usage.Databases[0].Name)
+		assert.Equal(t, pool.TemplateDBName(), usage.Databases[1].Name)
+		assert.Equal(t, usage.Databases[0].Bytes+usage.Databases[1].Bytes, usage.TotalBytes)
+	})
+
+	t.Run("acquire fails once the budget is crossed", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:                       "test-disk-budget",
+			Pool:                     connPool,
+			MaxDatabases:             2,
+			SetupTemplate:            setupTemplate,
+			MaxPoolDiskBytes:         1,
+			DiskUsageRefreshInterval: time.Nanosecond,
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		// Nothing exists yet, so the first acquire is within the budget.
+		_, err = pool.Acquire(ctx)
+		require.NoError(t, err)
+
+		_, err = pool.Acquire(ctx)
+		require.ErrorIs(t, err, testdbpool.ErrDiskBudgetExceeded)
+
+		var budgetErr *testdbpool.DiskBudgetExceededError
+		require.True(t, errors.As(err, &budgetErr))
+		assert.Equal(t, int64(1), budgetErr.Budget)
+		assert.Len(t, budgetErr.Usage.Databases, 2)
+	})
+}
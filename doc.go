@@ -100,9 +100,11 @@
 //	// Remove outdated pools
 //	err := testdbpool.CleanupPool(ctx, connPool, "myapp-test-old-hash")
 //
-// Users can implement automatic schema versioning by including schema hashes in pool IDs,
-// ensuring that schema changes trigger new pool creation while old pools are cleaned up
-// through dedicated cleanup scripts.
+// Schema changes can trigger new pool creation automatically by setting
+// Config.SchemaFingerprint, which appends a hash of the schema to the pool ID.
+// Pools of previous schemas are then removed with Pool.CleanupStale:
+//
+//	removed, err := pool.CleanupStale(ctx, "myapp-test")
 //
 // # Requirements
 //
@@ -0,0 +1,80 @@
+// Package databasesql is a repository written against database/sql only,
+// like code that uses lib/pq, and tested with testdbpool through the sqlpool
+// package.
+package databasesql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned when no user matches.
+var ErrNotFound = errors.New("user not found")
+
+// User is a row of the users table.
+type User struct {
+	ID    int64
+	Email string
+	Name  string
+}
+
+// Store reads and writes users.
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore returns a Store that uses db.
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Create inserts a user and returns it with its ID.
+func (s *Store) Create(ctx context.Context, email, name string) (User, error) {
+	u := User{Email: email, Name: name}
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO users (email, name) VALUES ($1, $2) RETURNING id`,
+		email, name,
+	).Scan(&u.ID)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+	return u, nil
+}
+
+// GetByEmail returns the user with email, or ErrNotFound.
+func (s *Store) GetByEmail(ctx context.Context, email string) (User, error) {
+	var u User
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, email, name FROM users WHERE email = $1`,
+		email,
+	).Scan(&u.ID, &u.Email, &u.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	return u, nil
+}
+
+// Rename changes the name of the user with id in a transaction.
+func (s *Store) Rename(ctx context.Context, id int64, name string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `UPDATE users SET name = $1 WHERE id = $2`, name, id)
+	if err != nil {
+		return fmt.Errorf("failed to rename user: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to rename user: %w", err)
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
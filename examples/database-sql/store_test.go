@@ -0,0 +1,39 @@
+package databasesql_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	databasesql "github.com/yuku/testdbpool/examples/database-sql"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	db, err := testPool.Acquire(t)
+	require.NoError(t, err)
+	store := databasesql.NewStore(db)
+
+	created, err := store.Create(ctx, "ged@example.com", "Sparrowhawk")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Rename(ctx, created.ID, "Ged"))
+	got, err := store.GetByEmail(ctx, "ged@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, databasesql.User{ID: created.ID, Email: "ged@example.com", Name: "Ged"}, got)
+
+	_, err = store.GetByEmail(ctx, "nobody@example.com")
+	assert.ErrorIs(t, err, databasesql.ErrNotFound)
+	assert.ErrorIs(t, store.Rename(ctx, created.ID+1, "Nobody"), databasesql.ErrNotFound)
+}
+
+// Each test gets a database of its own, cloned from the template, so the
+// user created by TestStore is not visible here.
+func TestStore_Isolated(t *testing.T) {
+	db, err := testPool.Acquire(t)
+	require.NoError(t, err)
+
+	_, err = databasesql.NewStore(db).GetByEmail(context.Background(), "ged@example.com")
+	assert.ErrorIs(t, err, databasesql.ErrNotFound)
+}
@@ -0,0 +1,93 @@
+package sqlcpgx_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/examples/sqlc-pgx/db"
+)
+
+// The connection pool of a test database satisfies sqlc's pgx-mode DBTX.
+var _ db.DBTX = (*pgxpool.Pool)(nil)
+
+func TestQueries(t *testing.T) {
+	ctx := context.Background()
+	testDB := testPool.AcquireT(t)
+	queries := db.New(testDB.Pool())
+
+	author, err := queries.CreateAuthor(ctx, db.CreateAuthorParams{
+		Name: "Ursula K. Le Guin",
+		Bio:  pgtype.Text{String: "Author of Earthsea", Valid: true},
+	})
+	require.NoError(t, err)
+
+	got, err := queries.GetAuthor(ctx, author.ID)
+	require.NoError(t, err)
+	assert.Equal(t, author, got)
+
+	_, err = queries.CreateBook(ctx, db.CreateBookParams{AuthorID: author.ID, Title: "A Wizard of Earthsea"})
+	require.NoError(t, err)
+	count, err := queries.CountBooksByAuthor(ctx, author.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestQueries_Transaction(t *testing.T) {
+	ctx := context.Background()
+	testDB := testPool.AcquireT(t)
+	queries := db.New(testDB.Pool())
+
+	author, err := queries.CreateAuthor(ctx, db.CreateAuthorParams{Name: "Octavia E. Butler"})
+	require.NoError(t, err)
+
+	// A failing transaction leaves no trace.
+	errAbort := errors.New("abort")
+	err = pgx.BeginFunc(ctx, testDB.Pool(), func(tx pgx.Tx) error {
+		qtx := queries.WithTx(tx)
+		if _, err := qtx.CreateBook(ctx, db.CreateBookParams{AuthorID: author.ID, Title: "Kindred"}); err != nil {
+			return err
+		}
+		count, err := qtx.CountBooksByAuthor(ctx, author.ID)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, int64(1), count, "the book is visible inside the transaction")
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+
+	count, err := queries.CountBooksByAuthor(ctx, author.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+// TestIsolation runs subtests in parallel, each with its own database, and
+// checks that none of them sees the data of the others.
+func TestIsolation(t *testing.T) {
+	names := []string{"Alice", "Bob", "Carol", "Dave"}
+
+	t.Run("group", func(t *testing.T) {
+		for _, name := range names {
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+				ctx := context.Background()
+				testDB := testPool.AcquireT(t)
+				queries := db.New(testDB.Pool())
+
+				_, err := queries.CreateAuthor(ctx, db.CreateAuthorParams{Name: name})
+				require.NoError(t, err)
+
+				authors, err := queries.ListAuthors(ctx)
+				require.NoError(t, err)
+				require.Len(t, authors, 1, "each test starts from an empty template copy")
+				assert.Equal(t, name, authors[0].Name)
+			})
+		}
+	})
+}
@@ -0,0 +1,27 @@
+-- name: GetAuthor :one
+SELECT * FROM authors
+WHERE id = $1 LIMIT 1;
+
+-- name: ListAuthors :many
+SELECT * FROM authors
+ORDER BY name;
+
+-- name: CreateAuthor :one
+INSERT INTO authors (
+  name, bio
+) VALUES (
+  $1, $2
+)
+RETURNING *;
+
+-- name: CreateBook :one
+INSERT INTO books (
+  author_id, title
+) VALUES (
+  $1, $2
+)
+RETURNING *;
+
+-- name: CountBooksByAuthor :one
+SELECT COUNT(*) FROM books
+WHERE author_id = $1;
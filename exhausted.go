@@ -0,0 +1,89 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// exhaustedUsageTimeout is how long reading the usage of the numpool for a
+// PoolExhaustedError may take, as the context of the acquisition is done by
+// then.
+const exhaustedUsageTimeout = 5 * time.Second
+
+// ErrPoolExhausted is returned by Acquire and its variants when no test
+// database became free before Config.AcquireTimeout, or the deadline of the
+// context, passed. It tells an exhausted pool apart from other failures,
+// e.g. an unreachable server. Use errors.As with *PoolExhaustedError to
+// inspect the usage of the pool at that time.
+var ErrPoolExhausted = errors.New("pool exhausted")
+
+// PoolExhaustedError describes the usage of the pool when an acquisition
+// gave up waiting for a free test database.
+type PoolExhaustedError struct {
+	// InUse is the number of test databases in use by all processes sharing
+	// the pool.
+	InUse int
+
+	// Waiting is the number of other acquisitions that were waiting, too.
+	Waiting int
+
+	// MaxDatabases is the configured Config.MaxDatabases.
+	MaxDatabases int
+
+	// Waited is how long the acquisition waited.
+	Waited time.Duration
+
+	// Err is the error of the context that ended the wait, usually
+	// context.DeadlineExceeded.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *PoolExhaustedError) Error() string {
+	return fmt.Sprintf(
+		"%s: %d of %d test databases in use, %d other waiters, gave up after %s: %s",
+		ErrPoolExhausted, e.InUse, e.MaxDatabases, e.Waiting, e.Waited, e.Err,
+	)
+}
+
+// Unwrap returns ErrPoolExhausted and Err so that errors.Is can be used with
+// either.
+func (e *PoolExhaustedError) Unwrap() []error {
+	return []error{ErrPoolExhausted, e.Err}
+}
+
+// withAcquireTimeout returns ctx bounded by Config.AcquireTimeout, for
+// waiting for slots of the numpool.
+func (p *Pool) withAcquireTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.cfg.AcquireTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.cfg.AcquireTimeout)
+}
+
+// exhaustedError returns err, the error of waiting for slots with waitCtx
+// since start, or a *PoolExhaustedError if the wait ran out of time. Running
+// out of time is not blamed on the pool if its usage cannot be read either,
+// as the server is then likely unreachable.
+func (p *Pool) exhaustedError(waitCtx context.Context, start time.Time, err error) error {
+	if !errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	waited := p.clock.Now().Sub(start).Round(time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(waitCtx), exhaustedUsageTimeout)
+	defer cancel()
+	usage, usageErr := p.numpoolUsage(ctx)
+	if usageErr != nil {
+		return fmt.Errorf("%w (waited %s; %w)", err, waited, usageErr)
+	}
+	return &PoolExhaustedError{
+		InUse:        usage.used,
+		Waiting:      usage.waiting,
+		MaxDatabases: p.cfg.MaxDatabases,
+		Waited:       waited,
+		Err:          waitCtx.Err(),
+	}
+}
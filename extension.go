@@ -0,0 +1,198 @@
+package testdbpool
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// ExtensionRequirement is a PostgreSQL extension that the template database
+// depends on.
+type ExtensionRequirement struct {
+	// Name is the name of the extension, e.g. "vector".
+	Name string
+
+	// MinVersion is the minimum required version of the extension, e.g. "0.7.0".
+	// If empty, any version satisfies the requirement.
+	MinVersion string
+}
+
+// ExtensionCheckStage tells at which point an extension requirement was not met.
+type ExtensionCheckStage string
+
+const (
+	// ExtensionNotAvailable means that the server does not provide a
+	// satisfying version of the extension (pg_available_extension_versions).
+	ExtensionNotAvailable ExtensionCheckStage = "available"
+
+	// ExtensionNotInstalled means that SetupTemplate did not install a
+	// satisfying version of the extension in the template (pg_extension).
+	ExtensionNotInstalled ExtensionCheckStage = "installed"
+)
+
+// UnmetExtension describes an extension requirement that was not met.
+type UnmetExtension struct {
+	ExtensionRequirement
+
+	// Stage tells whether the extension was not available on the server or
+	// not installed in the template database.
+	Stage ExtensionCheckStage
+
+	// FoundVersion is the highest version that was found, or empty if none was.
+	FoundVersion string
+}
+
+// ExtensionRequirementError is returned when one or more of
+// Config.RequiredExtensions are not met.
+type ExtensionRequirementError struct {
+	// Unmet lists every requirement that was not met.
+	Unmet []UnmetExtension
+}
+
+// Error implements the error interface.
+func (e *ExtensionRequirementError) Error() string {
+	reports := make([]string, 0, len(e.Unmet))
+	for _, u := range e.Unmet {
+		want := u.Name
+		if u.MinVersion != "" {
+			want += " >= " + u.MinVersion
+		}
+		found := "none"
+		if u.FoundVersion != "" {
+			found = u.FoundVersion
+		}
+		reports = append(reports, fmt.Sprintf("%s not %s (found: %s)", want, u.Stage, found))
+	}
+	return "unmet extension requirements: " + strings.Join(reports, "; ")
+}
+
+// WithExtensions returns a setup step that creates the extensions names,
+// e.g. "uuid-ossp" and "citext", unless they exist, in order. It is meant for
+// Config.SetupTemplate, alone or in ComposeSetup:
+//
+//	cfg.SetupTemplate = testdbpool.ComposeSetup(
+//		testdbpool.WithExtensions("uuid-ossp", "pgcrypto", "citext"),
+//		testdbpool.SetupFromSQLFiles("sql/schema.sql"),
+//	)
+//
+// The names are quoted as identifiers, and all of them are validated before
+// any extension is created. The connecting role needs the privileges to
+// create each extension: superuser for most extensions, or CREATE on the
+// database for trusted ones such as pgcrypto and citext on PostgreSQL 13 and
+// later. The extensions must be available on the server; see
+// Config.RequiredExtensions to check that before the setup runs.
+func WithExtensions(names ...string) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		queries := make([]string, len(names))
+		for i, name := range names {
+			query, err := sqlbuild.CreateExtensionIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			queries[i] = query
+		}
+		for i, query := range queries {
+			if _, err := conn.Exec(ctx, query); err != nil {
+				return fmt.Errorf("failed to create extension %s: %w", names[i], err)
+			}
+		}
+		return nil
+	}
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// checkAvailableExtensions verifies that the server provides a version of each
+// required extension that satisfies the requirement.
+func checkAvailableExtensions(ctx context.Context, db querier, reqs []ExtensionRequirement) error {
+	return checkExtensions(ctx, db, reqs, ExtensionNotAvailable,
+		`SELECT version FROM pg_available_extension_versions WHERE name = $1`)
+}
+
+// checkInstalledExtensions verifies that each required extension is installed
+// in the database of db with a version that satisfies the requirement.
+func checkInstalledExtensions(ctx context.Context, db querier, reqs []ExtensionRequirement) error {
+	return checkExtensions(ctx, db, reqs, ExtensionNotInstalled,
+		`SELECT extversion FROM pg_extension WHERE extname = $1`)
+}
+
+func checkExtensions(
+	ctx context.Context,
+	db querier,
+	reqs []ExtensionRequirement,
+	stage ExtensionCheckStage,
+	query string,
+) error {
+	var unmet []UnmetExtension
+	for _, req := range reqs {
+		rows, err := db.Query(ctx, query, req.Name)
+		if err != nil {
+			return fmt.Errorf("failed to query versions of extension %s: %w", req.Name, err)
+		}
+		versions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("failed to query versions of extension %s: %w", req.Name, err)
+		}
+
+		var found string
+		for _, v := range versions {
+			if found == "" || compareVersions(v, found) > 0 {
+				found = v
+			}
+		}
+		if found == "" || (req.MinVersion != "" && compareVersions(found, req.MinVersion) < 0) {
+			unmet = append(unmet, UnmetExtension{
+				ExtensionRequirement: req,
+				Stage:                stage,
+				FoundVersion:         found,
+			})
+		}
+	}
+
+	if len(unmet) > 0 {
+		return &ExtensionRequirementError{Unmet: unmet}
+	}
+	return nil
+}
+
+// compareVersions compares two extension version strings such as "0.7.0" and
+// "1.10" component by component. Numeric components are compared as numbers,
+// other components lexically. It returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := range max(len(as), len(bs)) {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+
+		xn, xerr := strconv.Atoi(orZero(x))
+		yn, yerr := strconv.Atoi(orZero(y))
+		switch {
+		case xerr == nil && yerr == nil:
+			if xn != yn {
+				return cmp.Compare(xn, yn)
+			}
+		case x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+func orZero(s string) string {
+	if s == "" {
+		return "0"
+	}
+	return s
+}
@@ -0,0 +1,153 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1", 0},
+		{"0.7.0", "0.7", 0},
+		{"0.6.2", "0.7.0", -1},
+		{"0.10.0", "0.7.0", 1},
+		{"1.10", "1.9", 1},
+		{"2.0beta1", "2.0beta2", -1},
+		{"99.0", "1.0", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			assert.Equal(t, tt.want, compareVersions(tt.a, tt.b))
+			assert.Equal(t, -tt.want, compareVersions(tt.b, tt.a))
+		})
+	}
+}
+
+func TestExtensionRequirementError(t *testing.T) {
+	err := &ExtensionRequirementError{Unmet: []UnmetExtension{
+		{
+			ExtensionRequirement: ExtensionRequirement{Name: "vector", MinVersion: "0.7.0"},
+			Stage:                ExtensionNotAvailable,
+			FoundVersion:         "0.6.2",
+		},
+		{
+			ExtensionRequirement: ExtensionRequirement{Name: "postgis"},
+			Stage:                ExtensionNotInstalled,
+		},
+	}}
+	assert.EqualError(t, err,
+		"unmet extension requirements: vector >= 0.7.0 not available (found: 0.6.2); postgis not installed (found: none)")
+}
+
+func TestRequiredExtensions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	noopSetup := func(ctx context.Context, conn *pgx.Conn) error { return nil }
+
+	t.Run("satisfiable requirement", func(t *testing.T) {
+		pool, err := New(ctx, &Config{
+			ID:                 "test-required-extensions-ok",
+			Pool:               connPool,
+			MaxDatabases:       1,
+			SetupTemplate:      noopSetup,
+			RequiredExtensions: []ExtensionRequirement{{Name: "plpgsql", MinVersion: "1.0"}},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+	})
+
+	t.Run("version not available on the server", func(t *testing.T) {
+		_, err := New(ctx, &Config{
+			ID:                 "test-required-extensions-unavailable",
+			Pool:               connPool,
+			MaxDatabases:       1,
+			SetupTemplate:      noopSetup,
+			RequiredExtensions: []ExtensionRequirement{{Name: "plpgsql", MinVersion: "99.0"}},
+		})
+
+		var extErr *ExtensionRequirementError
+		require.True(t, errors.As(err, &extErr))
+		require.Len(t, extErr.Unmet, 1)
+		assert.Equal(t, "plpgsql", extErr.Unmet[0].Name)
+		assert.Equal(t, ExtensionNotAvailable, extErr.Unmet[0].Stage)
+		assert.Equal(t, "1.0", extErr.Unmet[0].FoundVersion)
+	})
+
+	t.Run("extension not installed by SetupTemplate", func(t *testing.T) {
+		pool, err := New(ctx, &Config{
+			ID:                 "test-required-extensions-not-installed",
+			Pool:               connPool,
+			MaxDatabases:       1,
+			SetupTemplate:      noopSetup,
+			RequiredExtensions: []ExtensionRequirement{{Name: "postgres_fdw"}},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		_, err = pool.Acquire(ctx)
+		var extErr *ExtensionRequirementError
+		require.True(t, errors.As(err, &extErr))
+		require.Len(t, extErr.Unmet, 1)
+		assert.Equal(t, ExtensionNotInstalled, extErr.Unmet[0].Stage)
+		assert.False(t, testutil.DBExists(t, connPool, pool.TemplateDBName()),
+			"the template database should not be kept after a failed setup")
+	})
+}
+
+func TestWithExtensions(t *testing.T) {
+	t.Run("invalid name", func(t *testing.T) {
+		// The names are validated before the connection is used.
+		err := WithExtensions("citext", "")(context.Background(), nil)
+		assert.ErrorContains(t, err, "invalid extension name")
+	})
+
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-with-extensions",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: ComposeSetup(
+			WithExtensions("uuid-ossp", "pgcrypto"),
+			// Creating an existing extension is a no-op.
+			WithExtensions("pgcrypto"),
+		),
+		RequiredExtensions: []ExtensionRequirement{{Name: "uuid-ossp"}, {Name: "pgcrypto"}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Release(ctx)) }()
+	var uuid string
+	require.NoError(t, db.Pool().QueryRow(ctx, `SELECT uuid_generate_v4()::text`).Scan(&uuid))
+	assert.Len(t, uuid, 36)
+}
@@ -0,0 +1,144 @@
+package testdbpool
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// defaultMaxConsecutiveFailures is the default of
+// Config.MaxConsecutiveFailures.
+const defaultMaxConsecutiveFailures = 3
+
+// maxConsecutiveFailures returns Config.MaxConsecutiveFailures, or its
+// default if not set.
+func maxConsecutiveFailures(cfg *Config) int {
+	if cfg.MaxConsecutiveFailures == 0 {
+		return defaultMaxConsecutiveFailures
+	}
+	return cfg.MaxConsecutiveFailures
+}
+
+// ErrRecurringFailure is returned by Acquire and its variants when they are
+// handed a slot that has failed Config.MaxConsecutiveFailures times in a row.
+// Use errors.As with *RecurringFailureError to inspect the failures.
+var ErrRecurringFailure = errors.New("recurring test database failure")
+
+// Failure describes the failures recorded for a slot of a Pool, as returned
+// by Pool.Failures.
+type Failure struct {
+	// Index is the index of the slot.
+	Index int
+
+	// Consecutive is the number of failures since the database of the slot
+	// was last released with a plain Release.
+	Consecutive int
+
+	// Total is the number of failures of the slot since the Pool was created
+	// or Pool.ResetFailures was called.
+	Total int
+
+	// Reason is the reason of the last failure: the reason passed to
+	// TestDB.ReleaseFailed, or the error of creating the database.
+	Reason error
+
+	// At is the time of the last failure.
+	At time.Time
+}
+
+// RecurringFailureError is returned by Acquire when the slot it was handed
+// has failed too many times in a row.
+type RecurringFailureError struct {
+	// PoolID is the ID of the pool.
+	PoolID string
+
+	// Failure is the failures of the slot.
+	Failure Failure
+}
+
+// Error implements the error interface.
+func (e *RecurringFailureError) Error() string {
+	return fmt.Sprintf(
+		"%s: test database %d of pool %s failed %d times in a row, last at %s: %v",
+		ErrRecurringFailure, e.Failure.Index, e.PoolID, e.Failure.Consecutive,
+		e.Failure.At.Format(time.RFC3339), e.Failure.Reason,
+	)
+}
+
+// Unwrap returns ErrRecurringFailure and the reason of the last failure so
+// that errors.Is can be used with either.
+func (e *RecurringFailureError) Unwrap() []error {
+	return []error{ErrRecurringFailure, e.Failure.Reason}
+}
+
+// Failures returns the failures recorded for the slots of the pool by this
+// Pool instance, ordered by index. Slots without failures are left out.
+func (p *Pool) Failures() []Failure {
+	p.failuresMu.Lock()
+	defer p.failuresMu.Unlock()
+
+	failures := make([]Failure, 0, len(p.failures))
+	for _, f := range p.failures {
+		failures = append(failures, *f)
+	}
+	slices.SortFunc(failures, func(a, b Failure) int { return a.Index - b.Index })
+	return failures
+}
+
+// ResetFailures forgets the failures recorded for all slots, e.g. after
+// fixing what made them fail, so that Acquire tries them again.
+func (p *Pool) ResetFailures() {
+	p.failuresMu.Lock()
+	defer p.failuresMu.Unlock()
+	p.failures = nil
+}
+
+// recordFailure records reason as a failure of the slot at index.
+func (p *Pool) recordFailure(index int, reason error) {
+	p.failuresMu.Lock()
+	defer p.failuresMu.Unlock()
+
+	if p.failures == nil {
+		p.failures = make(map[int]*Failure)
+	}
+	f, ok := p.failures[index]
+	if !ok {
+		f = &Failure{Index: index}
+		p.failures[index] = f
+	}
+	f.Consecutive++
+	f.Total++
+	f.Reason = reason
+	f.At = p.clock.Now()
+}
+
+// recordOutcome records how the test database at index was released: as a
+// failure with reason, or, if reason is nil, as a success that ends the
+// failures in a row of the slot.
+func (p *Pool) recordOutcome(index int, reason error) {
+	if reason != nil {
+		p.recordFailure(index, reason)
+		return
+	}
+	p.failuresMu.Lock()
+	defer p.failuresMu.Unlock()
+	if f, ok := p.failures[index]; ok {
+		f.Consecutive = 0
+	}
+}
+
+// checkFailures returns a *RecurringFailureError if the slot at index has
+// failed Config.MaxConsecutiveFailures times in a row.
+func (p *Pool) checkFailures(index int) error {
+	p.failuresMu.Lock()
+	defer p.failuresMu.Unlock()
+
+	f, ok := p.failures[index]
+	if !ok || f.Consecutive < maxConsecutiveFailures(p.cfg) {
+		return nil
+	}
+	err := &RecurringFailureError{PoolID: p.cfg.ID, Failure: *f}
+	p.eventLogger().Warn("test database keeps failing; giving up on it", "index", index, "error", err)
+	return err
+}
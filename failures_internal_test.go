@@ -0,0 +1,64 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/clock"
+)
+
+func TestPool_Failures(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	p := &Pool{
+		cfg:   &Config{ID: "failures", MaxDatabases: 2, MaxConsecutiveFailures: 2},
+		clock: clock.NewFake(now),
+	}
+	release := func(reason error) {
+		t.Helper()
+		r := &flakyResource{index: 1}
+		db := &TestDB{resource: r, onOutcome: p.recordOutcome, clock: p.clock}
+		if reason != nil {
+			require.NoError(t, db.ReleaseFailed(ctx, reason))
+		} else {
+			require.NoError(t, db.Release(ctx))
+		}
+		assert.True(t, r.released)
+	}
+	corrupted := errors.New("dropped column users.name")
+
+	release(corrupted)
+	assert.Equal(t, []Failure{{Index: 1, Consecutive: 1, Total: 1, Reason: corrupted, At: now}}, p.Failures())
+	require.NoError(t, p.checkFailures(1))
+
+	// A plain release ends the failures in a row.
+	release(nil)
+	assert.Equal(t, []Failure{{Index: 1, Consecutive: 0, Total: 1, Reason: corrupted, At: now}}, p.Failures())
+
+	p.recordFailure(1, errors.New("template locked"))
+	release(corrupted)
+	err := p.checkFailures(1)
+	require.ErrorIs(t, err, ErrRecurringFailure)
+	require.ErrorIs(t, err, corrupted)
+	var failureErr *RecurringFailureError
+	require.ErrorAs(t, err, &failureErr)
+	assert.Equal(t, 3, failureErr.Failure.Total)
+	assert.EqualError(t, err, "recurring test database failure: test database 1 of pool failures failed 2 times in a row, last at 2024-01-02T03:04:05Z: dropped column users.name")
+	require.NoError(t, p.checkFailures(0))
+
+	p.ResetFailures()
+	assert.Empty(t, p.Failures())
+	require.NoError(t, p.checkFailures(1))
+}
+
+func TestTestDB_ReleaseFailedWithoutReason(t *testing.T) {
+	p := &Pool{cfg: &Config{}, clock: clock.NewFake(time.Now())}
+	db := &TestDB{resource: &flakyResource{}, onOutcome: p.recordOutcome, clock: p.clock}
+	require.NoError(t, db.ReleaseFailed(context.Background(), nil))
+	require.Len(t, p.Failures(), 1)
+	assert.EqualError(t, p.Failures()[0].Reason, "released as failed")
+}
@@ -0,0 +1,43 @@
+package testdbpool
+
+import (
+	"fmt"
+)
+
+// TemplateGenerationChangedError is returned by Acquire when
+// Config.FailOnTemplateGenerationChange is set and the template database has
+// been rebuilt, e.g. by another process sharing the pool ID that called
+// Cleanup, since this Pool started cloning it. Test databases cloned before
+// and after the change may have different schemas.
+type TemplateGenerationChangedError struct {
+	// Previous is the generation of the template that this Pool cloned from.
+	Previous string
+
+	// Current is the generation of the template as it exists now.
+	Current string
+}
+
+func (e *TemplateGenerationChangedError) Error() string {
+	return fmt.Sprintf("template database was recreated during the run (generation %s -> %s)", e.Previous, e.Current)
+}
+
+// onTemplateGenerationChange returns the function called when the template
+// database turns out to have been rebuilt by someone else.
+func onTemplateGenerationChange(cfg *Config) func(previous, current string) error {
+	return func(previous, current string) error {
+		if cfg.FailOnTemplateGenerationChange {
+			return &TemplateGenerationChangedError{Previous: previous, Current: current}
+		}
+		poolLogger(cfg).Warn("template database was recreated during the run; test databases may have mixed schemas",
+			"previous_generation", previous, "generation", current)
+		return nil
+	}
+}
+
+// TemplateGeneration returns the generation of the template database that
+// the test database was cloned from. The generation is a random ID assigned
+// whenever the template database is built. It is empty for databases acquired
+// with AcquireEmpty.
+func (db *TestDB) TemplateGeneration() string {
+	return db.templateGeneration
+}
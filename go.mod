@@ -7,6 +7,8 @@ toolchain go1.24.5
 require (
 	github.com/jackc/pgx/v5 v5.7.5
 	github.com/stretchr/testify v1.10.0
+	// Pinned: releaseSlot in numpooltable.go copies the internal release SQL of
+	// this version. Check it and TestNumpoolTableLayout before upgrading.
 	github.com/yuku/numpool v0.4.5
 )
 
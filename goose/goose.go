@@ -0,0 +1,69 @@
+// Package goose sets up testdbpool template databases with goose, so that
+// tests run against the schema built by the same migrations as production,
+// e.g. embedded ones:
+//
+//	//go:embed migrations/*.sql
+//	var migrations embed.FS
+//
+//	cfg.SetupTemplate = goose.SetupFromGoose(migrations, "migrations")
+package goose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	goosev3 "github.com/pressly/goose/v3"
+)
+
+// SetupFromGoose returns a function suitable for Config.SetupTemplate that
+// applies the goose migrations in the directory dir of fsys, e.g. an
+// embed.FS or os.DirFS("."), to the template database. opts are passed to
+// goose.NewProvider, e.g. goose.WithDisableVersioning(true) to apply the
+// migrations without recording them in the goose_db_version table.
+//
+// Template setup holds the advisory lock that serializes it across
+// processes, so concurrent first acquisitions do not apply the migrations
+// twice, and no goose session locker is needed. The migrations run on a
+// dedicated connection configured like conn, so they see what was committed
+// on conn before, but not an open transaction of it. If a migration fails,
+// the error names its file.
+func SetupFromGoose(fsys fs.FS, dir string, opts ...goosev3.ProviderOption) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		migrations, err := fs.Sub(fsys, dir)
+		if err != nil {
+			return fmt.Errorf("failed to open migrations directory %s: %w", dir, err)
+		}
+
+		db := stdlib.OpenDB(*conn.Config().Copy())
+		defer db.Close()
+		// Migrations that change session state must see it in the
+		// following ones.
+		db.SetMaxOpenConns(1)
+
+		provider, err := goosev3.NewProvider(goosev3.DialectPostgres, db, migrations, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to create goose provider for %s: %w", dir, err)
+		}
+		defer provider.Close()
+
+		if _, err := provider.Up(ctx); err != nil {
+			var partial *goosev3.PartialError
+			if errors.As(err, &partial) && partial.Failed != nil && partial.Failed.Source != nil {
+				// Go migrations registered in code have no file.
+				name := fmt.Sprintf("version %d", partial.Failed.Source.Version)
+				if partial.Failed.Source.Path != "" {
+					name = path.Join(dir, partial.Failed.Source.Path)
+				}
+				return fmt.Errorf("failed to apply migration %s after %d applied: %w",
+					name, len(partial.Applied), partial.Err)
+			}
+			return fmt.Errorf("failed to migrate template database: %w", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,87 @@
+package goose_test
+
+import (
+	"context"
+	"embed"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	goosev3 "github.com/pressly/goose/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool"
+	"github.com/yuku/testdbpool/goose"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+//go:embed testdata/migrations/*.sql
+var migrations embed.FS
+
+func TestSetupFromGoose(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newPool := func(t *testing.T, id string, setup func(context.Context, *pgx.Conn) error) (*testdbpool.Pool, error) {
+		t.Helper()
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            id,
+			Pool:          connPool,
+			MaxDatabases:  1,
+			SetupTemplate: setup,
+		})
+		if err == nil {
+			t.Cleanup(pool.Cleanup)
+		}
+		return pool, err
+	}
+	columns := func(t *testing.T, db *testdbpool.TestDB) []string {
+		t.Helper()
+		rows, err := db.Pool().Query(ctx, `
+			SELECT column_name::text FROM information_schema.columns
+			WHERE table_name = 'users' ORDER BY ordinal_position`)
+		require.NoError(t, err)
+		names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		require.NoError(t, err)
+		return names
+	}
+	versioned := func(t *testing.T, db *testdbpool.TestDB) bool {
+		t.Helper()
+		var exists bool
+		err := db.Pool().QueryRow(ctx, `SELECT to_regclass('goose_db_version') IS NOT NULL`).Scan(&exists)
+		require.NoError(t, err)
+		return exists
+	}
+
+	t.Run("embedded migrations", func(t *testing.T) {
+		pool, err := newPool(t, "test-goose-embed", goose.SetupFromGoose(migrations, "testdata/migrations"))
+		require.NoError(t, err)
+		db := pool.AcquireT(t)
+		assert.Equal(t, []string{"id", "name", "email"}, columns(t, db))
+		assert.True(t, versioned(t, db))
+	})
+
+	t.Run("without versioning", func(t *testing.T) {
+		pool, err := newPool(t, "test-goose-no-versioning", goose.SetupFromGoose(
+			os.DirFS("testdata"), "migrations", goosev3.WithDisableVersioning(true),
+		))
+		require.NoError(t, err)
+		db := pool.AcquireT(t)
+		assert.Equal(t, []string{"id", "name", "email"}, columns(t, db))
+		assert.False(t, versioned(t, db))
+	})
+
+	t.Run("failing migration", func(t *testing.T) {
+		pool, err := newPool(t, "test-goose-broken", goose.SetupFromGoose(os.DirFS("testdata"), "broken"))
+		if err == nil {
+			_, err = pool.Acquire(ctx)
+		}
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to apply migration broken/00002_add_email.sql after 1 applied")
+	})
+}
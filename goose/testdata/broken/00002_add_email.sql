@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE no_such_table ADD COLUMN email TEXT;
+
+-- +goose Down
+ALTER TABLE no_such_table DROP COLUMN email;
@@ -0,0 +1,5 @@
+-- +goose Up
+CREATE TABLE users (id BIGSERIAL PRIMARY KEY, name TEXT NOT NULL);
+
+-- +goose Down
+DROP TABLE users;
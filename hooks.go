@@ -0,0 +1,129 @@
+package testdbpool
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// HookLeakError is returned when a user hook that is given a connection or
+// pool, such as SetupTemplate, leaves an open transaction or a held
+// session-level lock behind. A database in this state would make the next
+// test that uses it hang on a lock.
+type HookLeakError struct {
+	// Hook is the name of the hook, e.g. "SetupTemplate".
+	Hook string
+
+	// Leaks describes what the hook left behind.
+	Leaks []string
+}
+
+func (e *HookLeakError) Error() string {
+	return fmt.Sprintf("%s left %s behind", e.Hook, strings.Join(e.Leaks, " and "))
+}
+
+// checkedHook wraps fn, which runs the hook named hook, so that it fails if
+// the hook leaks a transaction or lock on the connection (see checkHookConn).
+func checkedHook(cfg *Config, hook string, fn func(context.Context, *pgx.Conn) error) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		if err := fn(ctx, conn); err != nil {
+			return err
+		}
+		return checkHookConn(ctx, cfg, hook, conn)
+	}
+}
+
+// checkHookConn checks that hook left no open transaction and no advisory
+// lock on conn. If Config.TerminateLeakedHookSessions is set, the leaks are
+// cleaned up with a warning to Config.Logger instead.
+func checkHookConn(ctx context.Context, cfg *Config, hook string, conn *pgx.Conn) error {
+	ctx = withInternalQueries(ctx)
+	var leaks []string
+	switch conn.PgConn().TxStatus() {
+	case 'T':
+		leaks = append(leaks, "an open transaction")
+	case 'E':
+		leaks = append(leaks, "a failed transaction")
+	}
+	if len(leaks) > 0 {
+		if !cfg.TerminateLeakedHookSessions {
+			return &HookLeakError{Hook: hook, Leaks: leaks}
+		}
+		if _, err := conn.Exec(ctx, `ROLLBACK`); err != nil {
+			return fmt.Errorf("failed to roll back transaction left by %s: %w", hook, err)
+		}
+	}
+
+	var locks int
+	err := conn.QueryRow(ctx,
+		`SELECT COUNT(*) FROM pg_locks WHERE pid = pg_backend_pid() AND locktype = 'advisory'`,
+	).Scan(&locks)
+	if err != nil {
+		return fmt.Errorf("failed to check locks left by %s: %w", hook, err)
+	}
+	if locks > 0 {
+		leaks = append(leaks, fmt.Sprintf("%d advisory lock(s)", locks))
+		if !cfg.TerminateLeakedHookSessions {
+			return &HookLeakError{Hook: hook, Leaks: leaks}
+		}
+		if _, err := conn.Exec(ctx, `SELECT pg_advisory_unlock_all()`); err != nil {
+			return fmt.Errorf("failed to release locks left by %s: %w", hook, err)
+		}
+	}
+
+	if len(leaks) > 0 {
+		poolLogger(cfg).Warn("hook leaked session state; cleaned up", "error", &HookLeakError{Hook: hook, Leaks: leaks})
+	}
+	return nil
+}
+
+// checkHookSessions checks that hook left no idle-in-transaction sessions
+// connected to the databases. The sessions are terminated in any case so
+// that the databases can still be dropped. If
+// Config.TerminateLeakedHookSessions is set, a warning is logged to
+// Config.Logger instead of returning an error.
+func (p *Pool) checkHookSessions(ctx context.Context, hook string, databases []string) error {
+	rows, err := p.cfg.Pool.Query(ctx, `
+		SELECT pid, datname FROM pg_stat_activity
+		WHERE datname = ANY($1) AND state IN ('idle in transaction', 'idle in transaction (aborted)')
+		ORDER BY datname, pid`,
+		databases,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to check sessions left by %s: %w", hook, err)
+	}
+	defer rows.Close()
+
+	var pids []int32
+	var leaks []string
+	for rows.Next() {
+		var pid int32
+		var datname string
+		if err := rows.Scan(&pid, &datname); err != nil {
+			return fmt.Errorf("failed to check sessions left by %s: %w", hook, err)
+		}
+		pids = append(pids, pid)
+		leaks = append(leaks, fmt.Sprintf("an open transaction in %s (pid %d)", datname, pid))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to check sessions left by %s: %w", hook, err)
+	}
+	if len(leaks) == 0 {
+		return nil
+	}
+
+	for _, pid := range pids {
+		if _, err := p.cfg.Pool.Exec(ctx, `SELECT pg_terminate_backend($1)`, pid); err != nil {
+			return fmt.Errorf("failed to terminate session left by %s: %w", hook, err)
+		}
+	}
+
+	leakErr := &HookLeakError{Hook: hook, Leaks: leaks}
+	if !p.cfg.TerminateLeakedHookSessions {
+		return leakErr
+	}
+	p.eventLogger().Warn("hook leaked sessions; terminated", "error", leakErr)
+	return nil
+}
@@ -2,12 +2,21 @@ package testdbpool_test
 
 import (
 	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/yuku/testdbpool"
@@ -555,3 +564,1854 @@ func TestIntegration_DatabaseOwner(t *testing.T) {
 		require.NoError(t, db.Release(ctx))
 	})
 }
+
+// TestIntegration_MaxTemplateAge is an integration test that tests rebuilding
+// the template database once it exceeds Config.MaxTemplateAge.
+func TestIntegration_MaxTemplateAge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	var setupCount int32
+	newPool := func(maxAge time.Duration) *testdbpool.Pool {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:             "integration_max_template_age",
+			Pool:           connPool,
+			MaxDatabases:   1,
+			MaxTemplateAge: maxAge,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				atomic.AddInt32(&setupCount, 1)
+				_, err := conn.Exec(ctx, `CREATE TABLE foos (id SERIAL PRIMARY KEY, created_at TIMESTAMPTZ DEFAULT now())`)
+				return err
+			},
+		})
+		require.NoError(t, err)
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+		return pool
+	}
+
+	pool := newPool(0)
+	t.Cleanup(pool.Cleanup)
+	require.NoError(t, pool.Close(ctx))
+	require.Equal(t, int32(1), atomic.LoadInt32(&setupCount))
+
+	// The template is younger than an hour, so it is reused.
+	pool = newPool(time.Hour)
+	require.NoError(t, pool.Close(ctx))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&setupCount), "fresh template should be reused")
+
+	// The template is older than a millisecond, so it is rebuilt.
+	time.Sleep(10 * time.Millisecond)
+	pool = newPool(time.Millisecond)
+	require.NoError(t, pool.Close(ctx))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&setupCount), "stale template should be rebuilt")
+}
+
+// TestIntegration_SessionParams is an integration test that tests that the
+// session environment of the root pool is propagated to the template setup
+// and the test databases.
+func TestIntegration_SessionParams(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	basePool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(basePool))
+
+	// The root pool sets search_path in AfterConnect, which is not part of the
+	// connection configuration and used to be lost for the template setup.
+	poolConfig := basePool.Config().Copy()
+	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, `SET search_path TO app, public`)
+		return err
+	}
+	connPool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	require.NoError(t, err)
+	t.Cleanup(connPool.Close)
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "integration_session_params",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `
+				CREATE SCHEMA app;
+				CREATE TABLE foos (id SERIAL PRIMARY KEY, name TEXT);
+			`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Release(ctx) })
+
+	var schema string
+	err = db.Pool().QueryRow(ctx,
+		`SELECT table_schema FROM information_schema.tables WHERE table_name = 'foos'`,
+	).Scan(&schema)
+	require.NoError(t, err)
+	assert.Equal(t, "app", schema, "template setup should run with the root pool's search_path")
+
+	var count int
+	err = db.Pool().QueryRow(ctx, `SELECT COUNT(*) FROM foos`).Scan(&count)
+	require.NoError(t, err, "tables created by the template setup should be visible")
+	assert.Equal(t, 0, count)
+}
+
+// TestIntegration_SeedDatabaseIndexed is an integration test that tests
+// seeding each test database according to its resource index.
+func TestIntegration_SeedDatabaseIndexed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	t.Run("seeds each database by index", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_seed_indexed",
+			Pool:         connPool,
+			MaxDatabases: 2,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE shards (shard INT)`)
+				return err
+			},
+			SeedDatabaseIndexed: func(ctx context.Context, conn *pgx.Conn, index int) error {
+				_, err := conn.Exec(ctx, `INSERT INTO shards (shard) VALUES ($1)`, index)
+				return err
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		for range 2 {
+			db, err := pool.Acquire(ctx)
+			require.NoError(t, err)
+
+			var shard int
+			err = db.Pool().QueryRow(ctx, `SELECT shard FROM shards`).Scan(&shard)
+			require.NoError(t, err)
+			assert.Equal(t, db.Index(), shard)
+		}
+	})
+
+	t.Run("seed failure releases the database", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_seed_indexed_failure",
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+			SeedDatabaseIndexed: func(ctx context.Context, conn *pgx.Conn, index int) error {
+				return errors.New("seed failed")
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		_, err = pool.Acquire(ctx)
+		require.ErrorContains(t, err, "seed failed")
+
+		// The only database must be available again.
+		acquireCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		t.Cleanup(cancel)
+		_, err = pool.Acquire(acquireCtx)
+		require.ErrorContains(t, err, "seed failed")
+	})
+}
+
+// TestIntegration_SetupTestDB is an integration test that tests configuring
+// each test database after it has been cloned from the template.
+func TestIntegration_SetupTestDB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	t.Run("configures each database", func(t *testing.T) {
+		var mu sync.Mutex
+		var order []string
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_setup_test_db",
+			Pool:         connPool,
+			MaxDatabases: 2,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE SCHEMA app; CREATE TABLE app.users (name TEXT)`)
+				return err
+			},
+			SetupTestDB: func(ctx context.Context, conn *pgx.Conn, dbName string) error {
+				mu.Lock()
+				order = append(order, "setup "+dbName)
+				mu.Unlock()
+				_, err := conn.Exec(ctx, fmt.Sprintf(`ALTER DATABASE %s SET search_path = app`, pgx.Identifier{dbName}.Sanitize()))
+				return err
+			},
+			SeedDatabaseIndexed: func(ctx context.Context, conn *pgx.Conn, index int) error {
+				mu.Lock()
+				order = append(order, fmt.Sprintf("seed %d", index))
+				mu.Unlock()
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"setup " + db.Name(), fmt.Sprintf("seed %d", db.Index())}, order)
+
+		// The connections of the pool pick up the setting.
+		var count int
+		err = db.Pool().QueryRow(ctx, `SELECT count(*) FROM users`).Scan(&count)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+	})
+
+	t.Run("failure releases the database", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_setup_test_db_failure",
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+			SetupTestDB: func(ctx context.Context, conn *pgx.Conn, dbName string) error {
+				return errors.New("setup failed")
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		_, err = pool.Acquire(ctx)
+		require.ErrorContains(t, err, "setup failed")
+		assert.False(t, testutil.DBExists(t, connPool, "testdbpool_integration_setup_test_db_failure_0"))
+
+		// The only database must be available again.
+		acquireCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		t.Cleanup(cancel)
+		_, err = pool.Acquire(acquireCtx)
+		require.ErrorContains(t, err, "setup failed")
+	})
+}
+
+// TestIntegration_ConnStringFunc is an integration test that tests connecting
+// to the template and test databases with a custom connection string.
+func TestIntegration_ConnStringFunc(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	connConfig := connPool.Config().ConnConfig
+	var mu sync.Mutex
+	var dbNames []string
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "integration_conn_string_func",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE foos (id INT)`)
+			return err
+		},
+		ConnStringFunc: func(dbName string) (string, error) {
+			mu.Lock()
+			dbNames = append(dbNames, dbName)
+			mu.Unlock()
+			return fmt.Sprintf(
+				"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable application_name=custom",
+				connConfig.Host, connConfig.Port, connConfig.User, connConfig.Password, dbName,
+			), nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+
+	var appName string
+	err = db.Pool().QueryRow(ctx, `SELECT current_setting('application_name')`).Scan(&appName)
+	require.NoError(t, err)
+	assert.Equal(t, "custom", appName)
+	assert.Equal(t, []string{pool.TemplateDBName(), db.Name()}, dbNames)
+	require.NoError(t, db.Release(ctx))
+
+	t.Run("error is returned from Acquire", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_conn_string_func_error",
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+			ConnStringFunc: func(dbName string) (string, error) {
+				return "", errors.New("no credentials")
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		_, err = pool.Acquire(ctx)
+		require.ErrorContains(t, err, "no credentials")
+	})
+}
+
+// TestIntegration_RequiredRoles is an integration test that tests creating
+// the roles that the template and test databases depend on.
+func TestIntegration_RequiredRoles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	dropRole := func() {
+		_, _ = connPool.Exec(ctx, `DROP ROLE IF EXISTS testdbpool_app_reader`)
+	}
+	dropRole()
+
+	t.Run("missing roles are reported when creation is skipped", func(t *testing.T) {
+		_, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_required_roles_skip",
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+			RequiredRoles:    []testdbpool.RoleSpec{{Name: "testdbpool_app_reader"}},
+			SkipRoleCreation: true,
+		})
+		var rolesErr *testdbpool.MissingRolesError
+		require.ErrorAs(t, err, &rolesErr)
+		assert.Equal(t, []string{"testdbpool_app_reader"}, rolesErr.Roles)
+	})
+
+	t.Run("roles are created and usable in test databases", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_required_roles",
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `
+					CREATE TABLE foos (id INT);
+					GRANT SELECT ON foos TO testdbpool_app_reader;
+				`)
+				return err
+			},
+			RequiredRoles: []testdbpool.RoleSpec{{Name: "testdbpool_app_reader", Options: "NOLOGIN"}},
+		})
+		require.NoError(t, err)
+		// Cleanups run in reverse order, so the role is dropped after the
+		// databases holding privileges granted to it.
+		t.Cleanup(dropRole)
+		t.Cleanup(pool.Cleanup)
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+
+		err = pgx.BeginFunc(ctx, db.Pool(), func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, `SET LOCAL ROLE testdbpool_app_reader`); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `SELECT * FROM foos`)
+			return err
+		})
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+	})
+}
+
+// TestIntegration_SetupFromDatabase is an integration test that tests cloning
+// an existing database as the template database.
+func TestIntegration_SetupFromDatabase(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	// Curate a source database.
+	const source = "testdbpool_curated_source"
+	_, err := connPool.Exec(ctx, `DROP DATABASE IF EXISTS `+source)
+	require.NoError(t, err)
+	_, err = connPool.Exec(ctx, `CREATE DATABASE `+source)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = connPool.Exec(context.Background(), `DROP DATABASE IF EXISTS `+source)
+	})
+
+	sourceConfig := connPool.Config().ConnConfig.Copy()
+	sourceConfig.Database = source
+	sourceConn, err := pgx.ConnectConfig(ctx, sourceConfig)
+	require.NoError(t, err)
+	_, err = sourceConn.Exec(ctx, `
+		CREATE TABLE foos (id INT PRIMARY KEY, name TEXT);
+		INSERT INTO foos VALUES (1, 'curated'), (2, 'data');
+	`)
+	require.NoError(t, err)
+	// The open connection must not prevent the clone.
+	t.Cleanup(func() { _ = sourceConn.Close(context.Background()) })
+
+	t.Run("missing source database", func(t *testing.T) {
+		_, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:                "integration_setup_from_missing",
+			Pool:              connPool,
+			SetupFromDatabase: "testdbpool_no_such_source",
+		})
+		require.ErrorContains(t, err, "source database testdbpool_no_such_source does not exist")
+	})
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:                "integration_setup_from_database",
+		Pool:              connPool,
+		MaxDatabases:      2,
+		SetupFromDatabase: source,
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	for range 2 {
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+
+		rows, err := db.Pool().Query(ctx, `SELECT name FROM foos ORDER BY id`)
+		require.NoError(t, err)
+		names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		require.NoError(t, err)
+		assert.Equal(t, []string{"curated", "data"}, names)
+	}
+
+	metadata, err := pool.TemplateMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, source, metadata["testdbpool.source"])
+	assert.NotEmpty(t, metadata["testdbpool.source_bytes"])
+	assert.NotEmpty(t, metadata["testdbpool.source_cloned_at"])
+}
+
+func TestIntegration_HookLeaks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	createTable := func(ctx context.Context, conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, `CREATE TABLE items (id INT)`)
+		return err
+	}
+	// leakTx begins a transaction that is never committed, holding a lock on
+	// the items table.
+	leakTx := func(ctx context.Context, conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, `BEGIN; LOCK TABLE items`)
+		return err
+	}
+
+	t.Run("SetupTemplate", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_hook_leak_setup",
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				if err := createTable(ctx, conn); err != nil {
+					return err
+				}
+				_, err := conn.Exec(ctx, `SELECT pg_advisory_lock(42)`)
+				return err
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		_, err = pool.Acquire(ctx)
+		var leakErr *testdbpool.HookLeakError
+		require.ErrorAs(t, err, &leakErr)
+		assert.Equal(t, "SetupTemplate", leakErr.Hook)
+		assert.ErrorContains(t, err, "SetupTemplate left 1 advisory lock(s) behind")
+	})
+
+	t.Run("SeedDatabaseIndexed", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            "integration_hook_leak_seed",
+			Pool:          connPool,
+			MaxDatabases:  1,
+			SetupTemplate: createTable,
+			SeedDatabaseIndexed: func(ctx context.Context, conn *pgx.Conn, index int) error {
+				return leakTx(ctx, conn)
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		_, err = pool.Acquire(ctx)
+		assert.ErrorContains(t, err, "SeedDatabaseIndexed left an open transaction behind")
+
+		// The failure gives back the slot, so the next acquisition fails the
+		// same way instead of waiting for it.
+		_, err = pool.Acquire(ctx)
+		assert.ErrorContains(t, err, "SeedDatabaseIndexed left an open transaction behind")
+	})
+
+	t.Run("AcquireLinked", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            "integration_hook_leak_linked",
+			Pool:          connPool,
+			MaxDatabases:  2,
+			SetupTemplate: createTable,
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		var names []string
+		_, err = pool.AcquireLinked(ctx, 2, func(ctx context.Context, dbs []*testdbpool.TestDB) error {
+			for _, db := range dbs {
+				names = append(names, db.Name())
+			}
+			// A connection outside the test database's pool, e.g. one opened
+			// by a dblink or a helper of the code under test.
+			conn, err := pgx.ConnectConfig(ctx, dbs[1].Pool().Config().ConnConfig)
+			if err != nil {
+				return err
+			}
+			t.Cleanup(func() { _ = conn.Close(ctx) })
+			return leakTx(ctx, conn)
+		})
+		var leakErr *testdbpool.HookLeakError
+		require.ErrorAs(t, err, &leakErr)
+		assert.Equal(t, "AcquireLinked link", leakErr.Hook)
+		require.Len(t, leakErr.Leaks, 1)
+		assert.Contains(t, leakErr.Leaks[0], "an open transaction in "+names[1])
+
+		// The leaked session is terminated so that the databases are dropped.
+		for _, name := range names {
+			assert.False(t, testutil.DBExists(t, connPool, name))
+		}
+	})
+
+	t.Run("TerminateLeakedHookSessions", func(t *testing.T) {
+		events := newEventRecorder()
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            "integration_hook_leak_terminate",
+			Pool:          connPool,
+			MaxDatabases:  1,
+			SetupTemplate: createTable,
+			SeedDatabaseIndexed: func(ctx context.Context, conn *pgx.Conn, index int) error {
+				return leakTx(ctx, conn)
+			},
+			TerminateLeakedHookSessions: true,
+			Logger:                      slog.New(events),
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		// The table is not locked anymore.
+		_, err = db.Pool().Exec(ctx, `INSERT INTO items (id) VALUES (1)`)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+
+		// The leak is reported to the Logger.
+		var warnings []string
+		for _, e := range events.take() {
+			if e.level == slog.LevelWarn {
+				warnings = append(warnings, e.msg)
+			}
+		}
+		assert.Equal(t, []string{"hook leaked session state; cleaned up"}, warnings)
+	})
+}
+
+func TestIntegration_ForceTemplateRecreation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newPool := func(table string, force bool) *testdbpool.Pool {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_force_recreation",
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, fmt.Sprintf(`CREATE TABLE %s (id INT)`, table))
+				return err
+			},
+			ForceTemplateRecreation: force,
+		})
+		require.NoError(t, err)
+		return pool
+	}
+	tableOf := func(pool *testdbpool.Pool) string {
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Release(ctx)) }()
+
+		var table string
+		err = db.Pool().QueryRow(ctx,
+			`SELECT table_name FROM information_schema.tables WHERE table_schema = 'public'`,
+		).Scan(&table)
+		require.NoError(t, err)
+		return table
+	}
+
+	old := newPool("old_schema", false)
+	assert.Equal(t, "old_schema", tableOf(old))
+	require.NoError(t, old.Close(ctx))
+
+	// Without the option, the existing template is reused despite the new
+	// schema.
+	reused := newPool("new_schema", false)
+	assert.Equal(t, "old_schema", tableOf(reused))
+	require.NoError(t, reused.Close(ctx))
+
+	forced := newPool("new_schema", true)
+	assert.Equal(t, "new_schema", tableOf(forced))
+	// The template is recreated only once per Pool.
+	assert.Equal(t, "new_schema", tableOf(forced))
+
+	forced.Cleanup()
+	assert.False(t, testutil.DBExists(t, connPool, forced.TemplateDBName()))
+}
+
+func TestIntegration_ResetDatabase(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newPool := func(id string, reset func(ctx context.Context, conn *pgx.Conn) error) *testdbpool.Pool {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           id,
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE items (id INT)`)
+				return err
+			},
+			ResetDatabase: reset,
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+		return pool
+	}
+	// use writes to the database, including a table that the reset function
+	// does not know about, which tells whether the database was reused.
+	use := func(t *testing.T, pool *testdbpool.Pool) string {
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		_, err = db.Pool().Exec(ctx, `INSERT INTO items (id) VALUES (1); CREATE TABLE scratch (id INT)`)
+		require.NoError(t, err)
+		name := db.Name()
+		require.NoError(t, db.Release(ctx))
+		return name
+	}
+	tableExists := func(t *testing.T, db *testdbpool.TestDB, table string) bool {
+		var exists bool
+		err := db.Pool().QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists)
+		require.NoError(t, err)
+		return exists
+	}
+
+	t.Run("reuses the reset database", func(t *testing.T) {
+		pool := newPool("integration_reset_database", func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `TRUNCATE items`)
+			return err
+		})
+
+		name := use(t, pool)
+		assert.True(t, testutil.DBExists(t, connPool, name), "reset database should be kept")
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Release(ctx)) }()
+		assert.Equal(t, name, db.Name())
+		assert.True(t, tableExists(t, db, "scratch"), "database should have been reused")
+		count, err := db.CountWhere(ctx, "items", "")
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	})
+
+	t.Run("drops the database if the reset fails", func(t *testing.T) {
+		pool := newPool("integration_reset_database_fail", func(ctx context.Context, conn *pgx.Conn) error {
+			return errors.New("reset failed")
+		})
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		_, err = db.Pool().Exec(ctx, `INSERT INTO items (id) VALUES (1); CREATE TABLE scratch (id INT)`)
+		require.NoError(t, err)
+		name := db.Name()
+		err = db.Release(ctx)
+		require.ErrorIs(t, err, testdbpool.ErrResetFailed)
+		assert.NotErrorIs(t, err, testdbpool.ErrDropFailed)
+		assert.ErrorContains(t, err, "reset failed")
+		assert.False(t, testutil.DBExists(t, connPool, name), "database should be dropped")
+
+		db, err = pool.Acquire(ctx)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Release(ctx)) }()
+		assert.False(t, tableExists(t, db, "scratch"), "database should have been recreated")
+		count, err := db.CountWhere(ctx, "items", "")
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	})
+}
+
+func TestIntegration_ResetByTruncateAll(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "integration_reset_by_truncate_all",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			// books references both authors and the static categories.
+			_, err := conn.Exec(ctx, `
+				CREATE TABLE categories (id SERIAL PRIMARY KEY, name TEXT NOT NULL);
+				CREATE SCHEMA library;
+				CREATE TABLE library.authors (id SERIAL PRIMARY KEY, name TEXT NOT NULL);
+				CREATE TABLE books (
+					id SERIAL PRIMARY KEY,
+					author_id INT NOT NULL REFERENCES library.authors (id),
+					category_id INT NOT NULL REFERENCES categories (id)
+				);
+				INSERT INTO categories (name) VALUES ('fantasy'), ('poetry')`)
+			return err
+		},
+		ResetDatabase: testdbpool.ResetByTruncateAll("categories"),
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	name := db.Name()
+	_, err = db.Pool().Exec(ctx, `
+		INSERT INTO library.authors (name) VALUES ('Le Guin'), ('Tolkien');
+		INSERT INTO books (author_id, category_id) VALUES (1, 1), (2, 1)`)
+	require.NoError(t, err)
+	require.NoError(t, db.Release(ctx))
+
+	db, err = pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Release(ctx)) }()
+	assert.Equal(t, name, db.Name(), "reset database should be reused")
+	for table, want := range map[string]int64{"library.authors": 0, "books": 0, "categories": 2} {
+		count, err := db.CountWhere(ctx, table, "")
+		require.NoError(t, err)
+		assert.Equal(t, want, count, table)
+	}
+	var id int
+	require.NoError(t, db.Pool().QueryRow(ctx, `INSERT INTO library.authors (name) VALUES ('Pratchett') RETURNING id`).Scan(&id))
+	assert.Equal(t, 1, id, "identities should restart")
+}
+
+func TestIntegration_ResetByTruncateWithOptions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	seed := func(ctx context.Context, conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, `INSERT INTO users (name) VALUES ('admin')`)
+		return err
+	}
+	// ids returns the IDs of the users after one round of a test that adds a
+	// user and the reset.
+	ids := func(t *testing.T, id string, opts testdbpool.TruncateOptions) []int {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           id,
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				if _, err := conn.Exec(ctx, `CREATE TABLE users (id SERIAL PRIMARY KEY, name TEXT NOT NULL)`); err != nil {
+					return err
+				}
+				return seed(ctx, conn)
+			},
+			ResetDatabase: testdbpool.ResetByTruncateWithOptions([]string{"users"}, seed, opts),
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		_, err = db.Pool().Exec(ctx, `INSERT INTO users (name) VALUES ('alice')`)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+
+		db, err = pool.Acquire(ctx)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Release(ctx)) }()
+		rows, err := db.Pool().Query(ctx, `SELECT id FROM users ORDER BY id`)
+		require.NoError(t, err)
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+		require.NoError(t, err)
+		return ids
+	}
+
+	t.Run("restart identity", func(t *testing.T) {
+		assert.Equal(t, []int{1}, ids(t, "integration_truncate_restart_identity", testdbpool.TruncateOptions{RestartIdentity: true}))
+	})
+
+	t.Run("continue identity", func(t *testing.T) {
+		assert.Equal(t, []int{3}, ids(t, "integration_truncate_continue_identity", testdbpool.TruncateOptions{}))
+	})
+}
+
+func TestIntegration_ResetBySnapshot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	for _, tool := range []string{"pg_dump", "pg_restore"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "integration_reset_by_snapshot",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `
+				CREATE TABLE authors (id SERIAL PRIMARY KEY, name TEXT NOT NULL);
+				CREATE TABLE books (id SERIAL PRIMARY KEY, author_id INT NOT NULL REFERENCES authors (id), title TEXT NOT NULL);
+				INSERT INTO authors (name) VALUES ('Le Guin'), ('Tolkien');
+				INSERT INTO books (author_id, title) VALUES (1, 'A Wizard of Earthsea')`)
+			return err
+		},
+		ResetBySnapshot: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	name := db.Name()
+	_, err = db.Pool().Exec(ctx, `
+		DELETE FROM books;
+		UPDATE authors SET name = 'changed';
+		INSERT INTO authors (name) VALUES ('Pratchett')`)
+	require.NoError(t, err)
+	require.NoError(t, db.Release(ctx))
+	assert.True(t, testutil.DBExists(t, connPool, name), "reset database should be kept")
+
+	db, err = pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Release(ctx)) }()
+	assert.Equal(t, name, db.Name())
+	assert.Equal(t, int64(1), pool.Stat().TotalCreates)
+
+	rows, err := db.Pool().Query(ctx, `SELECT name FROM authors ORDER BY id`)
+	require.NoError(t, err)
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Le Guin", "Tolkien"}, names)
+	count, err := db.CountWhere(ctx, "books", "title = $1", "A Wizard of Earthsea")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	// The sequences are restored as well.
+	var id int
+	require.NoError(t, db.Pool().QueryRow(ctx, `INSERT INTO authors (name) VALUES ('Pratchett') RETURNING id`).Scan(&id))
+	assert.Equal(t, 3, id)
+}
+
+func TestIntegration_VerifyClean(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	var dirty []*testdbpool.DirtyError
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "integration_verify_clean",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `
+				CREATE TYPE mood AS ENUM ('happy', 'sad');
+				CREATE TABLE items (id SERIAL PRIMARY KEY, mood mood);
+				CREATE VIEW happy_items AS SELECT * FROM items WHERE mood = 'happy'`)
+			return err
+		},
+		ResetDatabase: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `TRUNCATE items RESTART IDENTITY`)
+			return err
+		},
+		VerifyClean: true,
+		OnDirty: func(err *testdbpool.DirtyError) {
+			dirty = append(dirty, err)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	use := func(t *testing.T, sql string) string {
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		_, err = db.Pool().Exec(ctx, sql)
+		require.NoError(t, err)
+		name := db.Name()
+		require.NoError(t, db.Release(ctx))
+		return name
+	}
+
+	// Rows are removed by the reset, so the database is kept.
+	name := use(t, `INSERT INTO items (mood) VALUES ('happy')`)
+	assert.Empty(t, dirty)
+	assert.True(t, testutil.DBExists(t, connPool, name), "clean database should be kept")
+
+	// Objects are not, so the database is dropped.
+	name = use(t, `CREATE TABLE scratch (id INT); CREATE TYPE color AS ENUM ('red'); DROP VIEW happy_items`)
+	require.Len(t, dirty, 1)
+	assert.Equal(t, name, dirty[0].Database)
+	assert.Equal(t, []string{"table public.scratch", "type public.color"}, dirty[0].Added)
+	assert.Equal(t, []string{"view public.happy_items"}, dirty[0].Missing)
+	assert.False(t, testutil.DBExists(t, connPool, name), "dirty database should be dropped")
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Release(ctx)) }()
+	var scratch bool
+	require.NoError(t, db.Pool().QueryRow(ctx, `SELECT to_regclass('scratch') IS NOT NULL`).Scan(&scratch))
+	assert.False(t, scratch, "database should have been recreated")
+}
+
+func TestIntegration_ReuseClonePools(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newPool := func(t *testing.T, id string) *testdbpool.Pool {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           id,
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE items (id INT)`)
+				return err
+			},
+			ResetDatabase: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `TRUNCATE items`)
+				return err
+			},
+			ReuseClonePools: true,
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+		return pool
+	}
+	// prepare prepares a statement on a connection of db and returns the
+	// backend PID of the connection.
+	prepare := func(t *testing.T, db *testdbpool.TestDB) uint32 {
+		conn, err := db.Pool().Acquire(ctx)
+		require.NoError(t, err)
+		defer conn.Release()
+		_, err = conn.Exec(ctx, `PREPARE count_items AS SELECT count(*) FROM items`)
+		require.NoError(t, err)
+		return conn.Conn().PgConn().PID()
+	}
+	// prepared reports whether the statement prepared by prepare exists on
+	// a connection of db, along with the backend PID of the connection.
+	prepared := func(t *testing.T, db *testdbpool.TestDB) (bool, uint32) {
+		conn, err := db.Pool().Acquire(ctx)
+		require.NoError(t, err)
+		defer conn.Release()
+		var exists bool
+		err = conn.QueryRow(ctx,
+			`SELECT EXISTS (SELECT FROM pg_prepared_statements WHERE name = 'count_items')`,
+		).Scan(&exists)
+		require.NoError(t, err)
+		return exists, conn.Conn().PgConn().PID()
+	}
+
+	t.Run("hands the same pool to the next acquirer", func(t *testing.T) {
+		pool := newPool(t, "integration_reuse_clone_pools")
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		pid := prepare(t, db)
+		first := db.Pool()
+		require.NoError(t, db.Release(ctx))
+
+		db, err = pool.Acquire(ctx)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Release(ctx)) }()
+		assert.Same(t, first, db.Pool())
+		exists, gotPID := prepared(t, db)
+		assert.Equal(t, pid, gotPID)
+		assert.True(t, exists, "prepared statement should survive the release")
+	})
+
+	t.Run("rebuilds a broken pool", func(t *testing.T) {
+		pool := newPool(t, "integration_reuse_clone_pools_broken")
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		name := db.Name()
+		first := db.Pool()
+		require.NoError(t, db.Release(ctx))
+
+		_, err = connPool.Exec(ctx,
+			`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1`, name)
+		require.NoError(t, err)
+
+		db, err = pool.Acquire(ctx)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Release(ctx)) }()
+		assert.Equal(t, name, db.Name())
+		assert.NotSame(t, first, db.Pool())
+		require.NoError(t, db.Pool().Ping(ctx))
+	})
+
+	t.Run("closes the pool of an invalidated database", func(t *testing.T) {
+		pool := newPool(t, "integration_reuse_clone_pools_invalidated")
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		prepare(t, db)
+		first := db.Pool()
+		db.Invalidate()
+		require.NoError(t, db.Release(ctx))
+		assert.Error(t, first.Ping(ctx), "pool should be closed")
+
+		db, err = pool.Acquire(ctx)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Release(ctx)) }()
+		assert.NotSame(t, first, db.Pool())
+		exists, _ := prepared(t, db)
+		assert.False(t, exists, "database should have been recreated")
+	})
+}
+
+func TestIntegration_ReuseAcrossRuns(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	// run constructs a Pool like a new run of the test binary would.
+	run := func(t *testing.T, events *eventRecorder) *testdbpool.Pool {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_reuse_across_runs",
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `
+					CREATE TABLE items (id INT);
+					INSERT INTO items (id) VALUES (1), (2);
+				`)
+				return err
+			},
+			// A reset that misses the rows inserted by the test, which the
+			// sentinel table catches.
+			ResetDatabase: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+			ReuseAcrossRuns:    true,
+			ReuseSentinelTable: "public.items",
+			Logger:             slog.New(events),
+		})
+		require.NoError(t, err)
+		return pool
+	}
+	count := func(t *testing.T, db *testdbpool.TestDB) int64 {
+		count, err := db.CountWhere(ctx, "items", "")
+		require.NoError(t, err)
+		return count
+	}
+	messages := func(recorder *eventRecorder) []string {
+		var msgs []string
+		for _, e := range recorder.take() {
+			msgs = append(msgs, e.msg)
+		}
+		return msgs
+	}
+
+	first := run(t, newEventRecorder())
+	t.Cleanup(first.Cleanup)
+	db, err := first.Acquire(ctx)
+	require.NoError(t, err)
+	name := db.Name()
+	require.NoError(t, db.Release(ctx))
+	require.NoError(t, first.Close(ctx))
+	assert.True(t, testutil.DBExists(t, connPool, name), "released database should be kept")
+
+	t.Run("reuses the kept database", func(t *testing.T) {
+		events := newEventRecorder()
+		second := run(t, events)
+		defer func() { require.NoError(t, second.Close(ctx)) }()
+
+		db, err := second.Acquire(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, name, db.Name())
+		assert.Zero(t, second.Stat().TotalCreates, "database should not be created")
+		assert.Contains(t, messages(events), "test database reused")
+		assert.Equal(t, int64(2), count(t, db))
+
+		// Leave the database dirty for the next run.
+		_, err = db.Pool().Exec(ctx, `INSERT INTO items (id) VALUES (3)`)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+	})
+
+	t.Run("recreates a dirty database", func(t *testing.T) {
+		events := newEventRecorder()
+		third := run(t, events)
+		defer func() { require.NoError(t, third.Close(ctx)) }()
+
+		db, err := third.Acquire(ctx)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Release(ctx)) }()
+		assert.Equal(t, int64(1), third.Stat().TotalCreates, "database should be recreated")
+		assert.Contains(t, messages(events), "released test database failed verification; recreating it")
+		assert.Equal(t, int64(2), count(t, db))
+	})
+}
+
+func TestIntegration_CloneStrategy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	// The strategy is ignored on servers older than PostgreSQL 15, so
+	// acquiring works everywhere.
+	for _, strategy := range []testdbpool.CloneStrategy{testdbpool.CloneStrategyFileCopy, testdbpool.CloneStrategyWALLog} {
+		t.Run(string(strategy), func(t *testing.T) {
+			pool, err := testdbpool.New(ctx, &testdbpool.Config{
+				ID:           "integration_clone_strategy_" + strings.ToLower(string(strategy)),
+				Pool:         connPool,
+				MaxDatabases: 1,
+				SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+					_, err := conn.Exec(ctx, `CREATE TABLE items (id INT); INSERT INTO items VALUES (1)`)
+					return err
+				},
+				CloneStrategy: strategy,
+			})
+			require.NoError(t, err)
+			t.Cleanup(pool.Cleanup)
+
+			db, err := pool.Acquire(ctx)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, db.Release(ctx)) }()
+			count, err := db.CountWhere(ctx, "items", "")
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), count)
+		})
+	}
+}
+
+func TestIntegration_MaxTemplateSetupDuration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	// The first setup hangs, like a migration waiting on a lock, until its
+	// context expires. The second one finishes in time.
+	var setups atomic.Int32
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "integration_max_template_setup_duration",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			if _, err := conn.Exec(ctx, `CREATE TABLE items (id INT)`); err != nil {
+				return err
+			}
+			if setups.Add(1) == 1 {
+				_, err := conn.Exec(ctx, `SELECT pg_sleep(60)`)
+				return err
+			}
+			return nil
+		},
+		MaxTemplateSetupDuration: 500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	start := time.Now()
+	_, err = pool.Acquire(ctx)
+	require.ErrorContains(t, err, "template setup did not finish within 500ms")
+	assert.Less(t, time.Since(start), 30*time.Second)
+	assert.False(t, testutil.DBExists(t, connPool, pool.TemplateDBName()),
+		"the partially set up template must be dropped")
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Release(ctx)) }()
+	count, err := db.CountWhere(ctx, "items", "")
+	require.NoError(t, err)
+	assert.Zero(t, count)
+	assert.Equal(t, int32(2), setups.Load())
+}
+
+func TestIntegration_Locale(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	var defaultCollate string
+	err := connPool.QueryRow(ctx,
+		`SELECT datcollate FROM pg_database WHERE datname = 'template1'`,
+	).Scan(&defaultCollate)
+	require.NoError(t, err)
+
+	newConfig := func(id string) *testdbpool.Config {
+		return &testdbpool.Config{
+			ID:           id,
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE words (word TEXT)`)
+				return err
+			},
+		}
+	}
+	localeOf := func(db string) (encoding, collate, ctype string) {
+		err := connPool.QueryRow(ctx,
+			`SELECT pg_encoding_to_char(encoding), datcollate, datctype FROM pg_database WHERE datname = $1`,
+			db,
+		).Scan(&encoding, &collate, &ctype)
+		require.NoError(t, err)
+		return encoding, collate, ctype
+	}
+
+	t.Run("template and test databases use the locale", func(t *testing.T) {
+		cfg := newConfig("integration_locale")
+		cfg.Encoding, cfg.Collate, cfg.CType = "utf8", "C", "C"
+		pool, err := testdbpool.New(ctx, cfg)
+		require.NoError(t, err)
+		defer pool.Cleanup()
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Release(ctx)) }()
+
+		for _, name := range []string{pool.TemplateDBName(), db.Name()} {
+			encoding, collate, ctype := localeOf(name)
+			assert.Equal(t, "UTF8", encoding, name)
+			assert.Equal(t, "C", collate, name)
+			assert.Equal(t, "C", ctype, name)
+		}
+
+		// Byte order sorts upper case before lower case.
+		_, err = db.Pool().Exec(ctx, `INSERT INTO words VALUES ('b'), ('B'), ('a')`)
+		require.NoError(t, err)
+		var words []string
+		err = db.Pool().QueryRow(ctx, `SELECT array_agg(word ORDER BY word) FROM words`).Scan(&words)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"B", "a", "b"}, words)
+	})
+
+	t.Run("unknown encoding", func(t *testing.T) {
+		cfg := newConfig("integration_locale_encoding")
+		cfg.Encoding = "NO_SUCH_ENCODING"
+		_, err := testdbpool.New(ctx, cfg)
+		assert.ErrorContains(t, err, "Encoding NO_SUCH_ENCODING is not supported by the server")
+	})
+
+	if defaultCollate == "C" || defaultCollate == "POSIX" {
+		t.Skip("the server default collation is C; cannot test a mismatch")
+	}
+
+	t.Run("existing template with another locale", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, newConfig("integration_locale_existing"))
+		require.NoError(t, err)
+		defer pool.Cleanup()
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+
+		cfg := newConfig("integration_locale_existing")
+		cfg.Collate = "C"
+		_, err = testdbpool.New(ctx, cfg)
+		assert.ErrorContains(t, err, "set ForceTemplateRecreation to rebuild it")
+
+		cfg = newConfig("integration_locale_existing")
+		cfg.Collate = "C"
+		cfg.ForceTemplateRecreation = true
+		forced, err := testdbpool.New(ctx, cfg)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, forced.Close(ctx)) }()
+		db, err = forced.Acquire(ctx)
+		require.NoError(t, err)
+		_, collate, _ := localeOf(db.Name())
+		assert.Equal(t, "C", collate)
+		require.NoError(t, db.Release(ctx))
+	})
+
+	t.Run("SetupFromDatabase with another locale", func(t *testing.T) {
+		source := "testdbpool_locale_source"
+		_, err := connPool.Exec(ctx, `CREATE DATABASE `+source)
+		require.NoError(t, err)
+		t.Cleanup(func() { _, _ = connPool.Exec(ctx, `DROP DATABASE IF EXISTS `+source) })
+
+		cfg := newConfig("integration_locale_source")
+		cfg.SetupFromDatabase = source
+		cfg.Collate = "C"
+		_, err = testdbpool.New(ctx, cfg)
+		assert.ErrorContains(t, err, "Collate C is incompatible with SetupFromDatabase "+source)
+	})
+}
+
+func TestIntegration_TemplateVersion(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	var setups atomic.Int64
+	newPool := func(version string) *testdbpool.Pool {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "integration_template_version",
+			Pool:         connPool,
+			MaxDatabases: 2,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				setups.Add(1)
+				_, err := conn.Exec(ctx, fmt.Sprintf(`CREATE TABLE schema_%s (id INT)`, version))
+				return err
+			},
+			ResetDatabase: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+			TemplateVersion: version,
+		})
+		require.NoError(t, err)
+		return pool
+	}
+
+	v1 := newPool("v1")
+	t.Cleanup(v1.Cleanup)
+	dbs, err := v1.AcquireMultiple(ctx, 2)
+	require.NoError(t, err)
+	names := []string{dbs[0].Name(), dbs[1].Name()}
+	require.NoError(t, testdbpool.ReleaseMultiple(ctx, dbs))
+	require.NoError(t, v1.Close(ctx))
+	// The released databases are kept for reuse.
+	for _, name := range names {
+		require.True(t, testutil.DBExists(t, connPool, name))
+	}
+
+	// The same version reuses the template.
+	same := newPool("v1")
+	_, err = same.TemplateMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), setups.Load())
+	require.NoError(t, same.Close(ctx))
+
+	// Two processes notice the new version at the same time; only one of
+	// them rebuilds the template.
+	v2a, v2b := newPool("v2"), newPool("v2")
+	var wg sync.WaitGroup
+	for _, pool := range []*testdbpool.Pool{v2a, v2b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pool.TemplateMetadata(ctx)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(2), setups.Load())
+
+	// The clones of the old template kept for reuse have been dropped.
+	for _, name := range names {
+		assert.False(t, testutil.DBExists(t, connPool, name))
+	}
+
+	db, err := v2a.Acquire(ctx)
+	require.NoError(t, err)
+	var table string
+	err = db.Pool().QueryRow(ctx,
+		`SELECT table_name FROM information_schema.tables WHERE table_schema = 'public'`,
+	).Scan(&table)
+	require.NoError(t, err)
+	assert.Equal(t, "schema_v2", table)
+	require.NoError(t, db.Release(ctx))
+	require.NoError(t, v2a.Close(ctx))
+	require.NoError(t, v2b.Close(ctx))
+}
+
+func TestIntegration_MetadataVersion(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	var setups atomic.Int64
+	cfg := &testdbpool.Config{
+		ID:           "integration_metadata_version",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			setups.Add(1)
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id INT)`)
+			return err
+		},
+	}
+	pool, err := testdbpool.New(ctx, cfg)
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+	_, err = pool.TemplateMetadata(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), setups.Load())
+	require.NoError(t, pool.Close(ctx))
+
+	templateName := pgx.Identifier{pool.TemplateDBName()}.Sanitize()
+	setComment := func(comment string) {
+		_, err := connPool.Exec(ctx, fmt.Sprintf(`COMMENT ON DATABASE %s IS '%s'`, templateName, comment))
+		require.NoError(t, err)
+	}
+	readMetadata := func() map[string]any {
+		var meta map[string]any
+		err := connPool.QueryRow(ctx,
+			`SELECT shobj_description(oid, 'pg_database')::json FROM pg_database WHERE datname = $1`,
+			pool.TemplateDBName(),
+		).Scan(&meta)
+		require.NoError(t, err)
+		return meta
+	}
+
+	t.Run("older version is migrated", func(t *testing.T) {
+		// Metadata as written before the version was recorded, without a
+		// generation.
+		setComment(`{"created_at": "2024-01-01T00:00:00Z", "values": {"schema": "v1"}}`)
+
+		pool, err := testdbpool.New(ctx, cfg)
+		require.NoError(t, err)
+		metadata, err := pool.TemplateMetadata(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"schema": "v1"}, metadata)
+		assert.Equal(t, int64(1), setups.Load(), "template must not be rebuilt")
+		require.NoError(t, pool.Close(ctx))
+
+		meta := readMetadata()
+		assert.Equal(t, float64(2), meta["metadata_version"])
+		assert.NotEmpty(t, meta["generation"])
+		assert.Equal(t, "2024-01-01T00:00:00Z", meta["created_at"])
+	})
+
+	t.Run("unreadable metadata leads to recreation", func(t *testing.T) {
+		setComment(`not json`)
+
+		pool, err := testdbpool.New(ctx, cfg)
+		require.NoError(t, err)
+		assert.False(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+		assert.Equal(t, int64(2), setups.Load())
+		require.NoError(t, pool.Close(ctx))
+		assert.Equal(t, float64(2), readMetadata()["metadata_version"])
+	})
+
+	t.Run("newer version fails", func(t *testing.T) {
+		setComment(`{"metadata_version": 99, "created_at": "2024-01-01T00:00:00Z"}`)
+
+		_, err := testdbpool.New(ctx, cfg)
+		require.ErrorIs(t, err, testdbpool.ErrTemplateMetadataTooNew)
+		assert.ErrorContains(t, err, "upgrade the library")
+		// The template is left alone for the newer version.
+		assert.True(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+		assert.Equal(t, float64(99), readMetadata()["metadata_version"])
+	})
+}
+
+// sqlFiles holds the SQL scripts of the SetupFromFiles tests.
+//
+//go:embed testdata/sqlfiles
+var sqlFiles embed.FS
+
+// TestIntegration_SetupFromSQLFiles is an integration test that tests setting
+// up the template from SQL scripts.
+func TestIntegration_SetupFromSQLFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	schema := writeFile("schema.sql", `
+		CREATE TABLE users (id INT PRIMARY KEY, name TEXT);
+		-- Semicolons inside the function body do not split statements.
+		CREATE FUNCTION greet(id INT) RETURNS TEXT AS $$
+		BEGIN
+			RETURN 'hello; ' || (SELECT name FROM users WHERE users.id = greet.id);
+		END;
+		$$ LANGUAGE plpgsql;
+	`)
+	seed := writeFile("seed.sql", `INSERT INTO users VALUES (1, 'alice');`)
+	// CREATE INDEX CONCURRENTLY cannot run inside the implicit transaction
+	// of a multi-statement script, so this one has to be split.
+	concurrently := writeFile("concurrently.sql", `
+		CREATE TABLE posts (id INT);
+		CREATE INDEX CONCURRENTLY posts_id_idx ON posts (id);
+	`)
+
+	t.Run("files", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            "integration_setup_from_sql_files",
+			Pool:          connPool,
+			MaxDatabases:  1,
+			SetupTemplate: testdbpool.SetupFromSQLFiles(schema, seed, concurrently),
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		db := pool.AcquireT(t)
+		var greeting string
+		require.NoError(t, db.Pool().QueryRow(ctx, `SELECT greet(1)`).Scan(&greeting))
+		assert.Equal(t, "hello; alice", greeting)
+		var indexes int
+		err = db.Pool().QueryRow(ctx, `SELECT count(*) FROM pg_indexes WHERE indexname = 'posts_id_idx'`).Scan(&indexes)
+		require.NoError(t, err)
+		assert.Equal(t, 1, indexes)
+	})
+
+	t.Run("embedded files", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            "integration_setup_from_files",
+			Pool:          connPool,
+			MaxDatabases:  1,
+			SetupTemplate: testdbpool.SetupFromFiles(sqlFiles, "testdata/sqlfiles/migrations/*.sql"),
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		db := pool.AcquireT(t)
+		count, err := db.CountWhere(ctx, "books", "title = $1", "A Wizard of Earthsea")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+		var indexes int
+		err = db.Pool().QueryRow(ctx, `SELECT count(*) FROM pg_indexes WHERE indexname = 'books_author_id_idx'`).Scan(&indexes)
+		require.NoError(t, err)
+		assert.Equal(t, 1, indexes)
+	})
+
+	t.Run("embedded files stop at the failing one", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            "integration_setup_from_files_error",
+			Pool:          connPool,
+			MaxDatabases:  1,
+			SetupTemplate: testdbpool.SetupFromFiles(sqlFiles, "testdata/sqlfiles/broken/*.sql"),
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		_, err = pool.Acquire(ctx)
+		require.ErrorContains(t, err, "failed to execute testdata/sqlfiles/broken/002_broken.sql at line 2")
+	})
+
+	t.Run("reader", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            "integration_setup_from_reader",
+			Pool:          connPool,
+			MaxDatabases:  1,
+			SetupTemplate: testdbpool.SetupFromReader(strings.NewReader(`CREATE TABLE items (id INT);`)),
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		db := pool.AcquireT(t)
+		_, err = db.Pool().Exec(ctx, `INSERT INTO items VALUES (1)`)
+		require.NoError(t, err)
+	})
+
+	t.Run("errors name the file and line", func(t *testing.T) {
+		broken := writeFile("broken.sql", "CREATE TABLE a (id INT);\nCREATE TABLE b (id INTEGR);\n")
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            "integration_setup_from_sql_files_error",
+			Pool:          connPool,
+			MaxDatabases:  1,
+			SetupTemplate: testdbpool.SetupFromSQLFiles(broken),
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		_, err = pool.Acquire(ctx)
+		require.ErrorContains(t, err, "failed to execute "+broken+" at line 2")
+	})
+}
+
+// TestIntegration_DisallowedConnections is an integration test that tests
+// template and test databases that refuse connections after being created,
+// as on servers whose policy sets datallowconn to false for new databases.
+func TestIntegration_DisallowedConnections(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	// newConfig returns a config whose databases are made to refuse
+	// connections right before the first connection to each of them.
+	connConfig := connPool.Config().ConnConfig
+	newConfig := func(id string) *testdbpool.Config {
+		var mu sync.Mutex
+		disallowed := map[string]bool{}
+		return &testdbpool.Config{
+			ID:           id,
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE users (id INT)`)
+				return err
+			},
+			ConnStringFunc: func(dbName string) (string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if !disallowed[dbName] {
+					disallowed[dbName] = true
+					query := fmt.Sprintf(`ALTER DATABASE %q ALLOW_CONNECTIONS false`, dbName)
+					if _, err := connPool.Exec(ctx, query); err != nil {
+						return "", err
+					}
+				}
+				return fmt.Sprintf(
+					"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+					connConfig.Host, connConfig.Port, connConfig.User, connConfig.Password, dbName,
+				), nil
+			},
+		}
+	}
+
+	t.Run("connections are allowed", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, newConfig("test-disallowed-conns"))
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		_, err = db.Pool().Exec(ctx, `INSERT INTO users VALUES (1)`)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+	})
+
+	t.Run("kept disallowed", func(t *testing.T) {
+		cfg := newConfig("test-kept-disallowed-conns")
+		cfg.KeepDisallowedConnections = true
+		pool, err := testdbpool.New(ctx, cfg)
+		if err == nil {
+			t.Cleanup(pool.Cleanup)
+			_, err = pool.Acquire(ctx)
+		}
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "does not accept connections (datallowconn is false)")
+		assert.Contains(t, err.Error(), `ALTER DATABASE "testdbpooltmpl_test-kept-disallowed-conns" ALLOW_CONNECTIONS true`)
+		assert.False(t, testutil.DBExists(t, connPool, "testdbpooltmpl_test-kept-disallowed-conns"),
+			"unusable template database should be dropped")
+	})
+}
+
+func TestIntegration_ReleaseFailed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "integration_release_failed",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE users (id SERIAL PRIMARY KEY, name TEXT NOT NULL)`)
+			return err
+		},
+		ResetDatabase:          testdbpool.ResetByTruncateAll(),
+		MaxConsecutiveFailures: 2,
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	corrupted := errors.New("dropped column users.name")
+	for range 2 {
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		name := db.Name()
+		_, err = db.Pool().Exec(ctx, `ALTER TABLE users DROP COLUMN name`)
+		require.NoError(t, err)
+
+		// The database is dropped even though it could be reset.
+		require.NoError(t, db.ReleaseFailed(ctx, corrupted))
+		assert.False(t, testutil.DBExists(t, connPool, name))
+	}
+
+	failures := pool.Failures()
+	require.Len(t, failures, 1)
+	assert.Equal(t, 0, failures[0].Index)
+	assert.Equal(t, 2, failures[0].Consecutive)
+	assert.Equal(t, corrupted, failures[0].Reason)
+
+	_, err = pool.Acquire(ctx)
+	require.ErrorIs(t, err, testdbpool.ErrRecurringFailure)
+	assert.ErrorContains(t, err, "failed 2 times in a row")
+	assert.ErrorContains(t, err, "dropped column users.name")
+	// The slot is given back.
+	assert.Zero(t, pool.Stat().AcquiredCount)
+
+	pool.ResetFailures()
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, db.Pool().QueryRow(ctx, `SELECT count(name) FROM users`).Scan(&count))
+	require.NoError(t, db.Release(ctx))
+	assert.Empty(t, pool.Failures())
+}
+
+func TestIntegration_RuntimeParams(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "integration_runtime_params",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			// The parameters do not apply to the template setup.
+			var timeout string
+			if err := conn.QueryRow(ctx, `SHOW statement_timeout`).Scan(&timeout); err != nil {
+				return err
+			}
+			if timeout == "50ms" {
+				return errors.New("statement_timeout applied to the template setup")
+			}
+			return nil
+		},
+		RuntimeParams: map[string]string{
+			"statement_timeout": "50ms",
+			"application_name":  "billing tests & more",
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	settings := func(t *testing.T, conn interface {
+		QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	}) (string, string) {
+		var timeout, appName string
+		require.NoError(t, conn.QueryRow(ctx,
+			`SELECT current_setting('statement_timeout'), current_setting('application_name')`,
+		).Scan(&timeout, &appName))
+		return timeout, appName
+	}
+
+	t.Run("without label", func(t *testing.T) {
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Release(ctx)) }()
+
+		timeout, appName := settings(t, db.Pool())
+		assert.Equal(t, "50ms", timeout)
+		assert.Equal(t, "billing tests & more", appName)
+		_, err = db.Pool().Exec(ctx, `SELECT pg_sleep(1)`)
+		assert.ErrorContains(t, err, "canceling statement due to statement timeout")
+
+		// The connection string carries the parameters, escaped.
+		conn, err := pgx.Connect(ctx, db.ConnString())
+		require.NoError(t, err)
+		defer conn.Close(ctx)
+		timeout, appName = settings(t, conn)
+		assert.Equal(t, "50ms", timeout)
+		assert.Equal(t, "billing tests & more", appName)
+	})
+
+	t.Run("with label", func(t *testing.T) {
+		db := pool.AcquireT(t)
+		timeout, appName := settings(t, db.Pool())
+		assert.Equal(t, "50ms", timeout)
+		// The label is appended to the application_name.
+		assert.True(t, strings.HasPrefix(appName, "billing_tests___more/integration_runtime_params/0/TestIntegration_"), appName)
+	})
+}
@@ -0,0 +1,65 @@
+// Package clock provides an abstraction of time so that time-dependent
+// behaviors can be tested deterministically with a fake clock.
+//
+// A Clock is only for durations and timers within one process. Clocks of the
+// hosts running tests may be skewed against the PostgreSQL server and against
+// each other, so timestamps that are persisted or compared across processes,
+// such as the creation time of a template database, are always taken from the
+// server's now(), and compared in SQL or against a now() fetched in the same
+// operation, never against a Clock.
+package clock
+
+import "time"
+
+// Clock tells the time and creates timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a Timer that sends the current time on its channel
+	// after at least duration d.
+	NewTimer(d time.Duration) Timer
+
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is a single event timer created by a Clock.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+
+	// Stop prevents the Timer from firing. It returns false if the timer has
+	// already expired or been stopped.
+	Stop() bool
+}
+
+// Real is the Clock backed by the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
@@ -0,0 +1,35 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+
+	timer := fake.NewTimer(time.Second)
+	stopped := fake.NewTimer(time.Second)
+	after := fake.After(2 * time.Second)
+	fake.WaitForTimers(3)
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	fake.Advance(time.Second - time.Nanosecond)
+	assert.Empty(t, timer.C())
+
+	fake.Advance(time.Nanosecond)
+	assert.Equal(t, start.Add(time.Second), <-timer.C())
+	assert.Empty(t, stopped.C())
+	assert.Empty(t, after)
+	assert.False(t, timer.Stop(), "fired timers cannot be stopped")
+
+	fake.Advance(time.Second)
+	assert.Equal(t, start.Add(2*time.Second), <-after)
+	assert.Equal(t, start.Add(2*time.Second), fake.Now())
+
+	assert.Equal(t, fake.Now(), <-fake.After(0), "non-positive durations fire immediately")
+}
@@ -1,6 +1,12 @@
 package pgconst
 
-import "regexp"
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
 
 const (
 	// MaxDatabaseNameLength is the maximum length of a database name in PostgreSQL.
@@ -8,6 +14,28 @@ const (
 
 	// MaxIdentifierLength is the maximum length of a PostgreSQL identifier.
 	MaxIdentifierLength = 63
+
+	// SQLStateInvalidCatalogName is the SQLSTATE returned when a database does not exist.
+	SQLStateInvalidCatalogName = "3D000"
+
+	// SQLStateUndefinedTable is the SQLSTATE returned when a table does not exist.
+	SQLStateUndefinedTable = "42P01"
+
+	// SQLStateInsufficientPrivilege is the SQLSTATE returned when the user
+	// lacks a privilege required by the statement.
+	SQLStateInsufficientPrivilege = "42501"
+
+	// SQLStateActiveSQLTransaction is the SQLSTATE returned when a statement
+	// that cannot run inside a transaction block is run inside one.
+	SQLStateActiveSQLTransaction = "25001"
+
+	// SQLStateObjectNotInPrerequisiteState is the SQLSTATE returned, among
+	// others, when connecting to a database that does not allow connections.
+	SQLStateObjectNotInPrerequisiteState = "55000"
+
+	// SQLStateObjectInUse is the SQLSTATE returned when a database cannot be
+	// dropped, or cloned, because other sessions are connected to it.
+	SQLStateObjectInUse = "55006"
 )
 
 var (
@@ -25,3 +53,17 @@ func IsValidPostgreSQLIdentifier(identifier string) bool {
 	}
 	return postgresIdentifierRegex.MatchString(identifier)
 }
+
+// QuoteLiteral quotes s as a PostgreSQL string literal.
+// It is meant for statements such as COMMENT ON that do not accept bind parameters.
+func QuoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// IsObjectInUse reports whether err is the error of dropping or cloning a
+// database that other sessions are connected to ("database is being accessed
+// by other users").
+func IsObjectInUse(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == SQLStateObjectInUse
+}
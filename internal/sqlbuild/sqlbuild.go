@@ -0,0 +1,219 @@
+// Package sqlbuild builds the SQL statements that take identifiers, such as
+// database and role names, which cannot be passed as bind parameters.
+// Every identifier is validated and quoted exactly once here, so callers pass
+// raw names and never format SQL themselves.
+package sqlbuild
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yuku/testdbpool/internal/pgconst"
+)
+
+// Ident validates and quotes an identifier that may consist of several parts,
+// e.g. a schema-qualified table name. Each part must be non-empty, must not
+// contain NUL bytes and must not exceed the maximum identifier length.
+func Ident(parts ...string) (string, error) {
+	if len(parts) == 0 {
+		return "", fmt.Errorf("empty identifier")
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", fmt.Errorf("empty identifier")
+		}
+		if strings.ContainsRune(part, 0) {
+			return "", fmt.Errorf("identifier contains NUL byte: %q", part)
+		}
+		if len(part) > pgconst.MaxIdentifierLength {
+			return "", fmt.Errorf("identifier exceeds maximum length of %d bytes: %q", pgconst.MaxIdentifierLength, part)
+		}
+	}
+	return pgx.Identifier(parts).Sanitize(), nil
+}
+
+// Table validates and quotes a table name given by the user, which may be
+// schema-qualified, e.g. "public.users". Unlike with Ident, each part must
+// be a valid unquoted PostgreSQL identifier.
+func Table(name string) (string, error) {
+	parts := strings.Split(name, ".")
+	if len(parts) > 2 {
+		return "", fmt.Errorf("invalid table name: %s", name)
+	}
+	for _, part := range parts {
+		if !pgconst.IsValidPostgreSQLIdentifier(part) {
+			return "", fmt.Errorf("invalid table name: %s", name)
+		}
+	}
+	return Ident(parts...)
+}
+
+// Column validates and quotes a column name given by the user, which must be
+// a valid unquoted PostgreSQL identifier.
+func Column(name string) (string, error) {
+	if !pgconst.IsValidPostgreSQLIdentifier(name) {
+		return "", fmt.Errorf("invalid column name: %s", name)
+	}
+	return Ident(name)
+}
+
+// CreateDatabaseOptions are the options of CreateDatabase.
+type CreateDatabaseOptions struct {
+	// Owner is the owner of the database. If empty, the current user owns it.
+	Owner string
+
+	// Template is the database to copy. If empty, the server default is used.
+	Template string
+
+	// IsTemplate marks the database as a template.
+	IsTemplate bool
+
+	// Strategy is the strategy used to copy the template, "WAL_LOG" or
+	// "FILE_COPY" (PostgreSQL 15 or later). If empty, the server default is
+	// used.
+	Strategy string
+
+	// Encoding, Collate and CType are the character set encoding, LC_COLLATE
+	// and LC_CTYPE of the database. If empty, they are copied from the
+	// template.
+	Encoding string
+	Collate  string
+	CType    string
+}
+
+// CreateDatabase returns a CREATE DATABASE statement.
+func CreateDatabase(name string, opts CreateDatabaseOptions) (string, error) {
+	ident, err := Ident(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid database name: %w", err)
+	}
+
+	var b strings.Builder
+	b.WriteString("CREATE DATABASE ")
+	b.WriteString(ident)
+	if opts.Owner != "" {
+		owner, err := Ident(opts.Owner)
+		if err != nil {
+			return "", fmt.Errorf("invalid owner: %w", err)
+		}
+		b.WriteString(" OWNER ")
+		b.WriteString(owner)
+	}
+	if opts.Template != "" {
+		template, err := Ident(opts.Template)
+		if err != nil {
+			return "", fmt.Errorf("invalid template: %w", err)
+		}
+		b.WriteString(" TEMPLATE ")
+		b.WriteString(template)
+	}
+	for _, opt := range []struct{ keyword, value string }{
+		{"ENCODING", opts.Encoding},
+		{"LC_COLLATE", opts.Collate},
+		{"LC_CTYPE", opts.CType},
+	} {
+		if opt.value != "" {
+			b.WriteString(" " + opt.keyword + " " + pgconst.QuoteLiteral(opt.value))
+		}
+	}
+	switch opts.Strategy {
+	case "":
+	case "WAL_LOG", "FILE_COPY":
+		b.WriteString(" STRATEGY " + opts.Strategy)
+	default:
+		return "", fmt.Errorf("invalid strategy: %s", opts.Strategy)
+	}
+	if opts.IsTemplate {
+		b.WriteString(" IS_TEMPLATE true")
+	}
+	return b.String(), nil
+}
+
+// DropDatabase returns a DROP DATABASE IF EXISTS statement. With force, other
+// sessions connected to the database are terminated (PostgreSQL 13 or later).
+func DropDatabase(name string, force bool) (string, error) {
+	ident, err := Ident(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid database name: %w", err)
+	}
+	if force {
+		return "DROP DATABASE IF EXISTS " + ident + " WITH (FORCE)", nil
+	}
+	return "DROP DATABASE IF EXISTS " + ident, nil
+}
+
+// AlterIsTemplate returns a statement that marks the database as a template
+// or not. A template database must be unmarked before it can be dropped.
+func AlterIsTemplate(name string, isTemplate bool) (string, error) {
+	ident, err := Ident(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid database name: %w", err)
+	}
+	return fmt.Sprintf("ALTER DATABASE %s IS_TEMPLATE %t", ident, isTemplate), nil
+}
+
+// AlterAllowConnections returns a statement that allows or disallows
+// connections to the database.
+func AlterAllowConnections(name string, allow bool) (string, error) {
+	ident, err := Ident(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid database name: %w", err)
+	}
+	return fmt.Sprintf("ALTER DATABASE %s ALLOW_CONNECTIONS %t", ident, allow), nil
+}
+
+// AlterOwner returns a statement that changes the owner of the database.
+func AlterOwner(name, owner string) (string, error) {
+	ident, err := Ident(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid database name: %w", err)
+	}
+	ownerIdent, err := Ident(owner)
+	if err != nil {
+		return "", fmt.Errorf("invalid owner: %w", err)
+	}
+	return "ALTER DATABASE " + ident + " OWNER TO " + ownerIdent, nil
+}
+
+// CommentOnDatabase returns a statement that sets the comment of the database.
+func CommentOnDatabase(name, comment string) (string, error) {
+	ident, err := Ident(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid database name: %w", err)
+	}
+	return "COMMENT ON DATABASE " + ident + " IS " + pgconst.QuoteLiteral(comment), nil
+}
+
+// CreateRoleIfNotExists returns a statement that creates the role with the
+// given CREATE ROLE options unless it exists. options are used verbatim.
+func CreateRoleIfNotExists(name, options string) (string, error) {
+	ident, err := Ident(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid role name: %w", err)
+	}
+	// CREATE ROLE has no IF NOT EXISTS; ignore the error of an existing role,
+	// which also covers a concurrent creation by another process. The body is
+	// quoted with a dollar tag that neither the name nor options contain, so
+	// that e.g. a password with $$ in it does not end the body early.
+	body := fmt.Sprintf(`BEGIN
+	CREATE ROLE %s %s;
+EXCEPTION WHEN duplicate_object THEN
+	NULL;
+END`, ident, options)
+	tag := "$role$"
+	for i := 1; strings.Contains(body, tag); i++ {
+		tag = fmt.Sprintf("$role%d$", i)
+	}
+	return "DO " + tag + "\n" + body + "\n" + tag, nil
+}
+
+// CreateExtensionIfNotExists returns a CREATE EXTENSION IF NOT EXISTS
+// statement.
+func CreateExtensionIfNotExists(name string) (string, error) {
+	ident, err := Ident(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid extension name: %w", err)
+	}
+	return "CREATE EXTENSION IF NOT EXISTS " + ident, nil
+}
@@ -0,0 +1,235 @@
+package sqlbuild
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var hostileNames = []string{
+	`plain`,
+	`with space`,
+	`"quoted"`,
+	`a"; DROP DATABASE postgres; --`,
+	`semi;colon`,
+	`back\slash`,
+	`it's`,
+	`$$dollar$$`,
+	`ユニコード`,
+	`emoji🐘`,
+	strings.Repeat("a", 63),
+}
+
+func TestIdent(t *testing.T) {
+	for _, name := range hostileNames {
+		t.Run(name, func(t *testing.T) {
+			got, err := Ident(name)
+			require.NoError(t, err)
+			assert.Equal(t, `"`+strings.ReplaceAll(name, `"`, `""`)+`"`, got)
+			assert.Equal(t, name, unquote(t, got))
+		})
+	}
+
+	t.Run("qualified", func(t *testing.T) {
+		got, err := Ident("my schema", `ta"ble`)
+		require.NoError(t, err)
+		assert.Equal(t, `"my schema"."ta""ble"`, got)
+	})
+
+	for _, tt := range []struct {
+		name  string
+		parts []string
+	}{
+		{"no parts", nil},
+		{"empty", []string{""}},
+		{"empty part", []string{"public", ""}},
+		{"too long", []string{strings.Repeat("a", 64)}},
+		{"too long multibyte", []string{strings.Repeat("あ", 22)}},
+		{"NUL byte", []string{"a\x00b"}},
+	} {
+		t.Run("rejects "+tt.name, func(t *testing.T) {
+			_, err := Ident(tt.parts...)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		table   string
+		want    string
+		wantErr bool
+	}{
+		{"simple table", "users", `"users"`, false},
+		{"schema-qualified table", "public.users", `"public"."users"`, false},
+		{"empty string", "", "", true},
+		{"empty schema", ".users", "", true},
+		{"too many parts", "db.public.users", "", true},
+		{"injection attempt", "users; DROP TABLE users", "", true},
+		{"quoted", `"users"`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Table(tt.table)
+			if tt.wantErr {
+				assert.EqualError(t, err, "invalid table name: "+tt.table)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestColumn(t *testing.T) {
+	got, err := Column("email")
+	require.NoError(t, err)
+	assert.Equal(t, `"email"`, got)
+
+	for _, name := range []string{"", "users.email", "email = 'x'"} {
+		_, err := Column(name)
+		assert.EqualError(t, err, "invalid column name: "+name)
+	}
+}
+
+func FuzzIdent(f *testing.F) {
+	for _, name := range hostileNames {
+		f.Add(name)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		got, err := Ident(name)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, name, unquote(t, got))
+	})
+}
+
+func TestCreateDatabase(t *testing.T) {
+	tests := []struct {
+		name string
+		opts CreateDatabaseOptions
+		want string
+	}{
+		{
+			name: "db",
+			want: `CREATE DATABASE "db"`,
+		},
+		{
+			name: `d"b`,
+			opts: CreateDatabaseOptions{Owner: `o"wner`, Template: `tmpl; --`, IsTemplate: true},
+			want: `CREATE DATABASE "d""b" OWNER "o""wner" TEMPLATE "tmpl; --" IS_TEMPLATE true`,
+		},
+		{
+			name: "db",
+			opts: CreateDatabaseOptions{Template: "template0"},
+			want: `CREATE DATABASE "db" TEMPLATE "template0"`,
+		},
+		{
+			name: "db",
+			opts: CreateDatabaseOptions{Template: "template0", Encoding: "UTF8", Collate: "C", CType: "it's", IsTemplate: true},
+			want: `CREATE DATABASE "db" TEMPLATE "template0" ENCODING 'UTF8' LC_COLLATE 'C' LC_CTYPE 'it''s' IS_TEMPLATE true`,
+		},
+		{
+			name: "db",
+			opts: CreateDatabaseOptions{Template: "tmpl", Strategy: "FILE_COPY"},
+			want: `CREATE DATABASE "db" TEMPLATE "tmpl" STRATEGY FILE_COPY`,
+		},
+	}
+	for _, tt := range tests {
+		got, err := CreateDatabase(tt.name, tt.opts)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+
+	_, err := CreateDatabase("", CreateDatabaseOptions{})
+	assert.ErrorContains(t, err, "invalid database name")
+	_, err = CreateDatabase("db", CreateDatabaseOptions{Owner: strings.Repeat("o", 64)})
+	assert.ErrorContains(t, err, "invalid owner")
+	_, err = CreateDatabase("db", CreateDatabaseOptions{Template: "t\x00"})
+	assert.ErrorContains(t, err, "invalid template")
+	_, err = CreateDatabase("db", CreateDatabaseOptions{Strategy: "COPY; --"})
+	assert.ErrorContains(t, err, "invalid strategy")
+}
+
+func TestDropDatabase(t *testing.T) {
+	got, err := DropDatabase(`d"b`, false)
+	require.NoError(t, err)
+	assert.Equal(t, `DROP DATABASE IF EXISTS "d""b"`, got)
+
+	got, err = DropDatabase("db", true)
+	require.NoError(t, err)
+	assert.Equal(t, `DROP DATABASE IF EXISTS "db" WITH (FORCE)`, got)
+
+	_, err = DropDatabase("", false)
+	assert.Error(t, err)
+}
+
+func TestAlterDatabase(t *testing.T) {
+	got, err := AlterIsTemplate(`d"b`, false)
+	require.NoError(t, err)
+	assert.Equal(t, `ALTER DATABASE "d""b" IS_TEMPLATE false`, got)
+
+	got, err = AlterAllowConnections(`d"b`, true)
+	require.NoError(t, err)
+	assert.Equal(t, `ALTER DATABASE "d""b" ALLOW_CONNECTIONS true`, got)
+
+	got, err = AlterOwner("db", `ow"ner`)
+	require.NoError(t, err)
+	assert.Equal(t, `ALTER DATABASE "db" OWNER TO "ow""ner"`, got)
+
+	_, err = AlterOwner("db", "")
+	assert.ErrorContains(t, err, "invalid owner")
+}
+
+func TestCommentOnDatabase(t *testing.T) {
+	got, err := CommentOnDatabase(`d"b`, `{"key":"it's"}`)
+	require.NoError(t, err)
+	assert.Equal(t, `COMMENT ON DATABASE "d""b" IS '{"key":"it''s"}'`, got)
+}
+
+func TestCreateRoleIfNotExists(t *testing.T) {
+	got, err := CreateRoleIfNotExists(`ro"le`, "NOLOGIN")
+	require.NoError(t, err)
+	assert.Contains(t, got, `CREATE ROLE "ro""le" NOLOGIN;`)
+
+	_, err = CreateRoleIfNotExists(strings.Repeat("r", 64), "")
+	assert.ErrorContains(t, err, "invalid role name")
+
+	t.Run("options containing the dollar tag", func(t *testing.T) {
+		got, err := CreateRoleIfNotExists("app", "LOGIN PASSWORD '$$x$role$y'")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(got, "DO $role1$\n"), got)
+		assert.True(t, strings.HasSuffix(got, "\n$role1$"), got)
+		assert.Contains(t, got, `CREATE ROLE "app" LOGIN PASSWORD '$$x$role$y';`)
+	})
+}
+
+func TestCreateExtensionIfNotExists(t *testing.T) {
+	got, err := CreateExtensionIfNotExists("uuid-ossp")
+	require.NoError(t, err)
+	assert.Equal(t, `CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`, got)
+
+	for _, name := range hostileNames {
+		got, err := CreateExtensionIfNotExists(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, unquote(t, strings.TrimPrefix(got, "CREATE EXTENSION IF NOT EXISTS ")))
+	}
+
+	_, err = CreateExtensionIfNotExists("")
+	assert.ErrorContains(t, err, "invalid extension name")
+}
+
+// unquote reverses the quoting of a single identifier, failing if the
+// identifier is not quoted as exactly one token.
+func unquote(t *testing.T, ident string) string {
+	t.Helper()
+	require.True(t, len(ident) >= 2 && ident[0] == '"' && ident[len(ident)-1] == '"', "not quoted: %s", ident)
+	inner := ident[1 : len(ident)-1]
+	require.NotContains(t, strings.ReplaceAll(inner, `""`, ""), `"`, "unescaped quote: %s", ident)
+	return strings.ReplaceAll(inner, `""`, `"`)
+}
@@ -0,0 +1,169 @@
+// Package sqlsplit splits SQL scripts into their statements.
+package sqlsplit
+
+import "strings"
+
+// Statement is a statement of a SQL script.
+type Statement struct {
+	// SQL is the text of the statement without the terminating semicolon
+	// and surrounding whitespace.
+	SQL string
+
+	// Line is the 1-based line of the script on which the statement starts.
+	Line int
+}
+
+// Split splits the SQL script sql at the semicolons that terminate its
+// statements. Semicolons inside string literals, quoted identifiers,
+// comments and dollar-quoted strings such as PL/pgSQL function bodies do not
+// terminate a statement. Statements that consist of whitespace and comments
+// only are left out.
+func Split(sql string) []Statement {
+	var stmts []Statement
+	start, line, startLine := 0, 1, 0
+	// content is whether the current statement has anything but whitespace
+	// and comments.
+	content := false
+
+	flush := func(end int) {
+		if content {
+			stmts = append(stmts, Statement{SQL: strings.TrimSpace(sql[start:end]), Line: startLine})
+		}
+		content = false
+	}
+	// skip advances i over sql[i:end], counting lines.
+	skip := func(i, end int) int {
+		line += strings.Count(sql[i:end], "\n")
+		return end
+	}
+	begin := func() {
+		if !content {
+			content = true
+			startLine = line
+		}
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f':
+			i++
+
+		case c == ';':
+			flush(i)
+			i++
+			start = i
+
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			i += end
+
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skip(i, blockCommentEnd(sql, i))
+
+		case c == '\'':
+			begin()
+			escapes := i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') && (i < 2 || !isIdentChar(sql[i-2]))
+			i = skip(i, quotedEnd(sql, i, '\'', escapes))
+
+		case c == '"':
+			begin()
+			i = skip(i, quotedEnd(sql, i, '"', false))
+
+		case c == '$' && (i == 0 || !isIdentChar(sql[i-1])):
+			begin()
+			if tag, ok := dollarTag(sql[i:]); ok {
+				end := strings.Index(sql[i+len(tag):], tag)
+				if end < 0 {
+					i = skip(i, len(sql))
+				} else {
+					i = skip(i, i+len(tag)+end+len(tag))
+				}
+			} else {
+				i++
+			}
+
+		default:
+			begin()
+			i++
+		}
+	}
+	flush(len(sql))
+	return stmts
+}
+
+// blockCommentEnd returns the index just after the possibly nested block
+// comment starting at sql[i], or len(sql) if it is not terminated.
+func blockCommentEnd(sql string, i int) int {
+	depth := 0
+	for i < len(sql) {
+		switch {
+		case strings.HasPrefix(sql[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(sql[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return len(sql)
+}
+
+// quotedEnd returns the index just after the string or identifier quoted
+// with quote starting at sql[i], or len(sql) if it is not terminated. A
+// doubled quote stands for the quote itself, and so does a quote escaped
+// with a backslash if escapes is set.
+func quotedEnd(sql string, i int, quote byte, escapes bool) int {
+	for i++; i < len(sql); i++ {
+		switch sql[i] {
+		case '\\':
+			if escapes {
+				i++
+			}
+		case quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+// dollarTag returns the tag, such as "$$" or "$body$", of the dollar-quoted
+// string that s starts with, if any.
+func dollarTag(s string) (string, bool) {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '$':
+			return s[:i+1], true
+		case c >= '0' && c <= '9':
+			if i == 1 {
+				// A positional parameter such as $1.
+				return "", false
+			}
+		case !isIdentChar(c):
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// isIdentChar reports whether c can be part of an unquoted identifier.
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
@@ -0,0 +1,71 @@
+package sqlsplit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []Statement
+	}{
+		{
+			name: "statements",
+			sql:  "CREATE TABLE a (id INT);\n\nINSERT INTO a VALUES (1);\nSELECT 1",
+			want: []Statement{
+				{SQL: "CREATE TABLE a (id INT)", Line: 1},
+				{SQL: "INSERT INTO a VALUES (1)", Line: 3},
+				{SQL: "SELECT 1", Line: 4},
+			},
+		},
+		{
+			name: "comments and empty statements",
+			sql:  "-- header; not a statement\n/* block; /* nested; */ still comment; */\n;;\nSELECT 1; -- trailing;\n",
+			want: []Statement{
+				{SQL: "SELECT 1", Line: 4},
+			},
+		},
+		{
+			name: "quoted",
+			sql:  "INSERT INTO \"a;b\" VALUES ('x;''y', E'\\';', e'\\\\');\nSELECT 2",
+			want: []Statement{
+				{SQL: "INSERT INTO \"a;b\" VALUES ('x;''y', E'\\';', e'\\\\')", Line: 1},
+				{SQL: "SELECT 2", Line: 2},
+			},
+		},
+		{
+			name: "function bodies",
+			sql: "CREATE FUNCTION f() RETURNS INT AS $$\nBEGIN\n  RETURN 1;\nEND;\n$$ LANGUAGE plpgsql;\n" +
+				"CREATE FUNCTION g() RETURNS TEXT AS $body$ SELECT '$$;' $body$ LANGUAGE sql;\n" +
+				"PREPARE p AS SELECT $1::int; SELECT a$b FROM t",
+			want: []Statement{
+				{SQL: "CREATE FUNCTION f() RETURNS INT AS $$\nBEGIN\n  RETURN 1;\nEND;\n$$ LANGUAGE plpgsql", Line: 1},
+				{SQL: "CREATE FUNCTION g() RETURNS TEXT AS $body$ SELECT '$$;' $body$ LANGUAGE sql", Line: 6},
+				{SQL: "PREPARE p AS SELECT $1::int", Line: 7},
+				{SQL: "SELECT a$b FROM t", Line: 7},
+			},
+		},
+		{
+			name: "unterminated",
+			sql:  "SELECT 1; SELECT 'abc;",
+			want: []Statement{
+				{SQL: "SELECT 1", Line: 1},
+				{SQL: "SELECT 'abc;", Line: 1},
+			},
+		},
+		{
+			name: "empty",
+			sql:  " \n-- nothing\n",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Split(tt.sql))
+		})
+	}
+}
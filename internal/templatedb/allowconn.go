@@ -0,0 +1,58 @@
+package templatedb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yuku/testdbpool/internal/pgconst"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// isNotAcceptingConnections reports whether err is the server refusing a
+// connection because datallowconn of the database is false.
+func isNotAcceptingConnections(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) &&
+		pgErr.Code == pgconst.SQLStateObjectNotInPrerequisiteState &&
+		strings.Contains(pgErr.Message, "not currently accepting connections")
+}
+
+// allowConnections calls connect, which connects to the database name that
+// has just been created. Some servers are set up so that new databases do
+// not accept connections until allowed explicitly. If connect fails because
+// of that, connections are allowed and connect is called again, unless
+// Config.KeepDisallowedConnections is set. If the database still refuses
+// connections, the returned error explains why and how to fix it. The caller
+// drops the unusable database.
+func (t *TemplateDB) allowConnections(ctx context.Context, name string, connect func() error) error {
+	err := connect()
+	if !isNotAcceptingConnections(err) {
+		return err
+	}
+
+	query, qerr := sqlbuild.AlterAllowConnections(name, true)
+	if qerr != nil {
+		return qerr
+	}
+	hint := "allowing them is disabled by configuration"
+	if !t.cfg.KeepDisallowedConnections {
+		if _, aerr := t.cfg.ConnPool.Exec(ctx, query); aerr != nil {
+			hint = fmt.Sprintf("allowing them failed: %v", aerr)
+		} else {
+			err = connect()
+			if !isNotAcceptingConnections(err) {
+				return err
+			}
+			hint = "they are disallowed again after allowing them"
+		}
+	}
+	return fmt.Errorf(
+		"database %s does not accept connections (datallowconn is false), "+
+			"likely because of a server policy for new databases, and %s; "+
+			"run %s as its owner or a superuser, or exempt test databases from the policy: %w",
+		name, hint, query, err,
+	)
+}
@@ -0,0 +1,52 @@
+package templatedb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsNotAcceptingConnections(t *testing.T) {
+	refused := &pgconn.PgError{
+		Code:    "55000",
+		Message: `database "testdbpooltmpl_app" is not currently accepting connections`,
+	}
+	assert.True(t, isNotAcceptingConnections(fmt.Errorf("failed to connect: %w", refused)))
+	assert.False(t, isNotAcceptingConnections(&pgconn.PgError{Code: "55000", Message: "other"}))
+	assert.False(t, isNotAcceptingConnections(&pgconn.PgError{Code: "3D000", Message: "does not exist"}))
+	assert.False(t, isNotAcceptingConnections(nil))
+}
+
+func TestAllowConnections_Kept(t *testing.T) {
+	connPool, err := pgxpool.New(context.Background(), "postgres://postgres@127.0.0.1:5432/postgres")
+	require.NoError(t, err)
+	t.Cleanup(connPool.Close)
+	tdb, err := New(&Config{PoolID: "app", ConnPool: connPool, KeepDisallowedConnections: true})
+	require.NoError(t, err)
+
+	refused := &pgconn.PgError{
+		Code:    "55000",
+		Message: `database "testdbpooltmpl_app" is not currently accepting connections`,
+	}
+	calls := 0
+	err = tdb.allowConnections(context.Background(), tdb.Name(), func() error {
+		calls++
+		return refused
+	})
+	require.ErrorIs(t, err, refused)
+	assert.Equal(t, 1, calls)
+	assert.Contains(t, err.Error(), "datallowconn is false")
+	assert.Contains(t, err.Error(), "allowing them is disabled by configuration")
+	assert.Contains(t, err.Error(), `run ALTER DATABASE "testdbpooltmpl_app" ALLOW_CONNECTIONS true as its owner`)
+
+	// Other errors are returned as they are.
+	err = tdb.allowConnections(context.Background(), tdb.Name(), func() error {
+		return context.Canceled
+	})
+	assert.Equal(t, context.Canceled, err)
+}
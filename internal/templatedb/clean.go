@@ -0,0 +1,169 @@
+package templatedb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// cleanMarkerPrefix prefixes the comment of a test database that has been
+// reset and can be reused by Create. The rest of the comment is the
+// generation of the template database it was cloned from.
+const cleanMarkerPrefix = "testdbpool:clean:"
+
+// releasedMarkerPrefix prefixes the comment of a test database that has been
+// released without a reset, and can be reused by Create only after
+// Config.VerifyReleased accepts it. The rest of the comment is the generation
+// of the template database it was cloned from.
+const releasedMarkerPrefix = "testdbpool:released:"
+
+// MarkClean marks the database name, cloned from the template database of the
+// given generation, as reset, so that the next Create with the same name
+// reuses it instead of recreating it from the template.
+func MarkClean(ctx context.Context, pool *pgxpool.Pool, name, generation string) error {
+	query, err := sqlbuild.CommentOnDatabase(name, cleanMarkerPrefix+generation)
+	if err != nil {
+		return err
+	}
+	if _, err := pool.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to mark database %s as clean: %w", name, err)
+	}
+	return nil
+}
+
+// MarkReleased marks the database name, cloned from the template database of
+// the given generation, as released without a reset, so that the next Create
+// with the same name reuses it if Config.VerifyReleased accepts it.
+func MarkReleased(ctx context.Context, pool *pgxpool.Pool, name, generation string) error {
+	query, err := sqlbuild.CommentOnDatabase(name, releasedMarkerPrefix+generation)
+	if err != nil {
+		return err
+	}
+	if _, err := pool.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to mark database %s as released: %w", name, err)
+	}
+	return nil
+}
+
+// dropStaleClones drops the test databases of the pool that were marked clean
+// or released after being cloned from a generation of the template database
+// other than generation. Other test databases may be in use and are left to Create,
+// which recreates them when it finds them. Connections to the stale ones,
+// e.g. of pools retained across acquisitions, are terminated.
+func (t *TemplateDB) dropStaleClones(ctx context.Context, tx pgx.Tx, generation string) error {
+	prefix := TestDatabasePrefix(t.cfg.NamePrefix, t.cfg.PoolID)
+	rows, err := tx.Query(ctx, `
+		SELECT datname FROM pg_database
+		WHERE left(datname, length($1)) = $1
+			AND substr(datname, length($1) + 1) ~ '^[0-9]+$'
+			AND (starts_with(coalesce(shobj_description(oid, 'pg_database'), ''), $2)
+				OR starts_with(coalesce(shobj_description(oid, 'pg_database'), ''), $3))
+			AND shobj_description(oid, 'pg_database') NOT IN ($2 || $4, $3 || $4)`,
+		prefix, cleanMarkerPrefix, releasedMarkerPrefix, generation,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to list stale test databases: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to list stale test databases: %w", err)
+	}
+
+	for _, name := range names {
+		if err := t.terminateConnections(ctx, name); err != nil {
+			return err
+		}
+		query, err := sqlbuild.DropDatabase(name, false)
+		if err != nil {
+			return err
+		}
+		if _, err := t.cfg.ConnPool.Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to drop stale test database %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// reuseIfClean reports whether the existing database name can be reused,
+// i.e. whether it was marked clean, or marked released if
+// Config.VerifyReleased is set, after being cloned from the current
+// generation of the template database. verify reports that it was marked
+// released, so that it must be verified before it is reused. The mark is
+// removed from a reused database so that it is recreated if it is not
+// marked again.
+func (t *TemplateDB) reuseIfClean(ctx context.Context, tx pgx.Tx, name string) (reused, verify bool, err error) {
+	var comment *string
+	err = tx.
+		QueryRow(ctx, `SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1`, name).
+		Scan(&comment)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to read comment of database %s: %w", name, err)
+	}
+	if comment == nil {
+		return false, false, nil
+	}
+	var generation string
+	switch {
+	case strings.HasPrefix(*comment, cleanMarkerPrefix):
+		generation = strings.TrimPrefix(*comment, cleanMarkerPrefix)
+	case strings.HasPrefix(*comment, releasedMarkerPrefix) && t.cfg.VerifyReleased != nil:
+		generation = strings.TrimPrefix(*comment, releasedMarkerPrefix)
+		verify = true
+	default:
+		return false, false, nil
+	}
+
+	t.mu.Lock()
+	current := t.generation
+	t.mu.Unlock()
+	if generation != current {
+		return false, false, nil
+	}
+
+	// An empty comment removes the comment.
+	query, err := sqlbuild.CommentOnDatabase(name, "")
+	if err != nil {
+		return false, false, err
+	}
+	if _, err := tx.Exec(ctx, query); err != nil {
+		return false, false, fmt.Errorf("failed to unmark database %s: %w", name, err)
+	}
+	return true, verify, nil
+}
+
+// verifyReleased connects to the database name, which Create reuses after it
+// was marked released, and returns the pool if Config.VerifyReleased accepts
+// the database. Otherwise the database is dropped and created again. It
+// reports whether the database was reused, like CreateReusing.
+func (t *TemplateDB) verifyReleased(ctx context.Context, name, appName string) (*pgxpool.Pool, bool, error) {
+	pool, err := t.connectPool(ctx, name, appName)
+	if err != nil {
+		return nil, false, err
+	}
+	_, values := t.Current()
+	err = t.cfg.VerifyReleased(ctx, pool, values)
+	if err == nil {
+		return pool, true, nil
+	}
+	pool.Close()
+	t.logger().Warn("released test database failed verification; recreating it",
+		append(t.databaseAttrs(name), "error", err)...)
+
+	// The mark has been removed, so Create recreates the database.
+	if err := t.terminateConnections(ctx, name); err != nil {
+		return nil, false, err
+	}
+	query, err := sqlbuild.DropDatabase(name, false)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := t.cfg.ConnPool.Exec(ctx, query); err != nil {
+		return nil, false, fmt.Errorf("failed to drop released database: %w", err)
+	}
+	pool, err = t.Create(ctx, name, appName)
+	return pool, false, err
+}
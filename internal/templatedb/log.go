@@ -0,0 +1,32 @@
+package templatedb
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// discardLogger is the logger used when Config.Logger is nil.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.Level(math.MaxInt)}))
+
+// logger returns Config.Logger, or a logger that discards everything if it
+// is nil.
+func (t *TemplateDB) logger() *slog.Logger {
+	if t.cfg.Logger == nil {
+		return discardLogger
+	}
+	return t.cfg.Logger
+}
+
+// databaseAttrs returns the log attributes of the database name: its name
+// and, if it is a test database of the pool, its index.
+func (t *TemplateDB) databaseAttrs(name string) []any {
+	attrs := []any{"database", name}
+	rest, ok := strings.CutPrefix(name, TestDatabasePrefix(t.cfg.NamePrefix, t.cfg.PoolID))
+	if index, err := strconv.Atoi(rest); ok && err == nil {
+		attrs = append(attrs, "index", index)
+	}
+	return attrs
+}
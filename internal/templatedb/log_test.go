@@ -0,0 +1,15 @@
+package templatedb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatabaseAttrs(t *testing.T) {
+	tdb := &TemplateDB{cfg: &Config{PoolID: "app", NamePrefix: "ci"}}
+
+	assert.Equal(t, []any{"database", "ci_app_3", "index", 3}, tdb.databaseAttrs("ci_app_3"))
+	assert.Equal(t, []any{"database", "ci_app_x"}, tdb.databaseAttrs("ci_app_x"))
+	assert.Equal(t, []any{"database", "other_3"}, tdb.databaseAttrs("other_3"))
+}
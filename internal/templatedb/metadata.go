@@ -0,0 +1,285 @@
+package templatedb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// MetadataVersion is the version of the format of the metadata that this
+// package records alongside the template database. It must be incremented
+// whenever the meaning of the metadata changes in a way that older data
+// would be misread, with a step added to metadataMigrations.
+//
+// Version 1 is the format before the version was recorded, in which the
+// generation may be missing. Version 2 records the version and always has a
+// generation.
+const MetadataVersion = 2
+
+// ErrMetadataTooNew is returned when the template database has been built by
+// a newer version of this package whose metadata this version cannot read.
+var ErrMetadataTooNew = errors.New("template database metadata is newer than supported")
+
+// metadataMigrations are the steps that bring metadata of an older version up
+// to date: metadataMigrations[i] migrates version i+1 to version i+2. A step
+// returns an error if the metadata cannot be migrated, in which case the
+// template database is rebuilt instead.
+var metadataMigrations = []func(*metadata) error{
+	// 1 -> 2: template databases built before generations were introduced
+	// get one, so that their clones can be told apart from later builds.
+	func(meta *metadata) error {
+		if meta.Generation != "" {
+			return nil
+		}
+		generation, err := newGeneration()
+		if err != nil {
+			return err
+		}
+		meta.Generation = generation
+		return nil
+	},
+}
+
+// metadata is the information recorded alongside the template database.
+// It is stored as JSON in the comment of the template database because
+// database comments are not copied to databases created from the template.
+// It is read and written only through readMetadata, writeMetadata and
+// MigrateMetadata, which take care of its version.
+type metadata struct {
+	// MetadataVersion is the version of the format of this metadata.
+	// It is missing, i.e. zero, in metadata of version 1.
+	MetadataVersion int `json:"metadata_version,omitempty"`
+
+	// CreatedAt is the time, according to the database server, at which
+	// the template database finished being set up.
+	CreatedAt time.Time `json:"created_at"`
+
+	// Values is the user-defined metadata set during the setup with
+	// SetValue.
+	Values map[string]string `json:"values,omitempty"`
+
+	// Generation is a random ID assigned when the template database is built,
+	// which tells apart the builds of the same template database.
+	Generation string `json:"generation,omitempty"`
+
+	// Version is Config.Version of the instance that built the template
+	// database.
+	Version string `json:"version,omitempty"`
+}
+
+// version returns the version of the format of meta.
+func (meta metadata) version() int {
+	return max(meta.MetadataVersion, 1)
+}
+
+// readMetadata reads the metadata recorded in the comment of the template
+// database. It returns zero metadata if nothing is recorded, and an error
+// wrapping ErrMetadataTooNew if it was recorded by a newer version of this
+// package.
+func (t *TemplateDB) readMetadata(ctx context.Context, q rowQuerier) (metadata, error) {
+	comment, err := t.readComment(ctx, q)
+	if err != nil {
+		return metadata{}, err
+	}
+
+	var meta metadata
+	if comment == nil {
+		return meta, nil
+	}
+	if err := json.Unmarshal([]byte(*comment), &meta); err != nil {
+		return metadata{}, fmt.Errorf("failed to decode template database metadata: %w", err)
+	}
+	if err := t.checkMetadataVersion(meta); err != nil {
+		return metadata{}, err
+	}
+	return meta, nil
+}
+
+// CreatedAt returns the time at which the template database with the given
+// comment finished being set up, or the zero time if the comment does not
+// record it.
+func CreatedAt(comment string) time.Time {
+	var meta metadata
+	if err := json.Unmarshal([]byte(comment), &meta); err != nil {
+		return time.Time{}
+	}
+	return meta.CreatedAt
+}
+
+// readComment reads the comment of the template database.
+func (t *TemplateDB) readComment(ctx context.Context, q rowQuerier) (*string, error) {
+	var comment *string
+	err := q.
+		QueryRow(ctx, `SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1`, t.name).
+		Scan(&comment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get template database metadata: %w", err)
+	}
+	return comment, nil
+}
+
+// checkMetadataVersion returns an error wrapping ErrMetadataTooNew if meta
+// was recorded by a newer version of this package.
+func (t *TemplateDB) checkMetadataVersion(meta metadata) error {
+	if meta.version() <= MetadataVersion {
+		return nil
+	}
+	return fmt.Errorf(
+		"%w: template database %s has metadata version %d, but this version of testdbpool supports up to %d; upgrade the library",
+		ErrMetadataTooNew, t.name, meta.version(), MetadataVersion,
+	)
+}
+
+// rowQuerier is the subset of pgx.Tx and pgxpool.Pool used to read metadata.
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// writeMetadata records the metadata of a template database that has just
+// been built with the given generation and values.
+func (t *TemplateDB) writeMetadata(ctx context.Context, tx pgx.Tx, generation string, values map[string]string) error {
+	meta := metadata{Values: values, Generation: generation, Version: t.cfg.Version}
+	// now() would be the start of tx, which may have waited for the lock and
+	// spanned the whole setup.
+	if err := tx.QueryRow(ctx, `SELECT clock_timestamp()`).Scan(&meta.CreatedAt); err != nil {
+		return fmt.Errorf("failed to get current time: %w", err)
+	}
+	return t.storeMetadata(ctx, meta)
+}
+
+// storeMetadata records meta in the current version.
+func (t *TemplateDB) storeMetadata(ctx context.Context, meta metadata) error {
+	meta.MetadataVersion = MetadataVersion
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	query, err := sqlbuild.CommentOnDatabase(t.name, string(b))
+	if err != nil {
+		return err
+	}
+	if _, err := t.cfg.ConnPool.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to comment on template database: %w", err)
+	}
+	return nil
+}
+
+// MigrateMetadata brings the metadata of an existing template database up to
+// MetadataVersion. Metadata of an older version is migrated in place, or, if
+// that is impossible, e.g. because none is recorded, the template database is
+// dropped so that the next Setup rebuilds it. Metadata of a newer version is
+// left alone and an error wrapping ErrMetadataTooNew is returned.
+// It returns a description of what it did, or an empty string if nothing had
+// to be done.
+func (t *TemplateDB) MigrateMetadata(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Most of the time there is nothing to do, which is checked without
+	// the advisory lock so as not to serialize every New on it.
+	if current, err := t.metadataCurrent(ctx, t.cfg.ConnPool); err != nil || current {
+		return "", err
+	}
+
+	var action string
+	err := pgx.BeginFunc(ctx, t.cfg.ConnPool, func(tx pgx.Tx) error {
+		// Get advisory lock to ensure that no other testdbpool instance is
+		// setting up or cloning the template database meanwhile, and check
+		// again under it, as another instance may have migrated the metadata.
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, lockID); err != nil {
+			return fmt.Errorf("failed to acquire advisory lock: %w", err)
+		}
+
+		if exists, err := checkIfExists(ctx, tx, t.name); err != nil {
+			return fmt.Errorf("failed to check if template database exists: %w", err)
+		} else if !exists {
+			return nil
+		}
+
+		comment, err := t.readComment(ctx, tx)
+		if err != nil {
+			return err
+		}
+		var meta metadata
+		reason := "no metadata is recorded"
+		if comment != nil {
+			reason = ""
+			if err := json.Unmarshal([]byte(*comment), &meta); err != nil {
+				reason = fmt.Sprintf("its metadata cannot be decoded: %v", err)
+			}
+		}
+
+		from := meta.version()
+		if reason == "" {
+			if err := t.checkMetadataVersion(meta); err != nil {
+				return err
+			}
+			if from == MetadataVersion {
+				return nil
+			}
+			for v := from; v < MetadataVersion && reason == ""; v++ {
+				if err := metadataMigrations[v-1](&meta); err != nil {
+					reason = fmt.Sprintf("its metadata cannot be migrated from version %d: %v", v, err)
+				}
+			}
+		}
+
+		if reason != "" {
+			if err := t.terminateConnections(ctx, t.name); err != nil {
+				return err
+			}
+			if err := t.drop(ctx); err != nil {
+				return fmt.Errorf("failed to drop template database for recreation: %w", err)
+			}
+			t.setup = false
+			action = fmt.Sprintf("dropped template database %s to rebuild it, as %s", t.name, reason)
+			return nil
+		}
+
+		if err := t.storeMetadata(ctx, meta); err != nil {
+			return fmt.Errorf("failed to record migrated template database metadata: %w", err)
+		}
+		action = fmt.Sprintf("migrated metadata of template database %s from version %d to %d",
+			t.name, from, MetadataVersion)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return action, nil
+}
+
+// metadataCurrent reports whether MigrateMetadata has nothing to do, i.e.
+// whether the template database does not exist or has metadata of
+// MetadataVersion. It returns an error wrapping ErrMetadataTooNew if the
+// metadata is of a newer version.
+func (t *TemplateDB) metadataCurrent(ctx context.Context, q rowQuerier) (bool, error) {
+	var comment *string
+	err := q.
+		QueryRow(ctx, `SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1`, t.name).
+		Scan(&comment)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get template database metadata: %w", err)
+	}
+	if comment == nil {
+		return false, nil
+	}
+
+	var meta metadata
+	if err := json.Unmarshal([]byte(*comment), &meta); err != nil {
+		return false, nil
+	}
+	if err := t.checkMetadataVersion(meta); err != nil {
+		return false, err
+	}
+	return meta.version() == MetadataVersion, nil
+}
@@ -0,0 +1,83 @@
+package templatedb
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataVersion(t *testing.T) {
+	require.Len(t, metadataMigrations, MetadataVersion-1, "every version needs a migration step")
+
+	var meta metadata
+	require.NoError(t, json.Unmarshal([]byte(`{"created_at": "2024-01-01T00:00:00Z"}`), &meta))
+	assert.Equal(t, 1, meta.version())
+
+	// Version 1 metadata without a generation gets one.
+	require.NoError(t, metadataMigrations[0](&meta))
+	assert.Len(t, meta.Generation, 16)
+	generation := meta.Generation
+	require.NoError(t, metadataMigrations[0](&meta))
+	assert.Equal(t, generation, meta.Generation)
+
+	tdb := &TemplateDB{name: "testdbpooltmpl_app"}
+	assert.NoError(t, tdb.checkMetadataVersion(metadata{MetadataVersion: MetadataVersion}))
+	err := tdb.checkMetadataVersion(metadata{MetadataVersion: MetadataVersion + 1})
+	assert.ErrorIs(t, err, ErrMetadataTooNew)
+	assert.ErrorContains(t, err, "template database testdbpooltmpl_app has metadata version 3, but this version of testdbpool supports up to 2; upgrade the library")
+}
+
+// commentQuerier answers the query for the comment of the template database.
+type commentQuerier struct {
+	comment *string
+	missing bool
+}
+
+func (q commentQuerier) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return commentRow(q)
+}
+
+type commentRow commentQuerier
+
+func (r commentRow) Scan(dest ...any) error {
+	if r.missing {
+		return pgx.ErrNoRows
+	}
+	*dest[0].(**string) = r.comment
+	return nil
+}
+
+func TestMetadataCurrent(t *testing.T) {
+	ctx := context.Background()
+	tdb := &TemplateDB{name: "testdbpooltmpl_app"}
+	comment := func(s string) *string { return &s }
+
+	tests := []struct {
+		name    string
+		q       commentQuerier
+		current bool
+		tooNew  bool
+	}{
+		{name: "missing template", q: commentQuerier{missing: true}, current: true},
+		{name: "no metadata", q: commentQuerier{}},
+		{name: "undecodable metadata", q: commentQuerier{comment: comment("{")}},
+		{name: "version 1", q: commentQuerier{comment: comment(`{"created_at": "2024-01-01T00:00:00Z"}`)}},
+		{name: "current version", q: commentQuerier{comment: comment(`{"metadata_version": 2, "generation": "0123456789abcdef"}`)}, current: true},
+		{name: "newer version", q: commentQuerier{comment: comment(`{"metadata_version": 3}`)}, tooNew: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current, err := tdb.metadataCurrent(ctx, tt.q)
+			if tt.tooNew {
+				assert.ErrorIs(t, err, ErrMetadataTooNew)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.current, current)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package templatedb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yuku/testdbpool/internal/clock"
+)
+
+// connectRetryDelays are the delays before each retry of connecting to a
+// newly created database after a transient failure.
+var connectRetryDelays = []time.Duration{
+	100 * time.Millisecond,
+	300 * time.Millisecond,
+	900 * time.Millisecond,
+}
+
+// createRetryBaseDelay is the delay before the first retry of cloning the
+// template database while other sessions are connected to it. It doubles
+// with each retry.
+const createRetryBaseDelay = 100 * time.Millisecond
+
+// backoffDelays returns n delays that start at base and double each time.
+func backoffDelays(base time.Duration, n int) []time.Duration {
+	delays := make([]time.Duration, n)
+	for i := range delays {
+		delays[i] = base << i
+	}
+	return delays
+}
+
+// isTransientConnectError reports whether err is a connection failure that
+// is likely to go away by itself, such as a failed DNS lookup or a refused
+// connection during network churn. Errors reported by the server, e.g. for
+// failed authentication or a missing database, are never transient.
+func isTransientConnectError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// pgconn.Timeout also reports the expiry of connect_timeout. An expired
+	// context of the caller is handled by the caller.
+	return pgconn.Timeout(err)
+}
+
+// retryTransient calls fn until it succeeds, returns an error that is not
+// transient, or has been retried once per delay. It waits for the delay,
+// measured by clk, before each retry and calls onRetry for it. It returns
+// early with the last error of fn when ctx is done.
+func retryTransient(ctx context.Context, clk clock.Clock, delays []time.Duration, onRetry func(), fn func() error) error {
+	return retryIf(ctx, clk, delays, isTransientConnectError, onRetry, fn)
+}
+
+// retryIf is like retryTransient, but retries the errors for which retryable
+// reports true.
+func retryIf(ctx context.Context, clk clock.Clock, delays []time.Duration, retryable func(error) bool, onRetry func(), fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil || attempt == len(delays) || !retryable(err) {
+			return err
+		}
+
+		timer := clk.NewTimer(delays[attempt])
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C():
+		}
+		if onRetry != nil {
+			onRetry()
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package templatedb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/clock"
+	"github.com/yuku/testdbpool/internal/pgconst"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+var (
+	errDNS     = &net.DNSError{Err: "no such host", Name: "db.ci.internal", IsNotFound: true}
+	errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTransientConnectError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"DNS failure", errDNS, true},
+		{"connection refused", fmt.Errorf("failed to connect: %w", errRefused), true},
+		{"timeout", &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, true},
+		{"authentication failure", &pgconn.PgError{Code: "28P01"}, false},
+		{"database does not exist", &pgconn.PgError{Code: "3D000"}, false},
+		{"other error", errors.New("tls: bad certificate"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isTransientConnectError(tt.err))
+		})
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	ctx := context.Background()
+	delays := []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+
+	run := func(ctx context.Context, script ...error) (calls, retries int, err error) {
+		err = retryTransient(ctx, clock.Real, delays, func() { retries++ }, func() error {
+			calls++
+			if calls > len(script) {
+				return nil
+			}
+			return script[calls-1]
+		})
+		return calls, retries, err
+	}
+
+	t.Run("succeeds after transient failures", func(t *testing.T) {
+		calls, retries, err := run(ctx, errDNS, errRefused)
+		require.NoError(t, err)
+		assert.Equal(t, 3, calls)
+		assert.Equal(t, 2, retries)
+	})
+
+	t.Run("gives up after the last delay", func(t *testing.T) {
+		calls, retries, err := run(ctx, errDNS, errDNS, errDNS, errRefused, errDNS)
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+		assert.Equal(t, 4, calls)
+		assert.Equal(t, 3, retries)
+	})
+
+	t.Run("does not retry other errors", func(t *testing.T) {
+		calls, retries, err := run(ctx, &pgconn.PgError{Code: "28P01"})
+		require.Error(t, err)
+		assert.Equal(t, 1, calls)
+		assert.Zero(t, retries)
+	})
+
+	t.Run("stops when ctx is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		calls, _, err := run(ctx, errDNS, errDNS)
+		require.ErrorIs(t, err, errDNS)
+		assert.Equal(t, 1, calls)
+	})
+	t.Run("waits for each delay on the clock", func(t *testing.T) {
+		fake := clock.NewFake(time.Now())
+		var calls atomic.Int32
+		done := make(chan error)
+		go func() {
+			done <- retryTransient(ctx, fake, connectRetryDelays, nil, func() error {
+				if calls.Add(1) < 3 {
+					return errDNS
+				}
+				return nil
+			})
+		}()
+
+		fake.WaitForTimers(1)
+		assert.Equal(t, int32(1), calls.Load())
+		fake.Advance(connectRetryDelays[0] - time.Nanosecond)
+		select {
+		case <-done:
+			t.Fatal("retried before the first delay elapsed")
+		default:
+		}
+		fake.Advance(time.Nanosecond)
+		fake.WaitForTimers(1)
+		assert.Equal(t, int32(2), calls.Load())
+		fake.Advance(connectRetryDelays[1])
+
+		require.NoError(t, <-done)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+}
+
+func TestRetryIf_ObjectInUse(t *testing.T) {
+	ctx := context.Background()
+	delays := backoffDelays(createRetryBaseDelay, 3)
+	inUse := &pgconn.PgError{Code: "55006", Message: `source database "testdbpooltmpl_app" is being accessed by other users`}
+
+	fake := clock.NewFake(time.Now())
+	var calls atomic.Int32
+	done := make(chan error)
+	go func() {
+		done <- retryIf(ctx, fake, delays, pgconst.IsObjectInUse, nil, func() error {
+			if calls.Add(1) < 3 {
+				return fmt.Errorf("failed to create database from template: %w", inUse)
+			}
+			return nil
+		})
+	}()
+	// The retries back off exponentially: 100ms, then 200ms.
+	for attempt, delay := range delays[:2] {
+		fake.WaitForTimers(1)
+		assert.Equal(t, int32(attempt+1), calls.Load())
+		fake.Advance(delay)
+	}
+	require.NoError(t, <-done)
+	assert.Equal(t, int32(3), calls.Load())
+
+	calls.Store(0)
+	err := retryIf(ctx, fake, delays, pgconst.IsObjectInUse, nil, func() error {
+		calls.Add(1)
+		return &pgconn.PgError{Code: "42P04"}
+	})
+	require.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load(), "errors other than 55006 must not be retried")
+}
+
+func TestBackoffDelays(t *testing.T) {
+	assert.Equal(t,
+		[]time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond},
+		backoffDelays(100*time.Millisecond, 3))
+	assert.Empty(t, backoffDelays(100*time.Millisecond, 0))
+}
+
+func TestCreate_RetryWhileTemplateInUse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	fake := clock.NewFake(time.Now())
+
+	tdb, err := New(&Config{
+		PoolID:   "create_retry",
+		ConnPool: connPool,
+		Setup: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE items (id int)`)
+			return err
+		},
+		CreateRetries: 3,
+		Clock:         fake,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tdb.Cleanup(context.Background()) })
+
+	// The first attempt finds a session that connected to the template after
+	// the leftover sessions were terminated, which PostgreSQL waits for
+	// about five seconds before refusing the clone. The retry terminates it.
+	attempts := 0
+	tdb.beforeClone = func() {
+		attempts++
+		if attempts > 1 {
+			return
+		}
+		conn, err := tdb.connect(ctx)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close(context.Background()) })
+	}
+
+	// The retry waits for the first backoff delay on the clock.
+	go func() {
+		fake.WaitForTimers(1)
+		fake.Advance(createRetryBaseDelay)
+	}()
+
+	name := TestDatabasePrefix("", "create_retry") + "0"
+	pool, err := tdb.Create(ctx, name, "")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = connPool.Exec(context.Background(), `DROP DATABASE IF EXISTS `+pgx.Identifier{name}.Sanitize())
+	})
+	pool.Close()
+
+	assert.Equal(t, 2, attempts)
+	assert.True(t, testutil.DBExists(t, connPool, name))
+}
+
+func TestConnectPool_Retry(t *testing.T) {
+	ctx := context.Background()
+
+	// newTemplateDB returns a TemplateDB whose connections are dialed by
+	// dial, without a server.
+	newTemplateDB := func(t *testing.T, dial func() error) *TemplateDB {
+		cfg, err := pgxpool.ParseConfig("postgres://postgres@127.0.0.1:5432/postgres?sslmode=disable")
+		require.NoError(t, err)
+		cfg.ConnConfig.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, dial()
+		}
+		connPool, err := pgxpool.NewWithConfig(ctx, cfg)
+		require.NoError(t, err)
+		t.Cleanup(connPool.Close)
+
+		tdb, err := New(&Config{PoolID: "retry", ConnPool: connPool})
+		require.NoError(t, err)
+		tdb.retryDelays = []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+		return tdb
+	}
+
+	t.Run("transient failures are retried", func(t *testing.T) {
+		var dials atomic.Int64
+		tdb := newTemplateDB(t, func() error {
+			if dials.Add(1)%2 == 0 {
+				return errRefused
+			}
+			return errDNS
+		})
+
+		_, err := tdb.connectPool(ctx, "testdbpool_retry_0", "")
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+		assert.Equal(t, int64(4), dials.Load())
+		assert.Equal(t, int64(3), tdb.ConnectRetries())
+	})
+
+	t.Run("other failures are not retried", func(t *testing.T) {
+		var dials atomic.Int64
+		tdb := newTemplateDB(t, func() error {
+			dials.Add(1)
+			return errors.New("tls: bad certificate")
+		})
+
+		_, err := tdb.connectPool(ctx, "testdbpool_retry_0", "")
+		require.ErrorContains(t, err, "tls: bad certificate")
+		assert.Equal(t, int64(1), dials.Load())
+		assert.Zero(t, tdb.ConnectRetries())
+	})
+}
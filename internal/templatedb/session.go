@@ -0,0 +1,59 @@
+package templatedb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SessionParams holds the session parameters that decide how unqualified
+// object names are resolved and which role creates and owns objects.
+// If they differ between the connection running the template setup and the
+// connections to the test databases, objects created by the setup may be
+// invisible to the tests.
+type SessionParams struct {
+	// SearchPath is the effective search_path of the session.
+	SearchPath string
+
+	// Role is the effective role of the session (current_user).
+	Role string
+}
+
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// QuerySessionParams returns the effective session parameters of db.
+func QuerySessionParams(ctx context.Context, db queryRower) (SessionParams, error) {
+	var params SessionParams
+	err := db.
+		QueryRow(ctx, `SELECT current_setting('search_path'), current_user`).
+		Scan(&params.SearchPath, &params.Role)
+	if err != nil {
+		return SessionParams{}, fmt.Errorf("failed to query session parameters: %w", err)
+	}
+	return params, nil
+}
+
+// Verify returns an error naming the first parameter that differs between
+// the expected parameters p and the actual parameters of db.
+func (p SessionParams) Verify(ctx context.Context, db queryRower) error {
+	actual, err := QuerySessionParams(ctx, db)
+	if err != nil {
+		return err
+	}
+	if actual.SearchPath != p.SearchPath {
+		return fmt.Errorf(
+			"search_path mismatch: root pool uses %q but the connection uses %q",
+			p.SearchPath, actual.SearchPath,
+		)
+	}
+	if actual.Role != p.Role {
+		return fmt.Errorf(
+			"role mismatch: root pool runs as %q but the connection runs as %q",
+			p.Role, actual.Role,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package templatedb
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestSetup_Canceled(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	connPool := testutil.GetTestDBPool(t)
+
+	t.Run("during SetupTemplate", func(t *testing.T) {
+		started := make(chan struct{})
+		var setups atomic.Int32
+		tdb, err := New(&Config{
+			PoolID:   "setup_canceled",
+			ConnPool: connPool,
+			Setup: func(ctx context.Context, conn *pgx.Conn) error {
+				if _, err := conn.Exec(ctx, `CREATE TABLE items (id int)`); err != nil {
+					return err
+				}
+				if setups.Add(1) == 1 {
+					close(started)
+					_, err := conn.Exec(ctx, `SELECT pg_sleep(60)`)
+					return err
+				}
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = tdb.Cleanup(context.Background()) })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+		start := time.Now()
+		err = tdb.Setup(ctx)
+		require.Error(t, err)
+		assert.Less(t, time.Since(start), 30*time.Second)
+		assert.False(t, testutil.DBExists(t, connPool, tdb.Name()),
+			"the partially set up template must be dropped")
+
+		// The lock has been released, so the next attempt builds the template.
+		setupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		require.NoError(t, tdb.Setup(setupCtx))
+		assert.Equal(t, int32(2), setups.Load())
+	})
+
+	t.Run("before the metadata is recorded", func(t *testing.T) {
+		var setups atomic.Int32
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		tdb, err := New(&Config{
+			PoolID:   "setup_canceled_metadata",
+			ConnPool: connPool,
+			Setup: func(ctx context.Context, conn *pgx.Conn) error {
+				setups.Add(1)
+				return nil
+			},
+			// The context is canceled right after SetupTemplate returns.
+			OnStep: func(name string, d time.Duration) {
+				if name == "run SetupTemplate" {
+					cancel()
+				}
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = tdb.Cleanup(context.Background()) })
+
+		require.ErrorIs(t, tdb.Setup(ctx), context.Canceled)
+		// A template without metadata would be taken for a complete one.
+		assert.False(t, testutil.DBExists(t, connPool, tdb.Name()),
+			"the template without metadata must be dropped")
+
+		require.NoError(t, tdb.Setup(context.Background()))
+		assert.Equal(t, int32(2), setups.Load())
+	})
+}
+
+func TestSetup_CreatedAt(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+
+	// The time at which SetupTemplate finished, according to the server.
+	var setupDone time.Time
+	tdb, err := New(&Config{
+		PoolID:   "setup_created_at",
+		ConnPool: connPool,
+		Setup: func(ctx context.Context, conn *pgx.Conn) error {
+			return conn.QueryRow(ctx, `SELECT pg_sleep(1), clock_timestamp()`).Scan(nil, &setupDone)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tdb.Cleanup(context.Background()) })
+	require.NoError(t, tdb.Setup(ctx))
+
+	meta, err := tdb.readMetadata(ctx, connPool)
+	require.NoError(t, err)
+	assert.False(t, meta.CreatedAt.Before(setupDone),
+		"CreatedAt %s must not be before the setup finished at %s", meta.CreatedAt, setupDone)
+}
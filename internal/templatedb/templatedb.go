@@ -2,12 +2,23 @@ package templatedb
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yuku/testdbpool/internal/clock"
 	"github.com/yuku/testdbpool/internal/pgconst"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
 )
 
 const (
@@ -29,12 +40,62 @@ type TemplateDB struct {
 
 	// mu is a mutex to protect access to the template database setup.
 	mu sync.Mutex
+
+	// builds is the number of times this instance has built the template
+	// database.
+	builds atomic.Int64
+
+	// creates is the number of databases this instance has created from the
+	// template database or template0.
+	creates atomic.Int64
+
+	// connectRetries is the number of times connecting to a created database
+	// has been retried after a transient failure.
+	connectRetries atomic.Int64
+
+	// retryDelays are the delays before the retries of connecting to a
+	// created database. Tests shorten them.
+	retryDelays []time.Duration
+
+	// createDelays are the delays before the retries of cloning the template
+	// database while other sessions are connected to it. Tests shorten them.
+	createDelays []time.Duration
+
+	// beforeClone, if set, is called before each attempt to clone the
+	// template database. Tests use it to connect to the template database.
+	beforeClone func()
+
+	// forced indicates that this instance has already recreated the template
+	// database because of ForceRecreate.
+	forced bool
+
+	// generation is the generation of the template database that this
+	// instance set up or last accepted in Create.
+	generation string
+
+	// values are the metadata values of the template database of generation.
+	values map[string]string
+
+	// clock is Config.Clock, or clock.Real if it is nil.
+	clock clock.Clock
+
+	// serverVersion is the server_version_num of the server, detected on
+	// the first clone with Config.Strategy. It is zero until then.
+	serverVersion int
+
+	// versionMu protects serverVersion.
+	versionMu sync.Mutex
 }
 
 type Config struct {
 	// PoolID is the ID of the pool that this template database belongs to.
 	PoolID string
 
+	// NamePrefix is the prefix of the names of the template database,
+	// "<NamePrefix>tmpl_<PoolID>", and of the test databases,
+	// "<NamePrefix>_<PoolID>_<index>". If empty, DefaultNamePrefix is used.
+	NamePrefix string
+
 	// ConnPool is the pgxpool.Pool to use for root database connections.
 	ConnPool *pgxpool.Pool
 
@@ -44,18 +105,126 @@ type Config struct {
 	// DatabaseOwner specifies the owner for the template and test databases.
 	// If empty, uses the default owner (connection user).
 	DatabaseOwner string
+
+	// MaxAge is the maximum age of the template database. DropIfStale drops
+	// the template database when it is older than this so that the next Setup
+	// rebuilds it. Zero disables the check.
+	MaxAge time.Duration
+
+	// SessionParams are the session parameters of the root connection pool.
+	// If set, they are propagated to the connections to the template and test
+	// databases, and an error is returned when a connection ends up with
+	// different parameters anyway.
+	SessionParams *SessionParams
+
+	// Source is the name of a database to clone as the template database.
+	// If set, the template database is created from it instead of being empty,
+	// and Setup, if any, runs on the clone.
+	Source string
+
+	// Encoding, Collate and CType are the character set encoding, LC_COLLATE
+	// and LC_CTYPE of the template and test databases. If any is set, the
+	// template database is created from template0, whose locale can be
+	// overridden, instead of template1.
+	Encoding string
+	Collate  string
+	CType    string
+
+	// Strategy is the strategy used to copy the template database into test
+	// databases, "WAL_LOG" or "FILE_COPY". It is ignored on servers older
+	// than PostgreSQL 15, which do not support it. If empty, the server
+	// default is used.
+	Strategy string
+
+	// KeepDisallowedConnections disables enabling connections to a new
+	// template or test database that the server created with datallowconn
+	// false, e.g. because of a policy of the DBA (see allowConnections).
+	KeepDisallowedConnections bool
+
+	// ConnString returns the connection string for the database with the given
+	// name. If set, it replaces the connection settings derived from ConnPool
+	// for connections to the template and test databases.
+	ConnString func(dbName string) (string, error)
+
+	// ForceRecreate makes the first Setup of this instance drop an existing
+	// template database and build it again instead of reusing it.
+	ForceRecreate bool
+
+	// Version identifies the schema that Setup builds, e.g. a hash of the
+	// migrations. It is recorded in the template database, and Setup drops
+	// and rebuilds an existing template database that was built for another
+	// version. Empty disables the check.
+	Version string
+
+	// OnStep is called with the name and duration of each step of Setup:
+	// waiting for the advisory lock and, when the template database is
+	// built, each phase of building it. Steps that fail are not reported.
+	OnStep func(name string, d time.Duration)
+
+	// SlowAfter is how long Setup may hold the advisory lock before OnSlow
+	// is called, once, with SlowAfter. Setup is not interrupted. Zero
+	// disables the check.
+	SlowAfter time.Duration
+	OnSlow    func(elapsed time.Duration)
+
+	// MaxSetupDuration bounds the context of the Setup function. If Setup
+	// has not returned when it expires, Setup of TemplateDB fails and drops
+	// the template database. If zero, Setup runs with the caller's context.
+	MaxSetupDuration time.Duration
+
+	// Clock is the source of time for OnStep and SlowAfter.
+	// If nil, clock.Real is used.
+	Clock clock.Clock
+
+	// OnGenerationChange is called by Create when the template database has
+	// been recreated, e.g. by another process, since this instance set it up.
+	// If it returns an error, Create fails with it and calls it again on the
+	// next attempt. Otherwise the new generation is accepted.
+	OnGenerationChange func(previous, current string) error
+
+	// VerifyReleased, if set, is called by Create with a pool connected to a
+	// database marked with MarkReleased and the metadata values of the
+	// template database it was cloned from. Create reuses the database only
+	// if it returns nil and recreates it otherwise. If nil, such databases
+	// are recreated.
+	VerifyReleased func(ctx context.Context, pool *pgxpool.Pool, values map[string]string) error
+
+	// CreateRetries is the number of times cloning the template database is
+	// retried, with exponential backoff, when it fails because other sessions
+	// are connected to the template database. If zero, it is not retried.
+	CreateRetries int
+
+	// RuntimeParams are the run-time parameters of the connections to each
+	// test database, set over those of ConnPool, e.g. statement_timeout.
+	RuntimeParams map[string]string
+
+	// WrapTracer, if set, is called with the tracer of the connections to
+	// each test database, which is that of ConnPool, and returns the tracer
+	// to use instead, e.g. one that counts the queries and delegates to it.
+	WrapTracer func(next pgx.QueryTracer) pgx.QueryTracer
+
+	// Logger receives the events of building the template database and of
+	// creating and dropping databases. If nil, nothing is logged.
+	Logger *slog.Logger
 }
 
 // New creates a new TemplateDB instance with the given configuration.
 func New(cfg *Config) (*TemplateDB, error) {
-	name, err := getTemplateDatabaseName(cfg.PoolID)
+	name, err := TemplateDatabaseName(cfg.NamePrefix, cfg.PoolID)
 	if err != nil {
 		return nil, fmt.Errorf("invalid template database name: %w", err)
 	}
+	c := cfg.Clock
+	if c == nil {
+		c = clock.Real
+	}
 	return &TemplateDB{
-		cfg:   cfg,
-		name:  name,
-		setup: false,
+		cfg:          cfg,
+		name:         name,
+		setup:        false,
+		retryDelays:  connectRetryDelays,
+		createDelays: backoffDelays(createRetryBaseDelay, cfg.CreateRetries),
+		clock:        c,
 	}, nil
 }
 
@@ -70,44 +239,341 @@ func (t *TemplateDB) Setup(ctx context.Context) error {
 		return nil // Template database already set up
 	}
 
+	var buildStart time.Time
 	err := pgx.BeginFunc(ctx, t.cfg.ConnPool, func(tx pgx.Tx) error {
 		// Get advisory lock to ensure only one testdbpool instance sets up the
 		// template database at a time.
+		done := t.timeStep("acquire lock")
 		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, lockID); err != nil {
 			return fmt.Errorf("failed to acquire advisory lock: %w", err)
 		}
+		done()
+		defer t.watchSlow()()
 
-		// TODO: Provide a way to force recreation of the template database.
-		if exists, err := checkIfExists(ctx, tx, t.name); err != nil {
+		exists, err := checkIfExists(ctx, tx, t.name)
+		if err != nil {
 			return fmt.Errorf("failed to check if template database exists: %w", err)
-		} else if exists {
+		}
+		recreate := exists && t.cfg.ForceRecreate && !t.forced
+		var meta metadata
+		if exists && !recreate {
+			meta, err = t.readMetadata(ctx, tx)
+			if err != nil {
+				return err
+			}
+			// Processes that waited for the lock while another one rebuilt
+			// the template for the same version find it up to date here.
+			recreate = t.cfg.Version != "" && meta.Version != t.cfg.Version
+		}
+		if recreate {
+			done := t.timeStep("drop outdated template")
+			if err := t.terminateConnections(ctx, t.name); err != nil {
+				return err
+			}
+			if err := t.drop(ctx); err != nil {
+				return fmt.Errorf("failed to drop template database for recreation: %w", err)
+			}
+			done()
+			exists = false
+		}
+		t.forced = true
+		if exists {
+			t.generation, t.values = meta.Generation, meta.Values
 			t.setup = true
 			return nil // Template database already exists
 		}
 
-		if err := t.createDatabase(ctx); err != nil {
-			return fmt.Errorf("failed to create template database: %w", err)
+		buildStart = t.clock.Now()
+		t.logger().Info("template setup started", "template", t.name)
+
+		// Until its metadata is recorded, drop the template database on any
+		// failure, including a cancellation of ctx while it is created or set
+		// up, so that the next attempt does not mistake it for a complete one.
+		// Sessions of an interrupted Setup may not have ended yet. The lock is
+		// still held meanwhile.
+		complete := false
+		defer func() {
+			if !complete {
+				cleanupCtx := context.WithoutCancel(ctx)
+				_ = t.terminateConnections(cleanupCtx, t.name)
+				_ = t.drop(cleanupCtx)
+			}
+		}()
+
+		var sourceValues map[string]string
+		if t.cfg.Source != "" {
+			done := t.timeStep("clone source database")
+			values, err := t.cloneSource(ctx)
+			if err != nil {
+				return err
+			}
+			done()
+			sourceValues = values
+		} else {
+			done := t.timeStep("create template database")
+			if err := t.createDatabase(ctx); err != nil {
+				return fmt.Errorf("failed to create template database: %w", err)
+			}
+			done()
 		}
 
-		conn, err := t.connect(ctx)
+		done = t.timeStep("run SetupTemplate")
+		values, err := t.runSetup(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to connect to template database: %w", err)
+			return err
 		}
-		defer func() { _ = conn.Close(ctx) }()
+		done()
+		maps.Copy(values, sourceValues)
 
-		if err := t.cfg.Setup(ctx, conn); err != nil {
-			return fmt.Errorf("failed to set up template database: %w", err)
+		done = t.timeStep("record metadata")
+		generation, err := newGeneration()
+		if err != nil {
+			return err
+		}
+		if err := t.writeMetadata(ctx, tx, generation, values); err != nil {
+			return fmt.Errorf("failed to record template database metadata: %w", err)
 		}
+		complete = true
+		done()
+		t.generation, t.values = generation, values
 		t.setup = true
+		t.builds.Add(1)
+
+		// Clones of a previous build kept for reuse are stale now.
+		done = t.timeStep("drop stale clones")
+		if err := t.dropStaleClones(ctx, tx, generation); err != nil {
+			return err
+		}
+		done()
 
 		return nil
 	})
+	if !buildStart.IsZero() {
+		if err != nil {
+			t.logger().Warn("template setup failed", "template", t.name, "error", err)
+		} else {
+			t.logger().Info("template setup finished", "template", t.name,
+				"generation", t.generation, "duration", t.clock.Now().Sub(buildStart))
+		}
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// timeStep returns a function that reports the time elapsed since timeStep was
+// called to OnStep as the duration of the step name.
+func (t *TemplateDB) timeStep(name string) func() {
+	if t.cfg.OnStep == nil {
+		return func() {}
+	}
+	start := t.clock.Now()
+	return func() {
+		t.cfg.OnStep(name, t.clock.Now().Sub(start))
+	}
+}
+
+// watchSlow calls OnSlow once SlowAfter has elapsed, unless the returned
+// function is called before. It does nothing when SlowAfter is zero.
+func (t *TemplateDB) watchSlow() (stop func()) {
+	if t.cfg.SlowAfter <= 0 || t.cfg.OnSlow == nil {
+		return func() {}
+	}
+	timer := t.clock.NewTimer(t.cfg.SlowAfter)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-timer.C():
+			t.cfg.OnSlow(t.cfg.SlowAfter)
+		case <-done:
+			timer.Stop()
+		}
+	}()
+	return func() { close(done) }
+}
+
+// DropIfStale drops the template database if it is older than MaxAge so that
+// the next Setup rebuilds it. Template databases without recorded metadata,
+// e.g. those created by older versions of this package, are considered stale.
+// It does nothing when MaxAge is zero or the template database does not exist.
+func (t *TemplateDB) DropIfStale(ctx context.Context) error {
+	if t.cfg.MaxAge <= 0 {
+		return nil
+	}
+	return t.dropIf(ctx, func(tx pgx.Tx) (bool, error) {
+		return t.isOlderThan(ctx, tx, t.cfg.MaxAge)
+	})
+}
+
+// Drop drops the template database so that the next Setup rebuilds it.
+// Unlike Cleanup, it drops the template database even if this instance has
+// not set it up, e.g. when it was set up by another process.
+// It does nothing when the template database does not exist.
+func (t *TemplateDB) Drop(ctx context.Context) error {
+	return t.dropIf(ctx, func(pgx.Tx) (bool, error) { return true, nil })
+}
+
+// dropIf drops the template database if it exists and cond returns true.
+func (t *TemplateDB) dropIf(ctx context.Context, cond func(pgx.Tx) (bool, error)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return pgx.BeginFunc(ctx, t.cfg.ConnPool, func(tx pgx.Tx) error {
+		// Get advisory lock to ensure that no other testdbpool instance is
+		// setting up or cloning the template database meanwhile.
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, lockID); err != nil {
+			return fmt.Errorf("failed to acquire advisory lock: %w", err)
+		}
+
+		if exists, err := checkIfExists(ctx, tx, t.name); err != nil {
+			return fmt.Errorf("failed to check if template database exists: %w", err)
+		} else if !exists {
+			t.setup = false
+			return nil
+		}
+
+		ok, err := cond(tx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		if err := t.drop(ctx); err != nil {
+			return err
+		}
+		t.setup = false
+		return nil
+	})
+}
+
+func (t *TemplateDB) isOlderThan(ctx context.Context, tx pgx.Tx, age time.Duration) (bool, error) {
+	var comment *string
+	var now time.Time
+	err := tx.
+		QueryRow(ctx, `SELECT shobj_description(oid, 'pg_database'), now() FROM pg_database WHERE datname = $1`, t.name).
+		Scan(&comment, &now)
+	if err != nil {
+		return false, fmt.Errorf("failed to read template database metadata: %w", err)
+	}
+	if comment == nil {
+		return true, nil
+	}
+
+	var meta metadata
+	if err := json.Unmarshal([]byte(*comment), &meta); err != nil || meta.CreatedAt.IsZero() {
+		return true, nil
+	}
+	return now.Sub(meta.CreatedAt) > age, nil
+}
+
+// runSetup runs the Setup function on the template database and returns the
+// metadata values it set.
+func (t *TemplateDB) runSetup(ctx context.Context) (map[string]string, error) {
+	var conn *pgx.Conn
+	err := t.allowConnections(ctx, t.name, func() error {
+		var err error
+		conn, err = t.connect(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to template database: %w", err)
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	values := &setupValues{values: map[string]string{}}
+	if t.cfg.Setup != nil {
+		setupCtx := withSetupValues(ctx, values)
+		if t.cfg.MaxSetupDuration > 0 {
+			var cancel context.CancelFunc
+			setupCtx, cancel = context.WithTimeout(setupCtx, t.cfg.MaxSetupDuration)
+			defer cancel()
+		}
+		err := t.cfg.Setup(setupCtx, conn)
+		if ctx.Err() == nil && errors.Is(setupCtx.Err(), context.DeadlineExceeded) {
+			// A Setup that ignores its context may return without an error
+			// after the deadline, with its work cut short by the canceled
+			// queries.
+			if err == nil {
+				err = context.DeadlineExceeded
+			}
+			return nil, fmt.Errorf("template setup did not finish within %s: %w", t.cfg.MaxSetupDuration, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up template database: %w", err)
+		}
+	}
+	return values.take(), nil
+}
+
+// Values returns the metadata values set during the setup of the template
+// database, setting it up first if needed.
+func (t *TemplateDB) Values(ctx context.Context) (map[string]string, error) {
+	if err := t.Setup(ctx); err != nil {
+		return nil, fmt.Errorf("failed to set up template database: %w", err)
+	}
+
+	meta, err := t.readMetadata(ctx, t.cfg.ConnPool)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	maps.Copy(values, meta.Values)
+	return values, nil
+}
+
+// Generation returns the generation of the template database that this
+// instance set up or last cloned from. It is empty before Setup and for
+// template databases built by older versions of this package.
+func (t *TemplateDB) Generation() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.generation
+}
+
+// Current returns the generation of the template database that this instance
+// set up or last cloned from, like Generation, together with its metadata
+// values.
+func (t *TemplateDB) Current() (generation string, values map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.generation, maps.Clone(t.values)
+}
+
+// checkGeneration calls OnGenerationChange if the template database has been
+// rebuilt since this instance set it up, and accepts the new generation
+// unless it returns an error. It must be called with the advisory lock held.
+func (t *TemplateDB) checkGeneration(ctx context.Context, tx pgx.Tx) error {
+	meta, err := t.readMetadata(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if meta.Generation == t.generation {
+		return nil
+	}
+	if t.generation != "" && t.cfg.OnGenerationChange != nil {
+		if err := t.cfg.OnGenerationChange(t.generation, meta.Generation); err != nil {
+			return err
+		}
+	}
+	t.generation, t.values = meta.Generation, meta.Values
+	return nil
+}
+
+// newGeneration returns a random generation ID.
+func newGeneration() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate template generation: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func checkIfExists(ctx context.Context, tx pgx.Tx, name string) (bool, error) {
 	var exists bool
 	err := tx.
@@ -121,25 +587,185 @@ func checkIfExists(ctx context.Context, tx pgx.Tx, name string) (bool, error) {
 
 func (t *TemplateDB) createDatabase(ctx context.Context) error {
 	// CREATE DATABASE cannot run inside a transaction block
-	var query string
-	if t.cfg.DatabaseOwner != "" {
-		query = fmt.Sprintf(`CREATE DATABASE %s OWNER %s IS_TEMPLATE true`,
-			t.SanitizedName(), pgx.Identifier{t.cfg.DatabaseOwner}.Sanitize())
-	} else {
-		query = fmt.Sprintf(`CREATE DATABASE %s IS_TEMPLATE true`, t.SanitizedName())
+	opts := t.createOptions()
+	opts.IsTemplate = true
+	if opts.Encoding != "" || opts.Collate != "" || opts.CType != "" {
+		opts.Template = "template0"
 	}
-
-	_, err := t.cfg.ConnPool.Exec(ctx, query)
+	query, err := sqlbuild.CreateDatabase(t.name, opts)
 	if err != nil {
+		return err
+	}
+
+	if _, err := t.cfg.ConnPool.Exec(ctx, query); err != nil {
 		return fmt.Errorf("failed to create template database: %w", err)
 	}
 	return nil
 }
 
+// Metadata keys under which the origin of a template database cloned from
+// Source is recorded.
+const (
+	SourceNameKey     = "testdbpool.source"
+	SourceBytesKey    = "testdbpool.source_bytes"
+	SourceClonedAtKey = "testdbpool.source_cloned_at"
+)
+
+// cloneSource creates the template database as a copy of the Source database
+// and returns metadata values describing the source.
+func (t *TemplateDB) cloneSource(ctx context.Context) (map[string]string, error) {
+	var bytes int64
+	var clonedAt time.Time
+	err := t.cfg.ConnPool.
+		QueryRow(ctx, `SELECT pg_database_size($1), now()`, t.cfg.Source).
+		Scan(&bytes, &clonedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get size of source database %s: %w", t.cfg.Source, err)
+	}
+
+	// A database cannot be used as a template while other sessions are
+	// connected to it.
+	if err := t.terminateConnections(ctx, t.cfg.Source); err != nil {
+		return nil, err
+	}
+
+	opts := t.createOptions()
+	opts.Template = t.cfg.Source
+	opts.IsTemplate = true
+	query, err := sqlbuild.CreateDatabase(t.name, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.cfg.ConnPool.Exec(ctx, query); err != nil {
+		return nil, fmt.Errorf("failed to clone source database %s: %w", t.cfg.Source, err)
+	}
+
+	return map[string]string{
+		SourceNameKey:     t.cfg.Source,
+		SourceBytesKey:    strconv.FormatInt(bytes, 10),
+		SourceClonedAtKey: clonedAt.UTC().Format(time.RFC3339Nano),
+	}, nil
+}
+
+// terminateConnections terminates the other sessions connected to the
+// database name.
+func (t *TemplateDB) terminateConnections(ctx context.Context, name string) error {
+	_, err := t.cfg.ConnPool.Exec(ctx, `
+		SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()`,
+		name,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to terminate connections to database %s: %w", name, err)
+	}
+	return nil
+}
+
 func (t *TemplateDB) connect(ctx context.Context) (*pgx.Conn, error) {
-	cfg := t.cfg.ConnPool.Config().ConnConfig.Copy()
-	cfg.Database = t.name
-	return pgx.ConnectConfig(ctx, cfg)
+	poolCfg := t.cfg.ConnPool.Config()
+	cfg, err := t.connConfig(poolCfg.ConnConfig, t.name)
+	if err != nil {
+		return nil, err
+	}
+	t.propagateSessionParams(cfg)
+
+	conn, err := pgx.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Run the same hook as connections of the root pool so that the setup
+	// runs in the same session environment as the tests.
+	if poolCfg.AfterConnect != nil {
+		if err := poolCfg.AfterConnect(ctx, conn); err != nil {
+			_ = conn.Close(ctx)
+			return nil, fmt.Errorf("failed to run AfterConnect hook: %w", err)
+		}
+	}
+
+	if t.cfg.SessionParams != nil {
+		if err := t.cfg.SessionParams.Verify(ctx, conn); err != nil {
+			_ = conn.Close(ctx)
+			return nil, fmt.Errorf("template database connection diverges from root pool: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// WithConn sets up the template database if needed and calls fn with a
+// connection to it. No database is cloned from the template database while fn
+// runs, as PostgreSQL refuses to clone a database with open connections.
+func (t *TemplateDB) WithConn(ctx context.Context, fn func(ctx context.Context, conn *pgx.Conn) error) error {
+	if err := t.Setup(ctx); err != nil {
+		return fmt.Errorf("failed to set up template database: %w", err)
+	}
+
+	return pgx.BeginFunc(ctx, t.cfg.ConnPool, func(tx pgx.Tx) error {
+		// Get advisory lock to ensure that no other testdbpool instance is
+		// setting up or cloning the template database meanwhile.
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, lockID); err != nil {
+			return fmt.Errorf("failed to acquire advisory lock: %w", err)
+		}
+
+		conn, err := t.connect(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to connect to template database: %w", err)
+		}
+		defer func() { _ = conn.Close(ctx) }()
+		return fn(ctx, conn)
+	})
+}
+
+// connConfig returns the connection configuration for the database name.
+// It is a copy of base with the database replaced, unless ConnString is set,
+// in which case it is parsed from the connection string ConnString returns.
+func (t *TemplateDB) connConfig(base *pgx.ConnConfig, name string) (*pgx.ConnConfig, error) {
+	if t.cfg.ConnString == nil {
+		cfg := base.Copy()
+		cfg.Database = name
+		return cfg, nil
+	}
+
+	connString, err := t.cfg.ConnString(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build connection string for %s: %w", name, err)
+	}
+	cfg, err := pgx.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse connection string for %s: %w", name, err)
+	}
+	return cfg, nil
+}
+
+// propagateSessionParams sets the recorded search_path of the root pool as a
+// runtime parameter of cfg, so that it applies regardless of how the root pool
+// established it (connection string options, AfterConnect, role defaults, ...).
+func (t *TemplateDB) propagateSessionParams(cfg *pgx.ConnConfig) {
+	if t.cfg.SessionParams == nil {
+		return
+	}
+	if cfg.RuntimeParams == nil {
+		cfg.RuntimeParams = map[string]string{}
+	}
+	cfg.RuntimeParams["search_path"] = t.cfg.SessionParams.SearchPath
+}
+
+// Builds returns the number of times this instance has built the template
+// database, as opposed to finding an existing one.
+func (t *TemplateDB) Builds() int64 {
+	return t.builds.Load()
+}
+
+// Creates returns the number of databases this instance has created from the
+// template database or template0, not counting reused ones.
+func (t *TemplateDB) Creates() int64 {
+	return t.creates.Load()
+}
+
+// ConnectRetries returns the number of times this instance has retried
+// connecting to a created database after a transient failure.
+func (t *TemplateDB) ConnectRetries() int64 {
+	return t.connectRetries.Load()
 }
 
 // Name returns the name of the template database.
@@ -147,14 +773,17 @@ func (t *TemplateDB) Name() string {
 	return t.name
 }
 
-// SanitizedName returns the sanitized name of the template database.
-// This is useful for safely using the name in SQL queries.
-func (t *TemplateDB) SanitizedName() string {
-	return pgx.Identifier{t.name}.Sanitize()
-}
+// DefaultNamePrefix is the prefix of database names used if
+// Config.NamePrefix is empty.
+const DefaultNamePrefix = "testdbpool"
 
-func getTemplateDatabaseName(id string) (string, error) {
-	name := fmt.Sprintf("testdbpooltmpl_%s", id)
+// TemplateDatabaseName returns the name of the template database of the pool
+// id with the given name prefix, or an error if it is too long.
+func TemplateDatabaseName(prefix, id string) (string, error) {
+	if prefix == "" {
+		prefix = DefaultNamePrefix
+	}
+	name := prefix + "tmpl_" + id
 	if len(name) > pgconst.MaxDatabaseNameLength {
 		return "", fmt.Errorf(
 			"template database name exceeds maximum length of %d characters: %s",
@@ -164,13 +793,36 @@ func getTemplateDatabaseName(id string) (string, error) {
 	return name, nil
 }
 
+// TestDatabasePrefix returns the common prefix of the names of the test
+// databases of the pool id with the given name prefix, which are followed by
+// their index.
+func TestDatabasePrefix(prefix, id string) string {
+	if prefix == "" {
+		prefix = DefaultNamePrefix
+	}
+	return prefix + "_" + id + "_"
+}
+
 // Create creates a new database using the template database and returns a
-// pgxpool.Pool connected to the new database.
-func (t *TemplateDB) Create(ctx context.Context, name string) (*pgxpool.Pool, error) {
+// pgxpool.Pool connected to the new database. If appName is not empty, the
+// connections of the pool use it as their application_name.
+func (t *TemplateDB) Create(ctx context.Context, name, appName string) (*pgxpool.Pool, error) {
+	pool, _, err := t.CreateReusing(ctx, name, appName, nil)
+	return pool, err
+}
+
+// CreateReusing is like Create, but returns warm, a pool connected to the
+// database name before, instead of connecting a new pool if the database is
+// reused and warm still answers a ping. Otherwise warm is closed, before the
+// database is dropped if it is recreated. warm may be nil. It also reports
+// whether the existing database was reused instead of created.
+func (t *TemplateDB) CreateReusing(ctx context.Context, name, appName string, warm *pgxpool.Pool) (*pgxpool.Pool, bool, error) {
 	if err := t.Setup(ctx); err != nil {
-		return nil, fmt.Errorf("failed to set up template database: %w", err)
+		closePool(warm)
+		return nil, false, fmt.Errorf("failed to set up template database: %w", err)
 	}
 
+	reused, verify := false, false
 	err := pgx.BeginFunc(ctx, t.cfg.ConnPool, func(tx pgx.Tx) error {
 		// Get advisory lock to ensure only one testdbpool instance sets up the
 		// template database at a time.
@@ -178,11 +830,36 @@ func (t *TemplateDB) Create(ctx context.Context, name string) (*pgxpool.Pool, er
 			return fmt.Errorf("failed to acquire advisory lock: %w", err)
 		}
 
+		if err := t.checkGeneration(ctx, tx); err != nil {
+			return err
+		}
+
 		if exists, err := checkIfExists(ctx, tx, name); err != nil {
-			return fmt.Errorf("failed to check if template database exists: %w", err)
+			return fmt.Errorf("failed to check if database exists: %w", err)
 		} else if exists {
-			t.setup = true
-			return nil // Template database already exists
+			var err error
+			reused, verify, err = t.reuseIfClean(ctx, tx, name)
+			if err != nil {
+				return err
+			}
+			if reused {
+				t.logger().Info("test database reused", t.databaseAttrs(name)...)
+				return nil
+			}
+			// Left behind dirty, e.g. by a crashed process, whose pools
+			// may still be connected to it.
+			closePool(warm)
+			warm = nil
+			if err := t.terminateConnections(ctx, name); err != nil {
+				return err
+			}
+			query, err := sqlbuild.DropDatabase(name, false)
+			if err != nil {
+				return err
+			}
+			if _, err := t.cfg.ConnPool.Exec(ctx, query); err != nil {
+				return fmt.Errorf("failed to drop leftover database: %w", err)
+			}
 		}
 
 		if err := t.createFromTemplate(ctx, name); err != nil {
@@ -191,34 +868,202 @@ func (t *TemplateDB) Create(ctx context.Context, name string) (*pgxpool.Pool, er
 		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create database: %w", err)
+		closePool(warm)
+		return nil, false, fmt.Errorf("failed to create database: %w", err)
 	}
 
+	if verify {
+		closePool(warm)
+		return t.verifyReleased(ctx, name, appName)
+	}
+	if warm != nil {
+		if reused {
+			err := warm.Ping(ctx)
+			if err == nil {
+				return warm, true, nil
+			}
+			t.logger().Warn("retained pool is broken; reconnecting",
+				append(t.databaseAttrs(name), "error", err)...)
+		}
+		warm.Close()
+	}
+	pool, err := t.connectPool(ctx, name, appName)
+	return pool, reused, err
+}
+
+// closePool closes pool unless it is nil.
+func closePool(pool *pgxpool.Pool) {
+	if pool != nil {
+		pool.Close()
+	}
+}
+
+// CreateEmpty creates a new empty database from template0, i.e. without the
+// contents of the template database, and returns a pgxpool.Pool connected to
+// the new database. An existing database with the same name is dropped first.
+// appName is used like in Create.
+func (t *TemplateDB) CreateEmpty(ctx context.Context, name, appName string) (*pgxpool.Pool, error) {
+	query, err := sqlbuild.DropDatabase(name, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.cfg.ConnPool.Exec(ctx, query); err != nil {
+		return nil, fmt.Errorf("failed to drop existing database: %w", err)
+	}
+
+	if err := t.createFrom(ctx, name, "template0", ""); err != nil {
+		return nil, fmt.Errorf("failed to create empty database: %w", err)
+	}
+	return t.connectPool(ctx, name, appName)
+}
+
+// connectPool returns a pgxpool.Pool connected to the database name, configured
+// like the root connection pool except for Config.RuntimeParams and the
+// application_name if appName is not empty. Transient connection failures, e.g. DNS
+// lookups failing during network churn, are retried a few times with backoff.
+func (t *TemplateDB) connectPool(ctx context.Context, name, appName string) (*pgxpool.Pool, error) {
 	cfg := t.cfg.ConnPool.Config().Copy()
-	cfg.ConnConfig.Database = name
-	return pgxpool.NewWithConfig(ctx, cfg)
+	connCfg, err := t.connConfig(cfg.ConnConfig, name)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ConnConfig = connCfg
+	t.propagateSessionParams(cfg.ConnConfig)
+	if len(t.cfg.RuntimeParams) > 0 || appName != "" {
+		if cfg.ConnConfig.RuntimeParams == nil {
+			cfg.ConnConfig.RuntimeParams = map[string]string{}
+		}
+		maps.Copy(cfg.ConnConfig.RuntimeParams, t.cfg.RuntimeParams)
+	}
+	if appName != "" {
+		cfg.ConnConfig.RuntimeParams["application_name"] = appName
+	}
+	if t.cfg.WrapTracer != nil {
+		cfg.ConnConfig.Tracer = t.cfg.WrapTracer(cfg.ConnConfig.Tracer)
+	}
+
+	var pool *pgxpool.Pool
+	err = t.allowConnections(ctx, name, func() error {
+		return retryTransient(ctx, t.clock, t.retryDelays, func() { t.connectRetries.Add(1) }, func() error {
+			var err error
+			pool, err = t.openPool(ctx, cfg)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pool, nil
 }
 
-func (t *TemplateDB) createFromTemplate(ctx context.Context, name string) error {
-	var query string
-	if t.cfg.DatabaseOwner != "" {
-		query = fmt.Sprintf(
-			`CREATE DATABASE %s OWNER %s TEMPLATE %s`,
-			pgx.Identifier{name}.Sanitize(),
-			pgx.Identifier{t.cfg.DatabaseOwner}.Sanitize(),
-			t.SanitizedName(),
-		)
+// openPool opens a pgxpool.Pool with cfg and makes sure that it can connect,
+// verifying the session parameters if configured.
+func (t *TemplateDB) openPool(ctx context.Context, cfg *pgxpool.Config) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.cfg.SessionParams != nil {
+		err = t.cfg.SessionParams.Verify(ctx, pool)
+		if err != nil {
+			err = fmt.Errorf("test database connection diverges from root pool: %w", err)
+		}
 	} else {
-		query = fmt.Sprintf(
-			`CREATE DATABASE %s TEMPLATE %s`,
-			pgx.Identifier{name}.Sanitize(), t.SanitizedName(),
-		)
+		err = pool.Ping(ctx)
 	}
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
 
-	_, err := t.cfg.ConnPool.Exec(ctx, query)
+// createFromTemplate creates the database name from the template database.
+// It must be called with the advisory lock held, under which nothing of this
+// package is connected to the template database, so that the sessions still
+// connected are leftovers, e.g. of a pool that has not finished closing,
+// and are terminated instead of failing the clone. Sessions that connect
+// after that, e.g. from psql or a monitoring tool, make the clone fail; it is
+// retried Config.CreateRetries times, terminating them again each time.
+func (t *TemplateDB) createFromTemplate(ctx context.Context, name string) error {
+	strategy, err := t.strategy(ctx)
 	if err != nil {
+		return err
+	}
+	attempt := 1
+	onRetry := func() {
+		attempt++
+		t.logger().Warn("template database in use; retrying clone",
+			append(t.databaseAttrs(name), "attempt", attempt)...)
+	}
+	return retryIf(ctx, t.clock, t.createDelays, pgconst.IsObjectInUse, onRetry, func() error {
+		if err := t.terminateConnections(ctx, t.name); err != nil {
+			return err
+		}
+		if t.beforeClone != nil {
+			t.beforeClone()
+		}
+		return t.createFrom(ctx, name, t.name, strategy)
+	})
+}
+
+// minStrategyVersion is the server_version_num of PostgreSQL 15, the first
+// version that supports the STRATEGY option of CREATE DATABASE.
+const minStrategyVersion = 150000
+
+// strategy returns Config.Strategy if the server supports it, or an empty
+// string otherwise. The server version is queried once.
+func (t *TemplateDB) strategy(ctx context.Context) (string, error) {
+	if t.cfg.Strategy == "" {
+		return "", nil
+	}
+
+	t.versionMu.Lock()
+	defer t.versionMu.Unlock()
+	if t.serverVersion == 0 {
+		var version string
+		if err := t.cfg.ConnPool.QueryRow(ctx, `SHOW server_version_num`).Scan(&version); err != nil {
+			return "", fmt.Errorf("failed to get server version: %w", err)
+		}
+		n, err := strconv.Atoi(version)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse server version %q: %w", version, err)
+		}
+		t.serverVersion = n
+	}
+	if t.serverVersion < minStrategyVersion {
+		return "", nil
+	}
+	return t.cfg.Strategy, nil
+}
+
+// createOptions returns the options common to all databases created by t.
+func (t *TemplateDB) createOptions() sqlbuild.CreateDatabaseOptions {
+	return sqlbuild.CreateDatabaseOptions{
+		Owner:    t.cfg.DatabaseOwner,
+		Encoding: t.cfg.Encoding,
+		Collate:  t.cfg.Collate,
+		CType:    t.cfg.CType,
+	}
+}
+
+// createFrom creates the database name from the template database template
+// with strategy, which is empty for the server default.
+func (t *TemplateDB) createFrom(ctx context.Context, name, template, strategy string) error {
+	opts := t.createOptions()
+	opts.Template = template
+	opts.Strategy = strategy
+	query, err := sqlbuild.CreateDatabase(name, opts)
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.cfg.ConnPool.Exec(ctx, query); err != nil {
 		return fmt.Errorf("failed to create database from template: %w", err)
 	}
+	t.creates.Add(1)
+	t.logger().Info("test database created", append(t.databaseAttrs(name), "template", template)...)
 	return nil
 }
 
@@ -231,21 +1076,31 @@ func (t *TemplateDB) Cleanup(ctx context.Context) error {
 		return nil // Template database not set up, nothing to clean up
 	}
 
+	if err := t.drop(ctx); err != nil {
+		return err
+	}
+	t.setup = false
+	return nil
+}
+
+func (t *TemplateDB) drop(ctx context.Context) error {
 	// To drop the template database, we need to first alter it to not be a template
 	// and then drop it.
-	_, err := t.cfg.ConnPool.Exec(ctx, fmt.Sprintf(
-		`ALTER DATABASE %s IS_TEMPLATE false`, t.SanitizedName(),
-	))
+	query, err := sqlbuild.AlterIsTemplate(t.name, false)
 	if err != nil {
+		return err
+	}
+	if _, err := t.cfg.ConnPool.Exec(ctx, query); err != nil {
 		return fmt.Errorf("failed to alter template database: %w", err)
 	}
 
-	_, err = t.cfg.ConnPool.Exec(ctx, fmt.Sprintf(
-		`DROP DATABASE IF EXISTS %s`, t.SanitizedName(),
-	))
+	query, err = sqlbuild.DropDatabase(t.name, false)
 	if err != nil {
+		return err
+	}
+	if _, err := t.cfg.ConnPool.Exec(ctx, query); err != nil {
 		return fmt.Errorf("failed to drop template database: %w", err)
 	}
-	t.setup = false
+	t.logger().Info("template dropped", "template", t.name)
 	return nil
 }
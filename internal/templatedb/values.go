@@ -0,0 +1,47 @@
+package templatedb
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+)
+
+// errNotInSetup is returned by SetValue when it is called outside of
+// Config.Setup.
+var errNotInSetup = errors.New("metadata can only be set during the template setup")
+
+type valuesKey struct{}
+
+// setupValues collects the user-defined metadata values set during the setup
+// of the template database. They are recorded in the metadata of the template
+// database once the setup completes.
+type setupValues struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// withSetupValues returns a context that makes SetValue record values in v.
+func withSetupValues(ctx context.Context, v *setupValues) context.Context {
+	return context.WithValue(ctx, valuesKey{}, v)
+}
+
+// SetValue sets the metadata value for key of the template database being set
+// up with ctx, which must be the context passed to Config.Setup.
+func SetValue(ctx context.Context, key, value string) error {
+	v, ok := ctx.Value(valuesKey{}).(*setupValues)
+	if !ok {
+		return errNotInSetup
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[key] = value
+	return nil
+}
+
+// take returns the values that have been set.
+func (v *setupValues) take() map[string]string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return maps.Clone(v.values)
+}
@@ -0,0 +1,52 @@
+package textdiff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnified(t *testing.T) {
+	lines := func(n int) string {
+		var b strings.Builder
+		for i := 1; i <= n; i++ {
+			b.WriteString(strings.Repeat("x", i) + "\n")
+		}
+		return b.String()
+	}
+
+	t.Run("equal", func(t *testing.T) {
+		assert.Empty(t, Unified("a", "b", "same\n", "same\n"))
+	})
+
+	t.Run("changed line", func(t *testing.T) {
+		old := "one\ntwo\nthree\n"
+		new := "one\n2\nthree\n"
+		assert.Equal(t, "--- a\n+++ b\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n", Unified("a", "b", old, new))
+	})
+
+	t.Run("added line at the end", func(t *testing.T) {
+		assert.Equal(t, "--- a\n+++ b\n@@ -1 +1,2 @@\n one\n+two\n", Unified("a", "b", "one\n", "one\ntwo\n"))
+	})
+
+	t.Run("from empty", func(t *testing.T) {
+		assert.Equal(t, "--- a\n+++ b\n@@ -0,0 +1 @@\n+one\n", Unified("a", "b", "", "one\n"))
+	})
+
+	t.Run("distant changes make separate hunks", func(t *testing.T) {
+		old := lines(20)
+		new := strings.Replace(strings.Replace(old, "x\n", "a\n", 1), strings.Repeat("x", 20)+"\n", "b\n", 1)
+		got := Unified("a", "b", old, new)
+		assert.Equal(t, 2, strings.Count(got, "@@ -"), got)
+		assert.Contains(t, got, "@@ -1,4 +1,4 @@\n-x\n+a\n")
+		assert.Contains(t, got, "@@ -17,4 +17,4 @@\n")
+	})
+
+	t.Run("close changes share a hunk", func(t *testing.T) {
+		old := lines(10)
+		new := strings.Replace(strings.Replace(old, "xx\n", "a\n", 1), "xxxxxxx\n", "b\n", 1)
+		got := Unified("a", "b", old, new)
+		assert.Equal(t, 1, strings.Count(got, "@@ -"), got)
+	})
+}
@@ -0,0 +1,99 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yuku/testdbpool/internal/templatedb"
+)
+
+// checkLocale verifies that Config.Encoding, Config.Collate and Config.CType
+// can be used together on the server, and that they match the databases
+// that the template is cloned from or that test databases are cloned from,
+// as PostgreSQL cannot change the locale of a clone of a database other
+// than template0.
+func checkLocale(ctx context.Context, cfg *Config) error {
+	if cfg.Encoding == "" && cfg.Collate == "" && cfg.CType == "" {
+		return nil
+	}
+
+	encoding := cfg.Encoding
+	if encoding != "" {
+		var valid bool
+		err := cfg.Pool.QueryRow(ctx,
+			`SELECT pg_char_to_encoding($1) >= 0, pg_encoding_to_char(pg_char_to_encoding($1))`,
+			cfg.Encoding,
+		).Scan(&valid, &encoding)
+		if err != nil {
+			return fmt.Errorf("failed to check Encoding: %w", err)
+		}
+		if !valid {
+			return fmt.Errorf("Encoding %s is not supported by the server", cfg.Encoding)
+		}
+
+		// A libc locale other than C and POSIX only works with the encoding
+		// of its character set. Locales unknown to pg_collation are left to
+		// CREATE DATABASE to check.
+		for _, locale := range []struct{ field, value string }{
+			{"Collate", cfg.Collate},
+			{"CType", cfg.CType},
+		} {
+			if locale.value == "" {
+				continue
+			}
+			var encodings []string
+			err := cfg.Pool.QueryRow(ctx, `
+				SELECT COALESCE(array_agg(DISTINCT pg_encoding_to_char(collencoding)), '{}')
+				FROM pg_collation
+				WHERE collprovider = 'c' AND collcollate = $1 AND collencoding <> -1`,
+				locale.value,
+			).Scan(&encodings)
+			if err != nil {
+				return fmt.Errorf("failed to check %s: %w", locale.field, err)
+			}
+			if len(encodings) > 0 && !slices.Contains(encodings, encoding) {
+				return fmt.Errorf("%s %s is incompatible with Encoding %s, it requires %s",
+					locale.field, locale.value, encoding, encodings[0])
+			}
+		}
+	}
+
+	template, _ := templatedb.TemplateDatabaseName(cfg.NamePrefix, cfg.ID)
+	source, what := template, "the existing template database"
+	if cfg.SetupFromDatabase != "" {
+		source, what = cfg.SetupFromDatabase, "SetupFromDatabase"
+	} else if cfg.ForceTemplateRecreation {
+		// The template is created from template0 with the locale of cfg.
+		return nil
+	}
+
+	var got struct{ encoding, collate, ctype string }
+	err := cfg.Pool.QueryRow(ctx,
+		`SELECT pg_encoding_to_char(encoding), datcollate, datctype FROM pg_database WHERE datname = $1`,
+		source,
+	).Scan(&got.encoding, &got.collate, &got.ctype)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check locale of %s: %w", source, err)
+	}
+	for _, field := range []struct{ name, want, got string }{
+		{"Encoding", encoding, got.encoding},
+		{"Collate", cfg.Collate, got.collate},
+		{"CType", cfg.CType, got.ctype},
+	} {
+		if field.want == "" || field.want == field.got {
+			continue
+		}
+		err := fmt.Errorf("%s %s is incompatible with %s %s, which has %s", field.name, field.want, what, source, field.got)
+		if cfg.SetupFromDatabase == "" {
+			err = fmt.Errorf("%w; set ForceTemplateRecreation to rebuild it", err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package testdbpool
+
+import (
+	"io"
+	"log/slog"
+	"math"
+)
+
+// discardLogger is the logger used when Config.Logger is nil.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.Level(math.MaxInt)}))
+
+// poolLogger returns the logger for the events of the pool of cfg, which
+// carry the pool ID, or discardLogger if Config.Logger is nil.
+func poolLogger(cfg *Config) *slog.Logger {
+	if cfg.Logger == nil {
+		return discardLogger
+	}
+	return cfg.Logger.With("pool_id", cfg.ID)
+}
+
+// eventLogger returns the logger for the events of p.
+func (p *Pool) eventLogger() *slog.Logger {
+	if p.logger == nil {
+		return discardLogger
+	}
+	return p.logger
+}
+
+// eventLogger returns the logger for the events of db, which carry its index
+// and name.
+func (db *TestDB) eventLogger() *slog.Logger {
+	if db.logger == nil {
+		return discardLogger
+	}
+	return db.logger
+}
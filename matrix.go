@@ -0,0 +1,125 @@
+package testdbpool
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Matrix runs the same test body against test databases from several pools,
+// typically pools on different PostgreSQL servers, as one named subtest per
+// target.
+type Matrix struct {
+	// Parallel makes the subtests of the targets run in parallel.
+	Parallel bool
+
+	// targets are the pools to run tests against, in the order they were added.
+	targets []matrixTarget
+
+	// rootPools are the root connection pools created by MatrixFromEnv.
+	rootPools []*pgxpool.Pool
+}
+
+type matrixTarget struct {
+	name  string
+	pool  *Pool
+	owned bool
+}
+
+// AddTarget adds a target named name that acquires test databases from pool.
+// The name is used as the subtest name, so failures are attributed to it.
+func (m *Matrix) AddTarget(name string, pool *Pool) {
+	m.targets = append(m.targets, matrixTarget{name: name, pool: pool})
+}
+
+// Run runs fn once per target as a subtest named after the target. Each
+// invocation gets a test database acquired from the target's pool, which is
+// released when the subtest finishes.
+func (m *Matrix) Run(t *testing.T, fn func(t *testing.T, db *TestDB)) {
+	t.Helper()
+
+	for _, target := range m.targets {
+		t.Run(target.name, func(t *testing.T) {
+			if m.Parallel {
+				t.Parallel()
+			}
+
+			ctx := context.Background()
+			db, err := target.pool.Acquire(ctx)
+			if err != nil {
+				t.Fatalf("target %s: failed to acquire test database: %v", target.name, err)
+			}
+			t.Cleanup(func() {
+				if err := db.Release(ctx); err != nil {
+					t.Errorf("target %s: failed to release test database: %v", target.name, err)
+				}
+			})
+
+			fn(t, db)
+		})
+	}
+}
+
+// Cleanup cleans up the pools and closes the root connection pools created by
+// MatrixFromEnv. Pools added with AddTarget are left to the caller.
+func (m *Matrix) Cleanup() {
+	for _, target := range m.targets {
+		if target.owned {
+			target.pool.Cleanup()
+		}
+	}
+	for _, rootPool := range m.rootPools {
+		rootPool.Close()
+	}
+}
+
+// MatrixFromEnv builds a Matrix from the comma-separated list of connection
+// strings in the environment variable envVar. For each connection string it
+// creates a root connection pool and a Pool configured like base, except that
+// Pool is set to the new root connection pool and ID is derived from base.ID
+// and the position of the connection string. Targets are named after the
+// position, the host and port of the server and the database, e.g.
+// "0_localhost:5432_postgres", so that connection strings differing only in
+// the database or the user get distinct names.
+// It returns an error if envVar is empty or any target cannot be set up.
+// Call Cleanup on the returned Matrix when done.
+func MatrixFromEnv(ctx context.Context, envVar string, base Config) (*Matrix, error) {
+	value := os.Getenv(envVar)
+	if strings.TrimSpace(value) == "" {
+		return nil, fmt.Errorf("environment variable %s is empty", envVar)
+	}
+
+	m := &Matrix{}
+	for i, dsn := range strings.Split(value, ",") {
+		dsn = strings.TrimSpace(dsn)
+		poolConfig, err := pgxpool.ParseConfig(dsn)
+		if err != nil {
+			m.Cleanup()
+			return nil, fmt.Errorf("failed to parse connection string #%d in %s: %w", i, envVar, err)
+		}
+		conn := poolConfig.ConnConfig
+		name := fmt.Sprintf("%d_%s:%d_%s", i, conn.Host, conn.Port, conn.Database)
+
+		rootPool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+		if err != nil {
+			m.Cleanup()
+			return nil, fmt.Errorf("target %s: failed to create connection pool: %w", name, err)
+		}
+		m.rootPools = append(m.rootPools, rootPool)
+
+		cfg := base
+		cfg.ID = fmt.Sprintf("%s_%d", base.ID, i)
+		cfg.Pool = rootPool
+		pool, err := New(ctx, &cfg)
+		if err != nil {
+			m.Cleanup()
+			return nil, fmt.Errorf("target %s: failed to create pool: %w", name, err)
+		}
+		m.targets = append(m.targets, matrixTarget{name: name, pool: pool, owned: true})
+	}
+	return m, nil
+}
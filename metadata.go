@@ -0,0 +1,56 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"maps"
+
+	"github.com/yuku/testdbpool/internal/templatedb"
+)
+
+// ErrTemplateMetadataReadOnly is returned by Pool.SetTemplateMetadata when it
+// is called outside of the SetupTemplate of the pool. The template metadata is
+// fixed once the template database has been set up; to change it, the template
+// database has to be recreated (see Pool.DropTemplate).
+var ErrTemplateMetadataReadOnly = errors.New("template metadata can only be set during SetupTemplate")
+
+// ErrTemplateMetadataTooNew is matched by errors.Is for the error that New
+// returns when the existing template database has been built by a newer
+// version of this package, whose bookkeeping this version cannot read. Older
+// bookkeeping is migrated, or the template is rebuilt, automatically.
+var ErrTemplateMetadataTooNew = templatedb.ErrMetadataTooNew
+
+type setupPoolKey struct{}
+
+// withSetupPool returns a context that allows Pool.SetTemplateMetadata of the
+// pool with poolID while its SetupTemplate runs.
+func withSetupPool(ctx context.Context, poolID string) context.Context {
+	return context.WithValue(ctx, setupPoolKey{}, poolID)
+}
+
+// SetTemplateMetadata sets the template metadata value for key.
+// It must be called from SetupTemplate with the context passed to it; the
+// metadata is recorded with the template database once it is set up, so it
+// is readable with TemplateMetadata, including by pools that reuse the
+// existing template database later, and with TestDB.Metadata from every test
+// database cloned from it. Otherwise it returns ErrTemplateMetadataReadOnly.
+func (p *Pool) SetTemplateMetadata(ctx context.Context, key, value string) error {
+	if poolID, ok := ctx.Value(setupPoolKey{}).(string); !ok || poolID != p.cfg.ID {
+		return ErrTemplateMetadataReadOnly
+	}
+	return templatedb.SetValue(ctx, key, value)
+}
+
+// TemplateMetadata returns the metadata set with SetTemplateMetadata while the
+// template database was set up. It sets up the template database if it does
+// not exist yet.
+func (p *Pool) TemplateMetadata(ctx context.Context) (map[string]string, error) {
+	return p.templateDB.Values(ctx)
+}
+
+// Metadata returns the template metadata of the template database this test
+// database was created from. Databases acquired with AcquireEmpty have no
+// metadata.
+func (db *TestDB) Metadata(ctx context.Context) (map[string]string, error) {
+	return maps.Clone(db.templateValues), nil
+}
@@ -0,0 +1,94 @@
+// Package migrate sets up testdbpool template databases with golang-migrate,
+// so that tests run against the schema built by the same migrations as
+// production:
+//
+//	cfg.SetupTemplate = migrate.SetupFromMigrate("file://db/migrations")
+//
+// The file:// source driver is registered by this package. Other sources,
+// e.g. iofs for embedded migrations, must be imported by the caller as usual
+// with golang-migrate.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/golang-migrate/migrate/v4"
+	pgxmigrate "github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// SetupFromMigrate returns a function suitable for Config.SetupTemplate that
+// applies all up migrations read from sourceURL, e.g. "file://db/migrations",
+// to the template database.
+//
+// The migrations run with golang-migrate's pgx/v5 database driver on a
+// dedicated connection configured like conn, so they see what was committed
+// on conn before, but not an open transaction of it. The migration version is
+// recorded in the schema_migrations table of the template, and thus of every
+// test database, as in production. If a migration fails, the error names its
+// version and tells that it left the template dirty; the template database
+// is rebuilt from scratch on the next setup.
+func SetupFromMigrate(sourceURL string) func(context.Context, *pgx.Conn) error {
+	return setup(sourceURL, func(m *migrate.Migrate) error {
+		return m.Up()
+	})
+}
+
+// SetupFromMigrateTo is like SetupFromMigrate, but migrates the template
+// database only up to version, e.g. to pin tests to the schema of a release.
+func SetupFromMigrateTo(sourceURL string, version uint) func(context.Context, *pgx.Conn) error {
+	return setup(sourceURL, func(m *migrate.Migrate) error {
+		return m.Migrate(version)
+	})
+}
+
+// setup returns a function that runs run with a Migrate instance of sourceURL
+// for the database of conn.
+func setup(sourceURL string, run func(*migrate.Migrate) error) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		db := stdlib.OpenDB(*conn.Config().Copy())
+		defer db.Close()
+
+		driver, err := pgxmigrate.WithInstance(db, &pgxmigrate.Config{})
+		if err != nil {
+			return fmt.Errorf("failed to create migrate database driver: %w", err)
+		}
+		m, err := migrate.NewWithDatabaseInstance(sourceURL, "pgx5", driver)
+		if err != nil {
+			return fmt.Errorf("failed to create migrate instance for %s: %w", sourceURL, err)
+		}
+		defer m.Close()
+
+		// golang-migrate does not take a context, but stops after the
+		// running migration when asked to.
+		stop := context.AfterFunc(ctx, func() { m.GracefulStop <- true })
+		defer stop()
+
+		err = run(m)
+		if errors.Is(err, migrate.ErrNoChange) {
+			return nil
+		}
+		if err != nil {
+			return describeError(m, err)
+		}
+		return ctx.Err()
+	}
+}
+
+// describeError adds to err, returned by a migration, what state it left the
+// template database in.
+func describeError(m *migrate.Migrate, err error) error {
+	var dirty migrate.ErrDirty
+	if errors.As(err, &dirty) {
+		return fmt.Errorf("template database is dirty at migration version %d, "+
+			"so a previous migration failed partway; fix the migration and retry: %w", dirty.Version, err)
+	}
+	if version, isDirty, verr := m.Version(); verr == nil && isDirty {
+		return fmt.Errorf("migration %d failed and left the template database dirty: %w", version, err)
+	}
+	return fmt.Errorf("failed to migrate template database: %w", err)
+}
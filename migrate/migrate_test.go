@@ -0,0 +1,78 @@
+package migrate_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool"
+	"github.com/yuku/testdbpool/internal/testutil"
+	"github.com/yuku/testdbpool/migrate"
+)
+
+func TestSetupFromMigrate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newPool := func(t *testing.T, id string, setup func(context.Context, *pgx.Conn) error) (*testdbpool.Pool, error) {
+		t.Helper()
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:            id,
+			Pool:          connPool,
+			MaxDatabases:  1,
+			SetupTemplate: setup,
+		})
+		if err == nil {
+			t.Cleanup(pool.Cleanup)
+		}
+		return pool, err
+	}
+	columns := func(t *testing.T, db *testdbpool.TestDB) []string {
+		t.Helper()
+		rows, err := db.Pool().Query(ctx, `
+			SELECT column_name::text FROM information_schema.columns
+			WHERE table_name = 'users' ORDER BY ordinal_position`)
+		require.NoError(t, err)
+		names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		require.NoError(t, err)
+		return names
+	}
+	version := func(t *testing.T, db *testdbpool.TestDB) int64 {
+		t.Helper()
+		var v int64
+		require.NoError(t, db.Pool().QueryRow(ctx, `SELECT version FROM schema_migrations`).Scan(&v))
+		return v
+	}
+
+	t.Run("all migrations", func(t *testing.T) {
+		pool, err := newPool(t, "test-migrate-up", migrate.SetupFromMigrate("file://testdata/migrations"))
+		require.NoError(t, err)
+		db := pool.AcquireT(t)
+		assert.Equal(t, []string{"id", "name", "email"}, columns(t, db))
+		assert.Equal(t, int64(2), version(t, db))
+	})
+
+	t.Run("pinned version", func(t *testing.T) {
+		pool, err := newPool(t, "test-migrate-to", migrate.SetupFromMigrateTo("file://testdata/migrations", 1))
+		require.NoError(t, err)
+		db := pool.AcquireT(t)
+		assert.Equal(t, []string{"id", "name"}, columns(t, db))
+		assert.Equal(t, int64(1), version(t, db))
+	})
+
+	t.Run("failing migration", func(t *testing.T) {
+		pool, err := newPool(t, "test-migrate-broken", migrate.SetupFromMigrate("file://testdata/broken"))
+		if err == nil {
+			_, err = pool.Acquire(ctx)
+		}
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "migration 2 failed and left the template database dirty")
+	})
+}
@@ -0,0 +1 @@
+ALTER TABLE no_such_table ADD COLUMN email TEXT;
@@ -0,0 +1 @@
+CREATE TABLE users (id BIGSERIAL PRIMARY KEY, name TEXT NOT NULL);
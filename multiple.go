@@ -0,0 +1,156 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// acquireMultipleBackoff and maxAcquireMultipleBackoff bound how long
+// AcquireMultiple waits before retrying after giving back a partial group.
+const (
+	acquireMultipleBackoff    = 50 * time.Millisecond
+	maxAcquireMultipleBackoff = time.Second
+)
+
+// AcquireMultiple acquires n test databases at once, for tests that need
+// several isolated databases, e.g. to simulate replication between them.
+// n must be between 1 and Config.MaxDatabases.
+//
+// Acquiring the databases one by one can deadlock when the pool is nearly
+// exhausted: two groups, possibly in different processes sharing the pool
+// ID, may each hold part of the slots while waiting for the rest.
+// AcquireMultiple therefore waits only for the first slot and takes the
+// others only if they are free right away. Otherwise it gives back all the
+// slots it holds and retries after a randomized backoff, until it gets all
+// of them, ctx is done or Config.AcquireTimeout passes. The databases are
+// created once all slots are held. If creating any of them fails or panics,
+// all of them are released.
+//
+// The returned databases can be released individually or together with
+// ReleaseMultiple.
+func (p *Pool) AcquireMultiple(ctx context.Context, n int) ([]*TestDB, error) {
+	if n < 1 || n > p.cfg.MaxDatabases {
+		return nil, fmt.Errorf(
+			"number of databases must be between 1 and %d, got %d",
+			p.cfg.MaxDatabases, n,
+		)
+	}
+	if err := p.beginAcquire(); err != nil {
+		return nil, err
+	}
+	defer p.endAcquire()
+	if err := p.checkDiskBudget(ctx); err != nil {
+		return nil, err
+	}
+
+	p.groupMu.Lock()
+	defer p.groupMu.Unlock()
+
+	start := p.clock.Now()
+	p.eventLogger().Info("waiting for test databases", "count", n)
+	waitCtx, cancel := p.withAcquireTimeout(ctx)
+	resources, err := p.acquireResources(waitCtx, n)
+	cancel()
+	waited := p.clock.Now().Sub(start)
+	if err != nil {
+		p.eventLogger().Warn("failed to acquire test databases", "count", n, "wait", waited, "error", err)
+		return nil, err
+	}
+
+	dbs := make([]*TestDB, 0, n)
+	var claimed claims
+	defer p.undoOnPanic(ctx, &claimed)
+	for i, r := range resources {
+		// createTestDB and seed give back the database at hand on failure.
+		claimed = claims{testDBs: dbs, resources: resources[i+1:]}
+		testDB, err := p.createTestDB(ctx, r, "", waited, p.cloneTemplate)
+		if err == nil {
+			p.initFromTemplate(testDB)
+			// seed releases testDB on failure.
+			err = p.seed(ctx, testDB)
+		}
+		if err != nil {
+			releaseAll(ctx, dbs)
+			p.releaseResources(ctx, resources[i+1:])
+			return nil, fmt.Errorf("failed to acquire test database %d of %d: %w", i+1, n, err)
+		}
+		dbs = append(dbs, testDB)
+	}
+	p.acquires.Add(int64(n))
+	return dbs, nil
+}
+
+// ReleaseMultiple releases all the given test databases, e.g. those returned
+// by AcquireMultiple. It releases every database even if releasing some of
+// them fails, and returns the errors joined.
+func ReleaseMultiple(ctx context.Context, dbs []*TestDB) error {
+	var errs []error
+	for _, db := range dbs {
+		if err := db.Release(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to release test database %s: %w", db.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// acquireResources acquires n resources from the numpool without holding
+// some of them while waiting for others (see AcquireMultiple).
+func (p *Pool) acquireResources(ctx context.Context, n int) ([]resource, error) {
+	backoff := acquireMultipleBackoff
+	begin := p.clock.Now()
+	for {
+		// Give back the slots that previous releases failed to return, as
+		// they might be what this acquisition would otherwise wait for.
+		p.reconcileStranded(ctx)
+
+		start := p.clock.Now()
+		first, err := p.acquireResource(ctx)
+		p.acquireWait.Add(int64(p.clock.Now().Sub(start)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire resource from numpool: %w", p.exhaustedError(ctx, begin, err))
+		}
+
+		held := []resource{first}
+		for len(held) < n {
+			r, err := p.tryAcquireResource(ctx)
+			if err != nil {
+				p.releaseResources(ctx, held)
+				return nil, err
+			}
+			if r == nil {
+				break
+			}
+			held = append(held, r)
+		}
+		if len(held) == n {
+			return held, nil
+		}
+
+		// Let whoever holds the missing slots finish their group.
+		p.releaseResources(ctx, held)
+		timer := p.clock.NewTimer(backoff/2 + rand.N(backoff))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err := p.exhaustedError(ctx, begin, ctx.Err())
+			return nil, fmt.Errorf("failed to acquire %d databases at once: %w", n, err)
+		case <-timer.C():
+		}
+		backoff = min(backoff*2, maxAcquireMultipleBackoff)
+	}
+}
+
+// releaseResources releases resources that have no test database yet back to
+// the numpool. Those that cannot be released are stranded and released again
+// before the next acquisition.
+func (p *Pool) releaseResources(ctx context.Context, resources []resource) {
+	ctx = context.WithoutCancel(ctx)
+	for _, r := range resources {
+		if err := releaseResource(ctx, p.clock, r); err != nil {
+			p.strand(r)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package testdbpool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yuku/testdbpool/internal/templatedb"
+)
+
+// poolMetadata is the metadata recorded with the numpool registration of a
+// pool, so that functions given only the pool ID, such as CleanupPool, find
+// its databases.
+type poolMetadata struct {
+	// NamePrefix is Config.NamePrefix. It is missing for the default prefix
+	// and in registrations made before it was recorded.
+	NamePrefix string `json:"name_prefix,omitempty"`
+
+	// VariantKey is Config.TemplateVariantKey. It is missing for pools
+	// without variants.
+	VariantKey string `json:"variant_key,omitempty"`
+}
+
+// registrationMetadata returns the metadata to record when registering the
+// pool of cfg, or nil if there is nothing to record.
+func registrationMetadata(cfg *Config) json.RawMessage {
+	meta := poolMetadata{VariantKey: cfg.TemplateVariantKey}
+	if cfg.NamePrefix != templatedb.DefaultNamePrefix {
+		meta.NamePrefix = cfg.NamePrefix
+	}
+	if meta == (poolMetadata{}) {
+		return nil
+	}
+	b, _ := json.Marshal(meta)
+	return b
+}
+
+// decodePoolMetadata decodes the metadata of a numpool registration. The
+// name prefix is templatedb.DefaultNamePrefix if none is recorded.
+func decodePoolMetadata(raw []byte) (poolMetadata, error) {
+	var meta poolMetadata
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return poolMetadata{}, fmt.Errorf("failed to decode pool metadata: %w", err)
+		}
+	}
+	if meta.NamePrefix == "" {
+		meta.NamePrefix = templatedb.DefaultNamePrefix
+	}
+	return meta, nil
+}
+
+// namePrefixOf returns the name prefix recorded in the metadata of a numpool
+// registration, which is templatedb.DefaultNamePrefix if none is recorded.
+func namePrefixOf(raw []byte) (string, error) {
+	meta, err := decodePoolMetadata(raw)
+	if err != nil {
+		return "", err
+	}
+	return meta.NamePrefix, nil
+}
+
+// checkNamePrefix returns an error if the registration of the pool of cfg
+// records a name prefix other than Config.NamePrefix, as the databases
+// created with the recorded one would be left behind.
+func checkNamePrefix(cfg *Config, raw []byte) error {
+	recorded, err := namePrefixOf(raw)
+	if err != nil {
+		return err
+	}
+	want := cfg.NamePrefix
+	if want == "" {
+		want = templatedb.DefaultNamePrefix
+	}
+	if recorded != want {
+		return fmt.Errorf("pool %s is registered with NamePrefix %q, got %q; remove it with CleanupPool first to change it",
+			cfg.ID, recorded, want)
+	}
+	return nil
+}
+
+// lookupNamePrefix returns the name prefix of the pool poolID recorded in
+// its numpool registration. It returns templatedb.DefaultNamePrefix if the
+// pool is not registered.
+func lookupNamePrefix(ctx context.Context, pool *pgxpool.Pool, poolID string) (string, error) {
+	var raw []byte
+	err := pool.QueryRow(ctx, `SELECT metadata FROM numpools WHERE id = $1`, poolID).Scan(&raw)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return templatedb.DefaultNamePrefix, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read registration of pool %s: %w", poolID, err)
+	}
+	return namePrefixOf(raw)
+}
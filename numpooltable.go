@@ -0,0 +1,94 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// numpool has no API to inspect the usage of a pool or to release a slot held
+// by another process, so the functions in this file use its numpools table
+// directly. They depend on the layout of the table as of numpool v0.4.5, which
+// is pinned in go.mod and checked by TestNumpoolTableLayout:
+// resource_usage_status is a BIT(64) whose leftmost max_resources_count bits
+// mark the slots in use, and wait_queue holds the acquisitions waiting for a
+// slot.
+
+// numpoolUsage is the usage of a numpool as recorded in the numpools table.
+type numpoolUsage struct {
+	// maxResources is the number of slots.
+	maxResources int
+
+	// used is the number of slots in use.
+	used int
+
+	// waiting is the number of acquisitions waiting for a slot.
+	waiting int
+}
+
+// numpoolUsage reads the usage of the numpool of the pool.
+func (p *Pool) numpoolUsage(ctx context.Context) (numpoolUsage, error) {
+	var usage numpoolUsage
+	var status string
+	err := p.cfg.Pool.QueryRow(ctx,
+		`SELECT resource_usage_status::text, max_resources_count, cardinality(wait_queue) FROM numpools WHERE id = $1`,
+		p.cfg.ID,
+	).Scan(&status, &usage.maxResources, &usage.waiting)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return numpoolUsage{}, fmt.Errorf("numpool %s does not exist", p.cfg.ID)
+	}
+	if err != nil {
+		return numpoolUsage{}, fmt.Errorf("failed to check numpool usage: %w", err)
+	}
+	usage.used = len(slotsInUse(status, usage.maxResources))
+	return usage, nil
+}
+
+// slotsInUse returns the indexes of the slots marked in use in status, the
+// resource_usage_status of a numpool with maxResources slots as text.
+func slotsInUse(status string, maxResources int) []int {
+	var indexes []int
+	for index := range min(maxResources, len(status)) {
+		if status[index] == '1' {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+// releaseSlot clears the bit of the slot index of the numpool poolID and
+// hands the slot over to the first waiter. It must be called in a
+// transaction that has locked the numpool row.
+func releaseSlot(ctx context.Context, tx pgx.Tx, poolID string, index int) error {
+	// The following statements copy how numpool releases a resource and hands
+	// it over to the first waiter, including the channel it notifies.
+	_, err := tx.Exec(ctx, `
+		UPDATE numpools
+		SET resource_usage_status = resource_usage_status & ~(1::BIT(64) << (63 - $2))
+		WHERE id = $1`,
+		poolID, index,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release slot %d: %w", index, err)
+	}
+	_, err = tx.Exec(ctx, `
+		WITH first_waiter AS (
+			SELECT wait_queue[1] AS waiter_id FROM numpools WHERE id = $1 AND cardinality(wait_queue) > 0
+		),
+		updated AS (
+			UPDATE numpools SET wait_queue = wait_queue[2:]
+			WHERE id = $1 AND cardinality(wait_queue) > 0
+			RETURNING true
+		)
+		SELECT pg_notify($2, first_waiter.waiter_id)
+		FROM first_waiter, updated
+		WHERE first_waiter.waiter_id IS NOT NULL`,
+		poolID, "np_"+poolID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to notify waiter of slot %d: %w", index, err)
+	}
+	return nil
+}
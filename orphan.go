@@ -0,0 +1,452 @@
+package testdbpool
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yuku/testdbpool/internal/pgconst"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// takeoverLockID is the advisory lock ID that serializes orphan takeovers so
+// that two processes never take over the same slot.
+const takeoverLockID = 132435465769
+
+// holders tracks which Pool instance holds which slot of the numpool, so that
+// slots held by crashed processes can be taken over (see
+// Config.OrphanTakeoverAfter). numpool itself only records whether a slot is
+// held, not by whom.
+//
+// Each Pool instance has a random holder ID and keeps a dedicated connection
+// that holds a session-level advisory lock derived from it for as long as it
+// lives. The server releases the lock when that connection ends, which
+// includes the process being killed, so a holder whose lock can be taken is
+// dead.
+//
+// A slot is recorded in the holders table after it is acquired and removed
+// before it is released. A slot whose bit is set without a row is therefore
+// being acquired or released by a live holder, and is never taken over.
+type holders struct {
+	// id is the holder ID of this Pool instance.
+	id string
+
+	// conn is the connection that holds the liveness lock of this holder.
+	// It is opened on the first registration.
+	conn *pgx.Conn
+
+	// mu protects conn.
+	mu sync.Mutex
+}
+
+func newHolders() (*holders, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate holder ID: %w", err)
+	}
+	return &holders{id: hex.EncodeToString(b)}, nil
+}
+
+// setupHoldersTable creates the table that records the holders of slots.
+func setupHoldersTable(ctx context.Context, pool *pgxpool.Pool) error {
+	return pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		// CREATE TABLE IF NOT EXISTS is not safe against concurrent creation.
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, takeoverLockID); err != nil {
+			return fmt.Errorf("failed to acquire advisory lock: %w", err)
+		}
+		_, err := tx.Exec(ctx, `
+			CREATE TABLE IF NOT EXISTS testdbpool_holders (
+				pool_id TEXT NOT NULL,
+				index INT NOT NULL,
+				holder_id TEXT NOT NULL,
+				PRIMARY KEY (pool_id, index)
+			)`)
+		if err != nil {
+			return fmt.Errorf("failed to create holders table: %w", err)
+		}
+		return nil
+	})
+}
+
+// registerHolder records that this holder holds the slot index.
+func (p *Pool) registerHolder(ctx context.Context, index int) error {
+	h := p.holders
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The liveness lock must be held before any row refers to this holder.
+	if h.conn == nil || h.conn.IsClosed() {
+		conn, err := pgx.ConnectConfig(ctx, p.cfg.Pool.Config().ConnConfig.Copy())
+		if err != nil {
+			return fmt.Errorf("failed to connect for liveness lock: %w", err)
+		}
+		if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock(hashtextextended($1, 0))`, h.id); err != nil {
+			_ = conn.Close(ctx)
+			return fmt.Errorf("failed to acquire liveness lock: %w", err)
+		}
+		h.conn = conn
+	}
+
+	_, err := p.cfg.Pool.Exec(ctx, `
+		INSERT INTO testdbpool_holders (pool_id, index, holder_id) VALUES ($1, $2, $3)
+		ON CONFLICT (pool_id, index) DO UPDATE SET holder_id = EXCLUDED.holder_id`,
+		p.cfg.ID, index, h.id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register holder of slot %d: %w", index, err)
+	}
+	return nil
+}
+
+// closeHolders releases the liveness lock of this holder.
+func (p *Pool) closeHolders(ctx context.Context) {
+	if p.holders == nil {
+		return
+	}
+	h := p.holders
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn != nil {
+		_ = h.conn.Close(ctx)
+		h.conn = nil
+	}
+}
+
+// heldResource is a resource whose holder is recorded in the holders table.
+type heldResource struct {
+	resource
+	pool *Pool
+}
+
+// Release removes the holder record of the slot and then releases it.
+func (r *heldResource) Release(ctx context.Context) error {
+	_, err := r.pool.cfg.Pool.Exec(ctx,
+		`DELETE FROM testdbpool_holders WHERE pool_id = $1 AND index = $2 AND holder_id = $3`,
+		r.pool.cfg.ID, r.Index(), r.pool.holders.id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to unregister holder of slot %d: %w", r.Index(), err)
+	}
+	return r.resource.Release(ctx)
+}
+
+// acquireResource acquires a resource from the numpool. If
+// Config.OrphanTakeoverAfter is set, slots held by dead processes are taken
+// over every time the acquisition has waited that long.
+func (p *Pool) acquireResource(ctx context.Context) (resource, error) {
+	numPool, err := p.openedNumpool(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.cfg.OrphanTakeoverAfter == 0 {
+		r, err := numPool.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	takeoverCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		for {
+			timer := p.clock.NewTimer(p.cfg.OrphanTakeoverAfter)
+			select {
+			case <-takeoverCtx.Done():
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+			// Failures are retried with the next tick.
+			_, _ = p.takeOverOrphans(takeoverCtx)
+		}
+	}()
+
+	r, err := numPool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.registerHolder(ctx, r.Index()); err != nil {
+		if err2 := r.Release(ctx); err2 != nil {
+			return nil, fmt.Errorf("failed to release resource after error: %w", err2)
+		}
+		return nil, err
+	}
+	return &heldResource{resource: r, pool: p}, nil
+}
+
+// takeOverOrphans releases the slots of the pool whose holders are dead,
+// dropping their databases first. It returns the indexes of the slots that
+// were taken over.
+func (p *Pool) takeOverOrphans(ctx context.Context) ([]int, error) {
+	var taken []int
+	err := p.cfg.Pool.AcquireFunc(ctx, func(conn *pgxpool.Conn) error {
+		// The lock is session-level because DROP DATABASE cannot run in a
+		// transaction block.
+		if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, takeoverLockID); err != nil {
+			return fmt.Errorf("failed to acquire takeover lock: %w", err)
+		}
+		defer func() {
+			_, _ = conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, takeoverLockID)
+		}()
+
+		// Rows are read under the takeover lock, so a slot that another
+		// process took over in the meantime and that got acquired again has
+		// either no row or the row of its new, live holder.
+		rows, err := conn.Query(ctx,
+			`SELECT index, holder_id FROM testdbpool_holders WHERE pool_id = $1 AND holder_id <> $2 ORDER BY index`,
+			p.cfg.ID, p.holders.id,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to query holders: %w", err)
+		}
+		type holder struct {
+			index int
+			id    string
+		}
+		held, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (holder, error) {
+			var h holder
+			err := row.Scan(&h.index, &h.id)
+			return h, err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to query holders: %w", err)
+		}
+
+		alive := map[string]bool{}
+		for _, h := range held {
+			if _, ok := alive[h.id]; !ok {
+				dead, err := isDeadHolder(ctx, conn.Conn(), h.id)
+				if err != nil {
+					return err
+				}
+				alive[h.id] = !dead
+			}
+			if alive[h.id] {
+				continue
+			}
+
+			if err := p.takeOver(ctx, conn.Conn(), h.index, h.id); err != nil {
+				return err
+			}
+			taken = append(taken, h.index)
+		}
+		return nil
+	})
+	return taken, err
+}
+
+// isDeadHolder reports whether the process of the holder has ended, i.e.
+// its liveness lock is free.
+func isDeadHolder(ctx context.Context, conn *pgx.Conn, holderID string) (bool, error) {
+	var free bool
+	err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock(hashtextextended($1, 0))`, holderID).Scan(&free)
+	if err != nil {
+		return false, fmt.Errorf("failed to check liveness of holder %s: %w", holderID, err)
+	}
+	if free {
+		if _, err := conn.Exec(ctx, `SELECT pg_advisory_unlock(hashtextextended($1, 0))`, holderID); err != nil {
+			return false, fmt.Errorf("failed to check liveness of holder %s: %w", holderID, err)
+		}
+	}
+	return free, nil
+}
+
+// takeOver drops the database of the slot index held by the dead holder and
+// releases the slot. It must be called with the takeover lock held.
+func (p *Pool) takeOver(ctx context.Context, conn *pgx.Conn, index int, holderID string) error {
+	name := getTestDBName(p.cfg.NamePrefix, p.cfg.ID, index)
+	query, err := sqlbuild.DropDatabase(name, false)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to drop orphaned database %s: %w", name, err)
+	}
+
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		// Lock the numpool row like numpool itself does before modifying it.
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM numpools WHERE id = $1 FOR UPDATE`, p.cfg.ID); err != nil {
+			return fmt.Errorf("failed to lock numpool: %w", err)
+		}
+
+		// Compare-and-delete: only take over the slot if it is still held by
+		// the dead holder.
+		tag, err := tx.Exec(ctx,
+			`DELETE FROM testdbpool_holders WHERE pool_id = $1 AND index = $2 AND holder_id = $3`,
+			p.cfg.ID, index, holderID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to remove holder of slot %d: %w", index, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return nil
+		}
+
+		return releaseSlot(ctx, tx, p.cfg.ID, index)
+	})
+}
+
+// CleanupOrphans reclaims the slots of the pool id that are marked in use but
+// whose holders are gone, e.g. because a test process was killed by a CI
+// timeout, dropping their test databases and releasing the slots so that the
+// next run has all of them again. It returns the number of slots reclaimed.
+// It does nothing if the pool does not exist, so it can be called from
+// TestMain before New.
+//
+// A slot whose holder is recorded (see Config.OrphanTakeoverAfter) is
+// reclaimed if that holder is dead, and sessions still connected to its
+// database, e.g. queries left running by the killed process, are terminated.
+// Any other slot in use is reclaimed only if no session is connected to its
+// database, as a live holder keeps connections to it. A process that is just
+// acquiring such a slot has not connected yet, so call CleanupOrphans before
+// other processes start acquiring from the pool, not while they do.
+func CleanupOrphans(ctx context.Context, pool *pgxpool.Pool, id string) (int, error) {
+	reclaimed := 0
+	err := pool.AcquireFunc(ctx, func(conn *pgxpool.Conn) error {
+		var exists, hasHolders bool
+		err := conn.QueryRow(ctx,
+			`SELECT to_regclass('numpools') IS NOT NULL, to_regclass('testdbpool_holders') IS NOT NULL`,
+		).Scan(&exists, &hasHolders)
+		if err != nil {
+			return fmt.Errorf("failed to check for numpool tables: %w", err)
+		}
+		if !exists {
+			return nil
+		}
+
+		// Serialize with orphan takeovers of running pools, which may
+		// reclaim the same slots.
+		if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, takeoverLockID); err != nil {
+			return fmt.Errorf("failed to acquire takeover lock: %w", err)
+		}
+		defer func() {
+			_, _ = conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, takeoverLockID)
+		}()
+
+		var status string
+		var maxResources int
+		var metadata []byte
+		err = conn.QueryRow(ctx,
+			`SELECT resource_usage_status::text, max_resources_count, metadata FROM numpools WHERE id = $1`, id,
+		).Scan(&status, &maxResources, &metadata)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read numpool %s: %w", id, err)
+		}
+		namePrefix, err := namePrefixOf(metadata)
+		if err != nil {
+			return err
+		}
+
+		holderIDs := map[int]string{}
+		if hasHolders {
+			rows, err := conn.Query(ctx, `SELECT index, holder_id FROM testdbpool_holders WHERE pool_id = $1`, id)
+			if err != nil {
+				return fmt.Errorf("failed to query holders: %w", err)
+			}
+			var index int
+			var holderID string
+			_, err = pgx.ForEachRow(rows, []any{&index, &holderID}, func() error {
+				holderIDs[index] = holderID
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to query holders: %w", err)
+			}
+		}
+
+		for _, index := range slotsInUse(status, maxResources) {
+			name := getTestDBName(namePrefix, id, index)
+			ok, err := reclaimOrphan(ctx, conn.Conn(), id, index, name, holderIDs[index])
+			if err != nil {
+				return err
+			}
+			if ok {
+				reclaimed++
+			}
+		}
+		return nil
+	})
+	return reclaimed, err
+}
+
+// reclaimOrphan drops the database name of the slot index of the pool poolID
+// and releases the slot if its holder, recorded as holderID or unknown if
+// empty, is gone. It reports whether the slot was reclaimed. It must be
+// called with the takeover lock held.
+func reclaimOrphan(ctx context.Context, conn *pgx.Conn, poolID string, index int, name, holderID string) (bool, error) {
+	if holderID != "" {
+		dead, err := isDeadHolder(ctx, conn, holderID)
+		if err != nil || !dead {
+			return false, err
+		}
+		_, err = conn.Exec(ctx, `
+			SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+			WHERE datname = $1 AND pid <> pg_backend_pid()`,
+			name,
+		)
+		if err != nil {
+			return false, fmt.Errorf("failed to terminate connections to orphaned database %s: %w", name, err)
+		}
+	} else {
+		var connected bool
+		err := conn.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM pg_stat_activity WHERE datname = $1)`, name).Scan(&connected)
+		if err != nil {
+			return false, fmt.Errorf("failed to check connections to %s: %w", name, err)
+		}
+		if connected {
+			return false, nil
+		}
+	}
+
+	query, err := sqlbuild.DropDatabase(name, false)
+	if err != nil {
+		return false, err
+	}
+	if _, err := conn.Exec(ctx, query); err != nil {
+		if pgconst.IsObjectInUse(err) {
+			// Someone connected in the meantime, so the slot is in use.
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to drop orphaned database %s: %w", name, err)
+	}
+
+	reclaimed := false
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		var status string
+		err := tx.QueryRow(ctx, `SELECT resource_usage_status::text FROM numpools WHERE id = $1 FOR UPDATE`, poolID).Scan(&status)
+		if err != nil {
+			return fmt.Errorf("failed to lock numpool: %w", err)
+		}
+		if status[index] != '1' {
+			return nil
+		}
+		if holderID != "" {
+			// Compare-and-delete, as in takeOver.
+			tag, err := tx.Exec(ctx,
+				`DELETE FROM testdbpool_holders WHERE pool_id = $1 AND index = $2 AND holder_id = $3`,
+				poolID, index, holderID,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to remove holder of slot %d: %w", index, err)
+			}
+			if tag.RowsAffected() == 0 {
+				return nil
+			}
+		}
+		if err := releaseSlot(ctx, tx, poolID, index); err != nil {
+			return err
+		}
+		reclaimed = true
+		return nil
+	})
+	return reclaimed, err
+}
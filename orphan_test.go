@@ -0,0 +1,222 @@
+package testdbpool_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+const orphanHolderEnv = "TESTDBPOOL_ORPHAN_HOLDER"
+
+func newOrphanTakeoverPool(t *testing.T) *testdbpool.Pool {
+	t.Helper()
+	pool, err := testdbpool.New(context.Background(), &testdbpool.Config{
+		ID:           "test-orphan-takeover",
+		Pool:         testutil.GetTestDBPool(t),
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE foos (id INT)`)
+			return err
+		},
+		OrphanTakeoverAfter: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	return pool
+}
+
+// TestOrphanHolderProcess is not a real test. It is run as a child process by
+// TestPool_OrphanTakeover to acquire a database and hold it until killed.
+func TestOrphanHolderProcess(t *testing.T) {
+	if os.Getenv(orphanHolderEnv) == "" {
+		t.Skip("only run as a child process")
+	}
+
+	db, err := newOrphanTakeoverPool(t).Acquire(context.Background())
+	require.NoError(t, err)
+	fmt.Println("acquired", db.Name())
+	select {}
+}
+
+func TestPool_OrphanTakeover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool := newOrphanTakeoverPool(t)
+	t.Cleanup(pool.Cleanup)
+
+	// Start a child process that holds the only slot of the pool.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestOrphanHolderProcess$")
+	cmd.Env = append(os.Environ(), orphanHolderEnv+"=1")
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+
+	var name string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if _, err := fmt.Sscanf(scanner.Text(), "acquired %s", &name); err == nil {
+			break
+		}
+	}
+	require.NotEmpty(t, name, "child process failed to acquire a database")
+
+	t.Run("live holders are not taken over", func(t *testing.T) {
+		acquireCtx, cancel := context.WithTimeout(ctx, time.Second)
+		t.Cleanup(cancel)
+		_, err := pool.Acquire(acquireCtx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.True(t, testutil.DBExists(t, connPool, name))
+	})
+
+	t.Run("slots of killed holders are taken over", func(t *testing.T) {
+		require.NoError(t, cmd.Process.Kill())
+		_ = cmd.Wait()
+
+		acquireCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		t.Cleanup(cancel)
+		db, err := pool.Acquire(acquireCtx)
+		require.NoError(t, err)
+		assert.Equal(t, name, db.Name())
+
+		// The database was recreated from the template.
+		exists, err := db.Exists(ctx, "foos", "")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		require.NoError(t, db.Release(ctx))
+	})
+}
+
+func TestCleanupOrphans(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	n, err := testdbpool.CleanupOrphans(ctx, connPool, "test-cleanup-orphans")
+	require.NoError(t, err)
+	assert.Zero(t, n, "nothing to reclaim before the pool exists")
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-cleanup-orphans",
+		Pool:         connPool,
+		MaxDatabases: 2,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	live, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, live.Index())
+
+	// Simulate a process that was killed while holding slot 1: its bit stays
+	// set and its database is left behind without connections.
+	orphan := "testdbpool_test-cleanup-orphans_1"
+	_, err = connPool.Exec(ctx, `
+		UPDATE numpools SET resource_usage_status = resource_usage_status | (1::BIT(64) << 62)
+		WHERE id = $1`,
+		"test-cleanup-orphans",
+	)
+	require.NoError(t, err)
+	_, err = connPool.Exec(ctx, fmt.Sprintf(`CREATE DATABASE %q`, orphan))
+	require.NoError(t, err)
+
+	n, err = testdbpool.CleanupOrphans(ctx, connPool, "test-cleanup-orphans")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.False(t, testutil.DBExists(t, connPool, orphan))
+	assert.True(t, testutil.DBExists(t, connPool, live.Name()), "live database must be kept")
+
+	// The reclaimed slot can be acquired again.
+	acquireCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	db, err := pool.Acquire(acquireCtx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, db.Index())
+	require.NoError(t, db.Release(ctx))
+	require.NoError(t, live.Release(ctx))
+
+	n, err = testdbpool.CleanupOrphans(ctx, connPool, "test-cleanup-orphans")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+// TestNumpoolTableLayout fails if the numpools table of the pinned numpool
+// version no longer has the layout that the slot releases and usage reads of
+// this package rely on (see numpooltable.go).
+func TestNumpoolTableLayout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	// Creating a pool sets up the table.
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-numpool-layout",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	rows, err := connPool.Query(ctx, `
+		SELECT attname, format_type(atttypid, atttypmod)
+		FROM pg_attribute
+		WHERE attrelid = 'numpools'::regclass AND attnum > 0 AND NOT attisdropped
+		ORDER BY attnum`)
+	require.NoError(t, err)
+	columns := map[string]string{}
+	var name, typ string
+	_, err = pgx.ForEachRow(rows, []any{&name, &typ}, func() error {
+		columns[name] = typ
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"id":                    "character varying(100)",
+		"max_resources_count":   "integer",
+		"resource_usage_status": "bit(64)",
+		"wait_queue":            "character varying(100)[]",
+		"metadata":              "jsonb",
+	}, columns)
+
+	// Slot 0 is the leftmost bit of resource_usage_status.
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	var status string
+	err = connPool.QueryRow(ctx,
+		`SELECT resource_usage_status::text FROM numpools WHERE id = $1`, "test-numpool-layout",
+	).Scan(&status)
+	require.NoError(t, err)
+	assert.Equal(t, "1"+strings.Repeat("0", 63), status)
+	require.NoError(t, db.Release(ctx))
+}
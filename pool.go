@@ -2,14 +2,22 @@ package testdbpool
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/yuku/numpool"
+	"github.com/yuku/testdbpool/internal/clock"
 	"github.com/yuku/testdbpool/internal/pgconst"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
 	"github.com/yuku/testdbpool/internal/templatedb"
 )
 
@@ -21,8 +29,17 @@ type Pool struct {
 	manager *numpool.Manager
 
 	// numPool is the numpool instance that manages the resources for this Pool.
+	// It is nil until the first acquisition if the pool was preregistered
+	// (see openedNumpool).
 	numPool *numpool.Numpool
 
+	// numpoolMu protects manager, numPool and numpoolClosed.
+	numpoolMu sync.Mutex
+
+	// numpoolClosed indicates that the Pool has been closed, so that the
+	// numpool must not be opened anymore.
+	numpoolClosed bool
+
 	// templateDB manages the template database used for creating test databases.
 	templateDB *templatedb.TemplateDB
 
@@ -30,10 +47,99 @@ type Pool struct {
 	// The length of this slice is equal to MaxDatabases and each index corresponds
 	// to a resource index in the numpool.
 	testDBs []*TestDB
+
+	// groupMu serializes acquisitions of multiple databases at once within
+	// this Pool, so that its groups do not keep taking slots from each other
+	// (see AcquireMultiple for groups of other processes).
+	groupMu sync.Mutex
+
+	// diskUsage is the cached disk usage used for the disk budget check.
+	diskUsage *DiskUsage
+
+	// diskUsageCheckedAt is the time at which diskUsage was last refreshed.
+	diskUsageCheckedAt time.Time
+
+	// diskMu protects diskUsage and diskUsageCheckedAt.
+	diskMu sync.Mutex
+
+	// stranded is the resources whose release back to the numpool failed.
+	// They are released again before the next acquisition.
+	stranded []resource
+
+	// strandedMu protects stranded.
+	strandedMu sync.Mutex
+
+	// failures are the failures recorded for each slot, by index (see
+	// Config.MaxConsecutiveFailures).
+	failures map[int]*Failure
+
+	// failuresMu protects failures.
+	failuresMu sync.Mutex
+
+	// holders records the slots held by this Pool instance so that other
+	// processes can take them over if this one dies. It is nil unless
+	// Config.OrphanTakeoverAfter is set.
+	holders *holders
+
+	// tryHits and tryMisses count the calls of TryAcquire that did and did
+	// not return a test database.
+	tryHits, tryMisses atomic.Int64
+
+	// acquired is the number of test databases currently acquired through
+	// this Pool.
+	acquired atomic.Int64
+
+	// acquires is the number of successful acquisitions of a test database.
+	acquires atomic.Int64
+
+	// acquireWait is the total time in nanoseconds that acquisitions have
+	// waited for a slot of the numpool.
+	acquireWait atomic.Int64
+
+	// clock is the source of time of this Pool and its test databases.
+	// Tests replace it with a fake clock.
+	clock clock.Clock
+
+	// closeMu protects closing, active and drained.
+	closeMu sync.Mutex
+
+	// closing indicates that CloseWait has been called, so that new
+	// acquisitions fail with ErrPoolClosing.
+	closing bool
+
+	// active is the number of acquisitions in progress plus the number of
+	// test databases acquired and not yet released.
+	active int
+
+	// drained is closed when active drops to zero while CloseWait waits.
+	drained chan struct{}
+
+	// snapshot is the snapshot of the template that test databases are reset
+	// from if Config.ResetBySnapshot is set, or nil otherwise.
+	snapshot *snapshot
+
+	// clonePools are the pools retained for the next acquirer of each index
+	// if Config.ReuseClonePools is set. Like testDBs, the length is equal to
+	// MaxDatabases.
+	clonePools []*pgxpool.Pool
+
+	// clonePoolsClosed indicates that the retained pools have been closed
+	// along with the Pool, so that no more are retained.
+	clonePoolsClosed bool
+
+	// clonePoolsMu protects clonePools and clonePoolsClosed.
+	clonePoolsMu sync.Mutex
+
+	// logger is Config.Logger with the pool ID attached. It is nil if the
+	// Pool was built without New, e.g. in tests, and used through
+	// eventLogger.
+	logger *slog.Logger
 }
 
 type Config struct {
 	// ID is a unique identifier for the TestDBPool instance.
+	// If TemplateVariantKey or SchemaFingerprint is set, the pool is
+	// identified by ID with their hashes appended (see Pool.EffectiveID).
 	ID string
 
 	// Pool is the pgxpool.Pool to use for root database connections.
@@ -44,10 +150,33 @@ type Config struct {
 	// If not set (0), defaults to min(runtime.GOMAXPROCS(0), numpool.MaxResourcesLimit).
 	MaxDatabases int
 
+	// NamePrefix replaces "testdbpool" in the names of the template database,
+	// "<NamePrefix>tmpl_<ID>", and of the test databases,
+	// "<NamePrefix>_<ID>_<index>", e.g. "ci_tmp_test" to match a naming
+	// policy. It must be a valid PostgreSQL identifier, and the names must fit
+	// in 63 bytes. It is recorded when the pool is first registered, and New
+	// fails if it differs from the recorded one.
+	// Optional. Defaults to "testdbpool".
+	NamePrefix string
+
 	// SetupTemplate is called once to set up the template database.
 	// The template database is used as a source for creating test databases.
+	// Required unless SetupFromDatabase is set.
 	SetupTemplate func(context.Context, *pgx.Conn) error
 
+	// SetupFromDatabase is the name of an existing database, e.g. a manually
+	// curated development database, to clone as the template database instead
+	// of building it with SetupTemplate. Connections to it are terminated when
+	// the template is built, as PostgreSQL requires. If SetupTemplate is also
+	// set, it runs on the clone afterwards.
+	// The name, size and time of the clone are recorded in the template
+	// metadata (see Pool.TemplateMetadata) under the keys "testdbpool.source",
+	// "testdbpool.source_bytes" and "testdbpool.source_cloned_at".
+	// To pick up later changes of the source, rebuild the template, e.g. with
+	// Pool.DropTemplate.
+	// Optional.
+	SetupFromDatabase string
+
 	// DatabaseOwner specifies the owner for template and test databases.
 	// If empty, uses the default owner (connection user).
 	//
@@ -65,6 +194,379 @@ type Config struct {
 	//   - Different user: Requires proper role membership or superuser privileges
 	//   - Empty string: Uses connection user as owner (recommended for simplicity)
 	DatabaseOwner string
+
+	// KeepDisallowedConnections stops testdbpool from allowing connections to
+	// template and test databases that the server created with datallowconn
+	// false, as some locked-down servers do for new databases. By default,
+	// such a database is altered with ALLOW_CONNECTIONS true when connecting
+	// to it fails. Either way, if it still refuses connections, it is dropped
+	// and the error explains the policy and the ALTER DATABASE needed.
+	// Optional. Defaults to false.
+	KeepDisallowedConnections bool
+
+	// Encoding, Collate and CType set the character set encoding, LC_COLLATE
+	// and LC_CTYPE of the template and test databases, e.g. "UTF8", "C" and
+	// "C" for byte-order sorting independent of the server default. If any
+	// is set, the template database is created from template0, as locales
+	// differing from template1 require. New fails if the values are not
+	// compatible with each other, with SetupFromDatabase, or with an existing
+	// template database that was created with a different locale.
+	// Optional. If empty, the server defaults are used.
+	Encoding string
+	Collate  string
+	CType    string
+
+	// CloneStrategy selects how test databases are copied from the template
+	// (see CloneStrategyFileCopy and CloneStrategyWALLog). It is ignored on
+	// servers older than PostgreSQL 15, which do not support the choice; the
+	// server version is detected on the first clone.
+	// Optional. If empty, the server default is used.
+	CloneStrategy CloneStrategy
+
+	// CreateRetries is the number of times cloning the template database is
+	// retried when PostgreSQL refuses it because other sessions are connected
+	// to the template, e.g. psql or a monitoring tool that connected after
+	// the leftover sessions were terminated. The retries wait 100ms, doubling
+	// each time, and terminate those sessions again.
+	// If not set (0), defaults to 3.
+	CreateRetries int
+
+	// MaxConsecutiveFailures is the number of failures in a row of a slot,
+	// counting the test databases released with TestDB.ReleaseFailed and the
+	// clones of the template that could not be created for it, after which
+	// Acquire returns a *RecurringFailureError when handed that slot instead
+	// of trying it again. A plain Release of the slot's database clears the
+	// count; Pool.ResetFailures clears all counts.
+	// If not set (0), defaults to 3.
+	MaxConsecutiveFailures int
+
+	// MaxTemplateAge is the maximum age of the template database.
+	// If the existing template database is older than this when New is called,
+	// it is dropped and rebuilt with SetupTemplate on the next Acquire. This is
+	// useful when seed data contains time-relative values that go stale on
+	// long-lived database servers.
+	// If not set (0), the template database is never rebuilt because of its age.
+	MaxTemplateAge time.Duration
+
+	// ForceTemplateRecreation makes this Pool drop an existing template
+	// database and build it again with SetupTemplate the first time it needs
+	// the template, instead of reusing it. It is meant for CI runs in which
+	// the schema may have changed while the pool ID stayed the same.
+	// Connections to the old template are terminated before it is dropped.
+	// Every Pool with this option rebuilds the template once, so with
+	// several processes sharing the pool ID, prefer TemplateVersion.
+	// Optional. Default is false.
+	ForceTemplateRecreation bool
+
+	// TemplateVersion identifies the schema that SetupTemplate builds, e.g.
+	// a hash of the migrations (see HashMigrations). It is recorded in the
+	// template database, and an existing template built for another version
+	// is dropped and rebuilt before any test database is cloned from it.
+	// With several processes sharing the pool ID, the first one to notice
+	// the change rebuilds the template while the others wait, and then
+	// reuse the new template. Released test databases kept for reuse (see
+	// ResetDatabase) that were cloned from the old template are dropped;
+	// those still in use are recreated when they are next acquired.
+	// Optional. If empty, an existing template is reused regardless of how
+	// it was built.
+	TemplateVersion string
+
+	// SchemaFingerprint returns a description of the schema that
+	// SetupTemplate builds, e.g. the contents or a hash of the migrations.
+	// If set, New calls it and identifies the pool, and thus its template and
+	// test databases, by ID followed by a dash and SchemaHashLength hex
+	// digits of its hash, so that a schema change leads to a fresh pool:
+	//
+	//	SchemaFingerprint: func() (string, error) {
+	//		return testdbpool.HashMigrations(os.DirFS("db"), "migrations/*.sql")
+	//	},
+	//
+	// Pools of previous fingerprints can be removed with Pool.CleanupStale.
+	// Optional.
+	SchemaFingerprint func() (string, error)
+
+	// TemplateVariantKey tells apart templates that SetupTemplate builds
+	// differently for the same ID, e.g. "flags=a,b" for a schema that depends
+	// on feature flags. New appends a tilde and a hash of it to ID, so that
+	// every variant gets its own template and test databases instead of
+	// rebuilding a shared one over and over. It is recorded in the template
+	// metadata under the key "testdbpool.variant" and in the pool
+	// registration (see ListPoolsInfo).
+	// Optional. If empty, the pool has no variants.
+	TemplateVariantKey string
+
+	// SetupProgress is called as a multi-step template setup makes progress,
+	// e.g. once per applied migration file, so that a slow first run does not
+	// look hung. Steps are reported by setup helpers of this package and by
+	// SetupTemplate itself through ReportSetupProgress; a SetupTemplate that
+	// does not report steps never triggers it.
+	// Optional.
+	SetupProgress func(step int, total int, desc string)
+
+	// OnTemplateStep is called with the name and duration of each step of
+	// the template setup, to find out where the time of a slow first Acquire
+	// goes. The steps are waiting for the setup lock, which processes sharing
+	// the server take in turn, and, when the template is built, "create
+	// template database" or "clone source database", "run SetupTemplate",
+	// "record metadata" and "drop stale clones". Steps that SetupTemplate
+	// times with TimeTemplateStep, e.g. each migration file, are reported
+	// too, before the "run SetupTemplate" step that contains them.
+	// Optional.
+	OnTemplateStep func(name string, d time.Duration)
+
+	// TemplateSetupTimeout is how long the template setup may hold the
+	// setup lock before OnTemplateSetupTimeout is called. Other processes
+	// sharing the server wait for the lock meanwhile. The setup is not
+	// interrupted.
+	// If not set (0), the duration of the setup is not checked.
+	TemplateSetupTimeout time.Duration
+
+	// MaxTemplateSetupDuration bounds the context passed to SetupTemplate,
+	// so that a hung setup, e.g. a migration waiting on a lock, fails the
+	// Acquire instead of blocking it and the processes waiting for the setup
+	// lock forever. A setup that does not finish in time is an error, and the
+	// partially set up template database is dropped, so that the next
+	// Acquire builds it from scratch.
+	// If not set (0), defaults to 5 minutes.
+	MaxTemplateSetupDuration time.Duration
+
+	// TemplateProgressInterval is how long SetupTemplate may run before a
+	// line reporting its progress is emitted, and how often after that, so
+	// that a slow first build does not look hung. The lines tell the elapsed
+	// time, the step last reported with ReportSetupProgress or
+	// TimeTemplateStep, and that the build is a one-time cost. They are
+	// logged as "template setup in progress" events to Logger and with
+	// t.Logf when the build runs for AcquireT.
+	// If not set (0), defaults to 5 seconds.
+	TemplateProgressInterval time.Duration
+
+	// OnTemplateSetupTimeout is called once, with TemplateSetupTimeout, when
+	// the template setup holds the setup lock for longer than that.
+	// Optional. If nil, a warning is logged to Logger.
+	OnTemplateSetupTimeout func(elapsed time.Duration)
+
+	// ResetDatabase makes released test databases reusable instead of
+	// dropping them. When set, Release runs it against the database, e.g. to
+	// TRUNCATE the tables, and the next Acquire of the same index reuses the
+	// database, skipping the clone from the template. It must bring the
+	// database back to the state of the template, as SeedDatabaseIndexed runs
+	// again on reuse. If it fails, the database is dropped and recreated as
+	// usual. It is not called for databases acquired with AcquireEmpty, and a
+	// database is not reused if the template has been rebuilt since it was
+	// cloned.
+	// Optional.
+	ResetDatabase func(ctx context.Context, conn *pgx.Conn) error
+
+	// ResetBySnapshot resets released test databases like ResetDatabase,
+	// for schemas whose seed data is hard to put back by hand. The data of
+	// the template is dumped with pg_dump --data-only once, on the first
+	// Release, and again after the template is rebuilt; each reset truncates
+	// the tables, restarting their sequences, and restores the dump with
+	// pg_restore. Tables of extensions are left alone. New fails if pg_dump
+	// or pg_restore is not found in PATH; they must be able to dump from and
+	// restore to the server.
+	//
+	// A reset spawns pg_restore and costs about as much as loading the seed
+	// data, while dropping and cloning a database costs about as much as
+	// copying all of the template, including its indexes and catalogs, plus
+	// a checkpoint. The snapshot is faster for large schemas with little
+	// data and slower for small schemas with a lot of it. It must not be set
+	// together with ResetDatabase.
+	// Optional.
+	ResetBySnapshot bool
+
+	// VerifyClean makes Release check, after ResetDatabase or
+	// ResetBySnapshot, that the database has the same tables, views,
+	// sequences and types as the template, so that an object a test created
+	// and left behind does not leak into the tests that reuse the database.
+	// Only the names are compared, against the ones recorded in the template
+	// metadata when the template was built. A database that differs is
+	// dropped instead of being kept, and a *DirtyError describing the
+	// difference is passed to OnDirty. Templates built before VerifyClean
+	// was set have no record, so their clones are always dropped until the
+	// template is rebuilt. It requires ResetDatabase or ResetBySnapshot.
+	// Optional.
+	VerifyClean bool
+
+	// OnDirty is called when VerifyClean finds that a reset database differs
+	// from the template, before the database is dropped, e.g. to fail the
+	// test run or to report which test left the objects behind.
+	// Optional. If nil, the difference is logged like a failed reset.
+	OnDirty func(err *DirtyError)
+
+	// ReuseClonePools keeps the pgxpool.Pool of a test database that has
+	// been reset (see ResetDatabase) open across Release and hands the same
+	// pool to the next acquirer of the same index, so that state kept on its
+	// connections, e.g. prepared statements and the statement cache of pgx,
+	// survives. The retained pool is pinged before it is handed out and
+	// replaced by a new one if that fails. It is closed whenever the database
+	// is dropped instead, e.g. after TestDB.Invalidate or a failed reset.
+	// The connections keep the application_name of the acquisition that
+	// opened them (see AcquireWithLabel). SetupTestDB, if set, makes them
+	// reconnect on every acquisition, which discards that state. It requires
+	// ResetDatabase or ResetBySnapshot.
+	// Optional.
+	ReuseClonePools bool
+
+	// ReuseAcrossRuns keeps released test databases that have been reset
+	// successfully by ResetDatabase or ResetBySnapshot, so that the next run,
+	// e.g. of go test on a developer machine, reuses them without cloning the
+	// template. A kept database is reused, in the same run or the next one,
+	// only if the template has not been rebuilt since and the row count of
+	// ReuseSentinelTable in it still matches the count in the template, which
+	// is recorded in the template metadata; otherwise it is recreated.
+	// Templates built before ReuseAcrossRuns was set have no count, so their
+	// clones are always recreated until the template is rebuilt. A database
+	// whose reset fails is dropped. Close the pool at the end of the run
+	// rather than calling Cleanup, which drops the databases. SetupTestDB and
+	// SeedDatabaseIndexed run again on reuse, so they must be idempotent. It
+	// is meant for local use: a reset that misses changes which keep the row
+	// count of the sentinel table goes unnoticed. It requires ResetDatabase
+	// or ResetBySnapshot.
+	// Optional.
+	ReuseAcrossRuns bool
+
+	// ReuseSentinelTable is the table, optionally schema-qualified, whose row
+	// count tells whether a database kept by ReuseAcrossRuns is still clean,
+	// e.g. a table that every test writes to.
+	// Required if ReuseAcrossRuns is set.
+	ReuseSentinelTable string
+
+	// SeedDatabaseIndexed is called for each test database after it has been
+	// created from the template and before it is returned by Acquire.
+	// index is the stable resource index of the database (see TestDB.Index),
+	// which allows seeding each database differently, e.g. with a different
+	// partition of test data. If it returns an error, the database is dropped
+	// and Acquire fails.
+	// Optional.
+	SeedDatabaseIndexed func(ctx context.Context, conn *pgx.Conn, index int) error
+
+	// SetupTestDB is called for each test database after it has been created
+	// from the template and before SeedDatabaseIndexed, for per-database
+	// configuration that cannot live in the template, e.g. CREATE EXTENSION,
+	// ALTER DATABASE ... SET or creating a logical replication slot. dbName
+	// is the name of the database (see TestDB.Name), which allows generating
+	// identifiers that are unique per database. Connections of TestDB.Pool
+	// are opened afterwards, so that they pick up settings made with ALTER
+	// DATABASE ... SET. Like SeedDatabaseIndexed, it runs again when a
+	// database is reused (see ResetDatabase), and it is not called for
+	// databases acquired with AcquireEmpty. If it returns an error, the
+	// database is dropped and Acquire fails.
+	// Optional.
+	SetupTestDB func(ctx context.Context, conn *pgx.Conn, dbName string) error
+
+	// RequiredExtensions lists PostgreSQL extensions that the template depends on.
+	// New fails if the server does not provide a satisfying version of each of
+	// them, and the template setup fails if SetupTemplate did not install one.
+	// This is verification only; installing the extensions remains the job of
+	// SetupTemplate. Failures are reported as *ExtensionRequirementError.
+	// Optional.
+	RequiredExtensions []ExtensionRequirement
+
+	// RequiredRoles lists PostgreSQL roles that the template and test
+	// databases depend on, e.g. for SET ROLE or GRANT in SetupTemplate.
+	// Roles are cluster-wide, so New creates the ones that do not exist yet
+	// before the template is set up. If the connection user lacks the
+	// CREATEROLE privilege, New fails with *MissingRolesError instead.
+	// Optional.
+	RequiredRoles []RoleSpec
+
+	// SkipRoleCreation makes New only check that RequiredRoles exist and fail
+	// with *MissingRolesError listing the missing ones, without creating them.
+	SkipRoleCreation bool
+
+	// MaxPoolDiskBytes is the disk budget of the pool in bytes, covering the
+	// template database and all test databases (see Pool.DiskUsage).
+	// When the budget is exceeded, Acquire fails with ErrDiskBudgetExceeded
+	// instead of creating another test database.
+	// If not set (0), the disk usage is not checked.
+	MaxPoolDiskBytes int64
+
+	// DiskUsageRefreshInterval is how long the disk usage measured for the
+	// MaxPoolDiskBytes check is cached before it is measured again.
+	// If not set (0), defaults to 10 seconds.
+	DiskUsageRefreshInterval time.Duration
+
+	// ConnStringFunc returns the full connection string for the database named
+	// dbName, which is the template database or a test database.
+	// If set, it is used instead of the connection settings of Pool with the
+	// database name replaced. This is an escape hatch for setups the default
+	// cannot express, e.g. connection service files or custom authentication.
+	// Pool settings such as AfterConnect still apply.
+	// Optional.
+	ConnStringFunc func(dbName string) (string, error)
+
+	// OrphanTakeoverAfter enables taking over slots held by crashed processes
+	// sharing the pool. When an acquisition has waited this long, the slots
+	// whose holding process has ended are released, after dropping their
+	// databases, so that the acquisition can proceed. A process is considered
+	// ended when its dedicated liveness connection to the server is gone.
+	// All processes sharing the pool must set it for their slots to be
+	// taken over.
+	// If not set (0), slots of crashed processes stay held until the pool is
+	// cleaned up.
+	OrphanTakeoverAfter time.Duration
+
+	// AcquireTimeout is how long Acquire and its variants wait for a test
+	// database to become free when all of them are in use, e.g. by other
+	// packages sharing the pool under go test -p. When it passes, they fail
+	// with an error wrapping ErrPoolExhausted, as they do when the deadline
+	// of their context passes first. Use TryAcquire to fail right away.
+	// If not set (0), they wait as long as their context allows.
+	AcquireTimeout time.Duration
+
+	// FailOnTemplateGenerationChange makes Acquire fail with
+	// *TemplateGenerationChangedError when the template database has been
+	// recreated, e.g. by another process sharing the pool ID that called
+	// Cleanup, since this Pool started cloning it. Otherwise a warning is
+	// logged to Logger and the new template is used.
+	// Optional. Default is false.
+	FailOnTemplateGenerationChange bool
+
+	// TerminateLeakedHookSessions makes the pool clean up open transactions
+	// and advisory locks that SetupTemplate, SetupTestDB, SeedDatabaseIndexed
+	// or the link function of AcquireLinked leave behind, logging a warning,
+	// instead of failing with *HookLeakError. Transactions on the connection
+	// given to SetupTemplate, SetupTestDB or SeedDatabaseIndexed are rolled
+	// back. Sessions left open by the link function are terminated even
+	// without this option, so that the databases can be dropped.
+	// Optional. Default is false.
+	TerminateLeakedHookSessions bool
+
+	// ApplicationNamePrefix is the prefix of the application_name of the
+	// connections to test databases acquired with a label, e.g. by AcquireT
+	// (see AcquireWithLabel).
+	// Optional. If empty, the application_name of RuntimeParams or else of
+	// Pool is used, or "testdbpool" if neither has one.
+	ApplicationNamePrefix string
+
+	// RuntimeParams are run-time parameters set on every connection to the
+	// test databases, over those of Pool, e.g. {"statement_timeout": "30s"}
+	// to cancel runaway queries of tests. They do not apply to the template
+	// setup. An application_name in them is used for databases acquired
+	// without a label, and as the default of ApplicationNamePrefix. The
+	// search_path cannot be set, as the test databases resolve names like
+	// the template, with the search_path of Pool.
+	// Optional.
+	RuntimeParams map[string]string
+
+	// LogAcquisitions makes AcquireT log a one-line summary per acquisition
+	// with t.Log when the database is released: the database name, how long
+	// acquiring and releasing it took, and whether the database was created
+	// for it or a database reset by ResetDatabase or ResetBySnapshot was
+	// reused. Like any t.Log output, it is shown with go test -v or when the
+	// test fails.
+	LogAcquisitions bool
+
+	// Logger receives structured events of the pool: template setup started
+	// and finished, test database created, reused and dropped, waiting for a
+	// free database, database acquired (with the wait duration), released,
+	// and reset failures, e.g. to see why tests sit in Acquire when many
+	// packages share a pool. Events carry the attribute "pool_id" and, for
+	// test databases, "index" and "database". Normal events are logged at
+	// the Info level and failures at the Warn level.
+	// Optional. If nil, nothing is logged.
+	Logger *slog.Logger
 }
 
 // Validate checks if the configuration is valid.
@@ -87,16 +589,123 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("MaxDatabases must be between 1 and %d, got %d", numpool.MaxResourcesLimit, c.MaxDatabases)
 	}
 
-	if c.SetupTemplate == nil {
+	if c.NamePrefix != "" && !pgconst.IsValidPostgreSQLIdentifier(c.NamePrefix) {
+		return fmt.Errorf("invalid NamePrefix: %s", c.NamePrefix)
+	}
+	if _, err := templatedb.TemplateDatabaseName(c.NamePrefix, c.ID); err != nil {
+		return fmt.Errorf("NamePrefix and ID are too long: %w", err)
+	}
+	if name := getTestDBName(c.NamePrefix, c.ID, c.MaxDatabases-1); len(name) > pgconst.MaxDatabaseNameLength {
+		return fmt.Errorf("NamePrefix and ID are too long: test database name exceeds maximum length of %d characters: %s",
+			pgconst.MaxDatabaseNameLength, name)
+	}
+
+	if c.SetupTemplate == nil && c.SetupFromDatabase == "" {
 		return fmt.Errorf("SetupTemplate function is required")
 	}
 
+	if c.ResetBySnapshot && c.ResetDatabase != nil {
+		return fmt.Errorf("ResetBySnapshot must not be set together with ResetDatabase")
+	}
+
+	if c.ReuseClonePools && c.ResetDatabase == nil && !c.ResetBySnapshot {
+		return fmt.Errorf("ReuseClonePools requires ResetDatabase or ResetBySnapshot")
+	}
+
+	if c.VerifyClean && c.ResetDatabase == nil && !c.ResetBySnapshot {
+		return fmt.Errorf("VerifyClean requires ResetDatabase or ResetBySnapshot")
+	}
+
+	if c.OnDirty != nil && !c.VerifyClean {
+		return fmt.Errorf("OnDirty requires VerifyClean")
+	}
+
+	if c.ReuseAcrossRuns && c.ReuseSentinelTable == "" {
+		return fmt.Errorf("ReuseAcrossRuns requires ReuseSentinelTable")
+	}
+
+	if c.ReuseAcrossRuns && c.ResetDatabase == nil && !c.ResetBySnapshot {
+		return fmt.Errorf("ReuseAcrossRuns requires ResetDatabase or ResetBySnapshot")
+	}
+
+	if c.SetupFromDatabase != "" {
+		template, _ := templatedb.TemplateDatabaseName(c.NamePrefix, c.ID)
+		if c.SetupFromDatabase == template || strings.HasPrefix(c.SetupFromDatabase, templatedb.TestDatabasePrefix(c.NamePrefix, c.ID)) {
+			return fmt.Errorf("SetupFromDatabase must not be a database of the pool itself, got %s", c.SetupFromDatabase)
+		}
+	}
+
 	if c.DatabaseOwner != "" {
 		if !pgconst.IsValidPostgreSQLIdentifier(c.DatabaseOwner) {
 			return fmt.Errorf("invalid DatabaseOwner: %s", c.DatabaseOwner)
 		}
 	}
 
+	switch c.CloneStrategy {
+	case CloneStrategyDefault, CloneStrategyFileCopy, CloneStrategyWALLog:
+	default:
+		return fmt.Errorf("invalid CloneStrategy: %s", c.CloneStrategy)
+	}
+
+	if c.CreateRetries < 0 {
+		return fmt.Errorf("CreateRetries must not be negative, got %d", c.CreateRetries)
+	}
+
+	if c.MaxConsecutiveFailures < 0 {
+		return fmt.Errorf("MaxConsecutiveFailures must not be negative, got %d", c.MaxConsecutiveFailures)
+	}
+
+	if c.MaxTemplateAge < 0 {
+		return fmt.Errorf("MaxTemplateAge must not be negative, got %s", c.MaxTemplateAge)
+	}
+
+	for _, ext := range c.RequiredExtensions {
+		if ext.Name == "" {
+			return fmt.Errorf("RequiredExtensions must not contain an empty name")
+		}
+	}
+
+	if err := validateRoles(c.RequiredRoles); err != nil {
+		return err
+	}
+
+	for name := range c.RuntimeParams {
+		if name == "" {
+			return fmt.Errorf("RuntimeParams must not contain an empty name")
+		}
+		if strings.EqualFold(name, "search_path") {
+			return fmt.Errorf("RuntimeParams must not set search_path; set it on Pool instead")
+		}
+	}
+
+	if c.MaxPoolDiskBytes < 0 {
+		return fmt.Errorf("MaxPoolDiskBytes must not be negative, got %d", c.MaxPoolDiskBytes)
+	}
+
+	if c.DiskUsageRefreshInterval < 0 {
+		return fmt.Errorf("DiskUsageRefreshInterval must not be negative, got %s", c.DiskUsageRefreshInterval)
+	}
+
+	if c.TemplateSetupTimeout < 0 {
+		return fmt.Errorf("TemplateSetupTimeout must not be negative, got %s", c.TemplateSetupTimeout)
+	}
+
+	if c.MaxTemplateSetupDuration < 0 {
+		return fmt.Errorf("MaxTemplateSetupDuration must not be negative, got %s", c.MaxTemplateSetupDuration)
+	}
+
+	if c.TemplateProgressInterval < 0 {
+		return fmt.Errorf("TemplateProgressInterval must not be negative, got %s", c.TemplateProgressInterval)
+	}
+
+	if c.OrphanTakeoverAfter < 0 {
+		return fmt.Errorf("OrphanTakeoverAfter must not be negative, got %s", c.OrphanTakeoverAfter)
+	}
+
+	if c.AcquireTimeout < 0 {
+		return fmt.Errorf("AcquireTimeout must not be negative, got %s", c.AcquireTimeout)
+	}
+
 	return nil
 }
 
@@ -108,49 +717,409 @@ func New(ctx context.Context, cfg *Config) (*Pool, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
+	if cfg.ResetBySnapshot {
+		if err := checkSnapshotTools(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.TemplateVariantKey != "" || cfg.SchemaFingerprint != nil {
+		// Work on a copy so that cfg can be passed to New again.
+		effective := *cfg
+		// The fingerprint suffix comes last, as CleanupStale expects.
+		effective.ID = cfg.ID + variantSuffix(cfg.TemplateVariantKey)
+		if cfg.SchemaFingerprint != nil {
+			fingerprint, err := cfg.SchemaFingerprint()
+			if err != nil {
+				return nil, fmt.Errorf("failed to compute schema fingerprint: %w", err)
+			}
+			effective.ID += fingerprintSuffix(fingerprint)
+		}
+		// The suffixes make the database names longer.
+		if err := effective.Validate(); err != nil {
+			return nil, err
+		}
+		cfg = &effective
+	}
+
+	if err := checkAvailableExtensions(ctx, cfg.Pool, cfg.RequiredExtensions); err != nil {
+		return nil, err
+	}
 
-	// Setup numpool database if needed
-	manager, err := numpool.Setup(ctx, cfg.Pool)
+	if err := ensureRoles(ctx, cfg.Pool, cfg.RequiredRoles, cfg.SkipRoleCreation); err != nil {
+		return nil, err
+	}
+
+	if cfg.SetupFromDatabase != "" {
+		var exists bool
+		err := cfg.Pool.
+			QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)`, cfg.SetupFromDatabase).
+			Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if source database exists: %w", err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("source database %s does not exist", cfg.SetupFromDatabase)
+		}
+	}
+
+	if err := checkLocale(ctx, cfg); err != nil {
+		return nil, err
+	}
+
+	// Check for a registration made by Preregister to skip creating what
+	// already exists, and to report a mismatching MaxDatabases early.
+	reg, err := lookupRegistration(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to setup numpool: %w", err)
+		return nil, err
 	}
 
-	// Create or open numpool
-	numPool, err := manager.GetOrCreate(ctx, numpool.Config{
-		ID:                cfg.ID,
-		MaxResourcesCount: int32(cfg.MaxDatabases),
-	})
+	// A preregistered numpool is opened on the first acquisition instead,
+	// which spares New the setup of numpool.
+	var manager *numpool.Manager
+	var numPool *numpool.Numpool
+	if reg.exists {
+		if err := checkNamePrefix(cfg, reg.metadata); err != nil {
+			return nil, err
+		}
+	} else {
+		manager, numPool, err = openNumpool(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	closeManager := func() {
+		if manager != nil {
+			manager.Close() // Closing manager also closes the numpool
+		}
+	}
+
+	// Record the session environment of the root pool so that the template
+	// setup and the test databases resolve unqualified names the same way.
+	sessionParams, err := templatedb.QuerySessionParams(ctx, cfg.Pool)
 	if err != nil {
-		manager.Close()
-		return nil, fmt.Errorf("failed to create numpool: %w", err)
+		closeManager()
+		return nil, err
 	}
 
+	// The Pool, its template setup and the template database share one clock,
+	// so that a fake clock in tests drives all of them.
+	clk := clock.Real
+
 	templateDB, err := templatedb.New(&templatedb.Config{
 		PoolID:        cfg.ID,
+		NamePrefix:    cfg.NamePrefix,
 		ConnPool:      cfg.Pool,
-		Setup:         cfg.SetupTemplate,
+		Setup:         checkedHook(cfg, "SetupTemplate", setupTemplateFunc(cfg, clk)),
 		DatabaseOwner: cfg.DatabaseOwner,
+		MaxAge:        cfg.MaxTemplateAge,
+		ForceRecreate: cfg.ForceTemplateRecreation,
+		Version:       cfg.TemplateVersion,
+		Source:        cfg.SetupFromDatabase,
+		SessionParams: &sessionParams,
+		ConnString:    cfg.ConnStringFunc,
+		Encoding:      cfg.Encoding,
+		Collate:       cfg.Collate,
+		CType:         cfg.CType,
+		Strategy:      string(cfg.CloneStrategy),
+		CreateRetries: createRetries(cfg),
+		RuntimeParams: cfg.RuntimeParams,
+
+		KeepDisallowedConnections: cfg.KeepDisallowedConnections,
+
+		OnStep:           cfg.OnTemplateStep,
+		SlowAfter:        cfg.TemplateSetupTimeout,
+		OnSlow:           onTemplateSetupTimeout(cfg),
+		MaxSetupDuration: maxTemplateSetupDuration(cfg),
+
+		OnGenerationChange: onTemplateGenerationChange(cfg),
+		VerifyReleased:     verifyReleasedFunc(cfg),
+
+		WrapTracer: func(next pgx.QueryTracer) pgx.QueryTracer {
+			return &queryCounter{next: next}
+		},
+
+		Clock:  clk,
+		Logger: poolLogger(cfg),
 	})
 	if err != nil {
-		manager.Close() // Closing manager also closes the numpool
+		closeManager()
 		return nil, fmt.Errorf("failed to create template database: %w", err)
 	}
 
+	// Bring the bookkeeping of a template built by another version of this
+	// package up to date before relying on it.
+	action, err := templateDB.MigrateMetadata(ctx)
+	if err != nil {
+		closeManager()
+		return nil, fmt.Errorf("failed to migrate template database metadata: %w", err)
+	}
+	if action != "" {
+		poolLogger(cfg).Info("template database metadata migrated", "action", action)
+	}
+
+	if err := templateDB.DropIfStale(ctx); err != nil {
+		closeManager()
+		return nil, fmt.Errorf("failed to drop stale template database: %w", err)
+	}
+
+	if !reg.activityTable {
+		if err := setupActivityTable(ctx, cfg.Pool); err != nil {
+			closeManager()
+			return nil, err
+		}
+	}
+
+	var h *holders
+	if cfg.OrphanTakeoverAfter > 0 {
+		if !reg.holdersTable {
+			if err := setupHoldersTable(ctx, cfg.Pool); err != nil {
+				closeManager()
+				return nil, err
+			}
+		}
+		if h, err = newHolders(); err != nil {
+			closeManager()
+			return nil, err
+		}
+	}
+
 	return &Pool{
 		cfg:        cfg,
 		manager:    manager,
 		numPool:    numPool,
 		templateDB: templateDB,
 		testDBs:    make([]*TestDB, cfg.MaxDatabases),
+		clonePools: make([]*pgxpool.Pool, cfg.MaxDatabases),
+		snapshot:   newSnapshot(cfg, templateDB),
+		holders:    h,
+		clock:      clk,
+		logger:     poolLogger(cfg),
 	}, nil
 }
 
+// setupTemplateFunc returns the function that sets up the template database,
+// which runs cfg.SetupTemplate with progress reporting and template metadata
+// writes enabled, reporting its progress with clk if it is slow, and then
+// verifies cfg.RequiredExtensions.
+func setupTemplateFunc(cfg *Config, clk clock.Clock) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		if cfg.SetupTemplate != nil {
+			setupCtx := withTemplateStep(withSetupProgress(ctx, cfg.SetupProgress), cfg.OnTemplateStep, clk)
+			setupCtx = withSetupPool(setupCtx, cfg.ID)
+			setupCtx, stop := watchTemplateProgress(setupCtx, cfg, clk)
+			defer stop()
+			if err := cfg.SetupTemplate(setupCtx, conn); err != nil {
+				return err
+			}
+		}
+		if cfg.TemplateVariantKey != "" {
+			if err := templatedb.SetValue(ctx, templateVariantKey, cfg.TemplateVariantKey); err != nil {
+				return fmt.Errorf("failed to record template variant: %w", err)
+			}
+		}
+		if cfg.ReuseAcrossRuns {
+			if err := recordSentinelRows(ctx, conn, cfg.ReuseSentinelTable); err != nil {
+				return err
+			}
+		}
+		if cfg.VerifyClean {
+			if err := recordObjects(ctx, conn); err != nil {
+				return err
+			}
+		}
+		return checkInstalledExtensions(ctx, conn, cfg.RequiredExtensions)
+	}
+}
+
 // Acquire acquires a test database from the pool.
 func (p *Pool) Acquire(ctx context.Context) (*TestDB, error) {
-	resource, err := p.numPool.Acquire(ctx)
+	return p.AcquireWithLabel(ctx, "")
+}
+
+// AcquireWithLabel acquires a test database from the pool like Acquire and
+// tags its connections with label, typically the name of the test, so that
+// the sessions of a hung test can be told apart on the server. The
+// application_name of the connections is set to
+// "<prefix>/<pool ID>/<index>/<label>", where prefix is
+// Config.ApplicationNamePrefix:
+//
+//	SELECT application_name, state, query FROM pg_stat_activity
+//	WHERE application_name LIKE 'testdbpool/%';
+//
+// Characters other than ASCII letters, digits and "/._-=:" are replaced with
+// "_". A name longer than the 63 bytes PostgreSQL keeps is truncated and ends
+// with "~" and a hash of the full name. If label is empty, the connections
+// keep the application_name of the root pool.
+func (p *Pool) AcquireWithLabel(ctx context.Context, label string) (*TestDB, error) {
+	testDB, err := p.acquire(ctx, label, p.cloneTemplate)
+	if err != nil {
+		return nil, err
+	}
+	p.initFromTemplate(testDB)
+	if err := p.seed(ctx, testDB); err != nil {
+		return nil, err
+	}
+	p.acquires.Add(1)
+	return testDB, nil
+}
+
+// initFromTemplate sets up testDB, which has been created from the template.
+func (p *Pool) initFromTemplate(testDB *TestDB) {
+	testDB.templateGeneration, testDB.templateValues = p.templateDB.Current()
+	reset := p.cfg.ResetDatabase
+	if p.snapshot != nil {
+		reset = p.snapshot.reset
+	}
+	if reset != nil && p.cfg.VerifyClean {
+		reset = verifiedReset(p.cfg, reset, testDB.templateValues)
+	}
+	if reset != nil {
+		testDB.reset = checkedHook(p.cfg, "ResetDatabase", reset)
+		if p.cfg.ReuseClonePools {
+			testDB.retainPool = p.retainClonePool
+		}
+	}
+	testDB.keepReleased = p.cfg.ReuseAcrossRuns
+}
+
+// seed runs Config.SetupTestDB and Config.SeedDatabaseIndexed against
+// testDB, releasing it on failure.
+func (p *Pool) seed(ctx context.Context, testDB *TestDB) error {
+	if p.cfg.SetupTestDB == nil && p.cfg.SeedDatabaseIndexed == nil {
+		return nil
+	}
+	defer p.undoOnPanic(ctx, &claims{testDBs: []*TestDB{testDB}})
+
+	if p.cfg.SetupTestDB != nil {
+		err := testDB.pool.AcquireFunc(ctx, func(conn *pgxpool.Conn) error {
+			if err := p.cfg.SetupTestDB(ctx, conn.Conn(), testDB.Name()); err != nil {
+				return err
+			}
+			return checkHookConn(ctx, p.cfg, "SetupTestDB", conn.Conn())
+		})
+		if err != nil {
+			return releaseAfterError(ctx, testDB, fmt.Errorf("failed to set up test database: %w", err))
+		}
+		// Settings made with ALTER DATABASE ... SET only apply to sessions
+		// started afterwards.
+		testDB.pool.Reset()
+	}
+
+	if p.cfg.SeedDatabaseIndexed != nil {
+		err := testDB.pool.AcquireFunc(ctx, func(conn *pgxpool.Conn) error {
+			if err := p.cfg.SeedDatabaseIndexed(ctx, conn.Conn(), testDB.Index()); err != nil {
+				return err
+			}
+			return checkHookConn(ctx, p.cfg, "SeedDatabaseIndexed", conn.Conn())
+		})
+		if err != nil {
+			return releaseAfterError(ctx, testDB, fmt.Errorf("failed to seed test database: %w", err))
+		}
+	}
+	return nil
+}
+
+// releaseAfterError releases testDB, whose preparation failed with err, and
+// returns err, or the error of the release if that fails as well.
+func releaseAfterError(ctx context.Context, testDB *TestDB, err error) error {
+	if err2 := testDB.Release(ctx); err2 != nil {
+		return fmt.Errorf("failed to release test database after error: %w", err2)
+	}
+	return err
+}
+
+// AcquireEmpty acquires a test database that is created from template0 instead
+// of the pool's template, so it contains no schema at all. It is meant for
+// testing migrations themselves, starting from an empty database.
+// The database occupies a slot of the pool like any other test database and
+// is dropped on Release. SeedDatabaseIndexed is not called for it.
+func (p *Pool) AcquireEmpty(ctx context.Context) (*TestDB, error) {
+	testDB, err := p.acquire(ctx, "", p.createEmpty)
+	if err != nil {
+		return nil, err
+	}
+	p.acquires.Add(1)
+	return testDB, nil
+}
+
+// AcquireT acquires a test database from the pool for the test t and
+// releases it when t and all its subtests complete. It fails t if the
+// database cannot be acquired or released. The database is labelled with
+// t.Name() (see AcquireWithLabel).
+// If Config.LogAcquisitions is set, it logs a summary of the acquisition.
+func (p *Pool) AcquireT(t testing.TB) *TestDB {
+	t.Helper()
+	// A slow template build for t reports its progress to t.
+	ctx := withProgressTB(context.Background(), t)
+
+	start := p.clock.Now()
+	db, err := p.AcquireWithLabel(ctx, t.Name())
 	if err != nil {
+		t.Fatalf("failed to acquire test database: %v", err)
+	}
+	acquireDuration := p.clock.Now().Sub(start)
+
+	t.Cleanup(func() {
+		name := db.Name()
+		start := p.clock.Now()
+		if err := db.Release(ctx); err != nil {
+			t.Errorf("failed to release test database %s: %v", name, err)
+			return
+		}
+		if p.cfg.LogAcquisitions {
+			t.Logf("testdbpool: %s acquire=%s release=%s recreated=%t",
+				name, acquireDuration, p.clock.Now().Sub(start), db.recreated)
+		}
+	})
+	return db
+}
+
+// acquire acquires a resource from the numpool and creates the test database
+// labelled with label for it with create.
+func (p *Pool) acquire(
+	ctx context.Context,
+	label string,
+	create createFunc,
+) (*TestDB, error) {
+	if err := p.beginAcquire(); err != nil {
+		return nil, err
+	}
+	defer p.endAcquire()
+	if err := p.checkDiskBudget(ctx); err != nil {
+		return nil, err
+	}
+
+	// Give back the slots that previous releases failed to return, as they
+	// might be what this acquisition would otherwise wait for.
+	p.reconcileStranded(ctx)
+
+	start := p.clock.Now()
+	p.eventLogger().Info("waiting for a test database", "label", label)
+	waitCtx, cancel := p.withAcquireTimeout(ctx)
+	resource, err := p.acquireResource(waitCtx)
+	waited := p.clock.Now().Sub(start)
+	p.acquireWait.Add(int64(waited))
+	if err != nil {
+		err = p.exhaustedError(waitCtx, start, err)
+		cancel()
+		p.eventLogger().Warn("failed to acquire a test database", "wait", waited, "error", err)
 		return nil, fmt.Errorf("failed to acquire resource from numpool: %w", err)
 	}
+	cancel()
+	return p.createTestDB(ctx, resource, label, waited, create)
+}
+
+// createTestDB creates the test database labelled with label for the acquired
+// resource with create, after waiting for the resource for waited. The
+// resource is released if the database cannot be created.
+func (p *Pool) createTestDB(
+	ctx context.Context,
+	resource resource,
+	label string,
+	waited time.Duration,
+	create createFunc,
+) (*TestDB, error) {
 	if resource == nil {
 		// should not happen, but just in case
 		return nil, fmt.Errorf("acquired nil resource from numpool")
@@ -175,34 +1144,114 @@ func (p *Pool) Acquire(ctx context.Context) (*TestDB, error) {
 		return nil, fmt.Errorf("test database at index %d is already acquired", dbIndex)
 	}
 
-	// Create database from template using DROP DATABASE strategy
-	dbName := getTestDBName(p.cfg.ID, dbIndex)
-	pool, err := p.templateDB.Create(ctx, dbName)
-	if err != nil {
-		if err2 := resource.Release(ctx); err2 != nil {
-			return nil, fmt.Errorf("failed to release resource after error: %w", err2)
+	// Create the database using DROP DATABASE strategy
+	dbName := getTestDBName(p.cfg.NamePrefix, p.cfg.ID, dbIndex)
+	var appName string
+	if label != "" {
+		appName = applicationName(applicationNamePrefix(p.cfg), p.cfg.ID, dbIndex, label)
+	}
+
+	// Until the TestDB owns them, the slot is given back and the database
+	// dropped if create fails or panics, e.g. in a user-supplied hook.
+	owned := false
+	defer func() {
+		if !owned {
+			p.abandon(ctx, resource, dbName)
 		}
-		return nil, fmt.Errorf("failed to create test database: %w", err)
+	}()
+	if err := p.checkFailures(dbIndex); err != nil {
+		return nil, err
+	}
+	pool, reused, err := create(ctx, dbIndex, dbName, appName)
+	if err != nil {
+		err = fmt.Errorf("failed to create test database: %w", err)
+		p.recordFailure(dbIndex, err)
+		return nil, err
 	}
 
-	p.testDBs[dbIndex] = &TestDB{
-		poolID:   p.cfg.ID,
-		pool:     pool,
-		resource: resource,
-		rootPool: p.cfg.Pool,
+	testDB := &TestDB{
+		poolID:    p.cfg.ID,
+		queries:   queryCounterOf(pool),
+		label:     label,
+		pool:      pool,
+		recreated: !reused,
+		resource:  resource,
+		rootPool:  p.cfg.Pool,
 		onRelease: func(index int) {
 			if index < len(p.testDBs) {
 				p.testDBs[index] = nil
 			}
+			p.acquired.Add(-1)
+			p.endAcquire()
 		},
+		onStranded: p.strand,
+		onOutcome:  p.recordOutcome,
+		onUse:      p.recordUse,
+		clock:      p.clock,
+		logger:     p.eventLogger().With("index", dbIndex, "database", dbName),
+	}
+	p.testDBs[dbIndex] = testDB
+	p.acquired.Add(1)
+	p.holdTestDB()
+	owned = true
+	p.recordUse(ctx)
+	testDB.logger.Info("test database acquired", "label", label, "wait", waited)
+	return testDB, nil
+}
+
+// AcquireLinked acquires n test databases at once and runs link against them
+// before returning. It is meant for tests that exercise cross-database code
+// paths such as postgres_fdw or dblink, where link typically creates foreign
+// servers and user mappings pointing at the sibling databases' names.
+//
+// The databases are cloned from the same template and their names, as
+// reported by TestDB.Name, stay stable until each of them is released.
+// If acquisition or link fails or panics, all databases acquired so far are
+// released.
+// On success, the returned databases can be released individually.
+func (p *Pool) AcquireLinked(
+	ctx context.Context,
+	n int,
+	link func(ctx context.Context, dbs []*TestDB) error,
+) ([]*TestDB, error) {
+	dbs, err := p.AcquireMultiple(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+
+	if link != nil {
+		defer p.undoOnPanic(ctx, &claims{testDBs: dbs})
+		if err := link(ctx, dbs); err != nil {
+			releaseAll(ctx, dbs)
+			return nil, fmt.Errorf("failed to link test databases: %w", err)
+		}
+		names := make([]string, len(dbs))
+		for i, db := range dbs {
+			names[i] = db.Name()
+		}
+		if err := p.checkHookSessions(ctx, "AcquireLinked link", names); err != nil {
+			releaseAll(ctx, dbs)
+			return nil, err
+		}
+	}
+	return dbs, nil
+}
+
+// releaseAll releases the given test databases, ignoring any errors.
+// It is used to roll back partially completed acquisitions, so it does not
+// give up when ctx has already been cancelled.
+func releaseAll(ctx context.Context, dbs []*TestDB) {
+	ctx = context.WithoutCancel(ctx)
+	for _, db := range dbs {
+		_ = db.Release(ctx)
 	}
-	return p.testDBs[dbIndex], nil
 }
 
 // Close closes all resources generated by this Pool.
 // It does not close the given root pgxpool.Pool since it is caller's
 // responsibility to manage that connection pool.
 func (p *Pool) Close(ctx context.Context) error {
+	p.closeClonePools()
 	for _, testDB := range p.testDBs {
 		if testDB != nil {
 			if err := testDB.Release(ctx); err != nil {
@@ -211,33 +1260,184 @@ func (p *Pool) Close(ctx context.Context) error {
 		}
 	}
 
-	p.manager.Close()
+	p.reconcileStranded(ctx)
+	p.closeNumpool()
+	p.closeHolders(ctx)
 	p.testDBs = nil
 	return nil
 }
 
+// defaultCleanupConcurrency is the default value of CleanupOptions.Concurrency.
+const defaultCleanupConcurrency = 8
+
+// beforeCleanupDrop, if not nil, is called by each worker of CleanupContext
+// right before dropping a database. It is set by tests to observe the number
+// of drops in flight.
+var beforeCleanupDrop func(name string)
+
+// CleanupOptions configures CleanupContext.
+type CleanupOptions struct {
+	// Concurrency is the maximum number of test databases dropped at the same
+	// time. Dropping many databases at once causes lock contention on the
+	// server, which makes cleanup slower rather than faster.
+	// If not set (0), defaults to 8. CleanupAllPools ignores it.
+	Concurrency int
+
+	// DryRun makes CleanupAllPools report the pools and databases it would
+	// remove without removing them. CleanupContext ignores it.
+	DryRun bool
+
+	// OlderThan makes CleanupAllPools remove only the pools whose test
+	// databases were last acquired or released, and whose template database
+	// was built, longer ago than OlderThan, according to the clock of the
+	// server. Pools with no record of either are removed only if they have
+	// no test databases. CleanupContext ignores it.
+	// If not set (0), all pools are removed.
+	OlderThan time.Duration
+}
+
+// CleanupResult reports what CleanupContext did.
+type CleanupResult struct {
+	// Databases lists the outcome of dropping each test database, ordered by index.
+	Databases []DatabaseCleanup
+
+	// Template is the outcome of dropping the template database.
+	Template DatabaseCleanup
+}
+
+// DatabaseCleanup is the outcome of dropping a single database.
+type DatabaseCleanup struct {
+	// Name is the name of the database.
+	Name string
+
+	// Duration is how long dropping the database took.
+	Duration time.Duration
+
+	// Err is the error returned while dropping the database, if any.
+	Err error
+}
+
 // Cleanup all resources including the databases.
 // It is mainly used in tests to ensure that all resources are cleaned up.
 // So it ignores any errors that might occur during cleanup.
 func (p *Pool) Cleanup() {
-	ctx := context.Background()
+	_, _ = p.CleanupContext(context.Background(), CleanupOptions{})
+}
+
+// CleanupContext drops all test databases of this Pool, releasing those
+// acquired by it, then drops the template database and closes the Pool. Test
+// databases are dropped by a bounded number of workers (see
+// CleanupOptions.Concurrency). The returned result reports the duration and
+// error of each drop, and the returned error joins all of them.
+func (p *Pool) CleanupContext(ctx context.Context, opts CleanupOptions) (*CleanupResult, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultCleanupConcurrency
+	}
 
-	_ = p.templateDB.Cleanup(ctx)
-	_ = p.Close(ctx)
+	result := &CleanupResult{
+		Databases: make([]DatabaseCleanup, p.cfg.MaxDatabases),
+	}
+	// Retained pools would keep the test databases from being dropped.
+	p.closeClonePools()
 
+	indexes := make(chan int)
 	wg := sync.WaitGroup{}
-	wg.Add(p.cfg.MaxDatabases)
-	for i := range p.cfg.MaxDatabases {
+	for range min(concurrency, p.cfg.MaxDatabases) {
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			_, _ = p.cfg.Pool.Exec(ctx, fmt.Sprintf(
-				"DROP DATABASE IF EXISTS %s",
-				pgx.Identifier{getTestDBName(p.cfg.ID, i)}.Sanitize(),
-			))
+			for i := range indexes {
+				name := getTestDBName(p.cfg.NamePrefix, p.cfg.ID, i)
+				if beforeCleanupDrop != nil {
+					beforeCleanupDrop(name)
+				}
+				start := p.clock.Now()
+				var err error
+				if i < len(p.testDBs) && p.testDBs[i] != nil {
+					// Acquired by this Pool: drop it and release its resource.
+					err = p.testDBs[i].Release(ctx)
+				} else {
+					var query string
+					if query, err = sqlbuild.DropDatabase(name, false); err == nil {
+						_, err = p.cfg.Pool.Exec(ctx, query)
+					}
+				}
+				result.Databases[i] = DatabaseCleanup{
+					Name:     name,
+					Duration: p.clock.Now().Sub(start),
+					Err:      err,
+				}
+			}
 		}()
 	}
-
+	for i := range p.cfg.MaxDatabases {
+		indexes <- i
+	}
+	close(indexes)
 	wg.Wait()
+
+	var errs []error
+	if p.holders != nil {
+		// Forget the slots of crashed processes along with their databases.
+		_, err := p.cfg.Pool.Exec(ctx, `DELETE FROM testdbpool_holders WHERE pool_id = $1`, p.cfg.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove holders: %w", err))
+		}
+	}
+	p.closeNumpool()
+	p.closeHolders(ctx)
+	p.testDBs = nil
+
+	// The template database is dropped last so that it outlives its clones.
+	start := p.clock.Now()
+	err := p.templateDB.Cleanup(ctx)
+	result.Template = DatabaseCleanup{
+		Name:     p.templateDB.Name(),
+		Duration: p.clock.Now().Sub(start),
+		Err:      err,
+	}
+
+	for _, db := range result.Databases {
+		if db.Err != nil {
+			errs = append(errs, fmt.Errorf("failed to drop test database %s: %w", db.Name, db.Err))
+		}
+	}
+	if result.Template.Err != nil {
+		errs = append(errs, fmt.Errorf("failed to drop template database: %w", result.Template.Err))
+	}
+	return result, errors.Join(errs...)
+}
+
+// DropTemplate drops the template database while keeping the pool registered,
+// so that the next Acquire rebuilds the template with SetupTemplate.
+// It is a faster alternative to Cleanup followed by New while iterating on a
+// schema. Test databases that have already been created are not affected.
+func (p *Pool) DropTemplate(ctx context.Context) error {
+	if err := p.templateDB.Drop(ctx); err != nil {
+		return fmt.Errorf("failed to drop template database: %w", err)
+	}
+	return nil
+}
+
+// BuildTemplate sets up the template database if it does not exist yet, so
+// that the one-time cost of building it is paid before the tests run rather
+// than by the first acquisition. It is meant to be called from TestMain with
+// a context that is cancelled on interrupt (see signal.NotifyContext): when
+// the setup is cancelled, e.g. by Ctrl-C, the partially built template
+// database is dropped, so that the next run starts from scratch.
+func (p *Pool) BuildTemplate(ctx context.Context) error {
+	if err := p.templateDB.Setup(ctx); err != nil {
+		return fmt.Errorf("failed to set up template database: %w", err)
+	}
+	return nil
+}
+
+// EffectiveID returns the ID that identifies this Pool in the numpool and in
+// the names of its databases. It is Config.ID, followed by the hashes of
+// Config.TemplateVariantKey and of the schema fingerprint if they are set.
+func (p *Pool) EffectiveID() string {
+	return p.cfg.ID
 }
 
 // TemplateDBName returns the name of the template database used by this Pool.
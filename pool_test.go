@@ -2,7 +2,14 @@ package testdbpool_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/assert"
@@ -119,3 +126,1097 @@ func TestPool_Cleanup(t *testing.T) {
 		require.False(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
 	})
 }
+
+func TestPool_AcquireLinked(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-acquire-linked",
+		Pool:         connPool,
+		MaxDatabases: 2,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `
+				CREATE EXTENSION IF NOT EXISTS postgres_fdw;
+				CREATE TABLE foos (id SERIAL PRIMARY KEY, name TEXT);
+			`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	t.Run("cross-database query via postgres_fdw", func(t *testing.T) {
+		connConfig := connPool.Config().ConnConfig
+		dbs, err := pool.AcquireLinked(ctx, 2, func(ctx context.Context, dbs []*testdbpool.TestDB) error {
+			_, err := dbs[0].Pool().Exec(ctx, fmt.Sprintf(`
+				CREATE SERVER sibling FOREIGN DATA WRAPPER postgres_fdw
+					OPTIONS (host '%s', port '%d', dbname '%s');
+				CREATE USER MAPPING FOR CURRENT_USER SERVER sibling
+					OPTIONS (user '%s', password '%s');
+				CREATE SCHEMA sibling;
+				IMPORT FOREIGN SCHEMA public LIMIT TO (foos) FROM SERVER sibling INTO sibling;
+			`, connConfig.Host, connConfig.Port, dbs[1].Name(), connConfig.User, connConfig.Password))
+			return err
+		})
+		require.NoError(t, err)
+		require.Len(t, dbs, 2)
+		assert.NotEqual(t, dbs[0].Name(), dbs[1].Name())
+
+		_, err = dbs[1].Pool().Exec(ctx, `INSERT INTO foos (name) VALUES ($1)`, "remote")
+		require.NoError(t, err)
+
+		var name string
+		err = dbs[0].Pool().QueryRow(ctx, `SELECT name FROM sibling.foos`).Scan(&name)
+		require.NoError(t, err)
+		assert.Equal(t, "remote", name)
+
+		for _, db := range dbs {
+			require.NoError(t, db.Release(ctx))
+		}
+	})
+
+	t.Run("link failure releases all databases", func(t *testing.T) {
+		var names []string
+		_, err := pool.AcquireLinked(ctx, 2, func(ctx context.Context, dbs []*testdbpool.TestDB) error {
+			for _, db := range dbs {
+				names = append(names, db.Name())
+			}
+			return errors.New("link failed")
+		})
+		require.ErrorContains(t, err, "link failed")
+		for _, name := range names {
+			assert.False(t, testutil.DBExists(t, connPool, name))
+		}
+
+		// All databases must be available again.
+		acquireCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		t.Cleanup(cancel)
+		dbs, err := pool.AcquireLinked(acquireCtx, 2, nil)
+		require.NoError(t, err)
+		for _, db := range dbs {
+			require.NoError(t, db.Release(ctx))
+		}
+	})
+
+	t.Run("invalid number of databases", func(t *testing.T) {
+		_, err := pool.AcquireLinked(ctx, 3, nil)
+		require.ErrorContains(t, err, "number of databases must be between 1 and 2, got 3")
+
+		_, err = pool.AcquireLinked(ctx, 0, nil)
+		require.ErrorContains(t, err, "number of databases must be between 1 and 2, got 0")
+	})
+}
+
+func TestPool_AcquireMultiple(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newPool := func() *testdbpool.Pool {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "test-acquire-multiple",
+			Pool:         connPool,
+			MaxDatabases: 2,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+				return err
+			},
+		})
+		require.NoError(t, err)
+		return pool
+	}
+	pool := newPool()
+	t.Cleanup(pool.Cleanup)
+
+	t.Run("acquires isolated databases", func(t *testing.T) {
+		dbs, err := pool.AcquireMultiple(ctx, 2)
+		require.NoError(t, err)
+		require.Len(t, dbs, 2)
+		assert.NotEqual(t, dbs[0].Name(), dbs[1].Name())
+
+		_, err = dbs[0].Pool().Exec(ctx, `INSERT INTO test_table DEFAULT VALUES`)
+		require.NoError(t, err)
+		var count int
+		require.NoError(t, dbs[1].Pool().QueryRow(ctx, `SELECT COUNT(*) FROM test_table`).Scan(&count))
+		assert.Zero(t, count)
+
+		require.NoError(t, testdbpool.ReleaseMultiple(ctx, dbs))
+		assert.Equal(t, 0, pool.Stat().AcquiredCount)
+	})
+
+	t.Run("does not hold part of the databases while waiting", func(t *testing.T) {
+		held, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+
+		acquireCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer cancel()
+		_, err = pool.AcquireMultiple(acquireCtx, 2)
+		require.Error(t, err)
+		assert.Equal(t, 1, pool.Stat().AcquiredCount)
+
+		// The free slot was given back, so a single database is available.
+		acquireCtx, cancel = context.WithTimeout(ctx, 500*time.Millisecond)
+		defer cancel()
+		db, err := pool.Acquire(acquireCtx)
+		require.NoError(t, err)
+		require.NoError(t, testdbpool.ReleaseMultiple(ctx, []*testdbpool.TestDB{db, held}))
+	})
+
+	t.Run("competing groups do not deadlock", func(t *testing.T) {
+		// Another Pool with the same ID stands in for another process.
+		other := newPool()
+		defer func() { require.NoError(t, other.Close(ctx)) }()
+
+		acquireCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		var wg sync.WaitGroup
+		errs := make(chan error, 2)
+		for _, p := range []*testdbpool.Pool{pool, other} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 5 {
+					dbs, err := p.AcquireMultiple(acquireCtx, 2)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if err := testdbpool.ReleaseMultiple(ctx, dbs); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("invalid number of databases", func(t *testing.T) {
+		_, err := pool.AcquireMultiple(ctx, 3)
+		require.ErrorContains(t, err, "number of databases must be between 1 and 2, got 3")
+	})
+}
+
+func TestPool_DropTemplate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	var setupCount int
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-drop-template",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			setupCount++
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	// Dropping a template that does not exist yet is a no-op.
+	require.NoError(t, pool.DropTemplate(ctx))
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db.Release(ctx))
+	require.Equal(t, 1, setupCount)
+	require.True(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+
+	require.NoError(t, pool.DropTemplate(ctx))
+	assert.False(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+
+	// The pool registration is preserved and the template is rebuilt.
+	pools, err := testdbpool.ListPools(ctx, connPool, "test-drop-template")
+	require.NoError(t, err)
+	assert.Contains(t, pools, "test-drop-template")
+
+	db, err = pool.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db.Release(ctx))
+	assert.Equal(t, 2, setupCount)
+	assert.True(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+}
+
+func TestPool_AcquireEmpty(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-acquire-empty",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.AcquireEmpty(ctx)
+	require.NoError(t, err)
+
+	var tables int
+	err = db.Pool().QueryRow(ctx,
+		`SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = 'public'`,
+	).Scan(&tables)
+	require.NoError(t, err)
+	assert.Equal(t, 0, tables, "empty database should not contain the template schema")
+
+	// Run a migration against the empty database.
+	_, err = db.Pool().Exec(ctx, `CREATE TABLE migrated (id INT)`)
+	require.NoError(t, err)
+
+	name := db.Name()
+	require.NoError(t, db.Release(ctx))
+	assert.False(t, testutil.DBExists(t, connPool, name))
+
+	// The same slot is reused for a regular database from the template.
+	db, err = pool.Acquire(ctx)
+	require.NoError(t, err)
+	exists, err := db.Exists(ctx, "information_schema.tables", "table_name = $1", "test_table")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	require.NoError(t, db.Release(ctx))
+}
+
+func TestPool_TemplateMetadata(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newPool := func(t *testing.T) *testdbpool.Pool {
+		var pool *testdbpool.Pool
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "test-template-metadata",
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				if err := pool.SetTemplateMetadata(ctx, "fixture", "v1"); err != nil {
+					return err
+				}
+				return pool.SetTemplateMetadata(ctx, "seed", "42")
+			},
+		})
+		require.NoError(t, err)
+		return pool
+	}
+
+	pool := newPool(t)
+	t.Cleanup(pool.Cleanup)
+	want := map[string]string{"fixture": "v1", "seed": "42"}
+
+	metadata, err := pool.TemplateMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, want, metadata)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	metadata, err = db.Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, want, metadata)
+
+	// The metadata is kept out of the schema of the databases.
+	var schemas int
+	err = db.Pool().QueryRow(ctx, `SELECT count(*) FROM pg_namespace WHERE nspname = 'testdbpool'`).Scan(&schemas)
+	require.NoError(t, err)
+	assert.Zero(t, schemas)
+	require.NoError(t, db.Release(ctx))
+
+	t.Run("writes outside of setup are rejected", func(t *testing.T) {
+		err := pool.SetTemplateMetadata(ctx, "fixture", "v2")
+		require.ErrorIs(t, err, testdbpool.ErrTemplateMetadataReadOnly)
+	})
+
+	t.Run("empty databases have no metadata", func(t *testing.T) {
+		db, err := pool.AcquireEmpty(ctx)
+		require.NoError(t, err)
+		metadata, err := db.Metadata(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, metadata)
+		require.NoError(t, db.Release(ctx))
+	})
+
+	t.Run("reopened pool reads the existing template", func(t *testing.T) {
+		require.NoError(t, pool.Close(ctx))
+
+		reopened := newPool(t)
+		t.Cleanup(reopened.Cleanup)
+		metadata, err := reopened.TemplateMetadata(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, want, metadata)
+	})
+}
+
+// logRecorder is a testing.TB that records the messages logged with Logf.
+type logRecorder struct {
+	testing.TB
+	logs []string
+}
+
+func (r *logRecorder) Logf(format string, args ...any) {
+	r.logs = append(r.logs, fmt.Sprintf(format, args...))
+}
+
+func TestPool_AcquireT(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-acquire-t",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+		LogAcquisitions: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	recorder := &logRecorder{TB: t}
+	var names []string
+	for i := range 2 {
+		t.Run(fmt.Sprintf("acquisition %d", i), func(t *testing.T) {
+			recorder.TB = t
+			db := pool.AcquireT(recorder)
+			names = append(names, db.Name())
+			assert.True(t, testutil.DBExists(t, connPool, db.Name()))
+		})
+	}
+
+	// Databases are released when the subtests complete.
+	for _, name := range names {
+		assert.False(t, testutil.DBExists(t, connPool, name))
+	}
+	require.Len(t, recorder.logs, 2)
+	assert.Regexp(t, `^testdbpool: testdbpool_test-acquire-t_0 acquire=\S+ release=\S+ recreated=true$`, recorder.logs[0])
+	assert.Regexp(t, `recreated=true$`, recorder.logs[1])
+
+	// With ResetDatabase, the database released by the first test is reused
+	// by the second one.
+	resetPool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-acquire-t-reset",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+		ResetDatabase: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `TRUNCATE test_table`)
+			return err
+		},
+		LogAcquisitions: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(resetPool.Cleanup)
+
+	recorder.logs = nil
+	for i := range 2 {
+		t.Run(fmt.Sprintf("reset acquisition %d", i), func(t *testing.T) {
+			recorder.TB = t
+			resetPool.AcquireT(recorder)
+		})
+	}
+	require.Len(t, recorder.logs, 2)
+	assert.Regexp(t, `recreated=true$`, recorder.logs[0])
+	assert.Regexp(t, `recreated=false$`, recorder.logs[1])
+}
+
+func TestPool_TryAcquire(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-try-acquire",
+		Pool:         connPool,
+		MaxDatabases: 2,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	var dbs []*testdbpool.TestDB
+	for range 2 {
+		db, ok, err := pool.TryAcquire(ctx)
+		require.NoError(t, err)
+		require.True(t, ok)
+		dbs = append(dbs, db)
+	}
+
+	// The pool is saturated, so TryAcquire returns without waiting.
+	start := time.Now()
+	db, ok, err := pool.TryAcquire(ctx)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, db)
+	assert.Less(t, time.Since(start), time.Second)
+
+	require.NoError(t, dbs[0].Release(ctx))
+	db, ok, err = pool.TryAcquire(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, dbs[0].Name(), db.Name())
+	require.NoError(t, db.Release(ctx))
+	require.NoError(t, dbs[1].Release(ctx))
+
+	stat := pool.Stat()
+	assert.Equal(t, int64(3), stat.TryHits)
+	assert.Equal(t, int64(1), stat.TryMisses)
+}
+
+func TestPool_AcquireTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-acquire-timeout",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			return nil
+		},
+		AcquireTimeout: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	held, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+
+	// The pool is exhausted, so Acquire waits for AcquireTimeout.
+	start := time.Now()
+	_, err = pool.Acquire(ctx)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, testdbpool.ErrPoolExhausted)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	var exhausted *testdbpool.PoolExhaustedError
+	require.ErrorAs(t, err, &exhausted)
+	assert.Equal(t, 1, exhausted.InUse)
+	assert.Equal(t, 1, exhausted.MaxDatabases)
+	assert.GreaterOrEqual(t, exhausted.Waited, 200*time.Millisecond)
+	assert.Contains(t, err.Error(), "1 of 1 test databases in use")
+
+	_, err = pool.AcquireMultiple(ctx, 1)
+	assert.ErrorIs(t, err, testdbpool.ErrPoolExhausted)
+
+	// The deadline of the context counts as well.
+	deadlineCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = pool.Acquire(deadlineCtx)
+	assert.ErrorIs(t, err, testdbpool.ErrPoolExhausted)
+
+	// A database released while waiting is handed over.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = held.Release(ctx)
+	}()
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db.Release(ctx))
+
+	// A cancelled context is not a timeout.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	held, err = pool.Acquire(ctx)
+	require.NoError(t, err)
+	_, err = pool.Acquire(cancelled)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, testdbpool.ErrPoolExhausted)
+	require.NoError(t, held.Release(ctx))
+}
+
+func TestPool_AcquirePanics(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	// assertNothingHeld asserts that the panicking acquisition left no slot
+	// held and no test database behind.
+	assertNothingHeld := func(t *testing.T, pool *testdbpool.Pool, n int) {
+		t.Helper()
+		assert.Equal(t, 0, pool.Stat().AcquiredCount)
+		for i := range n {
+			assert.False(t, testutil.DBExists(t, connPool, fmt.Sprintf("testdbpool_%s_%d", pool.EffectiveID(), i)))
+		}
+		dbs, err := pool.AcquireMultiple(ctx, n)
+		require.NoError(t, err)
+		require.NoError(t, testdbpool.ReleaseMultiple(ctx, dbs))
+	}
+
+	t.Run("create", func(t *testing.T) {
+		connConfig := connPool.Config().ConnConfig
+		var pool *testdbpool.Pool
+		var panics atomic.Bool
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "test-acquire-panics-create",
+			Pool:         connPool,
+			MaxDatabases: 1,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+			// The test database has been created by the time its
+			// connection string is built.
+			ConnStringFunc: func(dbName string) (string, error) {
+				if dbName != pool.TemplateDBName() && panics.Load() {
+					panic("boom")
+				}
+				return fmt.Sprintf(
+					"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+					connConfig.Host, connConfig.Port, connConfig.User, connConfig.Password, dbName,
+				), nil
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		panics.Store(true)
+		assert.PanicsWithValue(t, "boom", func() { _, _ = pool.Acquire(ctx) })
+		assert.PanicsWithValue(t, "boom", func() { _, _, _ = pool.TryAcquire(ctx) })
+		panics.Store(false)
+		assertNothingHeld(t, pool, 1)
+	})
+
+	t.Run("seed", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "test-acquire-panics-seed",
+			Pool:         connPool,
+			MaxDatabases: 3,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+			SeedDatabaseIndexed: func(ctx context.Context, conn *pgx.Conn, index int) error {
+				if index == 1 {
+					panic("boom")
+				}
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		// The second database panics while the first one is seeded and
+		// the third one is not created yet.
+		assert.PanicsWithValue(t, "boom", func() { _, _ = pool.AcquireMultiple(ctx, 3) })
+		assert.Equal(t, 0, pool.Stat().AcquiredCount)
+		for i := range 3 {
+			assert.False(t, testutil.DBExists(t, connPool, fmt.Sprintf("testdbpool_%s_%d", pool.EffectiveID(), i)))
+		}
+		db, ok, err := pool.TryAcquire(ctx)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, db.Release(ctx))
+	})
+
+	t.Run("link", func(t *testing.T) {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "test-acquire-panics-link",
+			Pool:         connPool,
+			MaxDatabases: 2,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		assert.PanicsWithValue(t, "boom", func() {
+			_, _ = pool.AcquireLinked(ctx, 2, func(ctx context.Context, dbs []*testdbpool.TestDB) error {
+				panic("boom")
+			})
+		})
+		assertNothingHeld(t, pool, 2)
+	})
+}
+
+func TestPool_Stat(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-stat",
+		Pool:         connPool,
+		MaxDatabases: 3,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	stat := pool.Stat()
+	assert.Equal(t, 3, stat.MaxDatabases)
+	assert.Equal(t, 0, stat.AcquiredCount)
+	assert.Equal(t, 3, stat.IdleCount)
+	assert.Zero(t, stat.TotalAcquires)
+
+	db1, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	db2, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db1.Release(ctx))
+
+	stat = pool.Stat()
+	assert.Equal(t, 1, stat.AcquiredCount)
+	assert.Equal(t, 2, stat.IdleCount)
+	assert.Equal(t, int64(2), stat.TotalAcquires)
+	assert.Equal(t, int64(2), stat.TotalCreates)
+	assert.Positive(t, stat.AcquireWaitDuration)
+
+	// Stat can be read while other goroutines acquire and release.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 5 {
+			_ = pool.Stat()
+		}
+	}()
+	db3, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db3.Release(ctx))
+	<-done
+
+	require.NoError(t, db2.Release(ctx))
+	stat = pool.Stat()
+	assert.Equal(t, 0, stat.AcquiredCount)
+	assert.Equal(t, 3, stat.IdleCount)
+	assert.Equal(t, int64(3), stat.TotalAcquires)
+	assert.Equal(t, int64(3), stat.TotalCreates)
+}
+
+func TestPool_AcquireWithTemplateConnection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-template-connection",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+	require.NoError(t, pool.BuildTemplate(ctx))
+
+	// A leftover session on the template, e.g. of a pool that has not
+	// finished closing, would make CREATE DATABASE fail.
+	cfg := connPool.Config().ConnConfig.Copy()
+	cfg.Database = pool.TemplateDBName()
+	stray, err := pgx.ConnectConfig(ctx, cfg)
+	require.NoError(t, err)
+	defer stray.Close(ctx)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db.Release(ctx))
+	assert.Error(t, stray.Ping(ctx), "session on the template should be terminated")
+}
+
+func TestPool_Warm(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-warm",
+		Pool:         connPool,
+		MaxDatabases: 3,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	assert.Error(t, pool.Warm(ctx, -1))
+
+	// n is bounded by MaxDatabases.
+	require.NoError(t, pool.Warm(ctx, 5))
+	stat := pool.Stat()
+	assert.Equal(t, int64(3), stat.TotalCreates)
+	assert.Zero(t, stat.AcquiredCount)
+	for i := range 3 {
+		assert.True(t, testutil.DBExists(t, connPool, fmt.Sprintf("testdbpool_test-warm_%d", i)))
+	}
+
+	// The warmed databases are reused instead of cloned again.
+	dbs, err := pool.AcquireMultiple(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), pool.Stat().TotalCreates)
+	require.NoError(t, testdbpool.ReleaseMultiple(ctx, dbs))
+}
+
+func TestPool_Utilization(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newConfig := func() *testdbpool.Config {
+		return &testdbpool.Config{
+			ID:           "test-utilization",
+			Pool:         connPool,
+			MaxDatabases: 3,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+				return err
+			},
+		}
+	}
+	pool, err := testdbpool.New(ctx, newConfig())
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	u, err := pool.Utilization(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, testdbpool.Utilization{MaxDatabases: 3, InUse: 0, Available: 3}, u)
+
+	db1, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer db1.Release(ctx)
+
+	// Databases held through another Pool instance with the same ID count
+	// as well.
+	other, err := testdbpool.New(ctx, newConfig())
+	require.NoError(t, err)
+	defer other.Close(ctx)
+	db2, err := other.Acquire(ctx)
+	require.NoError(t, err)
+
+	u, err = pool.Utilization(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, testdbpool.Utilization{MaxDatabases: 3, InUse: 2, Available: 1, TemplateReady: true}, u)
+
+	// The utilization can be read while other goroutines acquire and release.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 5 {
+			_, err := pool.Utilization(ctx)
+			assert.NoError(t, err)
+		}
+	}()
+	db3, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db3.Release(ctx))
+	<-done
+
+	require.NoError(t, db2.Release(ctx))
+	u, err = pool.Utilization(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, u.InUse)
+	assert.Equal(t, 2, u.Available)
+
+	require.NoError(t, pool.DropTemplate(ctx))
+	u, err = pool.Utilization(ctx)
+	require.NoError(t, err)
+	assert.False(t, u.TemplateReady)
+}
+
+// eventRecorder is a slog.Handler that records the messages and attributes
+// of the logged events.
+type eventRecorder struct {
+	mu     sync.Mutex
+	attrs  []slog.Attr
+	events *[]recordedEvent
+}
+
+type recordedEvent struct {
+	level slog.Level
+	msg   string
+	attrs map[string]any
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{events: new([]recordedEvent)}
+}
+
+func (r *eventRecorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (r *eventRecorder) Handle(_ context.Context, record slog.Record) error {
+	event := recordedEvent{level: record.Level, msg: record.Message, attrs: map[string]any{}}
+	for _, a := range r.attrs {
+		event.attrs[a.Key] = a.Value.Any()
+	}
+	record.Attrs(func(a slog.Attr) bool {
+		event.attrs[a.Key] = a.Value.Any()
+		return true
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.events = append(*r.events, event)
+	return nil
+}
+
+func (r *eventRecorder) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &eventRecorder{attrs: append(slices.Clone(r.attrs), attrs...), events: r.events}
+}
+
+func (r *eventRecorder) WithGroup(string) slog.Handler { return r }
+
+// take returns the recorded events and clears them.
+func (r *eventRecorder) take() []recordedEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := *r.events
+	*r.events = nil
+	return events
+}
+
+func TestPool_Logger(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	recorder := newEventRecorder()
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-logger",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+		ResetDatabase: func(ctx context.Context, conn *pgx.Conn) error {
+			return errors.New("reset broken")
+		},
+		Logger: slog.New(recorder),
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	messages := func(events []recordedEvent) []string {
+		var msgs []string
+		for _, e := range events {
+			msgs = append(msgs, e.msg)
+			assert.Equal(t, "test-logger", e.attrs["pool_id"], e.msg)
+		}
+		return msgs
+	}
+
+	db, err := pool.AcquireWithLabel(ctx, "TestSomething")
+	require.NoError(t, err)
+	events := recorder.take()
+	assert.Equal(t, []string{
+		"waiting for a test database",
+		"template setup started",
+		"template setup finished",
+		"test database created",
+		"test database acquired",
+	}, messages(events))
+	created, acquired := events[3], events[4]
+	assert.Equal(t, int64(0), created.attrs["index"])
+	assert.Equal(t, db.Name(), created.attrs["database"])
+	assert.Equal(t, int64(0), acquired.attrs["index"])
+	assert.Equal(t, db.Name(), acquired.attrs["database"])
+	assert.Equal(t, "TestSomething", acquired.attrs["label"])
+	assert.Contains(t, acquired.attrs, "wait")
+
+	require.ErrorIs(t, db.Release(ctx), testdbpool.ErrResetFailed)
+	events = recorder.take()
+	assert.Equal(t, []string{
+		"test database reset failed; dropping it",
+		"test database dropped",
+		"test database released",
+	}, messages(events))
+	assert.Equal(t, slog.LevelWarn, events[0].level)
+	for _, e := range events {
+		assert.Equal(t, int64(0), e.attrs["index"], e.msg)
+		assert.Equal(t, db.Name(), e.attrs["database"], e.msg)
+	}
+}
+
+func TestPool_CloseWait(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-close-wait",
+		Pool:         connPool,
+		MaxDatabases: 2,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	name := db.Name()
+
+	// CloseWait gives up when ctx is done before db is released.
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	err = pool.CloseWait(shortCtx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// New acquisitions are refused from then on.
+	_, err = pool.Acquire(ctx)
+	require.ErrorIs(t, err, testdbpool.ErrPoolClosing)
+	_, _, err = pool.TryAcquire(ctx)
+	require.ErrorIs(t, err, testdbpool.ErrPoolClosing)
+	_, err = pool.AcquireMultiple(ctx, 2)
+	require.ErrorIs(t, err, testdbpool.ErrPoolClosing)
+
+	closed := make(chan error, 1)
+	go func() { closed <- pool.CloseWait(ctx) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("CloseWait returned before the database was released: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, db.Release(ctx))
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("CloseWait did not return after the database was released")
+	}
+	assert.False(t, testutil.DBExists(t, connPool, name))
+}
+
+func TestPool_TemplateGenerationChange(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	newPool := func(failOnChange bool) *testdbpool.Pool {
+		pool, err := testdbpool.New(ctx, &testdbpool.Config{
+			ID:           "test-template-generation",
+			Pool:         connPool,
+			MaxDatabases: 2,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				_, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`)
+				return err
+			},
+			FailOnTemplateGenerationChange: failOnChange,
+		})
+		require.NoError(t, err)
+		return pool
+	}
+	first := newPool(true)
+	t.Cleanup(first.Cleanup)
+	second := newPool(false)
+	t.Cleanup(func() { _ = second.Close(ctx) })
+
+	db, err := first.Acquire(ctx)
+	require.NoError(t, err)
+	generation := db.TemplateGeneration()
+	assert.NotEmpty(t, generation)
+	require.NoError(t, db.Release(ctx))
+
+	// The second pool sees the same generation.
+	db, err = second.Acquire(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, generation, db.TemplateGeneration())
+	require.NoError(t, db.Release(ctx))
+
+	// The second pool recreates the template behind the first one's back.
+	require.NoError(t, second.DropTemplate(ctx))
+	db, err = second.Acquire(ctx)
+	require.NoError(t, err)
+	assert.NotEqual(t, generation, db.TemplateGeneration())
+	require.NoError(t, db.Release(ctx))
+
+	// The first pool detects the change and keeps failing.
+	for range 2 {
+		_, err = first.Acquire(ctx)
+		var changed *testdbpool.TemplateGenerationChangedError
+		require.ErrorAs(t, err, &changed)
+		assert.Equal(t, generation, changed.Previous)
+		assert.NotEqual(t, generation, changed.Current)
+	}
+}
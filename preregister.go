@@ -0,0 +1,184 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yuku/numpool"
+	"github.com/yuku/testdbpool/internal/pgconst"
+)
+
+// Preregister registers the pools described by configs ahead of time, e.g.
+// once by a CI orchestrator or a make target before running go test ./...,
+// so that New in each test package finds its registration instead of
+// creating it. It creates the numpool table, a numpool for every config, the
+// table recording when pools were last used, and the tables needed by
+// Config.OrphanTakeoverAfter if any config sets it.
+//
+// The configs are validated like in New; their Pool field may be nil, in
+// which case rootPool is used. A pool with a TemplateVariantKey is registered
+// under its ID with the hash of the key appended, like New does. The configs
+// themselves are not modified.
+// Pools that are already registered with the same MaxDatabases are left
+// untouched, and an error is returned if one is registered with a different
+// MaxDatabases.
+func Preregister(ctx context.Context, rootPool *pgxpool.Pool, configs []*Config) error {
+	cfgs := make([]Config, len(configs))
+	holdersTable := false
+	for i, cfg := range configs {
+		if cfg == nil {
+			return fmt.Errorf("config %d cannot be nil", i)
+		}
+		cfgs[i] = *cfg
+		cfgs[i].ID += variantSuffix(cfg.TemplateVariantKey)
+		if cfgs[i].Pool == nil {
+			cfgs[i].Pool = rootPool
+		}
+		if err := cfgs[i].Validate(); err != nil {
+			return fmt.Errorf("invalid config %s: %w", cfgs[i].ID, err)
+		}
+		holdersTable = holdersTable || cfgs[i].OrphanTakeoverAfter > 0
+	}
+
+	manager, err := numpool.Setup(ctx, rootPool)
+	if err != nil {
+		return fmt.Errorf("failed to setup numpool: %w", err)
+	}
+	defer manager.Close()
+
+	for _, cfg := range cfgs {
+		np, err := manager.GetOrCreate(ctx, numpool.Config{
+			ID:                cfg.ID,
+			MaxResourcesCount: int32(cfg.MaxDatabases),
+			Metadata:          registrationMetadata(&cfg),
+			NoStartListening:  true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to register pool %s: %w", cfg.ID, err)
+		}
+		if err := checkNamePrefix(&cfg, np.Metadata()); err != nil {
+			return err
+		}
+	}
+
+	if holdersTable {
+		if err := setupHoldersTable(ctx, rootPool); err != nil {
+			return err
+		}
+	}
+	return setupActivityTable(ctx, rootPool)
+}
+
+// registration is the state of a pool that New finds in the database.
+type registration struct {
+	// exists indicates that the numpool of the pool exists.
+	exists bool
+
+	// metadata is the metadata of the numpool, if it exists.
+	metadata []byte
+
+	// holdersTable indicates that the table for Config.OrphanTakeoverAfter
+	// exists.
+	holdersTable bool
+
+	// activityTable indicates that the table recording when pools were last
+	// used exists.
+	activityTable bool
+}
+
+// lookupRegistration finds the registration of the pool with a single query.
+// It returns an error if the pool is registered with a different
+// MaxDatabases, which numpool would otherwise only report after setting up.
+func lookupRegistration(ctx context.Context, cfg *Config) (registration, error) {
+	var maxDatabases *int32
+	var reg registration
+	err := cfg.Pool.QueryRow(ctx, `
+		SELECT
+			n.max_resources_count, n.metadata,
+			to_regclass('testdbpool_holders') IS NOT NULL,
+			to_regclass('testdbpool_activity') IS NOT NULL
+		FROM (SELECT 1) AS one
+		LEFT JOIN numpools n ON n.id = $1`,
+		cfg.ID,
+	).Scan(&maxDatabases, &reg.metadata, &reg.holdersTable, &reg.activityTable)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgconst.SQLStateUndefinedTable {
+			// numpool has never been set up on this server.
+			return registration{}, nil
+		}
+		return registration{}, fmt.Errorf("failed to look up registration of pool %s: %w", cfg.ID, err)
+	}
+	if maxDatabases == nil {
+		return reg, nil
+	}
+	if int(*maxDatabases) != cfg.MaxDatabases {
+		return registration{}, fmt.Errorf(
+			"pool %s is registered with MaxDatabases %d, got %d",
+			cfg.ID, *maxDatabases, cfg.MaxDatabases,
+		)
+	}
+	reg.exists = true
+	return reg, nil
+}
+
+// openNumpool sets up numpool and creates or opens the numpool of the pool.
+// The numpool listens for released slots with ctx until the returned manager
+// is closed.
+func openNumpool(ctx context.Context, cfg *Config) (*numpool.Manager, *numpool.Numpool, error) {
+	manager, err := numpool.Setup(ctx, cfg.Pool)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to setup numpool: %w", err)
+	}
+	numPool, err := manager.GetOrCreate(ctx, numpool.Config{
+		ID:                cfg.ID,
+		MaxResourcesCount: int32(cfg.MaxDatabases),
+		Metadata:          registrationMetadata(cfg),
+	})
+	if err != nil {
+		manager.Close()
+		return nil, nil, fmt.Errorf("failed to create numpool: %w", err)
+	}
+	if err := checkNamePrefix(cfg, numPool.Metadata()); err != nil {
+		manager.Close()
+		return nil, nil, err
+	}
+	return manager, numPool, nil
+}
+
+// openedNumpool returns the numpool of the pool, opening it first if New
+// found the pool preregistered.
+func (p *Pool) openedNumpool(ctx context.Context) (*numpool.Numpool, error) {
+	p.numpoolMu.Lock()
+	defer p.numpoolMu.Unlock()
+
+	if p.numPool != nil {
+		return p.numPool, nil
+	}
+	if p.numpoolClosed {
+		return nil, errors.New("pool is closed")
+	}
+	// The numpool keeps listening for released slots after the acquisition
+	// that opens it is done.
+	manager, numPool, err := openNumpool(context.WithoutCancel(ctx), p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.manager, p.numPool = manager, numPool
+	return numPool, nil
+}
+
+// closeNumpool closes the numpool of the pool, if opened, and keeps it from
+// being opened again.
+func (p *Pool) closeNumpool() {
+	p.numpoolMu.Lock()
+	defer p.numpoolMu.Unlock()
+
+	p.numpoolClosed = true
+	if p.manager != nil {
+		p.manager.Close()
+	}
+}
@@ -0,0 +1,144 @@
+package testdbpool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+// countingTracer counts the queries sent to the server.
+type countingTracer struct {
+	queries atomic.Int64
+
+	mu         sync.Mutex
+	statements []string
+}
+
+func (c *countingTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	c.queries.Add(1)
+	c.mu.Lock()
+	c.statements = append(c.statements, data.SQL)
+	c.mu.Unlock()
+	return ctx
+}
+
+// reset forgets the queries counted so far.
+func (c *countingTracer) reset() {
+	c.queries.Store(0)
+	c.mu.Lock()
+	c.statements = nil
+	c.mu.Unlock()
+}
+
+func (c *countingTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+func TestPreregister(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	tracer := &countingTracer{}
+	poolCfg := connPool.Config().Copy()
+	poolCfg.ConnConfig.Tracer = tracer
+	tracedPool, err := pgxpool.NewWithConfig(ctx, poolCfg)
+	require.NoError(t, err)
+	t.Cleanup(tracedPool.Close)
+
+	newConfig := func(id string, maxDatabases int) *Config {
+		return &Config{
+			ID:           id,
+			Pool:         tracedPool,
+			MaxDatabases: maxDatabases,
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				return nil
+			},
+			OrphanTakeoverAfter: time.Second,
+		}
+	}
+	lookup := func(cfg *Config) (registration, error) {
+		tracer.reset()
+		reg, err := lookupRegistration(ctx, cfg)
+		assert.Equal(t, int64(1), tracer.queries.Load(), "lookup must be a single query")
+		return reg, err
+	}
+
+	t.Run("absent", func(t *testing.T) {
+		reg, err := lookup(newConfig("test-preregister-absent", 2))
+		require.NoError(t, err)
+		assert.False(t, reg.exists)
+	})
+
+	preregistered := newConfig("test-preregister", 2)
+	require.NoError(t, Preregister(ctx, connPool, []*Config{
+		{ID: preregistered.ID, MaxDatabases: 2, SetupTemplate: preregistered.SetupTemplate, OrphanTakeoverAfter: time.Second},
+	}))
+	// Preregistering again is a no-op.
+	require.NoError(t, Preregister(ctx, connPool, []*Config{preregistered}))
+
+	t.Run("preregistered", func(t *testing.T) {
+		reg, err := lookup(preregistered)
+		require.NoError(t, err)
+		assert.True(t, reg.exists)
+		assert.True(t, reg.holdersTable)
+
+		pool, err := New(ctx, preregistered)
+		require.NoError(t, err)
+		t.Cleanup(pool.Cleanup)
+
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+	})
+
+	t.Run("New skips the numpool setup of a registered pool", func(t *testing.T) {
+		cfg := newConfig("test-preregister-new", 2)
+		tracer.reset()
+		first, err := New(ctx, cfg)
+		require.NoError(t, err)
+		t.Cleanup(first.Cleanup)
+		unregistered := tracer.queries.Load()
+		db, err := first.Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+
+		tracer.reset()
+		second, err := New(ctx, newConfig(cfg.ID, 2))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, second.Close(ctx)) }()
+		assert.Less(t, tracer.queries.Load(), unregistered)
+		tracer.mu.Lock()
+		for _, sql := range tracer.statements {
+			assert.NotContains(t, sql, "LOCK TABLE numpools", "numpool must not be set up by New")
+		}
+		tracer.mu.Unlock()
+
+		// The numpool is opened by the first acquisition.
+		db, err = second.Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, db.Release(ctx))
+	})
+
+	t.Run("mismatched", func(t *testing.T) {
+		mismatched := newConfig(preregistered.ID, 3)
+		_, err := lookup(mismatched)
+		assert.EqualError(t, err, "pool test-preregister is registered with MaxDatabases 2, got 3")
+
+		_, err = New(ctx, mismatched)
+		assert.EqualError(t, err, "pool test-preregister is registered with MaxDatabases 2, got 3")
+
+		err = Preregister(ctx, connPool, []*Config{mismatched})
+		assert.ErrorContains(t, err, "already exists with different max resources count")
+	})
+}
@@ -0,0 +1,199 @@
+package testdbpool
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yuku/testdbpool/internal/clock"
+	"github.com/yuku/testdbpool/internal/templatedb"
+)
+
+// defaultTemplateProgressInterval is the default of
+// Config.TemplateProgressInterval.
+const defaultTemplateProgressInterval = 5 * time.Second
+
+// defaultMaxTemplateSetupDuration is the default of
+// Config.MaxTemplateSetupDuration.
+const defaultMaxTemplateSetupDuration = 5 * time.Minute
+
+type setupProgressKey struct{}
+
+// ReportSetupProgress reports the progress of a multi-step template setup to
+// Config.SetupProgress. step is 1-based and total is the number of steps, or
+// 0 if unknown. It is meant to be called from SetupTemplate, e.g. once per
+// applied migration file, with the context passed to SetupTemplate.
+// The step also shows up in the progress lines of a slow setup (see
+// Config.TemplateProgressInterval).
+func ReportSetupProgress(ctx context.Context, step, total int, desc string) {
+	if w, ok := ctx.Value(progressWatcherKey{}).(*progressWatcher); ok {
+		if total > 0 {
+			w.setStep(fmt.Sprintf("%d/%d %s", step, total, desc))
+		} else {
+			w.setStep(fmt.Sprintf("%d %s", step, desc))
+		}
+	}
+	if fn, ok := ctx.Value(setupProgressKey{}).(func(int, int, string)); ok {
+		fn(step, total, desc)
+	}
+}
+
+// withSetupProgress returns a context that makes ReportSetupProgress call fn.
+func withSetupProgress(ctx context.Context, fn func(step, total int, desc string)) context.Context {
+	if fn == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, setupProgressKey{}, fn)
+}
+
+type templateStepKey struct{}
+
+// templateStep is the value of templateStepKey: the function to report the
+// duration of a step to, and the clock to time it with.
+type templateStep struct {
+	onStep func(name string, d time.Duration)
+	clock  clock.Clock
+}
+
+// TimeTemplateStep runs fn as a step of the template setup named name and
+// reports its duration to Config.OnTemplateStep, e.g. to time each migration
+// file. It is meant to be called from SetupTemplate with the context passed
+// to it. It returns the error of fn, whose duration is reported regardless.
+// Without Config.OnTemplateStep, it just calls fn. The step also shows up in
+// the progress lines of a slow setup (see Config.TemplateProgressInterval).
+func TimeTemplateStep(ctx context.Context, name string, fn func() error) error {
+	if w, ok := ctx.Value(progressWatcherKey{}).(*progressWatcher); ok {
+		w.setStep(name)
+	}
+	step, ok := ctx.Value(templateStepKey{}).(templateStep)
+	if !ok {
+		return fn()
+	}
+	start := step.clock.Now()
+	err := fn()
+	step.onStep(name, step.clock.Now().Sub(start))
+	return err
+}
+
+// withTemplateStep returns a context that makes TimeTemplateStep call fn with
+// the durations measured by clk.
+func withTemplateStep(ctx context.Context, fn func(name string, d time.Duration), clk clock.Clock) context.Context {
+	if fn == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, templateStepKey{}, templateStep{onStep: fn, clock: clk})
+}
+
+// onTemplateSetupTimeout returns the function called when the template setup
+// holds the setup lock for longer than Config.TemplateSetupTimeout.
+func onTemplateSetupTimeout(cfg *Config) func(elapsed time.Duration) {
+	if cfg.OnTemplateSetupTimeout != nil {
+		return cfg.OnTemplateSetupTimeout
+	}
+	return func(elapsed time.Duration) {
+		poolLogger(cfg).Warn("template setup is holding the setup lock; other processes sharing the server are waiting for it",
+			"elapsed", elapsed)
+	}
+}
+
+// maxTemplateSetupDuration returns Config.MaxTemplateSetupDuration, or its
+// default if not set.
+func maxTemplateSetupDuration(cfg *Config) time.Duration {
+	if cfg.MaxTemplateSetupDuration == 0 {
+		return defaultMaxTemplateSetupDuration
+	}
+	return cfg.MaxTemplateSetupDuration
+}
+
+type progressTBKey struct{}
+
+// withProgressTB returns a context that makes a template setup running with
+// it report its progress with tb.Logf as well.
+func withProgressTB(ctx context.Context, tb testing.TB) context.Context {
+	return context.WithValue(ctx, progressTBKey{}, tb)
+}
+
+type progressWatcherKey struct{}
+
+// progressWatcher reports the progress of a slow template setup periodically.
+type progressWatcher struct {
+	cfg      *Config
+	clock    clock.Clock
+	template string
+	tb       testing.TB
+	start    time.Time
+
+	// mu protects step.
+	mu sync.Mutex
+
+	// step is the step that the setup reported last, if any.
+	step string
+}
+
+// watchTemplateProgress starts reporting the progress of the template setup
+// of cfg every Config.TemplateProgressInterval until the returned function is
+// called. The returned context lets ReportSetupProgress and TimeTemplateStep
+// name the current step.
+func watchTemplateProgress(ctx context.Context, cfg *Config, clk clock.Clock) (context.Context, func()) {
+	interval := cfg.TemplateProgressInterval
+	if interval == 0 {
+		interval = defaultTemplateProgressInterval
+	}
+	template, err := templatedb.TemplateDatabaseName(cfg.NamePrefix, cfg.ID)
+	if err != nil {
+		template = cfg.ID
+	}
+	w := &progressWatcher{cfg: cfg, clock: clk, template: template, start: clk.Now()}
+	w.tb, _ = ctx.Value(progressTBKey{}).(testing.TB)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			timer := clk.NewTimer(interval)
+			select {
+			case <-timer.C():
+				w.report()
+			case <-done:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+	stop := func() {
+		close(done)
+		<-stopped
+	}
+	return context.WithValue(ctx, progressWatcherKey{}, w), stop
+}
+
+// setStep records the step that the setup is at.
+func (w *progressWatcher) setStep(step string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.step = step
+}
+
+// report reports that the setup is still running to Config.Logger and the
+// testing.TB of the setup, if any.
+func (w *progressWatcher) report() {
+	w.mu.Lock()
+	step := w.step
+	w.mu.Unlock()
+	elapsed := w.clock.Now().Sub(w.start).Round(time.Second)
+
+	poolLogger(w.cfg).Info("template setup in progress",
+		"template", w.template, "elapsed", elapsed, "step", step)
+	if w.tb == nil {
+		return
+	}
+	msg := fmt.Sprintf("testdbpool: still building template database %s of pool %s after %s", w.template, w.cfg.ID, elapsed)
+	if step != "" {
+		msg += fmt.Sprintf(" (at %s)", step)
+	}
+	msg += "; this is a one-time cost, later runs reuse the template"
+	w.tb.Logf("%s", msg)
+}
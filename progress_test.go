@@ -0,0 +1,269 @@
+package testdbpool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/clock"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestReportSetupProgress(t *testing.T) {
+	type report struct {
+		step, total int
+		desc        string
+	}
+
+	t.Run("reports steps to Config.SetupProgress", func(t *testing.T) {
+		var reports []report
+		setup := setupTemplateFunc(&Config{
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				ReportSetupProgress(ctx, 1, 2, "001_users.sql")
+				ReportSetupProgress(ctx, 2, 2, "002_posts.sql")
+				return nil
+			},
+			SetupProgress: func(step, total int, desc string) {
+				reports = append(reports, report{step, total, desc})
+			},
+		}, clock.Real)
+
+		require.NoError(t, setup(context.Background(), nil))
+		assert.Equal(t, []report{
+			{1, 2, "001_users.sql"},
+			{2, 2, "002_posts.sql"},
+		}, reports)
+	})
+
+	t.Run("no-op without Config.SetupProgress", func(t *testing.T) {
+		setup := setupTemplateFunc(&Config{
+			SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+				ReportSetupProgress(ctx, 1, 1, "schema.sql")
+				return nil
+			},
+		}, clock.Real)
+		assert.NotPanics(t, func() {
+			require.NoError(t, setup(context.Background(), nil))
+		})
+	})
+}
+
+func TestTimeTemplateStep(t *testing.T) {
+	errMigration := errors.New("syntax error")
+
+	type step struct {
+		name string
+		d    time.Duration
+	}
+
+	fake := clock.NewFake(time.Now())
+	var steps []step
+	setup := setupTemplateFunc(&Config{
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			err := TimeTemplateStep(ctx, "001_users.sql", func() error {
+				fake.Advance(3 * time.Second)
+				return nil
+			})
+			require.NoError(t, err)
+			return TimeTemplateStep(ctx, "002_posts.sql", func() error {
+				return errMigration
+			})
+		},
+		OnTemplateStep: func(name string, d time.Duration) {
+			steps = append(steps, step{name, d})
+		},
+	}, fake)
+
+	err := setup(context.Background(), nil)
+	assert.ErrorIs(t, err, errMigration)
+	assert.Equal(t, []step{
+		{"001_users.sql", 3 * time.Second},
+		{"002_posts.sql", 0},
+	}, steps)
+
+	t.Run("no-op without Config.OnTemplateStep", func(t *testing.T) {
+		called := false
+		err := TimeTemplateStep(context.Background(), "schema.sql", func() error {
+			called = true
+			return nil
+		})
+		require.NoError(t, err)
+		assert.True(t, called)
+	})
+}
+
+// progressRecorder is a testing.TB that records the messages logged with
+// Logf.
+type progressRecorder struct {
+	testing.TB
+	logs []string
+}
+
+func (r *progressRecorder) Logf(format string, args ...any) {
+	r.logs = append(r.logs, fmt.Sprintf(format, args...))
+}
+
+func TestWatchTemplateProgress(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	var logged bytes.Buffer
+	release := make(chan struct{})
+	setup := setupTemplateFunc(&Config{
+		ID: "app",
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			ReportSetupProgress(ctx, 1, 2, "001_users.sql")
+			<-release
+			return nil
+		},
+		TemplateProgressInterval: 10 * time.Second,
+		Logger:                   slog.New(slog.NewTextHandler(&logged, nil)),
+	}, fake)
+
+	tb := &progressRecorder{TB: t}
+	done := make(chan error)
+	go func() { done <- setup(withProgressTB(context.Background(), tb), nil) }()
+
+	fake.WaitForTimers(1)
+	fake.Advance(9 * time.Second)
+	assert.Empty(t, tb.logs)
+
+	// A line is reported once the interval has passed, and then once per
+	// interval. The next timer is created after reporting.
+	fake.Advance(time.Second)
+	fake.WaitForTimers(1)
+	fake.Advance(10 * time.Second)
+	fake.WaitForTimers(1)
+	assert.Equal(t, []string{
+		"testdbpool: still building template database testdbpooltmpl_app of pool app after 10s (at 1/2 001_users.sql); " +
+			"this is a one-time cost, later runs reuse the template",
+		"testdbpool: still building template database testdbpooltmpl_app of pool app after 20s (at 1/2 001_users.sql); " +
+			"this is a one-time cost, later runs reuse the template",
+	}, tb.logs)
+	events := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	require.Len(t, events, 2)
+	assert.Contains(t, events[1], `msg="template setup in progress" pool_id=app template=testdbpooltmpl_app elapsed=20s step="1/2 001_users.sql"`)
+
+	// Nothing is reported after the setup has finished.
+	close(release)
+	require.NoError(t, <-done)
+	fake.Advance(time.Minute)
+	assert.Len(t, tb.logs, 2)
+}
+
+func TestPool_BuildTemplate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	slow := true
+	pool, err := New(ctx, &Config{
+		ID:           "test-build-template",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			if _, err := conn.Exec(ctx, `CREATE TABLE test_table (id SERIAL PRIMARY KEY)`); err != nil {
+				return err
+			}
+			if slow {
+				_, err := conn.Exec(ctx, `SELECT pg_sleep(10)`)
+				return err
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	// An interrupted build leaves no partial template behind.
+	cancelCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	require.Error(t, pool.BuildTemplate(cancelCtx))
+	assert.False(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+
+	slow = false
+	require.NoError(t, pool.BuildTemplate(ctx))
+	assert.True(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+	assert.Equal(t, int64(1), pool.templateDB.Builds())
+}
+
+func TestPool_TemplateSteps(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	var mu sync.Mutex
+	var steps []string
+	var timeouts []time.Duration
+	pool, err := New(ctx, &Config{
+		ID:           "test-template-steps",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			return TimeTemplateStep(ctx, "001_slow.sql", func() error {
+				_, err := conn.Exec(ctx, `SELECT pg_sleep(0.2)`)
+				return err
+			})
+		},
+		OnTemplateStep: func(name string, d time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			steps = append(steps, name)
+		},
+		TemplateSetupTimeout: 50 * time.Millisecond,
+		OnTemplateSetupTimeout: func(elapsed time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			timeouts = append(timeouts, elapsed)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db.Release(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"acquire lock",
+		"create template database",
+		"001_slow.sql",
+		"run SetupTemplate",
+		"record metadata",
+		"drop stale clones",
+	}, steps)
+	assert.Equal(t, []time.Duration{50 * time.Millisecond}, timeouts)
+}
+
+func TestDefaultWarnings_Logger(t *testing.T) {
+	var logged bytes.Buffer
+	cfg := &Config{ID: "warnings", Logger: slog.New(slog.NewTextHandler(&logged, nil))}
+
+	onTemplateSetupTimeout(cfg)(2 * time.Minute)
+	require.NoError(t, onTemplateGenerationChange(cfg)("aaaa", "bbbb"))
+
+	out := logged.String()
+	assert.Contains(t, out, `level=WARN msg="template setup is holding the setup lock; other processes sharing the server are waiting for it" pool_id=warnings elapsed=2m0s`)
+	assert.Contains(t, out, `level=WARN msg="template database was recreated during the run; test databases may have mixed schemas" pool_id=warnings previous_generation=aaaa generation=bbbb`)
+
+	// Without a Logger, nothing is written anywhere.
+	cfg.Logger = nil
+	onTemplateSetupTimeout(cfg)(2 * time.Minute)
+}
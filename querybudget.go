@@ -0,0 +1,229 @@
+package testdbpool
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// queryBudgetReportSize is the number of most repeated statements that
+	// LimitQueries lists when the budget is exceeded.
+	queryBudgetReportSize = 5
+
+	// queryBudgetReportWidth is the length at which statements listed by
+	// LimitQueries are cut.
+	queryBudgetReportWidth = 120
+)
+
+// internalQueriesKey is the context key that marks queries run by the
+// library itself, which do not count towards LimitQueries.
+type internalQueriesKey struct{}
+
+// withInternalQueries returns ctx marked so that the queries run with it do
+// not count towards LimitQueries.
+func withInternalQueries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalQueriesKey{}, true)
+}
+
+// LimitQueries makes tb fail when more than max statements are executed
+// against the database from now until it is released, e.g. to catch N+1
+// query regressions. Statements sent through Pool, DB and Conn count, one per
+// statement of a batch, while those run by the library itself do not. When
+// the budget is exceeded, the database is released normally and tb fails
+// listing the most repeated statements. Calling it again replaces the budget
+// and restarts the count.
+func (db *TestDB) LimitQueries(tb testing.TB, max int) {
+	tb.Helper()
+	if db.queries == nil {
+		tb.Fatalf("test database %s does not count its queries", db.Name())
+	}
+	budget := &queryBudget{counts: map[string]int{}}
+	db.queries.budget.Store(budget)
+	db.CleanupBeforeRelease(tb, func() {
+		if !db.queries.budget.CompareAndSwap(budget, nil) {
+			// Replaced by a later call.
+			return
+		}
+		if n := budget.total(); n > max {
+			tb.Errorf("test database %s executed %d statements, exceeding the budget of %d; most repeated:\n%s",
+				db.Name(), n, max, budget.report(queryBudgetReportSize))
+		}
+	})
+}
+
+// queryBudget counts the statements executed while LimitQueries is in
+// effect.
+type queryBudget struct {
+	mu     sync.Mutex
+	counts map[string]int
+	n      int
+}
+
+// add counts the statement sql.
+func (b *queryBudget) add(sql string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.counts[strings.Join(strings.Fields(sql), " ")]++
+	b.n++
+}
+
+// total returns the number of statements counted.
+func (b *queryBudget) total() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+// report lists the n most repeated statements with their counts.
+func (b *queryBudget) report(n int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	type entry struct {
+		sql   string
+		count int
+	}
+	entries := make([]entry, 0, len(b.counts))
+	for sql, count := range b.counts {
+		entries = append(entries, entry{sql, count})
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return cmp.Or(cmp.Compare(b.count, a.count), strings.Compare(a.sql, b.sql))
+	})
+
+	var sb strings.Builder
+	for _, e := range entries[:min(n, len(entries))] {
+		sql := e.sql
+		if len(sql) > queryBudgetReportWidth {
+			sql = sql[:queryBudgetReportWidth] + "..."
+		}
+		fmt.Fprintf(&sb, "  %4d× %s\n", e.count, sql)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// queryCounter is the tracer of the connections to a test database. It counts
+// the statements executed while a budget of LimitQueries is in effect and
+// delegates everything to the tracer configured for the root pool, if any.
+type queryCounter struct {
+	next   pgx.QueryTracer
+	budget atomic.Pointer[queryBudget]
+}
+
+var (
+	_ pgx.QueryTracer    = (*queryCounter)(nil)
+	_ pgx.BatchTracer    = (*queryCounter)(nil)
+	_ pgx.CopyFromTracer = (*queryCounter)(nil)
+	_ pgx.PrepareTracer  = (*queryCounter)(nil)
+	_ pgx.ConnectTracer  = (*queryCounter)(nil)
+)
+
+// queryCounterOf returns the queryCounter of the connections of pool, or nil
+// if they have none.
+func queryCounterOf(pool *pgxpool.Pool) *queryCounter {
+	counter, _ := pool.Config().ConnConfig.Tracer.(*queryCounter)
+	return counter
+}
+
+// count counts sql unless ctx is marked by withInternalQueries.
+func (c *queryCounter) count(ctx context.Context, sql string) {
+	budget := c.budget.Load()
+	if budget == nil || ctx.Value(internalQueriesKey{}) != nil {
+		return
+	}
+	budget.add(sql)
+}
+
+// TraceQueryStart implements pgx.QueryTracer.
+func (c *queryCounter) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	c.count(ctx, data.SQL)
+	if c.next != nil {
+		return c.next.TraceQueryStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+// TraceQueryEnd implements pgx.QueryTracer.
+func (c *queryCounter) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	if c.next != nil {
+		c.next.TraceQueryEnd(ctx, conn, data)
+	}
+}
+
+// TraceBatchStart implements pgx.BatchTracer.
+func (c *queryCounter) TraceBatchStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	if next, ok := c.next.(pgx.BatchTracer); ok {
+		return next.TraceBatchStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+// TraceBatchQuery implements pgx.BatchTracer.
+func (c *queryCounter) TraceBatchQuery(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchQueryData) {
+	c.count(ctx, data.SQL)
+	if next, ok := c.next.(pgx.BatchTracer); ok {
+		next.TraceBatchQuery(ctx, conn, data)
+	}
+}
+
+// TraceBatchEnd implements pgx.BatchTracer.
+func (c *queryCounter) TraceBatchEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchEndData) {
+	if next, ok := c.next.(pgx.BatchTracer); ok {
+		next.TraceBatchEnd(ctx, conn, data)
+	}
+}
+
+// TraceCopyFromStart implements pgx.CopyFromTracer.
+func (c *queryCounter) TraceCopyFromStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	c.count(ctx, "COPY "+data.TableName.Sanitize()+" FROM STDIN")
+	if next, ok := c.next.(pgx.CopyFromTracer); ok {
+		return next.TraceCopyFromStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+// TraceCopyFromEnd implements pgx.CopyFromTracer.
+func (c *queryCounter) TraceCopyFromEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	if next, ok := c.next.(pgx.CopyFromTracer); ok {
+		next.TraceCopyFromEnd(ctx, conn, data)
+	}
+}
+
+// TracePrepareStart implements pgx.PrepareTracer.
+func (c *queryCounter) TracePrepareStart(ctx context.Context, conn *pgx.Conn, data pgx.TracePrepareStartData) context.Context {
+	if next, ok := c.next.(pgx.PrepareTracer); ok {
+		return next.TracePrepareStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+// TracePrepareEnd implements pgx.PrepareTracer.
+func (c *queryCounter) TracePrepareEnd(ctx context.Context, conn *pgx.Conn, data pgx.TracePrepareEndData) {
+	if next, ok := c.next.(pgx.PrepareTracer); ok {
+		next.TracePrepareEnd(ctx, conn, data)
+	}
+}
+
+// TraceConnectStart implements pgx.ConnectTracer.
+func (c *queryCounter) TraceConnectStart(ctx context.Context, data pgx.TraceConnectStartData) context.Context {
+	if next, ok := c.next.(pgx.ConnectTracer); ok {
+		return next.TraceConnectStart(ctx, data)
+	}
+	return ctx
+}
+
+// TraceConnectEnd implements pgx.ConnectTracer.
+func (c *queryCounter) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+	if next, ok := c.next.(pgx.ConnectTracer); ok {
+		next.TraceConnectEnd(ctx, data)
+	}
+}
@@ -0,0 +1,72 @@
+package testdbpool
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryCounter(t *testing.T) {
+	ctx := context.Background()
+	counter := &queryCounter{}
+
+	// Nothing is counted without a budget.
+	counter.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+
+	budget := &queryBudget{counts: map[string]int{}}
+	counter.budget.Store(budget)
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counter.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: "SELECT *\n\tFROM users WHERE id = $1"})
+			counter.TraceBatchQuery(ctx, nil, pgx.TraceBatchQueryData{SQL: fmt.Sprintf("SELECT %d", i%2)})
+		}()
+	}
+	wg.Wait()
+	counter.TraceQueryStart(withInternalQueries(ctx), nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+	counter.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: "UPDATE users SET name = '" + strings.Repeat("x", 200) + "'"})
+
+	assert.Equal(t, 21, budget.total())
+	assert.Equal(t, strings.Join([]string{
+		"    10× SELECT * FROM users WHERE id = $1",
+		"     5× SELECT 0",
+		"     5× SELECT 1",
+	}, "\n"), budget.report(3))
+	assert.Contains(t, budget.report(5), "     1× UPDATE users SET name = 'xxx")
+	assert.True(t, strings.HasSuffix(budget.report(5), "..."))
+}
+
+// recordingTracer records the queries traced through it.
+type recordingTracer struct {
+	queries []string
+}
+
+func (r *recordingTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	r.queries = append(r.queries, data.SQL)
+	return ctx
+}
+
+func (r *recordingTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+}
+
+func TestQueryCounter_Delegates(t *testing.T) {
+	ctx := context.Background()
+	next := &recordingTracer{}
+	counter := &queryCounter{next: next}
+
+	counter.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+	counter.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+	// next does not implement pgx.BatchTracer.
+	counter.TraceBatchStart(ctx, nil, pgx.TraceBatchStartData{})
+	counter.TraceBatchEnd(ctx, nil, pgx.TraceBatchEndData{})
+
+	assert.Equal(t, []string{"SELECT 1"}, next.queries)
+}
@@ -0,0 +1,73 @@
+package testdbpool_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestTestDB_LimitQueries(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-limit-queries",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE users (id int PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	t.Run("within budget", func(t *testing.T) {
+		recorder := &failureRecorder{TB: t}
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		db.LimitQueries(recorder, 3)
+
+		_, err = db.Pool().Exec(ctx, `INSERT INTO users VALUES (1)`)
+		require.NoError(t, err)
+		var n int
+		require.NoError(t, db.Pool().QueryRow(ctx, `SELECT count(*) FROM users`).Scan(&n))
+		_, err = db.Metadata(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, db.Release(ctx))
+		assert.Empty(t, recorder.errors)
+	})
+
+	t.Run("exceeded", func(t *testing.T) {
+		recorder := &failureRecorder{TB: t}
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		db.LimitQueries(recorder, 3)
+
+		for i := range 3 {
+			var n int
+			err := db.Pool().QueryRow(ctx, `SELECT count(*) FROM users WHERE id = $1`, i).Scan(&n)
+			require.NoError(t, err)
+		}
+		batch := &pgx.Batch{}
+		batch.Queue(`SELECT 1`)
+		batch.Queue(`SELECT 2`)
+		require.NoError(t, db.Pool().SendBatch(ctx, batch).Close())
+
+		require.NoError(t, db.Release(ctx))
+		require.Len(t, recorder.errors, 1)
+		assert.Contains(t, recorder.errors[0], "executed 5 statements, exceeding the budget of 3")
+		assert.Contains(t, recorder.errors[0], "3× SELECT count(*) FROM users WHERE id = $1")
+	})
+}
@@ -0,0 +1,176 @@
+package testdbpool
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/yuku/testdbpool/internal/clock"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+const (
+	// releaseAttempts is the number of attempts to release a resource back to
+	// the numpool before giving up and recording it as stranded.
+	releaseAttempts = 3
+
+	// releaseBackoff is the wait before the first retry of a failed resource
+	// release. It doubles with every retry.
+	releaseBackoff = 50 * time.Millisecond
+)
+
+// resource is the slot of a test database in the numpool.
+// It is satisfied by *numpool.Resource.
+type resource interface {
+	Index() int
+	Release(ctx context.Context) error
+}
+
+// Stat is a snapshot of the state of a Pool.
+type Stat struct {
+	// MaxDatabases is the maximum number of test databases in the pool.
+	MaxDatabases int
+
+	// AcquiredCount is the number of test databases currently acquired
+	// through this Pool.
+	AcquiredCount int
+
+	// IdleCount is the number of slots that this Pool neither holds nor has
+	// stranded. Slots held by other processes sharing the pool ID are
+	// counted as idle, as this Pool cannot see them.
+	IdleCount int
+
+	// TotalAcquires is the number of successful acquisitions of a test
+	// database through this Pool.
+	TotalAcquires int64
+
+	// TotalCreates is the number of test databases created by this Pool,
+	// from the template or template0. It is lower than TotalAcquires when
+	// released databases are reused (see Config.ResetDatabase).
+	TotalCreates int64
+
+	// AcquireWaitDuration is the total time that acquisitions, including
+	// failed ones, have waited for a free slot.
+	AcquireWaitDuration time.Duration
+
+	// ConnectRetries is the number of times connecting to a newly created
+	// test database has been retried after a transient failure, such as a
+	// failed DNS lookup or a refused connection. A steadily growing count
+	// points at flaky networking.
+	ConnectRetries int64
+
+	// Stranded is the indexes of the slots whose release back to the numpool
+	// failed even after retries. They are released again before the next
+	// acquisition, and are unavailable until then.
+	Stranded []int
+
+	// TryHits is the number of TryAcquire calls that returned a test database.
+	TryHits int64
+
+	// TryMisses is the number of TryAcquire calls that returned without a
+	// test database because the pool was full.
+	TryMisses int64
+}
+
+// Stat returns a snapshot of the state of the pool. It is safe to call
+// concurrently with acquisitions and releases, e.g. from a goroutine that
+// monitors the pool while tests run. The counters cover this Pool instance
+// only, not other processes sharing the pool ID.
+func (p *Pool) Stat() Stat {
+	p.strandedMu.Lock()
+	defer p.strandedMu.Unlock()
+
+	stranded := make([]int, 0, len(p.stranded))
+	for _, r := range p.stranded {
+		stranded = append(stranded, r.Index())
+	}
+	slices.Sort(stranded)
+	acquired := int(p.acquired.Load())
+	return Stat{
+		MaxDatabases:        p.cfg.MaxDatabases,
+		AcquiredCount:       acquired,
+		IdleCount:           max(p.cfg.MaxDatabases-acquired-len(stranded), 0),
+		TotalAcquires:       p.acquires.Load(),
+		TotalCreates:        p.templateDB.Creates(),
+		AcquireWaitDuration: time.Duration(p.acquireWait.Load()),
+		ConnectRetries:      p.templateDB.ConnectRetries(),
+		Stranded:            stranded,
+		TryHits:             p.tryHits.Load(),
+		TryMisses:           p.tryMisses.Load(),
+	}
+}
+
+// releaseResource releases r back to the numpool, retrying transient failures
+// with exponential backoff measured by clk.
+func releaseResource(ctx context.Context, clk clock.Clock, r resource) error {
+	backoff := releaseBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = r.Release(ctx); err == nil || attempt == releaseAttempts {
+			return err
+		}
+
+		timer := clk.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C():
+		}
+		backoff *= 2
+	}
+}
+
+// strand records r, whose release failed, so that the release is attempted
+// again by reconcileStranded.
+func (p *Pool) strand(r resource) {
+	p.strandedMu.Lock()
+	defer p.strandedMu.Unlock()
+	p.stranded = append(p.stranded, r)
+}
+
+// reconcileStranded attempts to release the stranded resources again.
+// Resources whose release fails again stay stranded.
+func (p *Pool) reconcileStranded(ctx context.Context) {
+	p.strandedMu.Lock()
+	defer p.strandedMu.Unlock()
+
+	p.stranded = slices.DeleteFunc(p.stranded, func(r resource) bool {
+		return r.Release(ctx) == nil
+	})
+}
+
+// claims is what an acquisition has claimed but not handed out yet: test
+// databases, and slots that do not have a test database yet.
+type claims struct {
+	testDBs   []*TestDB
+	resources []resource
+}
+
+// undoOnPanic gives back what c holds if a panic is unwinding, e.g. out of a
+// user-supplied hook, and then re-panics, so that the panic does not leave
+// slots held and databases behind. It must be deferred directly, as recover
+// has no effect otherwise.
+func (p *Pool) undoOnPanic(ctx context.Context, c *claims) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	releaseAll(ctx, c.testDBs)
+	p.releaseResources(ctx, c.resources)
+	panic(r)
+}
+
+// abandon drops the database dbName, which a failed or panicking creation
+// may have left behind, and gives back the slot r it was created for.
+func (p *Pool) abandon(ctx context.Context, r resource, dbName string) {
+	ctx = context.WithoutCancel(ctx)
+	// Failures are left to the next creation for the slot, which drops the
+	// leftover database.
+	if query, err := sqlbuild.DropDatabase(dbName, false); err == nil {
+		if _, err := p.cfg.Pool.Exec(ctx, query); err == nil {
+			p.eventLogger().Info("test database dropped", "index", r.Index(), "database", dbName)
+		}
+	}
+	p.releaseResources(ctx, []resource{r})
+}
@@ -0,0 +1,180 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/clock"
+	"github.com/yuku/testdbpool/internal/templatedb"
+)
+
+// flakyResource is a resource whose Release fails a given number of times
+// before it succeeds.
+type flakyResource struct {
+	index    int
+	failures int
+	attempts int
+	released bool
+}
+
+func (r *flakyResource) Index() int {
+	return r.index
+}
+
+func (r *flakyResource) Release(ctx context.Context) error {
+	r.attempts++
+	if r.attempts <= r.failures {
+		return errors.New("connection reset by peer")
+	}
+	r.released = true
+	return nil
+}
+
+func TestTestDB_ReleaseRetry(t *testing.T) {
+	ctx := context.Background()
+	newPool := func() *Pool {
+		return &Pool{
+			cfg:        &Config{MaxDatabases: 2},
+			testDBs:    make([]*TestDB, 2),
+			templateDB: &templatedb.TemplateDB{},
+			clock:      clock.NewFake(time.Now()),
+		}
+	}
+	newTestDB := func(p *Pool, r *flakyResource) *TestDB {
+		db := &TestDB{resource: r, onStranded: p.strand, clock: p.clock}
+		p.testDBs[r.index] = db
+		db.onRelease = func(index int) { p.testDBs[index] = nil }
+		return db
+	}
+
+	t.Run("transient failures are retried", func(t *testing.T) {
+		p := newPool()
+		fake := p.clock.(*clock.Fake)
+		r := &flakyResource{index: 1, failures: releaseAttempts - 1}
+
+		done := make(chan error)
+		go func() { done <- newTestDB(p, r).Release(ctx) }()
+
+		// The retries back off exponentially.
+		fake.WaitForTimers(1)
+		fake.Advance(releaseBackoff)
+		fake.WaitForTimers(1)
+		fake.Advance(releaseBackoff*2 - time.Nanosecond)
+		select {
+		case <-done:
+			t.Fatal("Release returned before the second backoff elapsed")
+		default:
+		}
+		fake.Advance(time.Nanosecond)
+
+		require.NoError(t, <-done)
+		assert.True(t, r.released)
+		assert.Equal(t, releaseAttempts, r.attempts)
+		assert.Empty(t, p.Stat().Stranded)
+	})
+
+	t.Run("persistent failures strand the slot until reconciled", func(t *testing.T) {
+		p := newPool()
+		fake := p.clock.(*clock.Fake)
+		r := &flakyResource{index: 1, failures: releaseAttempts + 1}
+
+		done := make(chan error)
+		go func() { done <- newTestDB(p, r).Release(ctx) }()
+		for i := range releaseAttempts - 1 {
+			fake.WaitForTimers(1)
+			fake.Advance(releaseBackoff << i)
+		}
+
+		err := <-done
+		require.ErrorContains(t, err, "connection reset by peer")
+		assert.False(t, r.released)
+		assert.Nil(t, p.testDBs[1])
+		assert.Equal(t, Stat{MaxDatabases: 2, IdleCount: 1, Stranded: []int{1}}, p.Stat())
+
+		// The state database is still unreachable.
+		p.reconcileStranded(ctx)
+		assert.Equal(t, []int{1}, p.Stat().Stranded)
+
+		// It is reachable again.
+		p.reconcileStranded(ctx)
+		assert.True(t, r.released)
+		assert.Empty(t, p.Stat().Stranded)
+	})
+}
+
+func TestTestDB_ReleaseResetError(t *testing.T) {
+	ctx := context.Background()
+
+	// The server is unreachable, so the database can be neither reset nor
+	// dropped.
+	rootPool, err := pgxpool.New(ctx, "postgres://postgres@127.0.0.1:1/postgres?connect_timeout=1")
+	require.NoError(t, err)
+	t.Cleanup(rootPool.Close)
+
+	newDB := func(t *testing.T, r *flakyResource) *TestDB {
+		pool, err := pgxpool.New(ctx, "postgres://postgres@127.0.0.1:1/testdbpool_reset-error_0?connect_timeout=1")
+		require.NoError(t, err)
+		return &TestDB{
+			poolID:   "reset-error",
+			pool:     pool,
+			rootPool: rootPool,
+			resource: r,
+			clock:    clock.Real,
+		}
+	}
+
+	t.Run("reset and drop fail", func(t *testing.T) {
+		r := &flakyResource{index: 0}
+		db := newDB(t, r)
+		db.reset = func(ctx context.Context, conn *pgx.Conn) error { return nil }
+
+		err := db.Release(ctx)
+		require.ErrorIs(t, err, ErrResetFailed)
+		var resetErr *ResetError
+		require.ErrorAs(t, err, &resetErr)
+		assert.Equal(t, "reset-error", resetErr.PoolID)
+		assert.Equal(t, "testdbpool_reset-error_0", resetErr.Database)
+		assert.ErrorContains(t, err, "failed to reset test database testdbpool_reset-error_0 of pool reset-error:")
+		require.ErrorIs(t, err, ErrDropFailed)
+		assert.ErrorContains(t, err, "failed to drop test database testdbpool_reset-error_0 of pool reset-error:")
+		// The slot is returned regardless.
+		assert.True(t, r.released)
+	})
+
+	t.Run("drop fails without a reset", func(t *testing.T) {
+		r := &flakyResource{index: 0}
+		db := newDB(t, r)
+
+		err := db.Release(ctx)
+		require.ErrorIs(t, err, ErrDropFailed)
+		assert.NotErrorIs(t, err, ErrResetFailed)
+		var dropErr *DropError
+		require.ErrorAs(t, err, &dropErr)
+		assert.Equal(t, "reset-error", dropErr.PoolID)
+		assert.Equal(t, "testdbpool_reset-error_0", dropErr.Database)
+		assert.NotContains(t, err.Error(), "failed to reset")
+		assert.True(t, r.released)
+	})
+
+	t.Run("the slot is not returned either", func(t *testing.T) {
+		r := &flakyResource{index: 0, failures: releaseAttempts}
+		db := newDB(t, r)
+		db.reset = func(ctx context.Context, conn *pgx.Conn) error { return nil }
+		// A canceled context makes releaseResource give up after the first
+		// attempt.
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := db.Release(canceled)
+		assert.ErrorIs(t, err, ErrResetFailed)
+		assert.ErrorIs(t, err, ErrDropFailed)
+		assert.ErrorContains(t, err, "failed to release resource: connection reset by peer")
+		assert.False(t, r.released)
+	})
+}
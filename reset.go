@@ -0,0 +1,141 @@
+package testdbpool
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// ResetByTruncateAll returns a function suitable for Config.ResetDatabase
+// that empties every table of the database in one TRUNCATE ... RESTART
+// IDENTITY statement, so that no order between tables referencing each
+// other has to be maintained and serial columns start over. The tables of
+// all schemas but the system ones are included; those of extensions are
+// left alone, as are the tables in exclude, e.g. static lookup tables
+// seeded by SetupTemplate. Each entry of exclude is either schema-qualified,
+// e.g. "public.categories", or a bare name that matches the table in any
+// schema. TRUNCATE fails rather than emptying an excluded table that
+// references one of the others.
+func ResetByTruncateAll(exclude ...string) func(context.Context, *pgx.Conn) error {
+	excluded := map[string]bool{}
+	for _, name := range exclude {
+		excluded[name] = true
+	}
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		tables, err := listTables(ctx, conn)
+		if err != nil {
+			return err
+		}
+		var truncate []string
+		for _, table := range tables {
+			if excluded[table.schema+"."+table.name] || excluded[table.name] {
+				continue
+			}
+			ident, err := table.identifier()
+			if err != nil {
+				return err
+			}
+			truncate = append(truncate, ident)
+		}
+		return truncateTables(ctx, conn, truncate)
+	}
+}
+
+// TruncateOptions configures ResetByTruncateWithOptions.
+type TruncateOptions struct {
+	// RestartIdentity restarts the sequences owned by the columns of the
+	// truncated tables, e.g. serial and identity columns, so that seed data
+	// and tests that rely on fixed IDs see the same IDs after every reset.
+	// A seed function that sets sequences with setval runs afterwards, so
+	// its values win.
+	RestartIdentity bool
+}
+
+// ResetByTruncateWithOptions returns a function suitable for
+// Config.ResetDatabase that empties tables with TRUNCATE ... CASCADE, which
+// also empties the tables referencing them, and then calls seed, if not nil,
+// to put back the rows that the tests expect. tables are optionally
+// schema-qualified names; an invalid one makes the function fail before
+// anything is truncated.
+func ResetByTruncateWithOptions(tables []string, seed func(context.Context, *pgx.Conn) error, opts TruncateOptions) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		identifiers := make([]string, len(tables))
+		for i, table := range tables {
+			ident, err := sqlbuild.Table(table)
+			if err != nil {
+				return err
+			}
+			identifiers[i] = ident
+		}
+		if len(identifiers) > 0 {
+			query := `TRUNCATE ` + strings.Join(identifiers, ", ")
+			if opts.RestartIdentity {
+				query += ` RESTART IDENTITY`
+			}
+			if _, err := conn.Exec(ctx, query+` CASCADE`); err != nil {
+				return fmt.Errorf("failed to truncate tables: %w", err)
+			}
+		}
+		if seed != nil {
+			if err := seed(ctx, conn); err != nil {
+				return fmt.Errorf("failed to seed database after truncation: %w", err)
+			}
+		}
+		return nil
+	}
+}
+
+// table is a table of a test database.
+type table struct {
+	schema, name string
+}
+
+// identifier returns the quoted, schema-qualified identifier of t.
+func (t table) identifier() (string, error) {
+	return sqlbuild.Ident(t.schema, t.name)
+}
+
+// listTables returns the tables and partitioned tables of the database conn
+// is connected to, outside of the system schemas.
+// The tables of extensions are left to them, as pg_dump does.
+func listTables(ctx context.Context, conn *pgx.Conn) ([]table, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT n.nspname, c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p')
+			AND n.nspname <> 'information_schema'
+			AND n.nspname NOT LIKE 'pg\_%'
+			AND NOT EXISTS (
+				SELECT 1 FROM pg_depend d
+				WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e'
+			)
+		ORDER BY n.nspname, c.relname`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	tables, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (table, error) {
+		var t table
+		err := row.Scan(&t.schema, &t.name)
+		return t, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	return tables, nil
+}
+
+// truncateTables empties the tables with the quoted identifiers in one
+// statement, restarting their sequences. It does nothing if there are none.
+func truncateTables(ctx context.Context, conn *pgx.Conn, identifiers []string) error {
+	if len(identifiers) == 0 {
+		return nil
+	}
+	if _, err := conn.Exec(ctx, `TRUNCATE `+strings.Join(identifiers, ", ")+` RESTART IDENTITY`); err != nil {
+		return fmt.Errorf("failed to truncate tables: %w", err)
+	}
+	return nil
+}
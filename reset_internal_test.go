@@ -0,0 +1,14 @@
+package testdbpool
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResetByTruncateWithOptions_InvalidTable(t *testing.T) {
+	// The names are checked before the connection is used.
+	reset := ResetByTruncateWithOptions([]string{"users", "users; DROP TABLE x"}, nil, TruncateOptions{RestartIdentity: true})
+	assert.EqualError(t, reset(context.Background(), nil), "invalid table name: users; DROP TABLE x")
+}
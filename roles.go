@@ -0,0 +1,113 @@
+package testdbpool
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/yuku/testdbpool/internal/pgconst"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// RoleSpec is a PostgreSQL role that the template and test databases depend on.
+type RoleSpec struct {
+	// Name is the name of the role. It must be a valid PostgreSQL identifier.
+	Name string
+
+	// Options are the options of CREATE ROLE, e.g. "NOLOGIN" or
+	// "LOGIN PASSWORD 'secret'". They are used verbatim as SQL and only when
+	// the role is created; the options of an existing role are not changed.
+	// Optional.
+	Options string
+}
+
+// MissingRolesError is returned by New when some of Config.RequiredRoles do
+// not exist and are not created, either because Config.SkipRoleCreation is
+// set or because the connection user lacks the CREATEROLE privilege.
+type MissingRolesError struct {
+	// Roles lists the names of the missing roles.
+	Roles []string
+
+	// Reason tells why the roles were not created.
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *MissingRolesError) Error() string {
+	return fmt.Sprintf("missing required roles: %s (%s)", strings.Join(e.Roles, ", "), e.Reason)
+}
+
+// ensureRoles creates the roles of specs that do not exist in the cluster yet.
+// Roles are cluster-wide, so once they exist, the template database and all
+// test databases can rely on them.
+func ensureRoles(ctx context.Context, pool *pgxpool.Pool, specs []RoleSpec, skipCreation bool) error {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(specs))
+	for i, spec := range specs {
+		names[i] = spec.Name
+	}
+	rows, err := pool.Query(ctx, `SELECT rolname FROM pg_roles WHERE rolname = ANY($1)`, names)
+	if err != nil {
+		return fmt.Errorf("failed to query roles: %w", err)
+	}
+	existing, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to query roles: %w", err)
+	}
+
+	var missing []RoleSpec
+	for _, spec := range specs {
+		if !slices.Contains(existing, spec.Name) {
+			missing = append(missing, spec)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	missingNames := make([]string, len(missing))
+	for i, spec := range missing {
+		missingNames[i] = spec.Name
+	}
+	if skipCreation {
+		return &MissingRolesError{Roles: missingNames, Reason: "role creation is skipped"}
+	}
+
+	var canCreate bool
+	err = pool.
+		QueryRow(ctx, `SELECT rolsuper OR rolcreaterole FROM pg_roles WHERE rolname = current_user`).
+		Scan(&canCreate)
+	if err != nil {
+		return fmt.Errorf("failed to check CREATEROLE privilege: %w", err)
+	}
+	if !canCreate {
+		return &MissingRolesError{Roles: missingNames, Reason: "connection user lacks the CREATEROLE privilege"}
+	}
+
+	for _, spec := range missing {
+		query, err := sqlbuild.CreateRoleIfNotExists(spec.Name, spec.Options)
+		if err != nil {
+			return err
+		}
+		if _, err := pool.Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to create role %s: %w", spec.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateRoles checks that every role spec has a valid name.
+func validateRoles(specs []RoleSpec) error {
+	for _, spec := range specs {
+		if !pgconst.IsValidPostgreSQLIdentifier(spec.Name) {
+			return fmt.Errorf("invalid RequiredRoles name: %q", spec.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package testdbpool
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"slices"
+)
+
+// SchemaHashLength is the length of the hashes returned by HashMigrations.
+// Together with the "testdbpooltmpl_" prefix of the template database, an ID
+// like "myapp-<hash>" stays well within PostgreSQL's 63 byte name limit.
+const SchemaHashLength = 12
+
+// HashMigrations returns a short hash of the contents of the files in fsys
+// that match glob (see fs.Glob), suitable for appending to Config.ID so that a
+// schema change leads to a fresh pool and template database:
+//
+//	hash, err := testdbpool.HashMigrations(os.DirFS("db"), "migrations/*.sql")
+//	cfg.ID = "myapp-" + hash
+//
+// The hash is stable across runs and operating systems: files are hashed in
+// lexical order of their paths, and CRLF line endings are normalized to LF.
+// Renaming a file changes the hash, as it may change the order in which
+// migrations are applied. It returns an error if no file matches glob.
+func HashMigrations(fsys fs.FS, glob string) (string, error) {
+	paths, err := fs.Glob(fsys, glob)
+	if err != nil {
+		return "", fmt.Errorf("invalid glob %q: %w", glob, err)
+	}
+	slices.Sort(paths)
+
+	h := sha256.New()
+	hashed := 0
+	for _, path := range paths {
+		info, err := fs.Stat(fsys, path)
+		if err != nil {
+			return "", fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		if info.IsDir() {
+			continue
+		}
+		content, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+
+		// Length-prefix both parts so that moving bytes between the path and
+		// the content, or between files, changes the hash.
+		fmt.Fprintf(h, "%d:%s%d:", len(path), path, len(content))
+		h.Write(content)
+		hashed++
+	}
+	if hashed == 0 {
+		return "", fmt.Errorf("no files match %q", glob)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:SchemaHashLength], nil
+}
+
+// fingerprintSuffix returns the suffix that New appends to Config.ID for the
+// schema fingerprint fingerprint: a dash followed by SchemaHashLength hex
+// digits of its hash.
+func fingerprintSuffix(fingerprint string) string {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return "-" + hex.EncodeToString(sum[:])[:SchemaHashLength]
+}
+
+// splitFingerprintSuffix returns id without its fingerprint suffix and the
+// suffix, or ok false if id does not end with a fingerprint suffix.
+func splitFingerprintSuffix(id string) (base, suffix string, ok bool) {
+	n := len(id) - SchemaHashLength - 1
+	if n < 0 || id[n] != '-' {
+		return "", "", false
+	}
+	for _, c := range id[n+1:] {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return "", "", false
+		}
+	}
+	return id[:n], id[n:], true
+}
@@ -0,0 +1,75 @@
+package testdbpool_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool"
+)
+
+func TestHashMigrations(t *testing.T) {
+	migrations := fstest.MapFS{
+		"migrations/001_users.sql": {Data: []byte("CREATE TABLE users (id INT);\n")},
+		"migrations/002_posts.sql": {Data: []byte("CREATE TABLE posts (id INT);\n")},
+		"migrations/README.md":     {Data: []byte("not a migration\n")},
+	}
+	hash, err := testdbpool.HashMigrations(migrations, "migrations/*.sql")
+	require.NoError(t, err)
+	assert.Len(t, hash, testdbpool.SchemaHashLength)
+	assert.Regexp(t, `^[0-9a-f]+$`, hash)
+	// The hash is a constant so that a change of the algorithm, which would
+	// spawn new pools everywhere, does not go unnoticed.
+	assert.Equal(t, "4a81179789c6", hash)
+
+	t.Run("ignores line endings", func(t *testing.T) {
+		crlf := fstest.MapFS{
+			"migrations/001_users.sql": {Data: []byte("CREATE TABLE users (id INT);\r\n")},
+			"migrations/002_posts.sql": {Data: []byte("CREATE TABLE posts (id INT);\r\n")},
+		}
+		got, err := testdbpool.HashMigrations(crlf, "migrations/*.sql")
+		require.NoError(t, err)
+		assert.Equal(t, hash, got)
+	})
+
+	t.Run("ignores non-matching files", func(t *testing.T) {
+		withoutReadme := fstest.MapFS{
+			"migrations/001_users.sql": migrations["migrations/001_users.sql"],
+			"migrations/002_posts.sql": migrations["migrations/002_posts.sql"],
+		}
+		got, err := testdbpool.HashMigrations(withoutReadme, "migrations/*.sql")
+		require.NoError(t, err)
+		assert.Equal(t, hash, got)
+	})
+
+	t.Run("changes with content", func(t *testing.T) {
+		changed := fstest.MapFS{
+			"migrations/001_users.sql": {Data: []byte("CREATE TABLE users (id BIGINT);\n")},
+			"migrations/002_posts.sql": migrations["migrations/002_posts.sql"],
+		}
+		got, err := testdbpool.HashMigrations(changed, "migrations/*.sql")
+		require.NoError(t, err)
+		assert.NotEqual(t, hash, got)
+	})
+
+	t.Run("changes with file names", func(t *testing.T) {
+		renamed := fstest.MapFS{
+			"migrations/001_users.sql": migrations["migrations/002_posts.sql"],
+			"migrations/002_posts.sql": migrations["migrations/001_users.sql"],
+		}
+		got, err := testdbpool.HashMigrations(renamed, "migrations/*.sql")
+		require.NoError(t, err)
+		assert.NotEqual(t, hash, got)
+	})
+
+	t.Run("no matching files", func(t *testing.T) {
+		_, err := testdbpool.HashMigrations(migrations, "schema/*.sql")
+		assert.EqualError(t, err, `no files match "schema/*.sql"`)
+	})
+
+	t.Run("invalid glob", func(t *testing.T) {
+		_, err := testdbpool.HashMigrations(migrations, "[")
+		assert.ErrorContains(t, err, "invalid glob")
+	})
+}
@@ -0,0 +1,294 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yuku/testdbpool/internal/textdiff"
+)
+
+// UpdateSnapshotsEnv is the environment variable that makes
+// AssertSchemaSnapshot rewrite golden files instead of comparing against
+// them, for packages that do not define an -update flag.
+const UpdateSnapshotsEnv = "TESTDBPOOL_UPDATE_SNAPSHOTS"
+
+// SchemaSnapshotOptions configures SchemaSnapshot.
+type SchemaSnapshotOptions struct {
+	// Schemas lists the schemas to include.
+	// If empty, all schemas are included except the system schemas.
+	Schemas []string
+}
+
+// snapshotRelation is a table or view in a schema snapshot.
+type snapshotRelation struct {
+	kind        string
+	columns     []string
+	constraints []string
+	indexes     []string
+	definition  string
+}
+
+// SchemaSnapshot returns a deterministic, DDL-like description of the schema
+// of the database conn is connected to: its tables with their columns,
+// constraints and indexes, and its views. It is meant to be compared against
+// a checked-in snapshot (see AssertSchemaSnapshot) to detect changes of
+// SetupTemplate.
+//
+// Relations, constraints and indexes are sorted by name, columns are kept in
+// their table order, and types and expressions are spelled the way
+// PostgreSQL prints them, e.g. "character varying(255)". Volatile details
+// such as OIDs and objects owned by extensions are left out. Indexes that
+// implement a constraint are described by the constraint only.
+func SchemaSnapshot(ctx context.Context, conn *pgx.Conn, opts SchemaSnapshotOptions) (string, error) {
+	schemas := opts.Schemas
+	if len(schemas) == 0 {
+		// NULL selects the default schemas.
+		schemas = nil
+	}
+	relations := map[string]*snapshotRelation{}
+
+	err := collectSnapshotRows(ctx, conn, `
+		SELECT
+			quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+			CASE c.relkind
+				WHEN 'v' THEN 'VIEW'
+				WHEN 'm' THEN 'MATERIALIZED VIEW'
+				ELSE 'TABLE'
+			END,
+			CASE WHEN c.relkind IN ('v', 'm') THEN pg_get_viewdef(c.oid, true) ELSE '' END
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'v', 'm') AND `+snapshotRelationFilter,
+		schemas,
+		func(name string, values []string) {
+			relations[name] = &snapshotRelation{kind: values[0], definition: values[1]}
+		},
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to list relations: %w", err)
+	}
+
+	err = collectSnapshotRows(ctx, conn, `
+		SELECT
+			quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+			quote_ident(a.attname) || ' ' || format_type(a.atttypid, a.atttypmod)
+			|| CASE WHEN a.attcollation <> t.typcollation
+				THEN ' COLLATE ' || quote_ident(co.collname) ELSE '' END
+			|| CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END
+			|| CASE
+				WHEN a.attidentity = 'a' THEN ' GENERATED ALWAYS AS IDENTITY'
+				WHEN a.attidentity = 'd' THEN ' GENERATED BY DEFAULT AS IDENTITY'
+				WHEN a.attgenerated = 's' THEN ' GENERATED ALWAYS AS (' || pg_get_expr(d.adbin, d.adrelid) || ') STORED'
+				WHEN d.adbin IS NOT NULL THEN ' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid)
+				ELSE ''
+			END
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_attribute a ON a.attrelid = c.oid
+		JOIN pg_type t ON t.oid = a.atttypid
+		LEFT JOIN pg_collation co ON co.oid = a.attcollation
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE c.relkind IN ('r', 'p', 'v', 'm') AND a.attnum > 0 AND NOT a.attisdropped
+			AND `+snapshotRelationFilter+`
+		ORDER BY a.attnum`,
+		schemas,
+		func(name string, values []string) {
+			if r := relations[name]; r != nil {
+				r.columns = append(r.columns, values[0])
+			}
+		},
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to list columns: %w", err)
+	}
+
+	// Not-null constraints are described by the columns, as only newer
+	// servers record them in pg_constraint.
+	err = collectSnapshotRows(ctx, conn, `
+		SELECT
+			quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+			'CONSTRAINT ' || quote_ident(con.conname) || ' ' || pg_get_constraintdef(con.oid)
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype IN ('p', 'u', 'f', 'c', 'x') AND `+snapshotRelationFilter,
+		schemas,
+		func(name string, values []string) {
+			if r := relations[name]; r != nil {
+				r.constraints = append(r.constraints, values[0])
+			}
+		},
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to list constraints: %w", err)
+	}
+
+	err = collectSnapshotRows(ctx, conn, `
+		SELECT
+			quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+			pg_get_indexdef(i.indexrelid)
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT EXISTS (
+			SELECT 1 FROM pg_constraint con
+			WHERE con.conindid = i.indexrelid AND con.contype IN ('p', 'u', 'x')
+		) AND `+snapshotRelationFilter,
+		schemas,
+		func(name string, values []string) {
+			if r := relations[name]; r != nil {
+				r.indexes = append(r.indexes, strings.TrimPrefix(values[0], "CREATE "))
+			}
+		},
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to list indexes: %w", err)
+	}
+
+	names := make([]string, 0, len(relations))
+	for name := range relations {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	for i, name := range names {
+		r := relations[name]
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s %s\n", r.kind, name)
+		for _, column := range r.columns {
+			fmt.Fprintf(&b, "    %s\n", column)
+		}
+		slices.Sort(r.constraints)
+		for _, constraint := range r.constraints {
+			fmt.Fprintf(&b, "    %s\n", constraint)
+		}
+		slices.Sort(r.indexes)
+		for _, index := range r.indexes {
+			fmt.Fprintf(&b, "    %s\n", index)
+		}
+		if r.definition != "" {
+			b.WriteString("    AS\n")
+			for _, line := range strings.Split(strings.TrimSpace(r.definition), "\n") {
+				fmt.Fprintf(&b, "    %s\n", strings.TrimRight(line, " "))
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// snapshotRelationFilter restricts the relation c in namespace n to the
+// schemas given as the first query parameter, or to the default schemas if
+// it is NULL, and leaves out relations owned by extensions.
+const snapshotRelationFilter = `
+	(
+		n.nspname = ANY($1)
+		OR $1::text[] IS NULL AND n.nspname <> 'information_schema'
+			AND n.nspname NOT LIKE 'pg\_%'
+	)
+	AND NOT EXISTS (
+		SELECT 1 FROM pg_depend dep
+		WHERE dep.classid = 'pg_class'::regclass AND dep.objid = c.oid AND dep.deptype = 'e'
+	)`
+
+// collectSnapshotRows runs query with schemas as its parameter and calls add
+// with the relation name in the first column and the values of the others.
+func collectSnapshotRows(
+	ctx context.Context,
+	conn *pgx.Conn,
+	query string,
+	schemas []string,
+	add func(name string, values []string),
+) error {
+	rows, err := conn.Query(ctx, query, schemas)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return err
+		}
+		strs := make([]string, len(values)-1)
+		for i, v := range values[1:] {
+			strs[i], _ = v.(string)
+		}
+		name, _ := values[0].(string)
+		add(name, strs)
+	}
+	return rows.Err()
+}
+
+// AssertSchemaSnapshot fails tb if the schema of db, as described by
+// SchemaSnapshot with the default options, differs from the golden file at
+// goldenPath, showing a unified diff between the two.
+//
+// If the test binary defines an -update flag, as is common for golden files,
+// and it is set, or if the environment variable TESTDBPOOL_UPDATE_SNAPSHOTS
+// is set to a true value, the golden file is written instead:
+//
+//	go test -run TestSchema -update
+//	TESTDBPOOL_UPDATE_SNAPSHOTS=1 go test -run TestSchema
+func AssertSchemaSnapshot(tb testing.TB, db *TestDB, goldenPath string) {
+	tb.Helper()
+	ctx := context.Background()
+
+	conn, err := db.Pool().Acquire(ctx)
+	if err != nil {
+		tb.Fatalf("failed to acquire connection to %s: %v", db.Name(), err)
+	}
+	got, err := SchemaSnapshot(ctx, conn.Conn(), SchemaSnapshotOptions{})
+	conn.Release()
+	if err != nil {
+		tb.Fatalf("failed to take schema snapshot of %s: %v", db.Name(), err)
+	}
+
+	if updateSnapshots() {
+		if err := os.MkdirAll(filepath.Dir(goldenPath), 0o755); err != nil {
+			tb.Fatalf("failed to create directory of schema snapshot: %v", err)
+		}
+		if err := os.WriteFile(goldenPath, []byte(got), 0o644); err != nil {
+			tb.Fatalf("failed to write schema snapshot: %v", err)
+		}
+		tb.Logf("updated schema snapshot %s", goldenPath)
+		return
+	}
+
+	want, err := os.ReadFile(goldenPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		tb.Fatalf("schema snapshot %s does not exist; run the test with -update or %s=1 to create it",
+			goldenPath, UpdateSnapshotsEnv)
+	}
+	if err != nil {
+		tb.Fatalf("failed to read schema snapshot: %v", err)
+	}
+	if diff := textdiff.Unified(goldenPath, "current schema", string(want), got); diff != "" {
+		tb.Errorf("schema differs from snapshot %s; run the test with -update or %s=1 to regenerate it:\n%s",
+			goldenPath, UpdateSnapshotsEnv, diff)
+	}
+}
+
+// updateSnapshots reports whether AssertSchemaSnapshot should rewrite golden
+// files.
+func updateSnapshots() bool {
+	if f := flag.Lookup("update"); f != nil {
+		if update, err := strconv.ParseBool(f.Value.String()); err == nil && update {
+			return true
+		}
+	}
+	update, _ := strconv.ParseBool(os.Getenv(UpdateSnapshotsEnv))
+	return update
+}
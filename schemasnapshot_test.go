@@ -0,0 +1,195 @@
+package testdbpool_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+// failureRecorder records the failures reported through it instead of
+// failing the test.
+type failureRecorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *failureRecorder) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestSchemaSnapshot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	var pool *testdbpool.Pool
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "test-schema-snapshot",
+		Pool:         connPool,
+		MaxDatabases: 2,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `
+				CREATE TABLE users (
+					id SERIAL PRIMARY KEY,
+					email VARCHAR(255) NOT NULL UNIQUE,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+				);
+				CREATE TABLE posts (
+					id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+					user_id INT NOT NULL REFERENCES users (id),
+					title TEXT CHECK (title <> '')
+				);
+				CREATE INDEX posts_user_id_idx ON posts (user_id);
+				CREATE VIEW user_post_counts AS
+					SELECT u.id, count(p.id) AS posts FROM users u LEFT JOIN posts p ON p.user_id = u.id GROUP BY u.id;
+			`)
+			if err != nil {
+				return err
+			}
+			// The template metadata is not part of the snapshot.
+			return pool.SetTemplateMetadata(ctx, "version", "1")
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	snapshot := func(db *testdbpool.TestDB) string {
+		t.Helper()
+		conn, err := db.Pool().Acquire(ctx)
+		require.NoError(t, err)
+		defer conn.Release()
+		s, err := testdbpool.SchemaSnapshot(ctx, conn.Conn(), testdbpool.SchemaSnapshotOptions{})
+		require.NoError(t, err)
+		return s
+	}
+
+	db1, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db1.Release(ctx)) }()
+	db2, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db2.Release(ctx)) }()
+
+	base := snapshot(db1)
+	for _, want := range []string{
+		"TABLE public.posts\n" +
+			"    id bigint NOT NULL GENERATED ALWAYS AS IDENTITY\n" +
+			"    user_id integer NOT NULL\n" +
+			"    title text\n" +
+			"    CONSTRAINT posts_pkey PRIMARY KEY (id)\n" +
+			"    CONSTRAINT posts_title_check CHECK ((title <> ''::text))\n" +
+			"    CONSTRAINT posts_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id)\n" +
+			"    INDEX posts_user_id_idx ON public.posts USING btree (user_id)\n",
+		"TABLE public.users\n" +
+			"    id integer NOT NULL DEFAULT nextval('users_id_seq'::regclass)\n" +
+			"    email character varying(255) NOT NULL\n" +
+			"    created_at timestamp with time zone NOT NULL DEFAULT now()\n" +
+			"    CONSTRAINT users_email_key UNIQUE (email)\n" +
+			"    CONSTRAINT users_pkey PRIMARY KEY (id)\n",
+		"VIEW public.user_post_counts\n    id integer\n    posts bigint\n    AS\n    SELECT u.id,",
+	} {
+		assert.Contains(t, base, want)
+	}
+	assert.NotContains(t, base, "testdbpool.")
+
+	t.Run("stable across runs and clones", func(t *testing.T) {
+		assert.Equal(t, base, snapshot(db1))
+		assert.Equal(t, base, snapshot(db2))
+	})
+
+	t.Run("schemas option", func(t *testing.T) {
+		conn, err := db1.Pool().Acquire(ctx)
+		require.NoError(t, err)
+		defer conn.Release()
+		s, err := testdbpool.SchemaSnapshot(ctx, conn.Conn(), testdbpool.SchemaSnapshotOptions{Schemas: []string{"other"}})
+		require.NoError(t, err)
+		assert.Empty(t, s)
+	})
+
+	golden := filepath.Join(t.TempDir(), "testdata", "schema.snapshot")
+
+	t.Run("missing golden file", func(t *testing.T) {
+		t.Setenv(testdbpool.UpdateSnapshotsEnv, "")
+		// Fatalf ends the goroutine that calls it, so run the assertion in
+		// a goroutine of its own.
+		done := make(chan struct{})
+		fatal := &fatalRecorder{failureRecorder: &failureRecorder{TB: t}}
+		go func() {
+			defer close(done)
+			testdbpool.AssertSchemaSnapshot(fatal, db1, golden)
+		}()
+		<-done
+		require.Len(t, fatal.fatals, 1)
+		assert.Contains(t, fatal.fatals[0], "run the test with -update or TESTDBPOOL_UPDATE_SNAPSHOTS=1 to create it")
+	})
+
+	t.Run("update writes the golden file", func(t *testing.T) {
+		t.Setenv(testdbpool.UpdateSnapshotsEnv, "1")
+		testdbpool.AssertSchemaSnapshot(t, db1, golden)
+		got, err := os.ReadFile(golden)
+		require.NoError(t, err)
+		assert.Equal(t, base, string(got))
+	})
+
+	t.Run("unchanged schema passes", func(t *testing.T) {
+		t.Setenv(testdbpool.UpdateSnapshotsEnv, "")
+		recorder := &failureRecorder{TB: t}
+		testdbpool.AssertSchemaSnapshot(recorder, db2, golden)
+		assert.Empty(t, recorder.errors)
+	})
+
+	t.Run("added column", func(t *testing.T) {
+		t.Setenv(testdbpool.UpdateSnapshotsEnv, "")
+		_, err := db1.Pool().Exec(ctx, `ALTER TABLE users ADD COLUMN nickname TEXT`)
+		require.NoError(t, err)
+
+		recorder := &failureRecorder{TB: t}
+		testdbpool.AssertSchemaSnapshot(recorder, db1, golden)
+		require.Len(t, recorder.errors, 1)
+		assert.Contains(t, recorder.errors[0], "--- "+golden+"\n+++ current schema\n")
+		assert.Contains(t, recorder.errors[0],
+			"     created_at timestamp with time zone NOT NULL DEFAULT now()\n"+
+				"+    nickname text\n")
+	})
+
+	t.Run("index change", func(t *testing.T) {
+		t.Setenv(testdbpool.UpdateSnapshotsEnv, "")
+		_, err := db2.Pool().Exec(ctx, `
+			DROP INDEX posts_user_id_idx;
+			CREATE INDEX posts_user_id_idx ON posts (user_id, id);
+		`)
+		require.NoError(t, err)
+
+		recorder := &failureRecorder{TB: t}
+		testdbpool.AssertSchemaSnapshot(recorder, db2, golden)
+		require.Len(t, recorder.errors, 1)
+		assert.Contains(t, recorder.errors[0],
+			"-    INDEX posts_user_id_idx ON public.posts USING btree (user_id)\n"+
+				"+    INDEX posts_user_id_idx ON public.posts USING btree (user_id, id)\n")
+	})
+}
+
+// fatalRecorder records calls of Fatalf and ends the goroutine like
+// testing.T does.
+type fatalRecorder struct {
+	*failureRecorder
+	fatals []string
+}
+
+func (r *fatalRecorder) Fatalf(format string, args ...any) {
+	r.fatals = append(r.fatals, fmt.Sprintf(format, args...))
+	runtime.Goexit()
+}
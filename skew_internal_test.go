@@ -0,0 +1,76 @@
+package testdbpool
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/clock"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+// TestPool_ClockSkew checks that template staleness is decided by the time of
+// the database server, not by the client clock.
+func TestPool_ClockSkew(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	for _, skew := range []time.Duration{-48 * time.Hour, 48 * time.Hour} {
+		t.Run(skew.String(), func(t *testing.T) {
+			pool, err := New(ctx, &Config{
+				ID:           "test-clock-skew",
+				Pool:         connPool,
+				MaxDatabases: 1,
+				SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+					return nil
+				},
+				MaxTemplateAge: time.Hour,
+			})
+			require.NoError(t, err)
+			t.Cleanup(pool.Cleanup)
+			pool.clock = clock.NewFake(time.Now().Add(skew))
+
+			db, err := pool.Acquire(ctx)
+			require.NoError(t, err)
+			require.NoError(t, db.Release(ctx))
+
+			// The creation time is recorded in server time.
+			var recent bool
+			err = connPool.QueryRow(ctx, `
+				SELECT (shobj_description(oid, 'pg_database')::json->>'created_at')::timestamptz
+					> now() - interval '1 minute'
+				FROM pg_database WHERE datname = $1`,
+				pool.TemplateDBName(),
+			).Scan(&recent)
+			require.NoError(t, err)
+			assert.True(t, recent)
+
+			// A fresh template is not stale whatever the client clock says.
+			require.NoError(t, pool.templateDB.DropIfStale(ctx))
+			assert.True(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+
+			// A template that is old in server time is stale.
+			var serverNow time.Time
+			require.NoError(t, connPool.QueryRow(ctx, `SELECT now()`).Scan(&serverNow))
+			comment, err := json.Marshal(map[string]any{"created_at": serverNow.Add(-2 * time.Hour)})
+			require.NoError(t, err)
+			query, err := sqlbuild.CommentOnDatabase(pool.TemplateDBName(), string(comment))
+			require.NoError(t, err)
+			_, err = connPool.Exec(ctx, query)
+			require.NoError(t, err)
+
+			require.NoError(t, pool.templateDB.DropIfStale(ctx))
+			assert.False(t, testutil.DBExists(t, connPool, pool.TemplateDBName()))
+		})
+	}
+}
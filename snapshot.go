@@ -0,0 +1,132 @@
+package testdbpool
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yuku/testdbpool/internal/templatedb"
+)
+
+// snapshotTools are the client programs that Config.ResetBySnapshot runs.
+var snapshotTools = []string{"pg_dump", "pg_restore"}
+
+// checkSnapshotTools returns an error naming the first of snapshotTools that
+// is not found in PATH.
+func checkSnapshotTools() error {
+	for _, tool := range snapshotTools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("ResetBySnapshot requires %s, which is installed with the PostgreSQL client: %w", tool, err)
+		}
+	}
+	return nil
+}
+
+// snapshot is the data-only dump of the template database that
+// Config.ResetBySnapshot restores test databases from.
+type snapshot struct {
+	templateDB *templatedb.TemplateDB
+
+	// mu protects generation and dump.
+	mu sync.Mutex
+
+	// generation is the generation of the template database that dump was
+	// taken from.
+	generation string
+
+	// dump is the dump in the custom format of pg_dump, or nil if none has
+	// been taken yet.
+	dump []byte
+}
+
+// newSnapshot returns the snapshot of the template database of templateDB
+// if cfg.ResetBySnapshot is set, or nil otherwise.
+func newSnapshot(cfg *Config, templateDB *templatedb.TemplateDB) *snapshot {
+	if !cfg.ResetBySnapshot {
+		return nil
+	}
+	return &snapshot{templateDB: templateDB}
+}
+
+// take returns the dump of the current generation of the template database,
+// dumping it on first use and whenever the template has been rebuilt. The
+// dump is taken while holding the setup lock, so that no database is cloned
+// from the template meanwhile.
+func (s *snapshot) take(ctx context.Context) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	generation := s.templateDB.Generation()
+	if s.dump != nil && s.generation == generation {
+		return s.dump, nil
+	}
+	var dump []byte
+	err := s.templateDB.WithConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		var err error
+		dump, err = runClientTool(ctx, conn.Config(), nil, "pg_dump",
+			"--data-only", "--format=custom")
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to take snapshot of template database: %w", err)
+	}
+	s.generation, s.dump = generation, dump
+	return dump, nil
+}
+
+// reset is the ResetDatabase function of Config.ResetBySnapshot. It empties
+// the tables of the database conn is connected to and restores the snapshot
+// into them.
+func (s *snapshot) reset(ctx context.Context, conn *pgx.Conn) error {
+	dump, err := s.take(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := ResetByTruncateAll()(ctx, conn); err != nil {
+		return err
+	}
+
+	_, err = runClientTool(ctx, conn.Config(), dump, "pg_restore",
+		"--data-only", "--single-transaction", "--exit-on-error")
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+	return nil
+}
+
+// runClientTool runs the PostgreSQL client program tool with args against
+// the database of cfg, feeding it stdin, and returns its standard output.
+// The connection settings are passed in the libpq environment variables, so
+// that the password does not show up on the command line and the runtime
+// parameters of pgx, which libpq does not accept, are left out.
+func runClientTool(ctx context.Context, cfg *pgx.ConnConfig, stdin []byte, tool string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, tool, append(args, "--dbname="+cfg.Database)...)
+	cmd.Env = append(os.Environ(),
+		"PGHOST="+cfg.Host,
+		"PGPORT="+strconv.Itoa(int(cfg.Port)),
+		"PGUSER="+cfg.User,
+	)
+	if cfg.Password != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+cfg.Password)
+	}
+	if sslmode, ok := connStringSettings(cfg.ConnString())["sslmode"]; ok {
+		cmd.Env = append(cmd.Env, "PGSSLMODE="+sslmode)
+	}
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %w: %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,25 @@
+package testdbpool
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_ResetBySnapshotWithoutTools(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	_, err := New(context.Background(), &Config{
+		ID:              "snapshot",
+		Pool:            &pgxpool.Pool{},
+		MaxDatabases:    1,
+		SetupTemplate:   func(ctx context.Context, conn *pgx.Conn) error { return nil },
+		ResetBySnapshot: true,
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ResetBySnapshot requires pg_dump")
+}
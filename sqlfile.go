@@ -0,0 +1,156 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yuku/testdbpool/internal/pgconst"
+	"github.com/yuku/testdbpool/internal/sqlsplit"
+)
+
+// SetupFromSQLFiles returns a function suitable for Config.SetupTemplate that
+// executes the SQL scripts at paths in order, e.g. a schema followed by seed
+// data:
+//
+//	cfg.SetupTemplate = testdbpool.SetupFromSQLFiles("sql/schema.sql", "sql/seed.sql")
+//
+// The files are read when the template is set up, relative to the working
+// directory, which is the package directory under go test. Each script is
+// sent as a whole and therefore runs in a single implicit transaction. If it
+// contains a statement that cannot run inside a transaction block, such as
+// CREATE INDEX CONCURRENTLY, it is split into its statements, which are
+// executed one by one instead. Semicolons inside string literals, comments
+// and dollar-quoted function bodies do not split statements. Errors name the
+// file and line of the failing statement.
+func SetupFromSQLFiles(paths ...string) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		for _, path := range paths {
+			sql, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read SQL file: %w", err)
+			}
+			if err := execScript(ctx, conn, path, string(sql)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// SetupFromFiles returns a function suitable for Config.SetupTemplate that
+// executes the SQL scripts in fsys matching patterns like SetupFromSQLFiles,
+// e.g. migrations embedded with go:embed:
+//
+//	//go:embed migrations/*.sql
+//	var migrations embed.FS
+//
+//	cfg.SetupTemplate = testdbpool.SetupFromFiles(migrations, "migrations/*.sql")
+//
+// The patterns are matched with fs.Glob in order, and the files matching each
+// one run in lexical order, so that 001_schema.sql runs before 002_seed.sql.
+// A file matched by more than one pattern runs once, and files containing
+// nothing but whitespace are skipped. It fails, before running any file, if
+// a pattern is malformed or matches no file. Each file is sent as a whole,
+// so COPY ... FROM STDIN with inline data does not work in them; use INSERT
+// or COPY from a server-side file instead.
+func SetupFromFiles(fsys fs.FS, patterns ...string) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		var paths []string
+		seen := map[string]bool{}
+		for _, pattern := range patterns {
+			matches, err := fs.Glob(fsys, pattern)
+			if err != nil {
+				return fmt.Errorf("invalid SQL file pattern %q: %w", pattern, err)
+			}
+			if len(matches) == 0 {
+				return fmt.Errorf("SQL file pattern %q matches no files", pattern)
+			}
+			slices.Sort(matches)
+			for _, path := range matches {
+				if !seen[path] {
+					seen[path] = true
+					paths = append(paths, path)
+				}
+			}
+		}
+
+		for _, path := range paths {
+			sql, err := fs.ReadFile(fsys, path)
+			if err != nil {
+				return fmt.Errorf("failed to read SQL file: %w", err)
+			}
+			if strings.TrimSpace(string(sql)) == "" {
+				continue
+			}
+			if err := execScript(ctx, conn, path, string(sql)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// SetupFromReader returns a function suitable for Config.SetupTemplate that
+// executes the SQL script read from r like SetupFromSQLFiles, e.g. one
+// embedded with go:embed. r is read when the function is first called, and
+// the script is kept for later calls.
+func SetupFromReader(r io.Reader) func(context.Context, *pgx.Conn) error {
+	read := sync.OnceValues(func() ([]byte, error) {
+		return io.ReadAll(r)
+	})
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		sql, err := read()
+		if err != nil {
+			return fmt.Errorf("failed to read SQL script: %w", err)
+		}
+		return execScript(ctx, conn, "SQL script", string(sql))
+	}
+}
+
+// execScript executes the SQL script sql named name against conn, see
+// SetupFromSQLFiles.
+func execScript(ctx context.Context, conn *pgx.Conn, name, sql string) error {
+	_, err := conn.Exec(ctx, sql)
+	if err == nil {
+		return nil
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return fmt.Errorf("failed to execute %s: %w", name, err)
+	}
+	if pgErr.Code != pgconst.SQLStateActiveSQLTransaction {
+		if line := scriptLine(sql, pgErr); line > 0 {
+			return fmt.Errorf("failed to execute %s at line %d: %w", name, line, err)
+		}
+		return fmt.Errorf("failed to execute %s: %w", name, err)
+	}
+
+	// The failed attempt has been rolled back as a whole.
+	for _, stmt := range sqlsplit.Split(sql) {
+		if _, err := conn.Exec(ctx, stmt.SQL); err != nil {
+			return fmt.Errorf("failed to execute %s at line %d: %w", name, stmt.Line, err)
+		}
+	}
+	return nil
+}
+
+// scriptLine returns the 1-based line of sql at which pgErr occurred, or 0
+// if the error does not tell.
+func scriptLine(sql string, pgErr *pgconn.PgError) int {
+	if pgErr.Position <= 0 {
+		return 0
+	}
+	// Position counts characters, not bytes, starting at 1.
+	runes := []rune(sql)
+	pos := min(int(pgErr.Position)-1, len(runes))
+	return strings.Count(string(runes[:pos]), "\n") + 1
+}
@@ -0,0 +1,29 @@
+package testdbpool
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptLine(t *testing.T) {
+	sql := "CREATE TABLE ä (id INT);\nCREATE TABLE b (id INT);\nSELECT oops;\n"
+	assert.Equal(t, 3, scriptLine(sql, &pgconn.PgError{Position: 57}))
+	assert.Equal(t, 1, scriptLine(sql, &pgconn.PgError{Position: 1}))
+	assert.Equal(t, 0, scriptLine(sql, &pgconn.PgError{}))
+}
+
+func TestSetupFromFiles_Patterns(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/001_schema.sql": {Data: []byte("CREATE TABLE a (id INT);")},
+	}
+	// The patterns are checked before connecting, so no connection is needed.
+	err := SetupFromFiles(fsys, "migrations/*.sql", "seeds/*.sql")(context.Background(), nil)
+	assert.EqualError(t, err, `SQL file pattern "seeds/*.sql" matches no files`)
+
+	err = SetupFromFiles(fsys, "migrations/[")(context.Background(), nil)
+	assert.ErrorContains(t, err, `invalid SQL file pattern "migrations/["`)
+}
@@ -0,0 +1,62 @@
+// Package sqlpool hands out the test databases of a testdbpool.Pool as
+// *sql.DB, for code written against database/sql only, e.g. repositories
+// with lib/pq-style queries:
+//
+//	var users *sqlpool.Wrapper // sqlpool.New(pool) in TestMain
+//
+//	func TestCreateUser(t *testing.T) {
+//		db, err := users.Acquire(t)
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		_, err = db.Exec(`INSERT INTO users (name) VALUES ($1)`, "alice")
+//		...
+//	}
+//
+// The *sql.DB is backed by the pgx stdlib driver, so no other driver needs
+// to be registered.
+package sqlpool
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/yuku/testdbpool"
+)
+
+// Wrapper acquires the test databases of a testdbpool.Pool as *sql.DB.
+type Wrapper struct {
+	pool *testdbpool.Pool
+}
+
+// New returns a Wrapper that acquires test databases from pool, which
+// remains the caller's to clean up.
+func New(pool *testdbpool.Pool) *Wrapper {
+	return &Wrapper{pool: pool}
+}
+
+// Pool returns the testdbpool.Pool that w acquires test databases from.
+func (w *Wrapper) Pool() *testdbpool.Pool {
+	return w.pool
+}
+
+// Acquire acquires a test database for t, labeled with the name of t, and
+// returns a *sql.DB connected to it (see testdbpool.TestDB.DB). The test
+// database is released when t completes, which closes the *sql.DB, so the
+// caller must not close it.
+func (w *Wrapper) Acquire(t testing.TB) (*sql.DB, error) {
+	t.Helper()
+	db, err := w.pool.AcquireWithLabel(context.Background(), t.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire test database: %w", err)
+	}
+	t.Cleanup(func() {
+		name := db.Name()
+		if err := db.Release(context.Background()); err != nil {
+			t.Errorf("failed to release test database %s: %v", name, err)
+		}
+	})
+	return db.DB(), nil
+}
@@ -0,0 +1,57 @@
+package sqlpool_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool"
+	"github.com/yuku/testdbpool/internal/testutil"
+	"github.com/yuku/testdbpool/sqlpool"
+)
+
+func TestWrapper_Acquire(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := testdbpool.New(ctx, &testdbpool.Config{
+		ID:           "sqlpool_acquire",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE users (id SERIAL PRIMARY KEY, name TEXT NOT NULL)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+	wrapper := sqlpool.New(pool)
+	assert.Same(t, pool, wrapper.Pool())
+
+	var acquired *sql.DB
+	t.Run("subtest", func(t *testing.T) {
+		db, err := wrapper.Acquire(t)
+		require.NoError(t, err)
+		acquired = db
+
+		_, err = db.Exec(`INSERT INTO users (name) VALUES ($1)`, "alice")
+		require.NoError(t, err)
+		var name string
+		require.NoError(t, db.QueryRow(`SELECT name FROM users WHERE id = $1`, 1).Scan(&name))
+		assert.Equal(t, "alice", name)
+		assert.Equal(t, 1, pool.Stat().AcquiredCount)
+	})
+
+	// The test database is released, and the *sql.DB closed, when the test
+	// that acquired it completes.
+	assert.Zero(t, pool.Stat().AcquiredCount)
+	assert.ErrorContains(t, acquired.Ping(), "database is closed")
+}
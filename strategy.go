@@ -0,0 +1,32 @@
+package testdbpool
+
+// CloneStrategy is the strategy that CREATE DATABASE uses to copy the
+// template database into a test database (see Config.CloneStrategy).
+type CloneStrategy string
+
+const (
+	// CloneStrategyDefault leaves the choice to the server, which is WAL_LOG
+	// on PostgreSQL 15 and later.
+	CloneStrategyDefault CloneStrategy = ""
+
+	// CloneStrategyFileCopy copies the files of the template database and
+	// only logs the operation in the WAL. It is much faster for large
+	// templates, but forces a checkpoint before and after each copy.
+	CloneStrategyFileCopy CloneStrategy = "FILE_COPY"
+
+	// CloneStrategyWALLog copies the template database block by block and
+	// logs each block in the WAL. It avoids checkpoints, which makes it
+	// faster for small templates and on servers with a lot of other writes.
+	CloneStrategyWALLog CloneStrategy = "WAL_LOG"
+)
+
+// defaultCreateRetries is the default of Config.CreateRetries.
+const defaultCreateRetries = 3
+
+// createRetries returns Config.CreateRetries, or its default if not set.
+func createRetries(cfg *Config) int {
+	if cfg.CreateRetries == 0 {
+		return defaultCreateRetries
+	}
+	return cfg.CreateRetries
+}
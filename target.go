@@ -0,0 +1,194 @@
+package testdbpool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// defaultTargetPort and defaultTargetDBName are used for the fields of a
+// target descriptor that are omitted.
+const (
+	defaultTargetPort   = 5432
+	defaultTargetDBName = "postgres"
+)
+
+// TargetInfo describes the PostgreSQL server that a target descriptor file
+// points at. See ConnectTarget for the file format.
+type TargetInfo struct {
+	// Host is the host name or address of the server.
+	Host string
+
+	// Port is the port of the server.
+	Port int
+
+	// User is the user to connect as.
+	User string
+
+	// Password is the password resolved from the environment variable named
+	// by the descriptor, or empty if it names none.
+	Password string
+
+	// DBName is the database that the root pool connects to.
+	DBName string
+
+	// Params are additional connection parameters, e.g. sslmode.
+	Params map[string]string
+}
+
+// targetDescriptor is the JSON document of a target descriptor file.
+type targetDescriptor struct {
+	Host        string            `json:"host"`
+	Port        int               `json:"port"`
+	User        string            `json:"user"`
+	PasswordEnv string            `json:"password_env"`
+	DBName      string            `json:"dbname"`
+	Params      map[string]string `json:"params"`
+}
+
+// ConnectTarget reads the target descriptor file at path, connects a root
+// pool to the server it describes and returns the pool along with the
+// resolved TargetInfo. It is meant for test infrastructure that picks the
+// server at job start and hands its coordinates over in a file rather than
+// in environment variables.
+//
+// The descriptor is a JSON object with the following fields:
+//
+//	{
+//	  "host": "db-2.ci.internal",       // required
+//	  "port": 6432,                     // optional, default 5432
+//	  "user": "ci",                     // required
+//	  "password_env": "CI_DB_PASSWORD", // optional, name of the environment variable holding the password
+//	  "dbname": "postgres",             // optional, default "postgres"
+//	  "params": {"sslmode": "disable"}  // optional, additional connection parameters
+//	}
+//
+// Unknown fields are rejected, and errors name the offending field. The
+// password itself is never stored in the file. The returned pool is the
+// caller's to close; to connect the template and test databases of a Pool
+// to the same server, set Config.ConnStringFunc to TargetInfo.ConnStringFunc.
+func ConnectTarget(ctx context.Context, path string) (*pgxpool.Pool, TargetInfo, error) {
+	info, err := readTarget(path)
+	if err != nil {
+		return nil, TargetInfo{}, err
+	}
+
+	pool, err := pgxpool.New(ctx, info.ConnString(info.DBName))
+	if err != nil {
+		return nil, TargetInfo{}, fmt.Errorf("failed to create pool for target %s: %w", path, err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, TargetInfo{}, fmt.Errorf("failed to connect to target %s: %w", path, err)
+	}
+	return pool, info, nil
+}
+
+// readTarget reads and validates the target descriptor file at path.
+func readTarget(path string) (TargetInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return TargetInfo{}, fmt.Errorf("failed to read target descriptor: %w", err)
+	}
+	info, err := parseTarget(data, os.LookupEnv)
+	if err != nil {
+		return TargetInfo{}, fmt.Errorf("invalid target descriptor %s: %w", path, err)
+	}
+	return info, nil
+}
+
+// parseTarget parses a target descriptor, resolving the password with
+// lookupEnv.
+func parseTarget(data []byte, lookupEnv func(string) (string, bool)) (TargetInfo, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var desc targetDescriptor
+	if err := dec.Decode(&desc); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return TargetInfo{}, fmt.Errorf("%q: must be of type %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return TargetInfo{}, err
+	}
+	if dec.More() {
+		return TargetInfo{}, fmt.Errorf("unexpected data after the JSON object")
+	}
+
+	if desc.Host == "" {
+		return TargetInfo{}, fmt.Errorf(`"host": is required`)
+	}
+	if desc.Port == 0 {
+		desc.Port = defaultTargetPort
+	}
+	if desc.Port < 1 || desc.Port > 65535 {
+		return TargetInfo{}, fmt.Errorf(`"port": must be between 1 and 65535, got %d`, desc.Port)
+	}
+	if desc.User == "" {
+		return TargetInfo{}, fmt.Errorf(`"user": is required`)
+	}
+	if desc.DBName == "" {
+		desc.DBName = defaultTargetDBName
+	}
+	for key := range desc.Params {
+		if key == "" {
+			return TargetInfo{}, fmt.Errorf(`"params": must not contain an empty key`)
+		}
+	}
+
+	var password string
+	if desc.PasswordEnv != "" {
+		var ok bool
+		password, ok = lookupEnv(desc.PasswordEnv)
+		if !ok {
+			return TargetInfo{}, fmt.Errorf(`"password_env": environment variable %s is not set`, desc.PasswordEnv)
+		}
+	}
+
+	return TargetInfo{
+		Host:     desc.Host,
+		Port:     desc.Port,
+		User:     desc.User,
+		Password: password,
+		DBName:   desc.DBName,
+		Params:   desc.Params,
+	}, nil
+}
+
+// ConnString returns the connection URL of the database dbName on the
+// target server.
+func (t TargetInfo) ConnString(dbName string) string {
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.User(t.User),
+		Host:   net.JoinHostPort(t.Host, strconv.Itoa(t.Port)),
+		Path:   "/" + dbName,
+	}
+	if t.Password != "" {
+		u.User = url.UserPassword(t.User, t.Password)
+	}
+	if len(t.Params) > 0 {
+		query := url.Values{}
+		for key, value := range t.Params {
+			query.Set(key, value)
+		}
+		// Encode sorts the parameters by key.
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// ConnStringFunc returns a function suitable for Config.ConnStringFunc that
+// connects the template and test databases to the target server.
+func (t TargetInfo) ConnStringFunc() func(dbName string) (string, error) {
+	return func(dbName string) (string, error) {
+		return t.ConnString(dbName), nil
+	}
+}
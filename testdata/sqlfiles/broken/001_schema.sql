@@ -0,0 +1 @@
+CREATE TABLE authors (id SERIAL PRIMARY KEY, name TEXT NOT NULL);
@@ -0,0 +1,2 @@
+INSERT INTO authors (name) VALUES ('Ursula K. Le Guin');
+INSERT INTO authors (nam) VALUES ('J. R. R. Tolkien');
@@ -0,0 +1,2 @@
+INSERT INTO authors (name) VALUES ('Ursula K. Le Guin');
+INSERT INTO books (author_id, title) VALUES (1, 'A Wizard of Earthsea');
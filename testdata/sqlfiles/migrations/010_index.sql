@@ -0,0 +1,2 @@
+-- Runs last, after the seed data has been loaded.
+CREATE INDEX books_author_id_idx ON books (author_id);
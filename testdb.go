@@ -2,61 +2,469 @@ package testdbpool
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/yuku/numpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/yuku/testdbpool/internal/clock"
+	"github.com/yuku/testdbpool/internal/pgconst"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+	"github.com/yuku/testdbpool/internal/templatedb"
 )
 
 type TestDB struct {
 	// poolID is the ID of the pool that this TestDB belongs to.
 	poolID string
 
+	// label is the label that the database was acquired with, if any.
+	label string
+
 	// pool is the pgxpool.Pool connected to the postgres database that db represents.
 	pool *pgxpool.Pool
 
+	// recreated reports whether the database was created for this
+	// acquisition, as opposed to reused after a reset.
+	recreated bool
+
 	// resource is the numpool.Resource that was acquired for this TestDB.
-	resource *numpool.Resource
+	resource resource
 
 	// rootPool is the root connection pool for database operations
 	rootPool *pgxpool.Pool
 
 	// onRelease is called when this TestDB is released to clear it from the pool.
 	onRelease func(int)
+
+	// onStranded is called with the resource when releasing it back to the
+	// numpool failed, so that the pool can release it again later.
+	onStranded func(resource)
+
+	// onOutcome is called with the index of the database and the reason
+	// passed to ReleaseFailed, or nil after a plain Release, so that the pool
+	// can count the failures of the slot.
+	onOutcome func(index int, reason error)
+
+	// onUse is called when the database is released, so that the pool can
+	// record when it was last used.
+	onUse func(ctx context.Context)
+
+	// clock is the clock of the pool, used to back off release retries.
+	clock clock.Clock
+
+	// logger is the logger of the pool with the index and name of the
+	// database attached. It is nil for TestDBs built in tests, and used
+	// through eventLogger.
+	logger *slog.Logger
+
+	// reset is Config.ResetDatabase, with the leak check applied. If set,
+	// Release resets the database for reuse instead of dropping it.
+	reset func(context.Context, *pgx.Conn) error
+
+	// retainPool is set if Config.ReuseClonePools is. Release hands pool to
+	// it instead of closing it if the database has been reset.
+	retainPool func(index int, pool *pgxpool.Pool)
+
+	// keepReleased is set if Config.ReuseAcrossRuns is. Release marks the
+	// reset database as released, to be verified before it is reused, instead
+	// of marking it clean.
+	keepReleased bool
+
+	// templateGeneration is the generation of the template database that
+	// this database was cloned from.
+	templateGeneration string
+
+	// templateValues are the metadata values of the template database that
+	// this database was cloned from.
+	templateValues map[string]string
+
+	// invalidated indicates that the database no longer exists, so Release
+	// must not try to drop it.
+	invalidated atomic.Bool
+
+	// failure is the reason passed to ReleaseFailed, which makes Release drop
+	// the database instead of resetting or keeping it.
+	failure error
+
+	// beforeRelease and afterRelease are the functions registered with
+	// CleanupBeforeRelease and CleanupAfterRelease, in registration order.
+	beforeRelease []func()
+	afterRelease  []func()
+
+	// released indicates that Release has been called.
+	released bool
+
+	// once holds the calls of Once by key.
+	once map[string]*onceCall
+
+	// conns are the dedicated connections opened with Conn, which Release
+	// closes before dropping the database.
+	conns []*pgx.Conn
+
+	// queries counts the statements executed through pool for LimitQueries.
+	// It is nil if pool does not have a counting tracer.
+	queries *queryCounter
+
+	// sqlDB is the database/sql wrapper of pool returned by DB, which
+	// Release closes before dropping the database.
+	sqlDB *sql.DB
+
+	// cleanupMu protects beforeRelease, afterRelease, released, once, conns
+	// and sqlDB.
+	cleanupMu sync.Mutex
+}
+
+// onceCall is a call of TestDB.Once with a given key.
+type onceCall struct {
+	once sync.Once
+	err  error
+}
+
+// ErrResetFailed is matched by errors.Is for the errors that Release returns
+// when the database could not be brought back to a clean state, so that
+// callers can tell them apart from failures to return the slot to the pool.
+// The errors are of type *ResetError.
+var ErrResetFailed = errors.New("failed to reset test database")
+
+// ErrDropFailed is matched by errors.Is for the errors that Release returns
+// when the database could not be dropped. The errors are of type *DropError.
+var ErrDropFailed = errors.New("failed to drop test database")
+
+// ResetError is returned by Release when the database could not be reset
+// with Config.ResetDatabase or Config.ResetBySnapshot. The database is
+// dropped instead, and the slot is returned to the pool regardless.
+type ResetError struct {
+	// PoolID is the ID of the pool that the database belongs to.
+	PoolID string
+
+	// Database is the name of the database.
+	Database string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *ResetError) Error() string {
+	return fmt.Sprintf("failed to reset test database %s of pool %s: %v", e.Database, e.PoolID, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ResetError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrResetFailed.
+func (e *ResetError) Is(target error) bool {
+	return target == ErrResetFailed
+}
+
+// DropError is returned by Release when the database could not be dropped.
+// The slot is still returned to the pool, and the next Acquire of the same
+// index drops the leftover database.
+type DropError struct {
+	// PoolID is the ID of the pool that the database belongs to.
+	PoolID string
+
+	// Database is the name of the database.
+	Database string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *DropError) Error() string {
+	return fmt.Sprintf("failed to drop test database %s of pool %s: %v", e.Database, e.PoolID, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DropError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrDropFailed.
+func (e *DropError) Is(target error) bool {
+	return target == ErrDropFailed
 }
 
 // Release releases the TestDB back to the pool.
-// The database will be dropped to ensure complete cleanup.
+// The database will be dropped to ensure complete cleanup, unless
+// Config.ResetDatabase is set and succeeds, in which case the database is kept
+// for the next acquisition of the same index, or the next run if
+// Config.ReuseAcrossRuns is set. A failed reset is returned as a *ResetError
+// and a failed drop as a *DropError, joined with each other and with a
+// failure to return the slot to the pool. A database that Config.VerifyClean
+// finds dirty is dropped without an error.
 func (db *TestDB) Release(ctx context.Context) error {
-	// 1. First close the connection pool
-	if db.pool != nil {
+	db.cleanupMu.Lock()
+	db.released = true
+	beforeRelease, afterRelease := db.beforeRelease, db.afterRelease
+	db.beforeRelease, db.afterRelease = nil, nil
+	db.once = nil
+	conns := db.conns
+	db.conns = nil
+	sqlDB := db.sqlDB
+	db.cleanupMu.Unlock()
+
+	runCleanups(beforeRelease)
+	defer runCleanups(afterRelease)
+
+	for _, conn := range conns {
+		_ = conn.Close(ctx)
+	}
+	if sqlDB != nil {
+		// This gives back its connections to pool, which it does not own.
+		_ = sqlDB.Close()
+	}
+
+	// 1. Reset the database for reuse if configured
+	reset := db.reset != nil && db.rootPool != nil && !db.invalidated.Load() && db.failure == nil
+	var resetErr error
+	if reset {
+		resetErr = db.runReset(ctx)
+		reset = resetErr == nil
+		if resetErr != nil {
+			db.eventLogger().Warn("test database reset failed; dropping it", "error", resetErr)
+		}
+	}
+
+	// 2. Close the connection pool, unless it is retained for the next
+	// acquirer of the reset database (see Config.ReuseClonePools)
+	retain := reset && db.retainPool != nil && db.pool != nil
+	if db.pool != nil && !retain {
 		db.pool.Close()
 	}
 
-	// 2. Drop the database to ensure complete cleanup
-	var err error
-	if db.rootPool != nil {
+	// 3. Mark the reset database as clean, or as released if it is kept
+	// across runs so that it is verified before it is reused, or drop it to
+	// ensure complete cleanup. A failed reset falls back to dropping so that
+	// isolation is preserved.
+	if reset {
+		if db.keepReleased {
+			resetErr = templatedb.MarkReleased(ctx, db.rootPool, db.Name(), db.templateGeneration)
+		} else {
+			resetErr = templatedb.MarkClean(ctx, db.rootPool, db.Name(), db.templateGeneration)
+		}
+		reset = resetErr == nil
+		if resetErr != nil {
+			db.eventLogger().Warn("test database reset failed; dropping it", "error", resetErr)
+		}
+	}
+	if retain {
+		if reset {
+			db.retainPool(db.resource.Index(), db.pool)
+		} else {
+			db.pool.Close()
+		}
+	}
+	kept := reset
+	var errs []error
+	if resetErr != nil && !isVerifyFailure(resetErr) {
+		errs = append(errs, &ResetError{PoolID: db.poolID, Database: db.Name(), Err: resetErr})
+	}
+	if !kept && db.rootPool != nil && !db.invalidated.Load() {
 		dbName := db.Name()
-		_, e := db.rootPool.Exec(ctx, fmt.Sprintf(
-			"DROP DATABASE IF EXISTS %s",
-			pgx.Identifier{dbName}.Sanitize(),
-		))
-		if e != nil {
-			err = fmt.Errorf("failed to drop database %s: %w", dbName, e)
+		query, err := sqlbuild.DropDatabase(dbName, false)
+		if err == nil {
+			_, err = db.rootPool.Exec(ctx, query)
+		}
+		if err != nil && !isUndefinedDatabase(err) {
+			db.eventLogger().Warn("failed to drop test database", "error", err)
+			errs = append(errs, &DropError{PoolID: db.poolID, Database: dbName, Err: err})
+		} else {
+			db.eventLogger().Info("test database dropped")
 		}
 	}
 
+	if db.onOutcome != nil {
+		db.onOutcome(db.resource.Index(), db.failure)
+	}
+	if db.onUse != nil {
+		db.onUse(ctx)
+	}
+
 	// Clear this TestDB from the pool's testDBs array
 	if db.onRelease != nil {
 		db.onRelease(db.resource.Index())
 	}
 
 	// Release the resource back to the numpool
-	if err := db.resource.Release(ctx); err != nil {
-		return fmt.Errorf("failed to release resource: %w", err)
+	if err := releaseResource(ctx, db.clock, db.resource); err != nil {
+		if db.onStranded != nil {
+			db.onStranded(db.resource)
+		}
+		db.eventLogger().Warn("failed to release test database; retrying later", "error", err)
+		return errors.Join(append(errs, fmt.Errorf("failed to release resource: %w", err))...)
+	}
+	db.eventLogger().Info("test database released", "reused", kept)
+	return errors.Join(errs...)
+}
+
+// ReleaseFailed is like Release, but for a database that must not be used
+// again, e.g. because the test left it in a state that Config.ResetDatabase
+// cannot undo: the database is always dropped, and reason is recorded as a
+// failure of its slot (see Pool.Failures). Once a slot has failed
+// Config.MaxConsecutiveFailures times in a row, Acquire reports the recurring
+// failure instead of recreating its database again.
+func (db *TestDB) ReleaseFailed(ctx context.Context, reason error) error {
+	if reason == nil {
+		reason = errors.New("released as failed")
 	}
-	return err
+	db.failure = reason
+	db.eventLogger().Warn("test database released as failed", "reason", reason)
+	return db.Release(ctx)
+}
+
+// runReset runs the reset function against the database.
+func (db *TestDB) runReset(ctx context.Context) error {
+	return db.pool.AcquireFunc(ctx, func(conn *pgxpool.Conn) error {
+		return db.reset(ctx, conn.Conn())
+	})
+}
+
+// CleanupBeforeRelease registers fn to be called when the database is
+// released, before it is dropped, so that fn can still use the database.
+// Unlike tb.Cleanup, the order relative to the release does not depend on
+// whether fn is registered before or after the database was acquired with
+// AcquireT. Functions are called in last added, first called order.
+func (db *TestDB) CleanupBeforeRelease(tb testing.TB, fn func()) {
+	tb.Helper()
+	db.addCleanup(tb, &db.beforeRelease, fn)
+}
+
+// CleanupAfterRelease registers fn to be called after the database has been
+// released, e.g. to assert on side effects of dropping it. Like
+// CleanupBeforeRelease, the order relative to the release is fixed, and
+// functions are called in last added, first called order.
+func (db *TestDB) CleanupAfterRelease(tb testing.TB, fn func()) {
+	tb.Helper()
+	db.addCleanup(tb, &db.afterRelease, fn)
+}
+
+func (db *TestDB) addCleanup(tb testing.TB, fns *[]func(), fn func()) {
+	tb.Helper()
+	db.cleanupMu.Lock()
+	defer db.cleanupMu.Unlock()
+
+	if db.released {
+		tb.Fatalf("test database %s is already released", db.Name())
+	}
+	*fns = append(*fns, fn)
+}
+
+// runCleanups calls fns in reverse order, like testing.T.Cleanup.
+func runCleanups(fns []func()) {
+	for _, fn := range slices.Backward(fns) {
+		fn()
+	}
+}
+
+// Once runs fn against the database the first time it is called with key
+// during this acquisition, and returns the error of that run to it and to
+// all other callers with the same key, which wait for the run to finish. It
+// is meant for per-database initialization that cannot be part of the
+// template, e.g. creating the partition for the current day, when parallel
+// subtests share the database:
+//
+//	err := db.Once("partitions", ensureTodayPartition)
+//
+// fn is called with a background context. Keys are arbitrary strings, and
+// a failed run is not retried. Once fails without calling fn after Release.
+func (db *TestDB) Once(key string, fn func(ctx context.Context, pool *pgxpool.Pool) error) error {
+	db.cleanupMu.Lock()
+	if db.released {
+		db.cleanupMu.Unlock()
+		return fmt.Errorf("test database %s is already released", db.Name())
+	}
+	if db.once == nil {
+		db.once = map[string]*onceCall{}
+	}
+	call := db.once[key]
+	if call == nil {
+		call = &onceCall{}
+		db.once[key] = call
+	}
+	db.cleanupMu.Unlock()
+
+	call.once.Do(func() {
+		call.err = fn(context.Background(), db.pool)
+	})
+	return call.err
+}
+
+// Conn opens a dedicated connection to the database, configured like the
+// connections of Pool, for tests that depend on session state such as
+// LISTEN/NOTIFY, session-level advisory locks or temporary tables, which a
+// pooled connection does not keep between queries. ctx bounds the connection
+// attempt. The caller may close the connection; otherwise Release closes it.
+func (db *TestDB) Conn(ctx context.Context) (*pgx.Conn, error) {
+	poolCfg := db.pool.Config()
+	conn, err := pgx.ConnectConfig(ctx, db.ConnConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to test database %s: %w", db.Name(), err)
+	}
+	if poolCfg.AfterConnect != nil {
+		if err := poolCfg.AfterConnect(ctx, conn); err != nil {
+			_ = conn.Close(ctx)
+			return nil, fmt.Errorf("failed to run AfterConnect hook: %w", err)
+		}
+	}
+
+	db.cleanupMu.Lock()
+	defer db.cleanupMu.Unlock()
+	if db.released {
+		_ = conn.Close(ctx)
+		return nil, fmt.Errorf("test database %s is already released", db.Name())
+	}
+	db.conns = append(db.conns, conn)
+	return conn, nil
+}
+
+// DB returns a *sql.DB backed by Pool, for code written against database/sql,
+// such as DAOs or sqlc code generated for it. It is created on the first call
+// and the same one is returned afterwards, so that its prepared statements
+// are kept. It is safe to call concurrently. Release closes it, so it must not
+// be closed by the caller.
+func (db *TestDB) DB() *sql.DB {
+	db.cleanupMu.Lock()
+	defer db.cleanupMu.Unlock()
+	if db.sqlDB == nil {
+		db.sqlDB = stdlib.OpenDBFromPool(db.pool)
+	}
+	return db.sqlDB
+}
+
+// ConnT opens a dedicated connection to the database like Conn for the test
+// tb and closes it when tb completes, unless Release has closed it already.
+// It fails tb if the connection cannot be opened.
+func (db *TestDB) ConnT(tb testing.TB) *pgx.Conn {
+	tb.Helper()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		tb.Fatalf("failed to open connection: %v", err)
+	}
+	tb.Cleanup(func() {
+		_ = conn.Close(context.Background())
+	})
+	return conn
+}
+
+// Invalidate tells the pool that the database has already been dropped, e.g.
+// by the code under test, so that Release does not try to drop it again.
+// Release must still be called to return the slot to the pool; the next
+// Acquire of the same index recreates the database from the template.
+func (db *TestDB) Invalidate() {
+	db.invalidated.Store(true)
 }
 
 // Pool returns the pgxpool.Pool connected to the postgres database that db represents.
@@ -64,13 +472,151 @@ func (db *TestDB) Pool() *pgxpool.Pool {
 	return db.pool
 }
 
+// Index returns the resource index of the test database in the pool.
+// It is between 0 and MaxDatabases-1, and a database with a given index
+// always has the same name, so it can be used to shard seed data.
+func (db *TestDB) Index() int {
+	return db.resource.Index()
+}
+
+// CountWhere returns the number of rows in table that match where.
+// The count is computed by the server, so no rows are transferred to the client.
+// table may be schema-qualified (e.g. "public.users") and each part must be a
+// valid PostgreSQL identifier. where is an SQL boolean expression that may
+// refer to args as $1, $2, ...; an empty where counts all rows.
+func (db *TestDB) CountWhere(ctx context.Context, table string, where string, args ...any) (int64, error) {
+	ident, err := sqlbuild.Table(table)
+	if err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s`, ident)
+	if where != "" {
+		query += " WHERE " + where
+	}
+
+	var count int64
+	if err := db.pool.QueryRow(ctx, query, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count rows in %s: %w", table, err)
+	}
+	return count, nil
+}
+
+// Exists reports whether table has at least one row that matches where.
+// It stops at the first matching row, so it is cheaper than CountWhere when
+// only the presence of a row matters. The arguments are interpreted as in
+// CountWhere.
+func (db *TestDB) Exists(ctx context.Context, table string, where string, args ...any) (bool, error) {
+	ident, err := sqlbuild.Table(table)
+	if err != nil {
+		return false, err
+	}
+
+	query := fmt.Sprintf(`SELECT 1 FROM %s`, ident)
+	if where != "" {
+		query += " WHERE " + where
+	}
+
+	var exists bool
+	err = db.pool.QueryRow(ctx, fmt.Sprintf(`SELECT EXISTS(%s)`, query), args...).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check rows in %s: %w", table, err)
+	}
+	return exists, nil
+}
+
+// CopyColumn describes a target column of CopyFromTyped.
+type CopyColumn struct {
+	// Name is the name of the column.
+	Name string
+
+	// TypeName is the name of the column type, e.g. "status_type" or
+	// "status_type[]". It is needed for types that pgx does not know out of the
+	// box, such as enums, domains, composite types and arrays of them.
+	// Optional.
+	TypeName string
+
+	// OID is the OID of the column type. It is used when TypeName is empty.
+	// Optional.
+	OID uint32
+}
+
+// CopyFromTyped is like pgx.Conn.CopyFrom, but registers the given column
+// types with the connection before copying, so that values for custom types
+// such as enums and arrays of enums are encoded correctly.
+// Columns without TypeName and OID are handled by pgx's default inference.
+func (db *TestDB) CopyFromTyped(
+	ctx context.Context,
+	tableName pgx.Identifier,
+	columns []CopyColumn,
+	rowSrc pgx.CopyFromSource,
+) (int64, error) {
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	typeMap := conn.Conn().TypeMap()
+	columnNames := make([]string, len(columns))
+	var typeNames []string
+	for i, col := range columns {
+		columnNames[i] = col.Name
+
+		typeName := col.TypeName
+		if typeName == "" && col.OID != 0 {
+			if _, ok := typeMap.TypeForOID(col.OID); ok {
+				continue
+			}
+			err := conn.QueryRow(ctx, `SELECT $1::oid::regtype::text`, col.OID).Scan(&typeName)
+			if err != nil {
+				return 0, fmt.Errorf("failed to resolve type OID %d of column %s: %w", col.OID, col.Name, err)
+			}
+		}
+		if typeName == "" {
+			continue
+		}
+		if _, ok := typeMap.TypeForName(typeName); !ok {
+			typeNames = append(typeNames, typeName)
+		}
+	}
+
+	if len(typeNames) > 0 {
+		types, err := conn.Conn().LoadTypes(ctx, typeNames)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load column types: %w", err)
+		}
+		typeMap.RegisterTypes(types)
+	}
+
+	n, err := conn.Conn().CopyFrom(ctx, tableName, columnNames, rowSrc)
+	if err != nil {
+		return n, fmt.Errorf("failed to copy into %s: %w", tableName.Sanitize(), err)
+	}
+	return n, nil
+}
+
+// Name returns the name of the test database.
 func (db *TestDB) Name() string {
 	// Extract database name from the pool configuration
 	return db.pool.Config().ConnConfig.Database
 }
 
-func getTestDBName(poolID string, index int) string {
-	// templatedb validates the length of the pool ID, and as long as it is valid,
-	// the string returned by this method will be valid too.
-	return fmt.Sprintf("testdbpool_%s_%d", poolID, index)
+// Label returns the label that the test database was acquired with (see
+// Pool.AcquireWithLabel), or an empty string if it has none.
+func (db *TestDB) Label() string {
+	return db.label
+}
+
+func getTestDBName(namePrefix, poolID string, index int) string {
+	// Config.Validate checks the length of the names, and as long as the
+	// configuration is valid, the string returned by this method will be
+	// valid too.
+	return templatedb.TestDatabasePrefix(namePrefix, poolID) + strconv.Itoa(index)
+}
+
+// isUndefinedDatabase reports whether err means that the database does not exist.
+func isUndefinedDatabase(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgconst.SQLStateInvalidCatalogName
 }
@@ -0,0 +1,479 @@
+package testdbpool
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestTestDB_CountWhereAndExists(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-count-where",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `
+				CREATE TABLE foos (id SERIAL PRIMARY KEY, name TEXT);
+				INSERT INTO foos (name) SELECT 'foo' || i FROM generate_series(1, 1000) AS i;
+			`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Release(ctx) })
+
+	count, err := db.CountWhere(ctx, "foos", "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), count)
+
+	count, err = db.CountWhere(ctx, "public.foos", "id <= $1", 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), count)
+
+	exists, err := db.Exists(ctx, "foos", "name = $1", "foo42")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = db.Exists(ctx, "foos", "name = $1", "bar")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = db.CountWhere(ctx, "foos; DROP TABLE foos", "")
+	assert.ErrorContains(t, err, "invalid table name")
+
+	_, err = db.Exists(ctx, "missing", "")
+	assert.ErrorContains(t, err, "failed to check rows in missing")
+}
+
+func TestTestDB_CopyFromTyped(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-copy-from-typed",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `
+				CREATE TYPE status_type AS ENUM ('active', 'inactive');
+				CREATE TABLE items (
+					id INT PRIMARY KEY,
+					status status_type NOT NULL,
+					history status_type[] NOT NULL,
+					tags TEXT[] NOT NULL
+				);
+			`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Release(ctx) })
+
+	var historyOID uint32
+	err = db.Pool().QueryRow(ctx, `SELECT 'status_type[]'::regtype::oid`).Scan(&historyOID)
+	require.NoError(t, err)
+
+	n, err := db.CopyFromTyped(ctx,
+		pgx.Identifier{"items"},
+		[]CopyColumn{
+			{Name: "id"},
+			{Name: "status", TypeName: "status_type"},
+			{Name: "history", OID: historyOID},
+			{Name: "tags"},
+		},
+		pgx.CopyFromRows([][]any{
+			{1, "active", []string{"inactive", "active"}, []string{"a", "b"}},
+			{2, "inactive", []string{}, []string{}},
+		}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	var status string
+	var history, tags []string
+	err = db.Pool().QueryRow(ctx, `SELECT status::text, history::text[], tags FROM items WHERE id = 1`).
+		Scan(&status, &history, &tags)
+	require.NoError(t, err)
+	assert.Equal(t, "active", status)
+	assert.Equal(t, []string{"inactive", "active"}, history)
+	assert.Equal(t, []string{"a", "b"}, tags)
+}
+
+func TestTestDB_ReleaseAfterDatabaseDropped(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-release-after-drop",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE foos (id SERIAL PRIMARY KEY)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	for _, invalidate := range []bool{false, true} {
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, db.Index())
+
+		// Simulate code under test dropping the database it is connected to.
+		_, err = connPool.Exec(ctx, fmt.Sprintf(
+			`DROP DATABASE %s WITH (FORCE)`, pgx.Identifier{db.Name()}.Sanitize(),
+		))
+		require.NoError(t, err)
+		if invalidate {
+			db.Invalidate()
+		}
+
+		require.NoError(t, db.Release(ctx))
+	}
+
+	// The slot is reusable and the database is recreated from the template.
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, db.Index())
+
+	var count int
+	err = db.Pool().QueryRow(ctx, `SELECT COUNT(*) FROM foos`).Scan(&count)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	require.NoError(t, db.Release(ctx))
+}
+
+func TestIsUndefinedDatabase(t *testing.T) {
+	assert.True(t, isUndefinedDatabase(fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "3D000"})))
+	assert.False(t, isUndefinedDatabase(&pgconn.PgError{Code: "55006"}))
+	assert.False(t, isUndefinedDatabase(errors.New("3D000")))
+}
+
+func TestTestDB_CleanupOrder(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-cleanup-order",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE foos (id INT)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	// acquireWithFixtures is a helper that acquires a database in a
+	// sub-function, after its caller registered cleanups.
+	acquireWithFixtures := func(t *testing.T) *TestDB {
+		db := pool.AcquireT(t)
+		_, err := db.Pool().Exec(ctx, `INSERT INTO foos (id) VALUES (1)`)
+		require.NoError(t, err)
+		return db
+	}
+
+	var events []string
+	var name string
+	t.Run("inverted registration", func(t *testing.T) {
+		// Registered before the database is acquired, so it runs after the
+		// release of AcquireT, when the database is already gone.
+		t.Cleanup(func() {
+			events = append(events, "t.Cleanup")
+		})
+
+		db := acquireWithFixtures(t)
+		name = db.Name()
+
+		db.CleanupAfterRelease(t, func() {
+			events = append(events, "after release")
+			assert.False(t, testutil.DBExists(t, connPool, name))
+		})
+		db.CleanupBeforeRelease(t, func() {
+			events = append(events, "before release 1")
+		})
+		db.CleanupBeforeRelease(t, func() {
+			events = append(events, "before release 2")
+			count, err := db.CountWhere(ctx, "foos", "")
+			assert.NoError(t, err, "the database must still be usable")
+			assert.Equal(t, int64(1), count)
+		})
+	})
+
+	assert.Equal(t, []string{
+		"before release 2",
+		"before release 1",
+		"after release",
+		"t.Cleanup",
+	}, events)
+	assert.False(t, testutil.DBExists(t, connPool, name))
+}
+
+func TestTestDB_Once(t *testing.T) {
+	ctx := context.Background()
+	// Once does not connect by itself.
+	pool, err := pgxpool.New(ctx, "postgres://postgres@127.0.0.1:1/testdbpool_once_0?connect_timeout=1")
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+	db := &TestDB{poolID: "once", pool: pool}
+
+	var calls atomic.Int64
+	var failures atomic.Int64
+	errPartition := errors.New("failed to create partition")
+
+	var wg sync.WaitGroup
+	results := make([]error, 64)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := "partitions"
+			if i%2 == 1 {
+				key = "broken"
+			}
+			results[i] = db.Once(key, func(ctx context.Context, p *pgxpool.Pool) error {
+				assert.Same(t, pool, p)
+				if key == "broken" {
+					failures.Add(1)
+					return errPartition
+				}
+				calls.Add(1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), calls.Load())
+	assert.Equal(t, int64(1), failures.Load())
+	for i, err := range results {
+		if i%2 == 1 {
+			assert.ErrorIs(t, err, errPartition)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	// A failed run is not retried.
+	err = db.Once("broken", func(ctx context.Context, p *pgxpool.Pool) error {
+		t.Error("fn must not be called again")
+		return nil
+	})
+	assert.ErrorIs(t, err, errPartition)
+
+	db.cleanupMu.Lock()
+	db.released = true
+	db.once = nil
+	db.cleanupMu.Unlock()
+	err = db.Once("partitions", func(ctx context.Context, p *pgxpool.Pool) error {
+		t.Error("fn must not be called after release")
+		return nil
+	})
+	assert.ErrorContains(t, err, "test database testdbpool_once_0 is already released")
+}
+
+func TestTestDB_Conn(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-conn",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	t.Run("session state", func(t *testing.T) {
+		db := pool.AcquireT(t)
+		conn := db.ConnT(t)
+
+		var name string
+		require.NoError(t, conn.QueryRow(ctx, `SELECT current_database()`).Scan(&name))
+		assert.Equal(t, db.Name(), name)
+
+		// Temporary tables and LISTEN live as long as the session.
+		_, err := conn.Exec(ctx, `CREATE TEMP TABLE scratch (id INT)`)
+		require.NoError(t, err)
+		_, err = conn.Exec(ctx, `LISTEN events`)
+		require.NoError(t, err)
+		_, err = db.Pool().Exec(ctx, `NOTIFY events, 'hello'`)
+		require.NoError(t, err)
+		notification, err := conn.WaitForNotification(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", notification.Payload)
+		_, err = conn.Exec(ctx, `INSERT INTO scratch VALUES (1)`)
+		require.NoError(t, err)
+	})
+
+	t.Run("closed on release", func(t *testing.T) {
+		db, err := pool.Acquire(ctx)
+		require.NoError(t, err)
+		conn, err := db.Conn(ctx)
+		require.NoError(t, err)
+
+		// The open connection does not prevent dropping the database.
+		require.NoError(t, db.Release(ctx))
+		assert.True(t, conn.IsClosed())
+		assert.False(t, testutil.DBExists(t, connPool, db.Name()))
+
+		_, err = db.Conn(ctx)
+		assert.ErrorContains(t, err, "is already released")
+	})
+}
+
+func TestTestDB_ConnString(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-conn-string",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.AcquireWithLabel(ctx, "TestConnString")
+	require.NoError(t, err)
+	defer db.Release(ctx)
+
+	connString := db.ConnString()
+	assert.Regexp(t, `^postgres://`, connString)
+	conn, err := pgx.Connect(ctx, connString)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+	var name, appName string
+	require.NoError(t, conn.QueryRow(ctx, `SELECT current_database(), current_setting('application_name')`).Scan(&name, &appName))
+	assert.Equal(t, db.Name(), name)
+	var poolAppName string
+	require.NoError(t, db.Pool().QueryRow(ctx, `SELECT current_setting('application_name')`).Scan(&poolAppName))
+	assert.Equal(t, poolAppName, appName)
+	assert.Contains(t, appName, "TestConnString")
+
+	// ConnConfig returns a copy that can be changed freely.
+	cfg := db.ConnConfig()
+	cfg.RuntimeParams["application_name"] = "tweaked"
+	assert.NotEqual(t, "tweaked", db.ConnConfig().RuntimeParams["application_name"])
+	conn2, err := pgx.ConnectConfig(ctx, cfg)
+	require.NoError(t, err)
+	defer conn2.Close(ctx)
+	require.NoError(t, conn2.QueryRow(ctx, `SELECT current_database(), current_setting('application_name')`).Scan(&name, &appName))
+	assert.Equal(t, db.Name(), name)
+	assert.Equal(t, "tweaked", appName)
+}
+
+func TestTestDB_DB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-db",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `CREATE TABLE items (id INT)`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	sqlDBs := make([]*sql.DB, 4)
+	for i := range sqlDBs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sqlDBs[i] = db.DB()
+		}()
+	}
+	wg.Wait()
+	for _, sqlDB := range sqlDBs {
+		assert.Same(t, sqlDBs[0], sqlDB)
+	}
+
+	// Both interfaces see the same data.
+	_, err = db.DB().ExecContext(ctx, `INSERT INTO items VALUES (1)`)
+	require.NoError(t, err)
+	_, err = db.Pool().Exec(ctx, `INSERT INTO items VALUES (2)`)
+	require.NoError(t, err)
+	var n int
+	require.NoError(t, db.DB().QueryRowContext(ctx, `SELECT count(*) FROM items`).Scan(&n))
+	assert.Equal(t, 2, n)
+	require.NoError(t, db.Pool().QueryRow(ctx, `SELECT count(*) FROM items`).Scan(&n))
+	assert.Equal(t, 2, n)
+
+	// Idle connections of the *sql.DB do not prevent dropping the database.
+	require.NoError(t, db.Release(ctx))
+	assert.False(t, testutil.DBExists(t, connPool, db.Name()))
+	assert.ErrorContains(t, sqlDBs[0].PingContext(ctx), "database is closed")
+}
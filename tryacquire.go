@@ -0,0 +1,90 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// tryAcquireTimeout is how long TryAcquire waits for numpool when the pool
+// looked available but the acquisition did not succeed immediately, e.g.
+// because another process took the last slot in the meantime.
+const tryAcquireTimeout = 100 * time.Millisecond
+
+// TryAcquire acquires a test database from the pool like Acquire, but returns
+// (nil, false, nil) instead of waiting when the pool is currently full. An
+// error is returned only for real failures.
+//
+// numpool has no non-blocking acquisition, so TryAcquire first checks whether
+// a slot is free and nobody is waiting for one, and then acquires with a
+// deadline of 100ms. A slot freed up within the deadline may therefore still
+// be acquired, and a slow server may cause a miss although a slot was free.
+// Misses are counted in Stat.TryMisses.
+func (p *Pool) TryAcquire(ctx context.Context) (*TestDB, bool, error) {
+	if err := p.beginAcquire(); err != nil {
+		return nil, false, err
+	}
+	defer p.endAcquire()
+	if err := p.checkDiskBudget(ctx); err != nil {
+		return nil, false, err
+	}
+	p.reconcileStranded(ctx)
+
+	resource, err := p.tryAcquireResource(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if resource == nil {
+		p.tryMisses.Add(1)
+		return nil, false, nil
+	}
+
+	testDB, err := p.createTestDB(ctx, resource, "", 0, p.cloneTemplate)
+	if err != nil {
+		return nil, false, err
+	}
+	p.initFromTemplate(testDB)
+	if err := p.seed(ctx, testDB); err != nil {
+		return nil, false, err
+	}
+	p.tryHits.Add(1)
+	p.acquires.Add(1)
+	return testDB, true, nil
+}
+
+// tryAcquireResource acquires a resource from the numpool like
+// acquireResource, but returns a nil resource instead of waiting when the
+// pool is currently full.
+func (p *Pool) tryAcquireResource(ctx context.Context) (resource, error) {
+	available, err := p.slotAvailable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !available {
+		return nil, nil
+	}
+
+	tryCtx, cancel := context.WithTimeout(ctx, tryAcquireTimeout)
+	defer cancel()
+	start := p.clock.Now()
+	resource, err := p.acquireResource(tryCtx)
+	p.acquireWait.Add(int64(p.clock.Now().Sub(start)))
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(tryCtx.Err(), context.DeadlineExceeded) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to acquire resource from numpool: %w", err)
+	}
+	return resource, nil
+}
+
+// slotAvailable reports whether the numpool has an unused slot and no
+// waiters, in which case numpool hands out the slot without waiting.
+func (p *Pool) slotAvailable(ctx context.Context) (bool, error) {
+	usage, err := p.numpoolUsage(ctx)
+	if err != nil {
+		return false, err
+	}
+	return usage.used < p.cfg.MaxDatabases && usage.waiting == 0, nil
+}
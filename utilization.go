@@ -0,0 +1,56 @@
+package testdbpool
+
+import (
+	"context"
+	"fmt"
+)
+
+// Utilization is the state of a pool shared by all processes using its ID,
+// as read from the database by Pool.Utilization. Unlike Stat, which covers
+// one Pool instance, it counts the test databases held by other processes as
+// well.
+type Utilization struct {
+	// MaxDatabases is the maximum number of test databases in the pool.
+	MaxDatabases int
+
+	// InUse is the number of slots currently held by any process, including
+	// slots whose release failed (see Stat.Stranded) and slots of crashed
+	// processes that have not been reclaimed yet.
+	InUse int
+
+	// Available is the number of slots that can be acquired without
+	// waiting.
+	Available int
+
+	// TemplateReady reports whether the template database has been set up
+	// completely, so that the next acquisition does not have to build it.
+	TemplateReady bool
+}
+
+// Utilization returns the utilization of the pool across all processes
+// sharing its ID, e.g. to log at the end of a slow test run whether
+// MaxDatabases is the bottleneck. Its queries take no locks, so it is cheap
+// and safe to call concurrently with acquisitions and releases; the counts
+// are a snapshot that may be outdated as soon as it returns.
+func (p *Pool) Utilization(ctx context.Context) (Utilization, error) {
+	usage, err := p.numpoolUsage(ctx)
+	if err != nil {
+		return Utilization{}, err
+	}
+	u := Utilization{
+		MaxDatabases: usage.maxResources,
+		InUse:        usage.used,
+		Available:    max(usage.maxResources-usage.used, 0),
+	}
+	err = p.cfg.Pool.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_database
+			WHERE datname = $1 AND shobj_description(oid, 'pg_database') IS NOT NULL
+		)`,
+		p.templateDB.Name(),
+	).Scan(&u.TemplateReady)
+	if err != nil {
+		return Utilization{}, fmt.Errorf("failed to check template database: %w", err)
+	}
+	return u, nil
+}
@@ -0,0 +1,31 @@
+package testdbpool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// variantHashLength is the number of hex digits of the hash of
+// Config.TemplateVariantKey that New appends to Config.ID.
+const variantHashLength = 8
+
+// templateVariantKey is the template metadata key under which
+// Config.TemplateVariantKey is recorded.
+const templateVariantKey = "testdbpool.variant"
+
+// variantSuffix returns the suffix that New appends to Config.ID for the
+// template variant key: a tilde followed by variantHashLength hex digits of
+// its hash. It is empty for an empty key.
+func variantSuffix(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "~" + hex.EncodeToString(sum[:])[:variantHashLength]
+}
+
+// VariantKey returns Config.TemplateVariantKey, which is empty for a pool
+// without variants.
+func (p *Pool) VariantKey() string {
+	return p.cfg.TemplateVariantKey
+}
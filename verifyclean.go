@@ -0,0 +1,157 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yuku/testdbpool/internal/templatedb"
+)
+
+// objectsKey is the template metadata key under which the objects of the
+// template are recorded for Config.VerifyClean.
+const objectsKey = "testdbpool.objects"
+
+// DirtyError describes how a reset test database differs from the template
+// (see Config.VerifyClean).
+type DirtyError struct {
+	// Database is the name of the test database.
+	Database string
+
+	// Added are the objects of the test database that the template does not
+	// have, e.g. "table public.scratch", in sorted order.
+	Added []string
+
+	// Missing are the objects of the template that the test database does
+	// not have, in sorted order.
+	Missing []string
+}
+
+func (e *DirtyError) Error() string {
+	var parts []string
+	if len(e.Added) > 0 {
+		parts = append(parts, "added "+strings.Join(e.Added, ", "))
+	}
+	if len(e.Missing) > 0 {
+		parts = append(parts, "missing "+strings.Join(e.Missing, ", "))
+	}
+	return fmt.Sprintf("test database %s differs from the template after reset: %s", e.Database, strings.Join(parts, "; "))
+}
+
+// errNoRecordedObjects is returned by the reset of verifiedReset for a
+// template built before Config.VerifyClean was set.
+var errNoRecordedObjects = errors.New("template has no recorded objects")
+
+// isVerifyFailure reports whether err, returned by the reset of
+// verifiedReset, means that the database was reset but cannot be verified to
+// be clean, as opposed to the reset itself failing.
+func isVerifyFailure(err error) bool {
+	var dirty *DirtyError
+	return errors.As(err, &dirty) || errors.Is(err, errNoRecordedObjects)
+}
+
+// listObjects returns the tables, views, sequences and types of the database
+// conn is connected to, outside of the system schemas, as "kind schema.name"
+// strings in sorted order. Row types of tables and the objects of extensions
+// are left out.
+func listObjects(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT kind || ' ' || format('%I.%I', nspname, name) FROM (
+			SELECT
+				CASE
+					WHEN c.relkind IN ('r', 'p', 'f') THEN 'table'
+					WHEN c.relkind IN ('v', 'm') THEN 'view'
+					ELSE 'sequence'
+				END AS kind,
+				n.nspname, c.relname AS name, c.oid AS objid, 'pg_class'::regclass AS classid
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.relkind IN ('r', 'p', 'f', 'v', 'm', 'S')
+			UNION ALL
+			SELECT 'type', n.nspname, t.typname, t.oid, 'pg_type'::regclass
+			FROM pg_type t
+			JOIN pg_namespace n ON n.oid = t.typnamespace
+			WHERE t.typtype IN ('c', 'd', 'e', 'm', 'r')
+				AND t.typelem = 0
+				AND (t.typrelid = 0 OR (SELECT relkind FROM pg_class WHERE oid = t.typrelid) = 'c')
+		) o
+		WHERE nspname <> 'information_schema'
+			AND nspname NOT LIKE 'pg\_%'
+			AND NOT EXISTS (
+				SELECT 1 FROM pg_depend d
+				WHERE d.classid = o.classid AND d.objid = o.objid AND d.deptype = 'e'
+			)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	objects, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	// Sorted bytewise rather than by the collation of the database, for
+	// the binary searches of verifiedReset.
+	slices.Sort(objects)
+	return objects, nil
+}
+
+// recordObjects records the objects of the template database conn is
+// connected to in the template metadata.
+func recordObjects(ctx context.Context, conn *pgx.Conn) error {
+	objects, err := listObjects(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if err := templatedb.SetValue(ctx, objectsKey, strings.Join(objects, "\n")); err != nil {
+		return fmt.Errorf("failed to record objects of template database: %w", err)
+	}
+	return nil
+}
+
+// verifiedReset wraps reset so that it fails with a *DirtyError, which makes
+// Release drop the database instead of keeping it, if the objects of the
+// database differ from those recorded in values, the metadata of the template
+// database it was cloned from, afterwards. The error is passed to
+// Config.OnDirty first.
+func verifiedReset(cfg *Config, reset func(context.Context, *pgx.Conn) error, values map[string]string) func(context.Context, *pgx.Conn) error {
+	return func(ctx context.Context, conn *pgx.Conn) error {
+		if err := reset(ctx, conn); err != nil {
+			return err
+		}
+
+		ctx = withInternalQueries(ctx)
+		recorded, ok := values[objectsKey]
+		if !ok {
+			return fmt.Errorf("%w to verify test database %s against", errNoRecordedObjects, conn.Config().Database)
+		}
+		var want []string
+		if recorded != "" {
+			want = strings.Split(recorded, "\n")
+		}
+		got, err := listObjects(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		dirty := &DirtyError{Database: conn.Config().Database}
+		for _, object := range got {
+			if _, found := slices.BinarySearch(want, object); !found {
+				dirty.Added = append(dirty.Added, object)
+			}
+		}
+		for _, object := range want {
+			if _, found := slices.BinarySearch(got, object); !found {
+				dirty.Missing = append(dirty.Missing, object)
+			}
+		}
+		if len(dirty.Added) == 0 && len(dirty.Missing) == 0 {
+			return nil
+		}
+		if cfg.OnDirty != nil {
+			cfg.OnDirty(dirty)
+		}
+		return dirty
+	}
+}
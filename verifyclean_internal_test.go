@@ -0,0 +1,20 @@
+package testdbpool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirtyError(t *testing.T) {
+	err := &DirtyError{
+		Database: "testdbpool_app_0",
+		Added:    []string{"table public.scratch", "type public.color"},
+		Missing:  []string{"table public.items"},
+	}
+	assert.EqualError(t, err, "test database testdbpool_app_0 differs from the template after reset: "+
+		"added table public.scratch, type public.color; missing table public.items")
+
+	err = &DirtyError{Database: "testdbpool_app_0", Missing: []string{"view public.report"}}
+	assert.EqualError(t, err, "test database testdbpool_app_0 differs from the template after reset: missing view public.report")
+}
@@ -0,0 +1,250 @@
+package testdbpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yuku/testdbpool/internal/pgconst"
+	"github.com/yuku/testdbpool/internal/sqlbuild"
+)
+
+// WarmCacheMethod is the way WarmTemplateCache read the template database.
+type WarmCacheMethod string
+
+const (
+	// WarmCacheMethodPrewarm means that every relation of the template
+	// database was loaded into shared buffers with the pg_prewarm extension.
+	WarmCacheMethodPrewarm WarmCacheMethod = "pg_prewarm"
+
+	// WarmCacheMethodScan means that every user table of the template
+	// database was read with a sequential scan, as pg_prewarm was not
+	// available.
+	WarmCacheMethodScan WarmCacheMethod = "seqscan"
+)
+
+// WarmCacheResult reports what WarmTemplateCache did.
+type WarmCacheResult struct {
+	// Method is the way the template database was read.
+	Method WarmCacheMethod
+
+	// Relations is the number of relations read.
+	Relations int
+
+	// Bytes is the size of the relations read.
+	Bytes int64
+
+	// Rows is the number of rows scanned. It is zero for
+	// WarmCacheMethodPrewarm, which reads blocks rather than rows.
+	Rows int64
+}
+
+// WarmTemplateCache reads the whole template database, setting it up first
+// if needed, so that its files are in the page cache of the server before a
+// burst of clones. Without it, the first clones after a cold server start
+// can be several times slower than later ones. It is meant to be called from
+// TestMain before running the tests.
+//
+// If the pg_prewarm extension is available on the server, it is used to load
+// every relation, including system catalogs and indexes. If it is not
+// installed in the template database, it is installed for the duration of the
+// call, provided that the connection user is permitted to. Otherwise every
+// user table is read with SELECT count(*). No database is cloned from the
+// template while it is being read.
+func (p *Pool) WarmTemplateCache(ctx context.Context) (WarmCacheResult, error) {
+	var result WarmCacheResult
+	err := p.templateDB.WithConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		var err error
+		result, err = warmCache(ctx, conn, true)
+		return err
+	})
+	if err != nil {
+		return WarmCacheResult{}, fmt.Errorf("failed to warm template database cache: %w", err)
+	}
+	return result, nil
+}
+
+// warmCache reads the database conn is connected to, with pg_prewarm if
+// usePrewarm is set and it can be used, and with sequential scans otherwise.
+func warmCache(ctx context.Context, conn *pgx.Conn, usePrewarm bool) (WarmCacheResult, error) {
+	if usePrewarm {
+		result, ok, err := prewarmRelations(ctx, conn)
+		if err != nil || ok {
+			return result, err
+		}
+	}
+	return scanTables(ctx, conn)
+}
+
+// prewarmRelations loads every relation of the database into shared buffers
+// with pg_prewarm. It returns ok false if pg_prewarm is not available or
+// cannot be installed.
+func prewarmRelations(ctx context.Context, conn *pgx.Conn) (result WarmCacheResult, ok bool, err error) {
+	var available, installed bool
+	err = conn.QueryRow(ctx, `
+		SELECT
+			EXISTS(SELECT 1 FROM pg_available_extensions WHERE name = 'pg_prewarm'),
+			EXISTS(SELECT 1 FROM pg_extension WHERE extname = 'pg_prewarm')`,
+	).Scan(&available, &installed)
+	if err != nil {
+		return WarmCacheResult{}, false, fmt.Errorf("failed to check for pg_prewarm: %w", err)
+	}
+	if !available {
+		return WarmCacheResult{}, false, nil
+	}
+
+	if !installed {
+		if _, err := conn.Exec(ctx, `CREATE EXTENSION pg_prewarm`); err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgconst.SQLStateInsufficientPrivilege {
+				return WarmCacheResult{}, false, nil
+			}
+			return WarmCacheResult{}, false, fmt.Errorf("failed to create extension pg_prewarm: %w", err)
+		}
+		// Leave the template as SetupTemplate built it.
+		defer func() {
+			if _, dropErr := conn.Exec(ctx, `DROP EXTENSION pg_prewarm`); dropErr != nil && err == nil {
+				err = fmt.Errorf("failed to drop extension pg_prewarm: %w", dropErr)
+			}
+		}()
+	}
+
+	var schema string
+	err = conn.QueryRow(ctx, `
+		SELECT n.nspname FROM pg_extension e
+		JOIN pg_namespace n ON n.oid = e.extnamespace
+		WHERE e.extname = 'pg_prewarm'`,
+	).Scan(&schema)
+	if err != nil {
+		return WarmCacheResult{}, false, fmt.Errorf("failed to find schema of pg_prewarm: %w", err)
+	}
+
+	prewarm, err := sqlbuild.Ident(schema, "pg_prewarm")
+	if err != nil {
+		return WarmCacheResult{}, false, err
+	}
+
+	// Only permanent relations with storage can be prewarmed.
+	result.Method = WarmCacheMethodPrewarm
+	err = conn.QueryRow(ctx, `
+		SELECT count(*), COALESCE(sum(`+prewarm+`(c.oid::regclass)), 0)
+			* current_setting('block_size')::bigint
+		FROM pg_class c
+		WHERE c.relkind IN ('r', 'i', 't', 'm') AND c.relpersistence = 'p'`,
+	).Scan(&result.Relations, &result.Bytes)
+	if err != nil {
+		return WarmCacheResult{}, false, fmt.Errorf("failed to prewarm relations: %w", err)
+	}
+	return result, true, nil
+}
+
+// scanTables reads every user table and populated materialized view of the
+// database with a sequential scan.
+func scanTables(ctx context.Context, conn *pgx.Conn) (WarmCacheResult, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT c.oid::regclass::text, pg_total_relation_size(c.oid)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'm') AND c.relpersistence = 'p' AND c.relispopulated
+			AND n.nspname <> 'information_schema' AND n.nspname NOT LIKE 'pg\_%'
+		ORDER BY 1`,
+	)
+	if err != nil {
+		return WarmCacheResult{}, fmt.Errorf("failed to list tables: %w", err)
+	}
+	type table struct {
+		name  string
+		bytes int64
+	}
+	tables, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (table, error) {
+		var t table
+		err := row.Scan(&t.name, &t.bytes)
+		return t, err
+	})
+	if err != nil {
+		return WarmCacheResult{}, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	result := WarmCacheResult{Method: WarmCacheMethodScan}
+	for _, t := range tables {
+		// The name is quoted and qualified as needed by the regclass output.
+		var n int64
+		if err := conn.QueryRow(ctx, `SELECT count(*) FROM `+t.name).Scan(&n); err != nil {
+			return WarmCacheResult{}, fmt.Errorf("failed to scan %s: %w", t.name, err)
+		}
+		result.Relations++
+		result.Bytes += t.bytes
+		result.Rows += n
+	}
+	return result, nil
+}
+
+// Warm prepares the pool for the first acquisitions, e.g. from TestMain
+// before m.Run: it sets up the template database like BuildTemplate, and
+// then creates up to n test databases in parallel, bounded by
+// Config.MaxDatabases and by the slots that are free right now. The created
+// databases are kept, marked clean, so that the next Acquire of each index
+// reuses its database instead of cloning the template, after which it is
+// released as usual. Creating a database also verifies that it can be
+// connected to. The errors of all databases are joined.
+func (p *Pool) Warm(ctx context.Context, n int) error {
+	if n < 0 {
+		return fmt.Errorf("number of databases must not be negative, got %d", n)
+	}
+	if err := p.BuildTemplate(ctx); err != nil {
+		return err
+	}
+	if err := p.beginAcquire(); err != nil {
+		return err
+	}
+	defer p.endAcquire()
+	p.reconcileStranded(ctx)
+
+	// All slots are held before any database is kept, so that no database
+	// is reused by another of the goroutines instead of being created.
+	var resources []resource
+	for range min(n, p.cfg.MaxDatabases) {
+		r, err := p.tryAcquireResource(ctx)
+		if err != nil {
+			p.releaseResources(ctx, resources)
+			return err
+		}
+		if r == nil {
+			break
+		}
+		resources = append(resources, r)
+	}
+
+	errs := make([]error, len(resources))
+	var wg sync.WaitGroup
+	for i, r := range resources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = p.warmDatabase(ctx, r)
+		}()
+	}
+	wg.Wait()
+	p.eventLogger().Info("pool warmed", "databases", len(resources))
+	return errors.Join(errs...)
+}
+
+// warmDatabase creates the test database for the acquired resource and
+// releases it, keeping the database for the next acquirer of its index.
+func (p *Pool) warmDatabase(ctx context.Context, r resource) error {
+	testDB, err := p.createTestDB(ctx, r, "", 0, p.cloneTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to warm test database %d: %w", r.Index(), err)
+	}
+	p.initFromTemplate(testDB)
+	// A fresh clone needs no reset to be reused; running the no-op reset
+	// checks that it can be connected to.
+	testDB.reset = func(context.Context, *pgx.Conn) error { return nil }
+	if err := testDB.Release(ctx); err != nil {
+		return fmt.Errorf("failed to warm test database %d: %w", r.Index(), err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package testdbpool
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuku/testdbpool/internal/testutil"
+)
+
+func TestPool_WarmTemplateCache(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test that requires database connection")
+	}
+
+	ctx := context.Background()
+	connPool := testutil.GetTestDBPool(t)
+	t.Cleanup(testutil.CleanupNumpool(connPool))
+
+	pool, err := New(ctx, &Config{
+		ID:           "test-warm-template-cache",
+		Pool:         connPool,
+		MaxDatabases: 1,
+		SetupTemplate: func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `
+				CREATE TABLE a (id INT PRIMARY KEY);
+				INSERT INTO a SELECT generate_series(1, 10);
+				CREATE SCHEMA "other schema";
+				CREATE TABLE "other schema"."B" (id INT);
+				INSERT INTO "other schema"."B" SELECT generate_series(1, 5);
+				CREATE UNLOGGED TABLE scratch (id INT);
+				CREATE MATERIALIZED VIEW not_populated AS SELECT 1 AS id WITH NO DATA;
+			`)
+			return err
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(pool.Cleanup)
+
+	t.Run("sequential scan", func(t *testing.T) {
+		var result WarmCacheResult
+		err := pool.templateDB.WithConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+			var err error
+			result, err = warmCache(ctx, conn, false)
+			return err
+		})
+		require.NoError(t, err)
+		assert.Equal(t, WarmCacheMethodScan, result.Method)
+		// a and "other schema"."B"; the unlogged table and the unpopulated
+		// view are skipped.
+		assert.Equal(t, 2, result.Relations)
+		assert.Equal(t, int64(15), result.Rows)
+		assert.Positive(t, result.Bytes)
+	})
+
+	t.Run("pg_prewarm", func(t *testing.T) {
+		var available bool
+		err := connPool.QueryRow(ctx,
+			`SELECT EXISTS(SELECT 1 FROM pg_available_extensions WHERE name = 'pg_prewarm')`,
+		).Scan(&available)
+		require.NoError(t, err)
+
+		result, err := pool.WarmTemplateCache(ctx)
+		require.NoError(t, err)
+		if !available {
+			assert.Equal(t, WarmCacheMethodScan, result.Method)
+			return
+		}
+		assert.Equal(t, WarmCacheMethodPrewarm, result.Method)
+		// System catalogs and indexes are prewarmed too.
+		assert.Greater(t, result.Relations, 3)
+		assert.Positive(t, result.Bytes)
+		assert.Zero(t, result.Rows)
+
+		// The extension is not left behind in the template.
+		err = pool.templateDB.WithConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+			var installed bool
+			err := conn.QueryRow(ctx,
+				`SELECT EXISTS(SELECT 1 FROM pg_extension WHERE extname = 'pg_prewarm')`,
+			).Scan(&installed)
+			assert.False(t, installed)
+			return err
+		})
+		require.NoError(t, err)
+	})
+
+	// The template can be cloned right after warming it.
+	db, err := pool.Acquire(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db.Release(ctx))
+}